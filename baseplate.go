@@ -52,6 +52,85 @@ type Config struct {
 	Secrets secrets.Config   `yaml:"secrets"`
 	Sentry  log.SentryConfig `yaml:"sentry"`
 	Tracing tracing.Config   `yaml:"tracing"`
+
+	// HTTP is the config of the HTTP servers created by
+	// httpbp.NewBaseplateServer.
+	HTTP HTTPConfig `yaml:"http"`
+}
+
+// Default timeouts of HTTPConfig.
+const (
+	DefaultHTTPReadHeaderTimeout = 10 * time.Second
+	DefaultHTTPIdleTimeout       = 2 * time.Minute
+)
+
+// HTTPConfig is the config of the HTTP servers created by
+// httpbp.NewBaseplateServer.
+//
+// For all the timeouts, a value < 0 means no timeout.
+type HTTPConfig struct {
+	// The max duration for reading the entire request, including the body.
+	//
+	// Optional. Defaults to no timeout, as it also applies to streaming
+	// requests.
+	ReadTimeout time.Duration `yaml:"readTimeout"`
+
+	// The max duration for reading the request headers.
+	//
+	// Optional. Defaults to DefaultHTTPReadHeaderTimeout.
+	ReadHeaderTimeout time.Duration `yaml:"readHeaderTimeout"`
+
+	// The max duration before timing out writes of the response.
+	//
+	// Optional. Defaults to no timeout, as it also applies to streaming
+	// responses.
+	WriteTimeout time.Duration `yaml:"writeTimeout"`
+
+	// The max duration to wait for the next request on keep-alive connections.
+	//
+	// Optional. Defaults to DefaultHTTPIdleTimeout.
+	IdleTimeout time.Duration `yaml:"idleTimeout"`
+
+	// When true, HTTP/2 is also served over cleartext (h2c).
+	//
+	// It's ignored when TLS is set, as HTTP/2 is always supported over TLS.
+	H2C bool `yaml:"h2c"`
+
+	// TLS is the optional TLS config. When set, the server only serves HTTPS.
+	TLS *TLSConfig `yaml:"tls"`
+}
+
+// TLSConfig is the TLS config of a server.
+//
+// The certificate and key are either loaded from files or from the secrets
+// store, and reloaded when they change.
+type TLSConfig struct {
+	// The paths to the PEM encoded certificate (chain) and private key files.
+	//
+	// The files are watched and reloaded when they change.
+	CertFile string `yaml:"certFile"`
+	KeyFile  string `yaml:"keyFile"`
+
+	// The paths in the secrets store of the simple secrets holding the PEM
+	// encoded certificate (chain) and private key,
+	// used when CertFile and KeyFile are not set.
+	//
+	// They are reloaded with the secrets store.
+	CertSecretPath string `yaml:"certSecretPath"`
+	KeySecretPath  string `yaml:"keySecretPath"`
+
+	// The optional path to the PEM encoded CA certificates to verify the client
+	// certificates with (mTLS).
+	//
+	// The file is watched and reloaded when it changes.
+	ClientCAFile string `yaml:"clientCAFile"`
+
+	// The client certificate policy, one of "none", "request", "require",
+	// "verify-if-given" and "require-and-verify".
+	//
+	// Optional. Defaults to "require-and-verify" when ClientCAFile is set,
+	// and "none" otherwise.
+	ClientAuth string `yaml:"clientAuth"`
 }
 
 // GetConfig implements Configer.
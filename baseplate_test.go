@@ -266,6 +266,14 @@ tracing:
  recordTimeout: 1ms
  sampleRate: 0.01
 
+http:
+ readHeaderTimeout: 5s
+ idleTimeout: 1m
+ tls:
+  certFile: /tmp/cert.pem
+  keyFile: /tmp/key.pem
+  clientCAFile: /tmp/ca.pem
+
 redis:
  addrs:
   - redis:8000
@@ -306,6 +314,16 @@ redis:
 			MaxRecordTimeout: time.Millisecond,
 			SampleRate:       0.01,
 		},
+
+		HTTP: baseplate.HTTPConfig{
+			ReadHeaderTimeout: time.Second * 5,
+			IdleTimeout:       time.Minute,
+			TLS: &baseplate.TLSConfig{
+				CertFile:     "/tmp/cert.pem",
+				KeyFile:      "/tmp/key.pem",
+				ClientCAFile: "/tmp/ca.pem",
+			},
+		},
 	}
 
 	validConfigService := struct{ Addrs []string }{
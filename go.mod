@@ -5,6 +5,7 @@ go 1.17
 require (
 	github.com/Shopify/sarama v1.29.1
 	github.com/alicebob/miniredis/v2 v2.14.3
+	github.com/andybalholm/brotli v1.0.4
 	github.com/apache/thrift v0.15.0
 	github.com/avast/retry-go v3.0.0+incompatible
 	github.com/getsentry/sentry-go v0.11.0
@@ -20,6 +21,7 @@ require (
 	github.com/prometheus/client_model v0.2.0
 	github.com/sony/gobreaker v0.4.1
 	go.uber.org/zap v1.15.0
+	golang.org/x/net v0.0.0-20210614182718-04defd469f4e
 	golang.org/x/sys v0.0.0-20210615035016-665e8c7367d1
 	google.golang.org/grpc v1.41.0
 	gopkg.in/fsnotify.v1 v1.4.7
@@ -62,7 +64,6 @@ require (
 	go.uber.org/multierr v1.5.0 // indirect
 	golang.org/x/crypto v0.0.0-20210616213533-5ff15b29337e // indirect
 	golang.org/x/lint v0.0.0-20200302205851-738671d3881b // indirect
-	golang.org/x/net v0.0.0-20210614182718-04defd469f4e // indirect
 	golang.org/x/text v0.3.6 // indirect
 	golang.org/x/tools v0.1.3-0.20210608163600-9ed039809d4c // indirect
 	google.golang.org/genproto v0.0.0-20200526211855-cb27e3aa2013 // indirect
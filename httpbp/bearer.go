@@ -0,0 +1,430 @@
+package httpbp
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/reddit/baseplate.go/filewatcher"
+	"github.com/reddit/baseplate.go/secrets"
+)
+
+const (
+	// AuthorizationHeader is the header carrying the bearer token.
+	AuthorizationHeader = "Authorization"
+
+	// WWWAuthenticateHeader is the header set on the Unauthorized responses of
+	// BearerAuth, see RFC 6750.
+	WWWAuthenticateHeader = "WWW-Authenticate"
+)
+
+// DefaultBearerAuthLeeway is the default BearerAuthArgs.Leeway.
+const DefaultBearerAuthLeeway = time.Minute
+
+// The supported signing algorithms of the bearer tokens.
+const (
+	AlgHS256 = "HS256"
+	AlgRS256 = "RS256"
+	AlgES256 = "ES256"
+)
+
+// Bearer token errors, returned as the cause of the Unauthorized errors of
+// BearerAuth.
+var (
+	ErrMissingBearerToken = errors.New("httpbp: missing bearer token")
+	ErrInvalidBearerToken = errors.New("httpbp: invalid bearer token")
+	ErrBearerTokenExpired = errors.New("httpbp: bearer token expired")
+)
+
+// Audience is the "aud" claim of a bearer token,
+// which can be either a string or an array of strings in JSON.
+type Audience []string
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (a *Audience) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err == nil {
+		*a = Audience{s}
+		return nil
+	}
+	var list []string
+	if err := json.Unmarshal(data, &list); err != nil {
+		return err
+	}
+	*a = list
+	return nil
+}
+
+// Contains returns whether the audience contains any of the given ones.
+func (a Audience) Contains(audiences ...string) bool {
+	for _, aud := range a {
+		for _, expected := range audiences {
+			if aud == expected {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Claims are the claims of a verified bearer token.
+type Claims struct {
+	Issuer    string
+	Subject   string
+	Audience  Audience
+	ID        string
+	ExpiresAt time.Time
+	NotBefore time.Time
+	IssuedAt  time.Time
+
+	// Raw holds all the claims, including the registered ones above,
+	// as decoded by encoding/json with numbers as json.Number.
+	Raw map[string]interface{}
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (c *Claims) UnmarshalJSON(data []byte) error {
+	var registered struct {
+		Issuer    string      `json:"iss"`
+		Subject   string      `json:"sub"`
+		Audience  Audience    `json:"aud"`
+		ID        string      `json:"jti"`
+		ExpiresAt json.Number `json:"exp"`
+		NotBefore json.Number `json:"nbf"`
+		IssuedAt  json.Number `json:"iat"`
+	}
+	if err := json.Unmarshal(data, &registered); err != nil {
+		return err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(&c.Raw); err != nil {
+		return err
+	}
+	c.Issuer = registered.Issuer
+	c.Subject = registered.Subject
+	c.Audience = registered.Audience
+	c.ID = registered.ID
+	for _, date := range []struct {
+		n   json.Number
+		dst *time.Time
+	}{
+		{registered.ExpiresAt, &c.ExpiresAt},
+		{registered.NotBefore, &c.NotBefore},
+		{registered.IssuedAt, &c.IssuedAt},
+	} {
+		if date.n == "" {
+			continue
+		}
+		f, err := date.n.Float64()
+		if err != nil {
+			return err
+		}
+		sec := int64(f)
+		*date.dst = time.Unix(sec, int64((f-float64(sec))*float64(time.Second)))
+	}
+	return nil
+}
+
+type claimsContextKey struct{}
+
+// ClaimsFromContext returns the claims of the bearer token verified by
+// BearerAuth.
+func ClaimsFromContext(ctx context.Context) (Claims, bool) {
+	claims, ok := ctx.Value(claimsContextKey{}).(Claims)
+	return claims, ok
+}
+
+// JWKS is a parsed JSON Web Key Set with RSA and P-256 EC public keys.
+//
+// Keys of other types and keys not used for signatures are ignored.
+type JWKS struct {
+	keys []jwk
+}
+
+type jwk struct {
+	id  string
+	key crypto.PublicKey
+}
+
+// JWKSParser is a filewatcher.Parser parsing JWKS files into *JWKS,
+// to be used in BearerAuthArgs.JWKS:
+//
+//     jwks, err := filewatcher.New(ctx, filewatcher.Config{
+//       Path:   "/var/run/keys/jwks.json",
+//       Parser: httpbp.JWKSParser,
+//       Logger: logger,
+//     })
+func JWKSParser(r io.Reader) (interface{}, error) {
+	var doc struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Use string `json:"use"`
+			Kid string `json:"kid"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			Crv string `json:"crv"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		} `json:"keys"`
+	}
+	if err := json.NewDecoder(r).Decode(&doc); err != nil {
+		return nil, fmt.Errorf("httpbp: failed to decode JWKS: %w", err)
+	}
+	jwks := new(JWKS)
+	for _, k := range doc.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		var key crypto.PublicKey
+		switch k.Kty {
+		case "RSA":
+			n, err := decodeJWKInt(k.N)
+			if err != nil {
+				return nil, fmt.Errorf("httpbp: invalid JWK %q: %w", k.Kid, err)
+			}
+			e, err := decodeJWKInt(k.E)
+			if err != nil || !e.IsInt64() {
+				return nil, fmt.Errorf("httpbp: invalid JWK %q exponent", k.Kid)
+			}
+			key = &rsa.PublicKey{N: n, E: int(e.Int64())}
+		case "EC":
+			if k.Crv != "P-256" {
+				continue
+			}
+			x, err := decodeJWKInt(k.X)
+			if err != nil {
+				return nil, fmt.Errorf("httpbp: invalid JWK %q: %w", k.Kid, err)
+			}
+			y, err := decodeJWKInt(k.Y)
+			if err != nil {
+				return nil, fmt.Errorf("httpbp: invalid JWK %q: %w", k.Kid, err)
+			}
+			if !elliptic.P256().IsOnCurve(x, y) {
+				return nil, fmt.Errorf("httpbp: invalid JWK %q: point not on curve", k.Kid)
+			}
+			key = &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}
+		default:
+			continue
+		}
+		jwks.keys = append(jwks.keys, jwk{id: k.Kid, key: key})
+	}
+	return jwks, nil
+}
+
+func decodeJWKInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) == 0 {
+		return nil, errors.New("empty value")
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+// BearerAuthArgs are the args to be passed into BearerAuth.
+//
+// At least one of HMACSecretPath and JWKS is required.
+type BearerAuthArgs struct {
+	// The secrets store and the path of the versioned secret used to verify
+	// HS256 tokens.
+	//
+	// All the current, previous and next versions of the secret are accepted,
+	// so the secret can be rotated.
+	SecretsStore   *secrets.Store
+	HMACSecretPath string
+
+	// The file watcher of the JWKS used to verify RS256 and ES256 tokens,
+	// created by filewatcher.New with JWKSParser.
+	JWKS filewatcher.FileWatcher
+
+	// The accepted "iss" claims.
+	//
+	// Optional. When empty, the issuer is not checked.
+	Issuers []string
+
+	// The accepted "aud" claims, the token must have at least one of them.
+	//
+	// Optional. When empty, the audience is not checked.
+	Audiences []string
+
+	// The tolerated clock skew when checking "exp" and "nbf".
+	//
+	// Optional. Default to DefaultBearerAuthLeeway.
+	Leeway time.Duration
+
+	// Authorize is called with the verified claims,
+	// the request is rejected with Forbidden when it returns false.
+	//
+	// Optional. When nil, all the verified tokens are authorized.
+	Authorize func(ctx context.Context, r *http.Request, claims Claims) bool
+
+	// The realm of the WWW-Authenticate header.
+	//
+	// Optional.
+	Realm string
+}
+
+// BearerAuth returns a Middleware that verifies the signed bearer token (JWT)
+// in the Authorization header and puts its claims in the context,
+// to be read with ClaimsFromContext.
+//
+// HS256 tokens are verified with the versioned secret at HMACSecretPath,
+// RS256 and ES256 tokens are verified with the keys in JWKS,
+// matched by the "kid" header of the token when present.
+// The "exp" claim is required, and "nbf", "iss" and "aud" are checked when
+// present or configured.
+//
+// Requests without a valid token are rejected with Unauthorized and the
+// WWW-Authenticate header, and requests refused by Authorize are rejected with
+// Forbidden. The error bodies are negotiated by NegotiateError.
+func BearerAuth(args BearerAuthArgs) Middleware {
+	if args.Leeway <= 0 {
+		args.Leeway = DefaultBearerAuthLeeway
+	}
+	return func(name string, next HandlerFunc) HandlerFunc {
+		return func(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+			claims, err := args.verify(r.Header.Get(AuthorizationHeader), time.Now())
+			if err != nil {
+				challenge := "Bearer"
+				if args.Realm != "" {
+					challenge += fmt.Sprintf(" realm=%q,", args.Realm)
+				}
+				if !errors.Is(err, ErrMissingBearerToken) {
+					challenge += ` error="invalid_token"`
+				}
+				w.Header().Set(WWWAuthenticateHeader, strings.TrimSuffix(challenge, ","))
+				return NegotiateError(r, Unauthorized(), err, nil)
+			}
+			if args.Authorize != nil && !args.Authorize(ctx, r, claims) {
+				return NegotiateError(
+					r,
+					Forbidden(),
+					fmt.Errorf("httpbp: bearer token of %q not authorized for %q", claims.Subject, name),
+					nil,
+				)
+			}
+			return next(context.WithValue(ctx, claimsContextKey{}, claims), w, r)
+		}
+	}
+}
+
+func (args BearerAuthArgs) verify(header string, now time.Time) (Claims, error) {
+	const prefix = "bearer "
+	if len(header) < len(prefix) || !strings.EqualFold(header[:len(prefix)], prefix) {
+		return Claims{}, ErrMissingBearerToken
+	}
+	token := strings.TrimSpace(header[len(prefix):])
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return Claims{}, fmt.Errorf("%w: malformed token", ErrInvalidBearerToken)
+	}
+	var jose struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeTokenPart(parts[0], &jose); err != nil {
+		return Claims{}, fmt.Errorf("%w: malformed header: %v", ErrInvalidBearerToken, err)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return Claims{}, fmt.Errorf("%w: malformed signature: %v", ErrInvalidBearerToken, err)
+	}
+	signed := []byte(parts[0] + "." + parts[1])
+	if err := args.verifySignature(jose.Alg, jose.Kid, signed, signature); err != nil {
+		return Claims{}, fmt.Errorf("%w: %v", ErrInvalidBearerToken, err)
+	}
+
+	var claims Claims
+	if err := decodeTokenPart(parts[1], &claims); err != nil {
+		return Claims{}, fmt.Errorf("%w: malformed claims: %v", ErrInvalidBearerToken, err)
+	}
+	switch {
+	case claims.ExpiresAt.IsZero():
+		return Claims{}, fmt.Errorf("%w: missing exp claim", ErrInvalidBearerToken)
+	case !now.Before(claims.ExpiresAt.Add(args.Leeway)):
+		return Claims{}, ErrBearerTokenExpired
+	case !claims.NotBefore.IsZero() && now.Add(args.Leeway).Before(claims.NotBefore):
+		return Claims{}, fmt.Errorf("%w: token not valid yet", ErrInvalidBearerToken)
+	case len(args.Issuers) > 0 && !Audience(args.Issuers).Contains(claims.Issuer):
+		return Claims{}, fmt.Errorf("%w: unexpected issuer %q", ErrInvalidBearerToken, claims.Issuer)
+	case len(args.Audiences) > 0 && !claims.Audience.Contains(args.Audiences...):
+		return Claims{}, fmt.Errorf("%w: unexpected audience %q", ErrInvalidBearerToken, claims.Audience)
+	}
+	return claims, nil
+}
+
+func (args BearerAuthArgs) verifySignature(alg, kid string, signed, signature []byte) error {
+	switch alg {
+	case AlgHS256:
+		if args.HMACSecretPath == "" || args.SecretsStore == nil {
+			return fmt.Errorf("unsupported algorithm %q", alg)
+		}
+		secret, err := args.SecretsStore.GetVersionedSecret(args.HMACSecretPath)
+		if err != nil {
+			return err
+		}
+		for _, version := range secret.GetAll() {
+			mac := hmac.New(sha256.New, version)
+			mac.Write(signed)
+			if hmac.Equal(mac.Sum(nil), signature) {
+				return nil
+			}
+		}
+		return errors.New("signature mismatch")
+
+	case AlgRS256, AlgES256:
+		if args.JWKS == nil {
+			return fmt.Errorf("unsupported algorithm %q", alg)
+		}
+		digest := sha256.Sum256(signed)
+		for _, k := range args.JWKS.Get().(*JWKS).keys {
+			if kid != "" && k.id != kid {
+				continue
+			}
+			switch key := k.key.(type) {
+			case *rsa.PublicKey:
+				if alg == AlgRS256 && rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature) == nil {
+					return nil
+				}
+			case *ecdsa.PublicKey:
+				// ES256 signatures are the 32 bytes r and s concatenated.
+				if alg == AlgES256 && len(signature) == 64 {
+					r := new(big.Int).SetBytes(signature[:32])
+					s := new(big.Int).SetBytes(signature[32:])
+					if ecdsa.Verify(key, digest[:], r, s) {
+						return nil
+					}
+				}
+			}
+		}
+		return fmt.Errorf("signature mismatch with key %q", kid)
+
+	default:
+		return fmt.Errorf("unsupported algorithm %q", alg)
+	}
+}
+
+func decodeTokenPart(part string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
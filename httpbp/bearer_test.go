@@ -0,0 +1,340 @@
+package httpbp_test
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/reddit/baseplate.go/filewatcher"
+	"github.com/reddit/baseplate.go/httpbp"
+)
+
+const bearerSecretPath = "secret/http/edge-context-signature"
+
+func encodeTokenPart(t *testing.T, v interface{}) string {
+	t.Helper()
+
+	data, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// signToken returns a token signed with key, which is a []byte for HS256,
+// *rsa.PrivateKey for RS256 or *ecdsa.PrivateKey for ES256.
+func signToken(t *testing.T, alg, kid string, key interface{}, claims map[string]interface{}) string {
+	t.Helper()
+
+	header := map[string]string{"alg": alg, "typ": "JWT"}
+	if kid != "" {
+		header["kid"] = kid
+	}
+	signed := encodeTokenPart(t, header) + "." + encodeTokenPart(t, claims)
+	digest := sha256.Sum256([]byte(signed))
+
+	var signature []byte
+	switch k := key.(type) {
+	case []byte:
+		mac := hmac.New(sha256.New, k)
+		mac.Write([]byte(signed))
+		signature = mac.Sum(nil)
+	case *rsa.PrivateKey:
+		var err error
+		if signature, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, digest[:]); err != nil {
+			t.Fatal(err)
+		}
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, k, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		signature = make([]byte, 64)
+		r.FillBytes(signature[:32])
+		s.FillBytes(signature[32:])
+	case nil:
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func newTestJWKS(t *testing.T, rsaKey *rsa.PrivateKey, ecKey *ecdsa.PrivateKey) filewatcher.FileWatcher {
+	t.Helper()
+
+	encode := func(b []byte) string {
+		return base64.RawURLEncoding.EncodeToString(b)
+	}
+	jwks := fmt.Sprintf(`{"keys": [
+		{"kty": "RSA", "use": "sig", "kid": "rsa", "n": %q, "e": %q},
+		{"kty": "EC", "kid": "ec", "crv": "P-256", "x": %q, "y": %q},
+		{"kty": "oct", "kid": "ignored", "k": "c2VjcmV0"}
+	]}`,
+		encode(rsaKey.N.Bytes()),
+		encode(big.NewInt(int64(rsaKey.E)).Bytes()),
+		encode(ecKey.X.Bytes()),
+		encode(ecKey.Y.Bytes()),
+	)
+	fw, err := filewatcher.NewMockFilewatcher(strings.NewReader(jwks), httpbp.JWKSParser)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fw
+}
+
+func TestBearerAuth(t *testing.T) {
+	t.Parallel()
+
+	store := newSecretsStore(t)
+	defer store.Close()
+	secret, err := store.GetVersionedSecret(bearerSecretPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherECKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	claims := func(overrides map[string]interface{}) map[string]interface{} {
+		c := map[string]interface{}{
+			"iss":   "https://issuer.example.com",
+			"sub":   "t2_foo",
+			"aud":   "test-service",
+			"exp":   now.Add(time.Hour).Unix(),
+			"nbf":   now.Add(-time.Hour).Unix(),
+			"scope": "read",
+		}
+		for k, v := range overrides {
+			if v == nil {
+				delete(c, k)
+			} else {
+				c[k] = v
+			}
+		}
+		return c
+	}
+
+	var gotClaims httpbp.Claims
+	handler := httpbp.NewHandler(
+		"test",
+		func(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+			gotClaims, _ = httpbp.ClaimsFromContext(ctx)
+			return nil
+		},
+		httpbp.BearerAuth(httpbp.BearerAuthArgs{
+			SecretsStore:   store,
+			HMACSecretPath: bearerSecretPath,
+			JWKS:           newTestJWKS(t, rsaKey, ecKey),
+			Issuers:        []string{"https://issuer.example.com"},
+			Audiences:      []string{"test-service"},
+			Realm:          "test",
+			Authorize: func(ctx context.Context, r *http.Request, claims httpbp.Claims) bool {
+				return claims.Raw["scope"] != "none"
+			},
+		}),
+	)
+
+	cases := []struct {
+		name     string
+		header   string
+		expected int
+	}{
+		{
+			name:     "missing",
+			header:   "",
+			expected: http.StatusUnauthorized,
+		},
+		{
+			name:     "basic",
+			header:   "Basic dXNlcjpwYXNz",
+			expected: http.StatusUnauthorized,
+		},
+		{
+			name:     "hs256",
+			header:   "Bearer " + signToken(t, httpbp.AlgHS256, "", []byte(secret.Current), claims(nil)),
+			expected: http.StatusOK,
+		},
+		{
+			name:     "hs256-previous",
+			header:   "bearer " + signToken(t, httpbp.AlgHS256, "", []byte(secret.Previous), claims(nil)),
+			expected: http.StatusOK,
+		},
+		{
+			name:     "hs256-wrong-secret",
+			header:   "Bearer " + signToken(t, httpbp.AlgHS256, "", []byte("wrong"), claims(nil)),
+			expected: http.StatusUnauthorized,
+		},
+		{
+			name:     "rs256",
+			header:   "Bearer " + signToken(t, httpbp.AlgRS256, "rsa", rsaKey, claims(nil)),
+			expected: http.StatusOK,
+		},
+		{
+			name:     "rs256-no-kid",
+			header:   "Bearer " + signToken(t, httpbp.AlgRS256, "", rsaKey, claims(nil)),
+			expected: http.StatusOK,
+		},
+		{
+			name:     "es256",
+			header:   "Bearer " + signToken(t, httpbp.AlgES256, "ec", ecKey, claims(nil)),
+			expected: http.StatusOK,
+		},
+		{
+			name:     "es256-wrong-key",
+			header:   "Bearer " + signToken(t, httpbp.AlgES256, "ec", otherECKey, claims(nil)),
+			expected: http.StatusUnauthorized,
+		},
+		{
+			name:     "wrong-kid",
+			header:   "Bearer " + signToken(t, httpbp.AlgRS256, "ec", rsaKey, claims(nil)),
+			expected: http.StatusUnauthorized,
+		},
+		{
+			name:     "alg-none",
+			header:   "Bearer " + signToken(t, "none", "", nil, claims(nil)),
+			expected: http.StatusUnauthorized,
+		},
+		{
+			name:     "malformed",
+			header:   "Bearer foo.bar",
+			expected: http.StatusUnauthorized,
+		},
+		{
+			name:     "expired",
+			header:   "Bearer " + signToken(t, httpbp.AlgES256, "ec", ecKey, claims(map[string]interface{}{"exp": now.Add(-2 * time.Minute).Unix()})),
+			expected: http.StatusUnauthorized,
+		},
+		{
+			name:     "expired-within-leeway",
+			header:   "Bearer " + signToken(t, httpbp.AlgES256, "ec", ecKey, claims(map[string]interface{}{"exp": now.Add(-10 * time.Second).Unix()})),
+			expected: http.StatusOK,
+		},
+		{
+			name:     "missing-exp",
+			header:   "Bearer " + signToken(t, httpbp.AlgES256, "ec", ecKey, claims(map[string]interface{}{"exp": nil})),
+			expected: http.StatusUnauthorized,
+		},
+		{
+			name:     "not-before",
+			header:   "Bearer " + signToken(t, httpbp.AlgES256, "ec", ecKey, claims(map[string]interface{}{"nbf": now.Add(time.Hour).Unix()})),
+			expected: http.StatusUnauthorized,
+		},
+		{
+			name:     "wrong-issuer",
+			header:   "Bearer " + signToken(t, httpbp.AlgES256, "ec", ecKey, claims(map[string]interface{}{"iss": "https://evil.example.com"})),
+			expected: http.StatusUnauthorized,
+		},
+		{
+			name:     "wrong-audience",
+			header:   "Bearer " + signToken(t, httpbp.AlgES256, "ec", ecKey, claims(map[string]interface{}{"aud": "other-service"})),
+			expected: http.StatusUnauthorized,
+		},
+		{
+			name:     "audience-list",
+			header:   "Bearer " + signToken(t, httpbp.AlgES256, "ec", ecKey, claims(map[string]interface{}{"aud": []string{"other-service", "test-service"}})),
+			expected: http.StatusOK,
+		},
+		{
+			name:     "forbidden",
+			header:   "Bearer " + signToken(t, httpbp.AlgES256, "ec", ecKey, claims(map[string]interface{}{"scope": "none"})),
+			expected: http.StatusForbidden,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			gotClaims = httpbp.Claims{}
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			if c.header != "" {
+				r.Header.Set(httpbp.AuthorizationHeader, c.header)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+
+			if w.Code != c.expected {
+				t.Fatalf("Expected code %d, got %d: %s", c.expected, w.Code, w.Body.String())
+			}
+			switch c.expected {
+			case http.StatusOK:
+				if gotClaims.Subject != "t2_foo" {
+					t.Errorf("Expected subject %q in the context claims, got %q", "t2_foo", gotClaims.Subject)
+				}
+				if scope := gotClaims.Raw["scope"]; scope != "read" {
+					t.Errorf("Expected raw claim scope %q, got %v", "read", scope)
+				}
+				if gotClaims.ExpiresAt.IsZero() {
+					t.Error("Expected ExpiresAt to be set")
+				}
+			case http.StatusUnauthorized:
+				expected := `Bearer realm="test", error="invalid_token"`
+				if c.header == "" || strings.HasPrefix(c.header, "Basic") {
+					expected = `Bearer realm="test"`
+				}
+				if got := w.Header().Get(httpbp.WWWAuthenticateHeader); got != expected {
+					t.Errorf("Expected %s header %q, got %q", httpbp.WWWAuthenticateHeader, expected, got)
+				}
+				fallthrough
+			default:
+				var body httpbp.ErrorResponseJSONWrapper
+				if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+					t.Fatalf("Expected JSON error body, got %q: %v", w.Body.String(), err)
+				}
+				if expected := httpbp.ErrorForCode(c.expected).Reason; body.Error == nil || body.Error.Reason != expected {
+					t.Errorf("Expected error reason %q, got %+v", expected, body.Error)
+				}
+			}
+		})
+	}
+}
+
+func TestBearerAuthHS256WithoutSecret(t *testing.T) {
+	t.Parallel()
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// HS256 tokens must not be verified with the public keys.
+	handle := httpbp.Wrap(
+		"test",
+		func(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+			return nil
+		},
+		httpbp.BearerAuth(httpbp.BearerAuthArgs{
+			JWKS: newTestJWKS(t, rsaKey, ecKey),
+		}),
+	)
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set(httpbp.AuthorizationHeader, "Bearer "+signToken(t, httpbp.AlgHS256, "rsa", rsaKey.N.Bytes(), map[string]interface{}{
+		"exp": time.Now().Add(time.Hour).Unix(),
+	}))
+	if err := handle(r.Context(), httptest.NewRecorder(), r); err == nil {
+		t.Error("Expected an error, got nil")
+	}
+}
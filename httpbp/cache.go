@@ -0,0 +1,774 @@
+package httpbp
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/opentracing/opentracing-go"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/reddit/baseplate.go/ecinterface"
+	"github.com/reddit/baseplate.go/log"
+	"github.com/reddit/baseplate.go/redis/cache/redisx"
+)
+
+// DefaultCacheRedisKeyPrefix is the default key prefix used by
+// RedisCacheStore.
+const DefaultCacheRedisKeyPrefix = "httpbp:cache:"
+
+// Default values of CacheConfig.
+const (
+	DefaultCacheMaxBytes     = 64 << 20
+	DefaultCacheMaxEntrySize = 1 << 20
+	DefaultCacheStaleTTL     = time.Hour
+)
+
+// The results of the Cache middleware,
+// reported as the value of CacheResultTag and the http_cache_result label.
+const (
+	// The response is served from the cache without sending the request.
+	CacheHit = "hit"
+
+	// The response is from the upstream server.
+	CacheMiss = "miss"
+
+	// The cached response is served after the upstream server confirmed it's
+	// still valid with a 304 response.
+	CacheRevalidated = "revalidated"
+)
+
+// CacheResultTag is the span tag set by the Cache middleware.
+const CacheResultTag = "http.cache_result"
+
+const cacheResultLabel = "http_cache_result"
+
+var cacheRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: promNamespace,
+	Subsystem: subsystemClient,
+	Name:      "cache_requests_total",
+	Help:      "The number of cacheable requests by the result of the cache lookup",
+}, []string{serverSlugLabel, cacheResultLabel})
+
+// heuristicallyCacheable are the status codes cacheable by default,
+// see RFC 7231 section 6.1.
+var heuristicallyCacheable = map[int]bool{
+	http.StatusOK:                   true,
+	http.StatusNonAuthoritativeInfo: true,
+	http.StatusNoContent:            true,
+	http.StatusMultipleChoices:      true,
+	http.StatusMovedPermanently:     true,
+	http.StatusNotFound:             true,
+	http.StatusMethodNotAllowed:     true,
+	http.StatusGone:                 true,
+	http.StatusRequestURITooLong:    true,
+	http.StatusNotImplemented:       true,
+}
+
+// CacheStore defines the storage of the Cache middleware.
+type CacheStore interface {
+	// Get returns the value stored with key,
+	// or nil if it does not exist or it's expired.
+	Get(ctx context.Context, key string) ([]byte, error)
+
+	// Set stores value with key, which expires after ttl.
+	Set(ctx context.Context, key string, value []byte, ttl time.Duration) error
+
+	// Delete deletes the value stored with key, if any.
+	Delete(ctx context.Context, key string) error
+}
+
+// CacheConfig is the configuration of the Cache middleware.
+type CacheConfig struct {
+	// The storage of the cached responses.
+	//
+	// Optional. Default to a MemoryCacheStore of DefaultCacheMaxBytes used by
+	// this middleware only.
+	Store CacheStore
+
+	// The max size of a response body to be cached.
+	//
+	// Optional. Default to DefaultCacheMaxEntrySize.
+	MaxEntrySize int64
+
+	// How long to keep the responses with a validator (ETag or Last-Modified
+	// header) after they become stale, so they can be revalidated.
+	//
+	// Optional. Default to DefaultCacheStaleTTL.
+	StaleTTL time.Duration
+
+	// The logger to be called when the store returns an error.
+	// In such case the request is sent to the upstream server.
+	//
+	// Optional. If nil, log.DefaultWrapper will be used.
+	Logger log.Wrapper
+
+	// The edgecontext implementation used to tell whether the request is made
+	// on behalf of an end user, see Cache.
+	//
+	// Optional. If not set, the global one from ecinterface.Get will be used
+	// instead.
+	EdgeContextImpl ecinterface.Interface
+}
+
+// Cache returns a ClientMiddleware that implements a RFC 7234 shared cache.
+//
+// Only GET requests are served from the cache, and only the responses with
+// the status codes cacheable by default are stored.
+// A response is fresh for the max-age of its "Cache-Control" header,
+// or until its "Expires" header, or for 10% of the time since its
+// "Last-Modified" header.
+// Stale responses with an "ETag" or "Last-Modified" header are revalidated by
+// sending the request with "If-None-Match" or "If-Modified-Since" header,
+// and served from the cache again if the upstream server responds 304.
+// The "no-store", "no-cache", "max-age", "min-fresh", "max-stale" and
+// "only-if-cached" request directives are honored.
+// Requests with their own conditional headers bypass the cache.
+//
+// Only a single variant of each URL is stored. When the response has a "Vary"
+// header, the cached response is only used for the requests with the same
+// values of the nominated headers.
+// Successful responses to unsafe requests (e.g. POST) invalidate the cached
+// response of the same URL.
+//
+// The cache can be shared by all the callers (and all the client instances
+// when using RedisCacheStore), so the requests made on behalf of a caller,
+// with an "Authorization", "Cookie" or "X-Edge-Request" header, or an edge
+// request context in their context, are only served from and stored into the
+// cache when the response is explicitly marked as "public" by its
+// "Cache-Control" header, see RFC 7234 section 3.2.
+// Responses marked as "private" are never stored.
+//
+// It should be used through the Cache field of ClientConfig (or
+// DefaultClientMiddlewareArgs), which applies it right after
+// ForwardEdgeRequestContext,
+// so the requests served from the cache are not reported as upstream requests:
+//
+//     config.Cache = &httpbp.CacheConfig{}
+//     client, err := httpbp.NewClient(config)
+//
+// Middlewares adding the "Authorization" header should be applied before it,
+// e.g. as the additional middlewares of NewClient.
+//
+// Note that the 4xx and 5xx responses are turned into errors by
+// ClientErrorWrapper before reaching this middleware, so they are not cached.
+//
+// It sets CacheResultTag on the span in the request context,
+// and reports the httpbp_client_cache_requests_total prometheus metric with
+// the given slug.
+func Cache(slug string, cfg CacheConfig) ClientMiddleware {
+	if cfg.Store == nil {
+		cfg.Store = NewMemoryCacheStore(DefaultCacheMaxBytes)
+	}
+	if cfg.MaxEntrySize <= 0 {
+		cfg.MaxEntrySize = DefaultCacheMaxEntrySize
+	}
+	if cfg.StaleTTL <= 0 {
+		cfg.StaleTTL = DefaultCacheStaleTTL
+	}
+	if cfg.EdgeContextImpl == nil {
+		cfg.EdgeContextImpl = ecinterface.Get()
+	}
+	c := &httpCache{
+		slug: slug,
+		cfg:  cfg,
+	}
+	return func(next http.RoundTripper) http.RoundTripper {
+		return roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			return c.roundTrip(next, req)
+		})
+	}
+}
+
+type httpCache struct {
+	slug string
+	cfg  CacheConfig
+}
+
+func (c *httpCache) roundTrip(next http.RoundTripper, req *http.Request) (*http.Response, error) {
+	ctx := req.Context()
+	key := req.URL.String()
+
+	switch req.Method {
+	case http.MethodGet:
+	case http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return next.RoundTrip(req)
+	default:
+		// Unsafe methods, see RFC 7234 section 4.4.
+		resp, err := next.RoundTrip(req)
+		if err == nil && resp.StatusCode < http.StatusBadRequest {
+			if err := c.cfg.Store.Delete(ctx, key); err != nil {
+				c.cfg.Logger.Log(ctx, "httpbp: cache store failed: "+err.Error())
+			}
+		}
+		return resp, err
+	}
+
+	reqCC := parseCacheControl(req.Header)
+	if reqCC.has("no-store") || hasConditionalHeaders(req.Header) {
+		return next.RoundTrip(req)
+	}
+
+	private := c.private(req)
+	entry := c.load(ctx, key, req)
+	if entry != nil && private && !entry.public() {
+		entry = nil
+	}
+	if entry != nil && entry.fresh(reqCC, time.Now()) {
+		c.report(ctx, CacheHit)
+		return entry.response(req, time.Now()), nil
+	}
+	if entry == nil && reqCC.has("only-if-cached") {
+		c.report(ctx, CacheMiss)
+		return &http.Response{
+			Status:     fmt.Sprintf("%d %s", http.StatusGatewayTimeout, http.StatusText(http.StatusGatewayTimeout)),
+			StatusCode: http.StatusGatewayTimeout,
+			Proto:      "HTTP/1.1",
+			ProtoMajor: 1,
+			ProtoMinor: 1,
+			Header:     make(http.Header),
+			Body:       http.NoBody,
+			Request:    req,
+		}, nil
+	}
+
+	outReq := req
+	if entry != nil && entry.hasValidators() {
+		outReq = req.Clone(ctx)
+		if etag := entry.Header.Get("ETag"); etag != "" {
+			outReq.Header.Set("If-None-Match", etag)
+		}
+		if lastModified := entry.Header.Get("Last-Modified"); lastModified != "" {
+			outReq.Header.Set("If-Modified-Since", lastModified)
+		}
+	}
+
+	requestTime := time.Now()
+	resp, err := next.RoundTrip(outReq)
+	if err != nil {
+		c.report(ctx, CacheMiss)
+		return resp, err
+	}
+	responseTime := time.Now()
+
+	if resp.StatusCode == http.StatusNotModified && outReq != req {
+		DrainAndClose(resp.Body)
+		entry.update(resp.Header, requestTime, responseTime)
+		if parseCacheControl(entry.Header).has("private") {
+			if err := c.cfg.Store.Delete(ctx, key); err != nil {
+				c.cfg.Logger.Log(ctx, "httpbp: cache store failed: "+err.Error())
+			}
+		} else {
+			c.store(ctx, key, entry)
+		}
+		c.report(ctx, CacheRevalidated)
+		return entry.response(req, responseTime), nil
+	}
+
+	c.report(ctx, CacheMiss)
+	if !storable(reqCC, resp) || (private && !parseCacheControl(resp.Header).has("public")) {
+		return resp, nil
+	}
+	entry = &cacheEntry{
+		StatusCode:   resp.StatusCode,
+		Header:       resp.Header.Clone(),
+		Vary:         varyHeaders(req.Header, resp.Header),
+		RequestTime:  requestTime,
+		ResponseTime: responseTime,
+	}
+	resp.Body = &cacheBody{
+		ReadCloser: resp.Body,
+		max:        c.cfg.MaxEntrySize,
+		done: func(body []byte) {
+			entry.Body = body
+			c.store(ctx, key, entry)
+		},
+	}
+	return resp, nil
+}
+
+// load returns the cached entry of the key matching req, or nil.
+func (c *httpCache) load(ctx context.Context, key string, req *http.Request) *cacheEntry {
+	data, err := c.cfg.Store.Get(ctx, key)
+	if err != nil {
+		c.cfg.Logger.Log(ctx, "httpbp: cache store failed: "+err.Error())
+		return nil
+	}
+	if data == nil {
+		return nil
+	}
+	var entry cacheEntry
+	if err := json.Unmarshal(data, &entry); err != nil {
+		c.cfg.Logger.Log(ctx, "httpbp: failed to decode cached response: "+err.Error())
+		return nil
+	}
+	if !entry.varyMatches(req.Header) {
+		return nil
+	}
+	return &entry
+}
+
+// private returns whether req is made on behalf of a caller.
+func (c *httpCache) private(req *http.Request) bool {
+	if req.Header.Get(AuthorizationHeader) != "" ||
+		req.Header.Get("Cookie") != "" ||
+		req.Header.Get(EdgeContextHeader) != "" {
+		return true
+	}
+	_, ok := c.cfg.EdgeContextImpl.ContextToHeader(req.Context())
+	return ok
+}
+
+func (c *httpCache) store(ctx context.Context, key string, entry *cacheEntry) {
+	ttl := entry.freshnessLifetime() - entry.currentAge(time.Now())
+	if entry.hasValidators() {
+		ttl += c.cfg.StaleTTL
+	}
+	if ttl <= 0 {
+		return
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		c.cfg.Logger.Log(ctx, "httpbp: failed to encode cached response: "+err.Error())
+		return
+	}
+	if err := c.cfg.Store.Set(ctx, key, data, ttl); err != nil {
+		c.cfg.Logger.Log(ctx, "httpbp: cache store failed: "+err.Error())
+	}
+}
+
+func (c *httpCache) report(ctx context.Context, result string) {
+	cacheRequests.With(prometheus.Labels{
+		serverSlugLabel:  c.slug,
+		cacheResultLabel: result,
+	}).Inc()
+	if span := opentracing.SpanFromContext(ctx); span != nil {
+		span.SetTag(CacheResultTag, result)
+	}
+}
+
+// storable returns whether the response can be stored,
+// see RFC 7234 section 3.
+func storable(reqCC cacheControl, resp *http.Response) bool {
+	if !heuristicallyCacheable[resp.StatusCode] {
+		return false
+	}
+	respCC := parseCacheControl(resp.Header)
+	if reqCC.has("no-store") || respCC.has("no-store") {
+		return false
+	}
+	// The cache is shared, see RFC 7234 section 5.2.2.6.
+	if respCC.has("private") {
+		return false
+	}
+	for _, v := range resp.Header.Values("Vary") {
+		if strings.TrimSpace(v) == "*" {
+			return false
+		}
+	}
+	return respCC.has("max-age") ||
+		resp.Header.Get("Expires") != "" ||
+		resp.Header.Get("ETag") != "" ||
+		resp.Header.Get("Last-Modified") != ""
+}
+
+func hasConditionalHeaders(h http.Header) bool {
+	for _, name := range []string{
+		"If-Match",
+		"If-None-Match",
+		"If-Modified-Since",
+		"If-Unmodified-Since",
+		"If-Range",
+		"Range",
+	} {
+		if h.Get(name) != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// varyHeaders returns the request headers nominated by the Vary header of the
+// response.
+func varyHeaders(reqHeader, respHeader http.Header) http.Header {
+	var vary http.Header
+	for _, v := range respHeader.Values("Vary") {
+		for _, name := range strings.Split(v, ",") {
+			name = http.CanonicalHeaderKey(strings.TrimSpace(name))
+			if name == "" {
+				continue
+			}
+			if vary == nil {
+				vary = make(http.Header)
+			}
+			// Keep the header even if the request does not have it,
+			// so it only matches the requests without it either.
+			vary[name] = append([]string{}, reqHeader.Values(name)...)
+		}
+	}
+	return vary
+}
+
+// cacheControl is the parsed Cache-Control header.
+type cacheControl map[string]string
+
+func parseCacheControl(h http.Header) cacheControl {
+	cc := make(cacheControl)
+	for _, v := range h.Values("Cache-Control") {
+		for _, directive := range strings.Split(v, ",") {
+			name, value := directive, ""
+			if i := strings.IndexByte(directive, '='); i >= 0 {
+				name, value = directive[:i], strings.Trim(strings.TrimSpace(directive[i+1:]), `"`)
+			}
+			name = strings.ToLower(strings.TrimSpace(name))
+			if name != "" {
+				cc[name] = value
+			}
+		}
+	}
+	// See RFC 7234 section 5.4.
+	if _, ok := h["Cache-Control"]; !ok && strings.EqualFold(h.Get("Pragma"), "no-cache") {
+		cc["no-cache"] = ""
+	}
+	return cc
+}
+
+func (cc cacheControl) has(directive string) bool {
+	_, ok := cc[directive]
+	return ok
+}
+
+// seconds returns the value of a delta-seconds directive.
+func (cc cacheControl) seconds(directive string) (time.Duration, bool) {
+	value, ok := cc[directive]
+	if !ok {
+		return 0, false
+	}
+	seconds, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || seconds < 0 {
+		return 0, false
+	}
+	return time.Duration(seconds) * time.Second, true
+}
+
+// cacheEntry is a cached response.
+type cacheEntry struct {
+	StatusCode int         `json:"status"`
+	Header     http.Header `json:"header"`
+	Body       []byte      `json:"body"`
+
+	// The request headers nominated by the Vary header of the response.
+	Vary http.Header `json:"vary,omitempty"`
+
+	// The time the request was sent and the response was received, used to
+	// calculate the age of the response.
+	RequestTime  time.Time `json:"requestTime"`
+	ResponseTime time.Time `json:"responseTime"`
+}
+
+func (e *cacheEntry) hasValidators() bool {
+	return e.Header.Get("ETag") != "" || e.Header.Get("Last-Modified") != ""
+}
+
+// public returns whether the cached response can be served to any caller.
+func (e *cacheEntry) public() bool {
+	return parseCacheControl(e.Header).has("public")
+}
+
+func (e *cacheEntry) varyMatches(h http.Header) bool {
+	for name, values := range e.Vary {
+		if strings.Join(values, ", ") != strings.Join(h.Values(name), ", ") {
+			return false
+		}
+	}
+	return true
+}
+
+func (e *cacheEntry) date() time.Time {
+	if date, err := http.ParseTime(e.Header.Get("Date")); err == nil {
+		return date
+	}
+	return e.ResponseTime
+}
+
+// freshnessLifetime implements RFC 7234 section 4.2.1.
+func (e *cacheEntry) freshnessLifetime() time.Duration {
+	cc := parseCacheControl(e.Header)
+	if cc.has("no-cache") {
+		return 0
+	}
+	if maxAge, ok := cc.seconds("max-age"); ok {
+		return maxAge
+	}
+	if expires := e.Header.Get("Expires"); expires != "" {
+		t, err := http.ParseTime(expires)
+		if err != nil {
+			// Invalid Expires means already expired.
+			return 0
+		}
+		return t.Sub(e.date())
+	}
+	if lastModified, err := http.ParseTime(e.Header.Get("Last-Modified")); err == nil {
+		if d := e.date().Sub(lastModified); d > 0 {
+			return d / 10
+		}
+	}
+	return 0
+}
+
+// currentAge implements RFC 7234 section 4.2.3.
+func (e *cacheEntry) currentAge(now time.Time) time.Duration {
+	apparentAge := e.ResponseTime.Sub(e.date())
+	if apparentAge < 0 {
+		apparentAge = 0
+	}
+	correctedAge := e.ResponseTime.Sub(e.RequestTime)
+	if age, err := strconv.ParseInt(e.Header.Get("Age"), 10, 64); err == nil && age > 0 {
+		correctedAge += time.Duration(age) * time.Second
+	}
+	if correctedAge < apparentAge {
+		correctedAge = apparentAge
+	}
+	return correctedAge + now.Sub(e.ResponseTime)
+}
+
+// fresh returns whether the cached response can be served without
+// revalidation, see RFC 7234 section 4.2 and 5.2.1.
+func (e *cacheEntry) fresh(reqCC cacheControl, now time.Time) bool {
+	if reqCC.has("no-cache") {
+		return false
+	}
+	lifetime := e.freshnessLifetime()
+	age := e.currentAge(now)
+	if maxAge, ok := reqCC.seconds("max-age"); ok && age > maxAge {
+		return false
+	}
+	if minFresh, ok := reqCC.seconds("min-fresh"); ok {
+		age += minFresh
+	}
+	if age < lifetime {
+		return true
+	}
+
+	respCC := parseCacheControl(e.Header)
+	if respCC.has("must-revalidate") || respCC.has("no-cache") || !reqCC.has("max-stale") {
+		return false
+	}
+	maxStale, ok := reqCC.seconds("max-stale")
+	// max-stale without a value means any stale response is acceptable.
+	return !ok || age-lifetime <= maxStale
+}
+
+// update updates the cached response with the headers of a 304 response,
+// see RFC 7234 section 4.3.4.
+func (e *cacheEntry) update(header http.Header, requestTime, responseTime time.Time) {
+	for name, values := range header {
+		if name == ContentLengthHeader {
+			continue
+		}
+		e.Header[name] = values
+	}
+	e.RequestTime = requestTime
+	e.ResponseTime = responseTime
+}
+
+// response returns the cached response to req.
+func (e *cacheEntry) response(req *http.Request, now time.Time) *http.Response {
+	header := e.Header.Clone()
+	header.Set("Age", strconv.FormatInt(int64(e.currentAge(now)/time.Second), 10))
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", e.StatusCode, http.StatusText(e.StatusCode)),
+		StatusCode:    e.StatusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          io.NopCloser(bytes.NewReader(e.Body)),
+		ContentLength: int64(len(e.Body)),
+		Request:       req,
+	}
+}
+
+// cacheBody buffers the response body while it's read by the caller,
+// and calls done with the whole body once it's fully read.
+type cacheBody struct {
+	io.ReadCloser
+
+	max      int64
+	done     func(body []byte)
+	buf      bytes.Buffer
+	tooLarge bool
+	finished bool
+}
+
+func (b *cacheBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if !b.tooLarge {
+		if int64(b.buf.Len()+n) > b.max {
+			b.tooLarge = true
+			b.buf = bytes.Buffer{}
+		} else {
+			b.buf.Write(p[:n])
+		}
+	}
+	if err == io.EOF && !b.tooLarge && !b.finished {
+		b.finished = true
+		b.done(b.buf.Bytes())
+	}
+	return n, err
+}
+
+// MemoryCacheStore is a CacheStore keeping the responses in memory,
+// evicting the least recently used ones when the total size exceeds the limit.
+//
+// It's safe for concurrent use.
+type MemoryCacheStore struct {
+	maxBytes int64
+
+	lock  sync.Mutex
+	size  int64
+	lru   *list.List
+	items map[string]*list.Element
+}
+
+type memoryCacheItem struct {
+	key       string
+	value     []byte
+	expiresAt time.Time
+}
+
+func (i *memoryCacheItem) size() int64 {
+	return int64(len(i.key) + len(i.value))
+}
+
+// NewMemoryCacheStore creates a new, empty MemoryCacheStore,
+// which keeps at most maxBytes of keys and values.
+func NewMemoryCacheStore(maxBytes int64) *MemoryCacheStore {
+	return &MemoryCacheStore{
+		maxBytes: maxBytes,
+		lru:      list.New(),
+		items:    make(map[string]*list.Element),
+	}
+}
+
+// Get implements CacheStore.
+//
+// It never returns an error.
+func (s *MemoryCacheStore) Get(_ context.Context, key string) ([]byte, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	elem, ok := s.items[key]
+	if !ok {
+		return nil, nil
+	}
+	item := elem.Value.(*memoryCacheItem)
+	if !time.Now().Before(item.expiresAt) {
+		s.remove(elem)
+		return nil, nil
+	}
+	s.lru.MoveToFront(elem)
+	return item.value, nil
+}
+
+// Set implements CacheStore.
+//
+// Values larger than maxBytes are not stored.
+// It never returns an error.
+func (s *MemoryCacheStore) Set(_ context.Context, key string, value []byte, ttl time.Duration) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if elem, ok := s.items[key]; ok {
+		s.remove(elem)
+	}
+	item := &memoryCacheItem{
+		key:       key,
+		value:     value,
+		expiresAt: time.Now().Add(ttl),
+	}
+	if item.size() > s.maxBytes {
+		return nil
+	}
+	s.items[key] = s.lru.PushFront(item)
+	s.size += item.size()
+	for s.size > s.maxBytes {
+		s.remove(s.lru.Back())
+	}
+	return nil
+}
+
+// Delete implements CacheStore.
+//
+// It never returns an error.
+func (s *MemoryCacheStore) Delete(_ context.Context, key string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if elem, ok := s.items[key]; ok {
+		s.remove(elem)
+	}
+	return nil
+}
+
+func (s *MemoryCacheStore) remove(elem *list.Element) {
+	item := s.lru.Remove(elem).(*memoryCacheItem)
+	delete(s.items, item.key)
+	s.size -= item.size()
+}
+
+// RedisCacheStore is a CacheStore keeping the responses in redis,
+// so they are shared among all the client instances.
+type RedisCacheStore struct {
+	// The redis client, usually created with redispipebp.
+	Client redisx.Sync
+
+	// The prefix of the redis keys of the responses.
+	//
+	// Optional. Default to DefaultCacheRedisKeyPrefix.
+	KeyPrefix string
+}
+
+func (s RedisCacheStore) key(key string) string {
+	if s.KeyPrefix == "" {
+		return DefaultCacheRedisKeyPrefix + key
+	}
+	return s.KeyPrefix + key
+}
+
+// Get implements CacheStore.
+func (s RedisCacheStore) Get(ctx context.Context, key string) ([]byte, error) {
+	var value []byte
+	if err := (redisx.Syncx{Sync: s.Client}).Do(ctx, &value, "GET", s.key(key)); err != nil {
+		return nil, err
+	}
+	return value, nil
+}
+
+// Set implements CacheStore.
+func (s RedisCacheStore) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	millis := ttl.Milliseconds()
+	if millis <= 0 {
+		return nil
+	}
+	return (redisx.Syncx{Sync: s.Client}).Do(ctx, nil, "SET", s.key(key), value, "PX", millis)
+}
+
+// Delete implements CacheStore.
+func (s RedisCacheStore) Delete(ctx context.Context, key string) error {
+	return (redisx.Syncx{Sync: s.Client}).Do(ctx, nil, "DEL", s.key(key))
+}
+
+var (
+	_ CacheStore = (*MemoryCacheStore)(nil)
+	_ CacheStore = RedisCacheStore{}
+)
@@ -0,0 +1,432 @@
+package httpbp_test
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/joomcode/redispipe/redis"
+	"github.com/joomcode/redispipe/redisconn"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/reddit/baseplate.go/ecinterface"
+	"github.com/reddit/baseplate.go/httpbp"
+	"github.com/reddit/baseplate.go/prometheusbp/promtest"
+	"github.com/reddit/baseplate.go/redis/cache/redisx"
+)
+
+func TestCache(t *testing.T) {
+	t.Parallel()
+
+	newStores := map[string]func(t *testing.T) httpbp.CacheStore{
+		"memory": func(t *testing.T) httpbp.CacheStore {
+			return httpbp.NewMemoryCacheStore(httpbp.DefaultCacheMaxBytes)
+		},
+		"redis": func(t *testing.T) httpbp.CacheStore {
+			s, err := miniredis.Run()
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(s.Close)
+			sender, err := redisconn.Connect(context.Background(), s.Addr(), redisconn.Opts{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(sender.Close)
+			return httpbp.RedisCacheStore{
+				Client: redisx.BaseSync{SyncCtx: redis.SyncCtx{S: sender}},
+			}
+		},
+	}
+
+	type request struct {
+		method string
+		header http.Header
+
+		expectedBody   string
+		expectedResult string
+	}
+
+	cases := []struct {
+		name    string
+		handler func(w http.ResponseWriter, r *http.Request, n int64)
+		// The expected number of requests received by the upstream server.
+		expectedUpstream int64
+		requests         []request
+	}{
+		{
+			name: "fresh",
+			handler: func(w http.ResponseWriter, r *http.Request, n int64) {
+				w.Header().Set("Cache-Control", "max-age=60")
+			},
+			expectedUpstream: 1,
+			requests: []request{
+				{expectedBody: "1", expectedResult: httpbp.CacheMiss},
+				{expectedBody: "1", expectedResult: httpbp.CacheHit},
+			},
+		},
+		{
+			name: "revalidate",
+			handler: func(w http.ResponseWriter, r *http.Request, n int64) {
+				w.Header().Set("Cache-Control", "max-age=0")
+				w.Header().Set("ETag", `"v1"`)
+				if r.Header.Get("If-None-Match") == `"v1"` {
+					w.WriteHeader(http.StatusNotModified)
+				}
+			},
+			expectedUpstream: 2,
+			requests: []request{
+				{expectedBody: "1", expectedResult: httpbp.CacheMiss},
+				{expectedBody: "1", expectedResult: httpbp.CacheRevalidated},
+			},
+		},
+		{
+			name: "modified",
+			handler: func(w http.ResponseWriter, r *http.Request, n int64) {
+				w.Header().Set("Last-Modified", time.Now().Add(-time.Duration(n)*time.Hour).UTC().Format(http.TimeFormat))
+				w.Header().Set("Cache-Control", "no-cache")
+			},
+			expectedUpstream: 2,
+			requests: []request{
+				{expectedBody: "1", expectedResult: httpbp.CacheMiss},
+				{expectedBody: "2", expectedResult: httpbp.CacheMiss},
+			},
+		},
+		{
+			name: "vary",
+			handler: func(w http.ResponseWriter, r *http.Request, n int64) {
+				w.Header().Set("Cache-Control", "max-age=60")
+				w.Header().Set("Vary", "Accept-Language")
+			},
+			expectedUpstream: 2,
+			requests: []request{
+				{
+					header:         http.Header{"Accept-Language": {"en"}},
+					expectedBody:   "1",
+					expectedResult: httpbp.CacheMiss,
+				},
+				{
+					header:         http.Header{"Accept-Language": {"en"}},
+					expectedBody:   "1",
+					expectedResult: httpbp.CacheHit,
+				},
+				{
+					header:         http.Header{"Accept-Language": {"fr"}},
+					expectedBody:   "2",
+					expectedResult: httpbp.CacheMiss,
+				},
+			},
+		},
+		{
+			name: "no-store",
+			handler: func(w http.ResponseWriter, r *http.Request, n int64) {
+				w.Header().Set("Cache-Control", "max-age=60, no-store")
+			},
+			expectedUpstream: 2,
+			requests: []request{
+				{expectedBody: "1", expectedResult: httpbp.CacheMiss},
+				{expectedBody: "2", expectedResult: httpbp.CacheMiss},
+			},
+		},
+		{
+			name: "request-no-cache",
+			handler: func(w http.ResponseWriter, r *http.Request, n int64) {
+				w.Header().Set("Cache-Control", "max-age=60")
+			},
+			expectedUpstream: 2,
+			requests: []request{
+				{expectedBody: "1", expectedResult: httpbp.CacheMiss},
+				{
+					header:         http.Header{"Cache-Control": {"no-cache"}},
+					expectedBody:   "2",
+					expectedResult: httpbp.CacheMiss,
+				},
+				{expectedBody: "2", expectedResult: httpbp.CacheHit},
+			},
+		},
+		{
+			name: "invalidate",
+			handler: func(w http.ResponseWriter, r *http.Request, n int64) {
+				w.Header().Set("Cache-Control", "max-age=60")
+			},
+			expectedUpstream: 3,
+			requests: []request{
+				{expectedBody: "1", expectedResult: httpbp.CacheMiss},
+				{method: http.MethodPost, expectedBody: "2"},
+				{expectedBody: "3", expectedResult: httpbp.CacheMiss},
+			},
+		},
+	}
+
+	for _storeName, _newStore := range newStores {
+		storeName, newStore := _storeName, _newStore
+		t.Run(storeName, func(t *testing.T) {
+			t.Parallel()
+
+			for _, _c := range cases {
+				c := _c
+				t.Run(c.name, func(t *testing.T) {
+					t.Parallel()
+
+					var upstream int64
+					server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+						n := atomic.AddInt64(&upstream, 1)
+						c.handler(w, r, n)
+						io.WriteString(w, strconv.FormatInt(n, 10))
+					}))
+					defer server.Close()
+
+					slug := "cache-" + storeName + "-" + c.name
+					client := &http.Client{
+						Transport: httpbp.WrapTransport(
+							http.DefaultTransport,
+							httpbp.Cache(slug, httpbp.CacheConfig{Store: newStore(t)}),
+						),
+					}
+					for i, r := range c.requests {
+						method := r.method
+						if method == "" {
+							method = http.MethodGet
+						}
+						req, err := http.NewRequest(method, server.URL, nil)
+						if err != nil {
+							t.Fatal(err)
+						}
+						for k, v := range r.header {
+							req.Header[k] = v
+						}
+
+						result := promtest.NewGatheredMetricTest(t, "httpbp_client_cache_requests_total", prometheus.Labels{
+							"http_slug":         slug,
+							"http_cache_result": r.expectedResult,
+						})
+						resp, err := client.Do(req)
+						if err != nil {
+							t.Fatal(err)
+						}
+						body, err := io.ReadAll(resp.Body)
+						resp.Body.Close()
+						if err != nil {
+							t.Fatal(err)
+						}
+						if resp.StatusCode != http.StatusOK {
+							t.Errorf("#%d: Expected status %d, got %d", i, http.StatusOK, resp.StatusCode)
+						}
+						if string(body) != r.expectedBody {
+							t.Errorf("#%d: Expected body %q, got %q", i, r.expectedBody, body)
+						}
+						if r.expectedResult != "" {
+							result.CheckDelta(1)
+						}
+					}
+					if n := atomic.LoadInt64(&upstream); n != c.expectedUpstream {
+						t.Errorf("Expected %d upstream requests, got %d", c.expectedUpstream, n)
+					}
+				})
+			}
+		})
+	}
+}
+
+func TestCacheEdgeContext(t *testing.T) {
+	t.Parallel()
+
+	for _, c := range []struct {
+		label            string
+		cacheControl     string
+		expectedUpstream int64
+		expectedShared   bool
+	}{
+		{
+			label:            "private",
+			cacheControl:     "max-age=60",
+			expectedUpstream: 5,
+		},
+		{
+			label:            "public",
+			cacheControl:     "public, max-age=60",
+			expectedUpstream: 1,
+			expectedShared:   true,
+		},
+	} {
+		c := c
+		t.Run(c.label, func(t *testing.T) {
+			t.Parallel()
+
+			var upstream int64
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				atomic.AddInt64(&upstream, 1)
+				w.Header().Set("Cache-Control", c.cacheControl)
+				io.WriteString(w, r.Header.Get(httpbp.EdgeContextHeader)+r.Header.Get(httpbp.AuthorizationHeader)+r.Header.Get("Cookie"))
+			}))
+			t.Cleanup(server.Close)
+
+			ecImpl := ecinterface.Mock()
+			client, err := httpbp.NewClient(httpbp.ClientConfig{
+				Slug:            "cache-edge-context-" + c.label,
+				EdgeContextImpl: ecImpl,
+				Cache:           &httpbp.CacheConfig{},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			get := func(user string, header http.Header) string {
+				t.Helper()
+
+				ctx, err := ecImpl.HeaderToContext(context.Background(), user)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if user == "" {
+					ctx = context.Background()
+				}
+				req, err := http.NewRequestWithContext(ctx, http.MethodGet, server.URL, nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				for k, v := range header {
+					req.Header[k] = v
+				}
+				resp, err := client.Do(req)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer resp.Body.Close()
+				body, err := io.ReadAll(resp.Body)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return string(body)
+			}
+
+			a := get("user-a", nil)
+			b := get("user-b", nil)
+			if shared := a == b; shared != c.expectedShared {
+				t.Errorf("Expected shared response %v, got %q for user-a and %q for user-b", c.expectedShared, a, b)
+			}
+			auth := get("", http.Header{httpbp.AuthorizationHeader: {"Bearer token"}})
+			if shared := auth == a; shared != c.expectedShared {
+				t.Errorf("Expected shared response %v, got %q for user-a and %q with authorization", c.expectedShared, a, auth)
+			}
+			cookie := get("", http.Header{"Cookie": {"session=token"}})
+			if shared := cookie == a; shared != c.expectedShared {
+				t.Errorf("Expected shared response %v, got %q for user-a and %q with cookie", c.expectedShared, a, cookie)
+			}
+			anonymous := get("", nil)
+			if shared := anonymous == cookie; shared != c.expectedShared {
+				t.Errorf("Expected shared response %v, got %q with cookie and %q without", c.expectedShared, cookie, anonymous)
+			}
+			if n := atomic.LoadInt64(&upstream); n != c.expectedUpstream {
+				t.Errorf("Expected %d upstream requests, got %d", c.expectedUpstream, n)
+			}
+		})
+	}
+}
+
+func TestCachePrivateResponse(t *testing.T) {
+	t.Parallel()
+
+	var upstream int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&upstream, 1)
+		w.Header().Set("Cache-Control", "private, max-age=60")
+		io.WriteString(w, "private")
+	}))
+	t.Cleanup(server.Close)
+
+	client, err := httpbp.NewClient(httpbp.ClientConfig{
+		Slug:  "cache-private-response",
+		Cache: &httpbp.CacheConfig{},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		resp, err := client.Get(server.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}
+	if n := atomic.LoadInt64(&upstream); n != 2 {
+		t.Errorf("Expected private responses not to be stored, got %d upstream requests for 2 requests", n)
+	}
+}
+
+func TestCacheOnlyIfCached(t *testing.T) {
+	t.Parallel()
+
+	client := &http.Client{
+		Transport: httpbp.WrapTransport(
+			http.DefaultTransport,
+			httpbp.Cache("cache-only-if-cached", httpbp.CacheConfig{}),
+		),
+	}
+	req, err := http.NewRequest(http.MethodGet, "http://127.0.0.1:0/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Cache-Control", "only-if-cached")
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	httpbp.DrainAndClose(resp.Body)
+	if resp.StatusCode != http.StatusGatewayTimeout {
+		t.Errorf("Expected status %d, got %d", http.StatusGatewayTimeout, resp.StatusCode)
+	}
+}
+
+func TestMemoryCacheStore(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	// Fits 2 entries of 1 byte key and 4 bytes value.
+	store := httpbp.NewMemoryCacheStore(10)
+
+	get := func(key string) string {
+		t.Helper()
+		value, err := store.Get(ctx, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(value)
+	}
+
+	store.Set(ctx, "a", []byte("aaaa"), time.Minute)
+	store.Set(ctx, "b", []byte("bbbb"), time.Minute)
+	// Makes b the least recently used one.
+	if v := get("a"); v != "aaaa" {
+		t.Errorf("Expected %q, got %q", "aaaa", v)
+	}
+	store.Set(ctx, "c", []byte("cccc"), time.Minute)
+	if v := get("b"); v != "" {
+		t.Errorf("Expected b to be evicted, got %q", v)
+	}
+	if v := get("a"); v != "aaaa" {
+		t.Errorf("Expected %q, got %q", "aaaa", v)
+	}
+
+	store.Set(ctx, "d", []byte("too large value"), time.Minute)
+	if v := get("d"); v != "" {
+		t.Errorf("Expected too large value to not be stored, got %q", v)
+	}
+
+	store.Set(ctx, "e", []byte("e"), time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+	if v := get("e"); v != "" {
+		t.Errorf("Expected e to be expired, got %q", v)
+	}
+
+	store.Delete(ctx, "a")
+	if v := get("a"); v != "" {
+		t.Errorf("Expected a to be deleted, got %q", v)
+	}
+}
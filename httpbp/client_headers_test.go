@@ -0,0 +1,156 @@
+package httpbp_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/reddit/baseplate.go/ecinterface"
+	"github.com/reddit/baseplate.go/httpbp"
+	"github.com/reddit/baseplate.go/tracing"
+)
+
+type headerRecorder struct {
+	header http.Header
+	trust  httpbp.HeaderTrustHandler
+
+	trustSpan        bool
+	trustEdgeContext bool
+}
+
+func (h *headerRecorder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.header = r.Header.Clone()
+	if h.trust != nil {
+		h.trustSpan = h.trust.TrustSpan(r)
+		h.trustEdgeContext = h.trust.TrustEdgeContext(r)
+	}
+}
+
+func TestNewClientPropagatesHeaders(t *testing.T) {
+	const edgeContext = "dummy-edge-context"
+
+	signer := getTrustHeaderSignature(newSecretsStore(t))
+	impl := ecinterface.Mock()
+
+	cases := []struct {
+		name   string
+		signer *httpbp.TrustHeaderSignature
+	}{
+		{
+			name: "unsigned",
+		},
+		{
+			name:   "signed",
+			signer: &signer,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			recorder := &headerRecorder{trust: signer}
+			server := httptest.NewServer(recorder)
+			defer server.Close()
+
+			client, err := httpbp.NewClient(httpbp.ClientConfig{
+				Slug:            "test",
+				EdgeContextImpl: impl,
+				HeaderSignature: c.signer,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			ctx, serverSpan := tracing.StartSpanFromHeaders(
+				context.Background(),
+				"server",
+				tracing.Headers{},
+			)
+			defer serverSpan.Stop(ctx, nil)
+			ctx, err = impl.HeaderToContext(ctx, edgeContext)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			req, err := http.NewRequestWithContext(ctx, http.MethodGet, server.URL, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			httpbp.DrainAndClose(resp.Body)
+
+			if len(req.Header) != 0 {
+				t.Errorf("Expected the original request headers to be untouched, got %v", req.Header)
+			}
+
+			header := recorder.header
+			if got, want := header.Get(httpbp.TraceIDHeader), serverSpan.TraceID(); got != want {
+				t.Errorf("%s header expected %q, got %q", httpbp.TraceIDHeader, want, got)
+			}
+			// The direct parent is the retry wrapper client span.
+			if got := header.Get(httpbp.ParentIDHeader); got == "" || got == serverSpan.ID() {
+				t.Errorf("%s header expected to be the wrapper client span, got %q", httpbp.ParentIDHeader, got)
+			}
+			if got := header.Get(httpbp.SpanIDHeader); got == "" || got == serverSpan.ID() {
+				t.Errorf("%s header expected to be a new client span, got %q", httpbp.SpanIDHeader, got)
+			}
+			if got, want := header.Get(httpbp.SpanFlagsHeader), strconv.FormatInt(serverSpan.Flags(), 10); got != want {
+				t.Errorf("%s header expected %q, got %q", httpbp.SpanFlagsHeader, want, got)
+			}
+			if got := header.Get(httpbp.SpanSampledHeader); got != "0" && got != "1" {
+				t.Errorf("%s header expected to be either 0 or 1, got %q", httpbp.SpanSampledHeader, got)
+			}
+			ec, err := httpbp.NewEdgeContextHeaders(header)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ec.EdgeRequest != edgeContext {
+				t.Errorf("%s header expected %q, got %q", httpbp.EdgeContextHeader, edgeContext, ec.EdgeRequest)
+			}
+
+			signed := c.signer != nil
+			if recorder.trustSpan != signed {
+				t.Errorf("Expected TrustSpan to be %v, got %v", signed, recorder.trustSpan)
+			}
+			if recorder.trustEdgeContext != signed {
+				t.Errorf("Expected TrustEdgeContext to be %v, got %v", signed, recorder.trustEdgeContext)
+			}
+		})
+	}
+}
+
+func TestInjectSpanHeadersNoSpan(t *testing.T) {
+	recorder := &headerRecorder{}
+	server := httptest.NewServer(recorder)
+	defer server.Close()
+
+	client := &http.Client{
+		Transport: httpbp.WrapTransport(
+			nil,
+			httpbp.ForwardEdgeRequestContext(httpbp.ForwardEdgeRequestContextArgs{
+				EdgeContextImpl: ecinterface.Mock(),
+			}),
+			httpbp.InjectSpanHeaders(httpbp.InjectSpanHeadersArgs{}),
+		),
+	}
+	resp, err := client.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	httpbp.DrainAndClose(resp.Body)
+
+	for _, key := range []string{
+		httpbp.TraceIDHeader,
+		httpbp.SpanIDHeader,
+		httpbp.SpanSignatureHeader,
+		httpbp.EdgeContextHeader,
+		httpbp.EdgeContextSignatureHeader,
+	} {
+		if v := recorder.header.Get(key); v != "" {
+			t.Errorf("Expected no %s header, got %q", key, v)
+		}
+	}
+}
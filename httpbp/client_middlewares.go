@@ -1,7 +1,9 @@
 package httpbp
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"io"
 	"net/http"
 	"strconv"
@@ -14,6 +16,7 @@ import (
 	"github.com/prometheus/client_golang/prometheus"
 
 	"github.com/reddit/baseplate.go/breakerbp"
+	"github.com/reddit/baseplate.go/ecinterface"
 	"github.com/reddit/baseplate.go/retrybp"
 	"github.com/reddit/baseplate.go/tracing"
 	"github.com/reddit/baseplate.go/transport"
@@ -37,21 +40,156 @@ func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
 	return f(req)
 }
 
-// NewClient returns a standard HTTP client wrapped with the default middleware
-// plus any additional client middleware passed into this function. Default
-// middlewares are:
+// DefaultClientMiddlewareArgs provides the arguments for the default,
+// Baseplate client middlewares.
+type DefaultClientMiddlewareArgs struct {
+	// Slug is a short identifier for the HTTP service you are creating
+	// clients for, used in span names and metrics labels.
+	Slug string
+
+	// RetryOptions is the list of retry.Options to apply as the defaults for the
+	// Retries middleware.
+	//
+	// This is optional, if it is not set, we will use a single option,
+	// retry.Attempts(1).  This sets up the retry middleware but does not
+	// automatically retry any requests.  You can set retry behavior per-call by
+	// using retrybp.WithOptions.
+	RetryOptions []retry.Option
+
+	// The max bytes to read from a failed response to be attached to the
+	// ClientError.
+	//
+	// Optional. Default to DefaultMaxErrorReadAhead if <= 0.
+	MaxErrorReadAhead int
+
+	// When BreakerConfig is non-nil, the CircuitBreaker middleware will be used.
+	BreakerConfig *breakerbp.Config
+
+	// When MaxConcurrency > 0, the MaxConcurrency middleware will be used.
+	MaxConcurrency int64
+
+	// When Hedge is non-nil, the Hedge middleware will be used.
+	Hedge *HedgeConfig
+
+	// The RetryBudget shared by the retried and the hedged requests.
+	//
+	// Optional. If nil and Hedge is non-nil, the budget configured by Hedge
+	// is used by both. If both are nil, retries are not capped by any budget.
+	RetryBudget *RetryBudget
+
+	// When DecompressResponse is true, the DecompressResponse middleware will
+	// be used.
+	DecompressResponse bool
+
+	// When Cache is non-nil, the Cache middleware will be used.
+	Cache *CacheConfig
+
+	// The edgecontext implementation to use. Optional.
+	// If not set, the global one from ecinterface.Get will be used instead.
+	EdgeContextImpl ecinterface.Interface
+
+	// Optional. If set, the span and edge context headers will be signed with
+	// it.
+	HeaderSignature *TrustHeaderSignature
+}
+
+// DefaultClientMiddleware returns the default client middlewares that should
+// be used by a baseplate service.
 //
-// * MonitorClient with transport.WithRetrySlugSuffix
+// Currently they are (in order):
 //
-// * PrometheusClientMetrics with transport.WithRetrySlugSuffix
+// 1. CircuitBreaker - Only if BreakerConfig is non-nil.
 //
-// * Retries
+// 2. ForwardEdgeRequestContext
 //
-// * MonitorClient
+// 3. Cache - Only if Cache is non-nil.
 //
-// * PrometheusClientMetrics
+// 4. MaxConcurrency - Only if MaxConcurrency > 0.
 //
+// 5. MonitorClient with transport.WithRetrySlugSuffix - This creates the spans
+// from the view of the client that group all retries into a single,
+// wrapped span.
+//
+// 6. PrometheusClientMetrics with transport.WithRetrySlugSuffix
+//
+// 7. RetriesWithBudget(maxErrorReadAhead, retryBudget, retryOptions) -
 // ClientErrorWrapper is included as transitive middleware through Retries.
+//
+// 8. Hedge - Only if Hedge is non-nil, sharing the same RetryBudget as
+// RetriesWithBudget.
+//
+// 9. MonitorClient - This creates the spans of the raw client calls.
+//
+// 10. PrometheusClientMetrics
+//
+// 11. InjectSpanHeaders
+//
+// 12. SetDeadlineBudget
+//
+// 13. DecompressResponse - Only if DecompressResponse is true.
+func DefaultClientMiddleware(args DefaultClientMiddlewareArgs) []ClientMiddleware {
+	if args.MaxErrorReadAhead <= 0 {
+		args.MaxErrorReadAhead = DefaultMaxErrorReadAhead
+	}
+	if len(args.RetryOptions) == 0 {
+		args.RetryOptions = []retry.Option{retry.Attempts(1)}
+	}
+
+	budget := args.RetryBudget
+	if budget == nil && args.Hedge != nil {
+		budget = args.Hedge.budget()
+	}
+
+	var middlewares []ClientMiddleware
+	if args.BreakerConfig != nil {
+		middlewares = append(middlewares, CircuitBreaker(*args.BreakerConfig))
+	}
+	middlewares = append(middlewares, ForwardEdgeRequestContext(ForwardEdgeRequestContextArgs{
+		EdgeContextImpl: args.EdgeContextImpl,
+		Signer:          args.HeaderSignature,
+	}))
+	if args.Cache != nil {
+		cache := *args.Cache
+		if cache.EdgeContextImpl == nil {
+			cache.EdgeContextImpl = args.EdgeContextImpl
+		}
+		middlewares = append(middlewares, Cache(args.Slug, cache))
+	}
+	if args.MaxConcurrency > 0 {
+		middlewares = append(middlewares, MaxConcurrency(args.MaxConcurrency))
+	}
+	middlewares = append(
+		middlewares,
+		MonitorClient(args.Slug+transport.WithRetrySlugSuffix),
+		PrometheusClientMetrics(args.Slug+transport.WithRetrySlugSuffix),
+		RetriesWithBudget(args.MaxErrorReadAhead, budget, args.RetryOptions...),
+	)
+	if args.Hedge != nil {
+		hedge := *args.Hedge
+		hedge.Budget = budget
+		middlewares = append(middlewares, Hedge(args.Slug, hedge))
+	}
+	middlewares = append(
+		middlewares,
+		MonitorClient(args.Slug),
+		PrometheusClientMetrics(args.Slug),
+		InjectSpanHeaders(InjectSpanHeadersArgs{
+			Signer: args.HeaderSignature,
+		}),
+		SetDeadlineBudget,
+	)
+	if args.DecompressResponse {
+		middlewares = append(middlewares, DecompressResponse)
+	}
+	return middlewares
+}
+
+// NewClient returns a standard HTTP client wrapped with the default middleware
+// plus any additional client middleware passed into this function.
+//
+// The default middlewares are the ones from DefaultClientMiddleware,
+// configured by the given ClientConfig.
+// The additional middlewares are applied before the default ones.
 func NewClient(config ClientConfig, middleware ...ClientMiddleware) (*http.Client, error) {
 	if err := config.Validate(); err != nil {
 		return nil, err
@@ -63,30 +201,19 @@ func NewClient(config ClientConfig, middleware ...ClientMiddleware) (*http.Clien
 		httpTransport.MaxConnsPerHost = config.MaxConnections
 	}
 
-	// apply default if not set
-	if config.MaxErrorReadAhead == 0 {
-		config.MaxErrorReadAhead = DefaultMaxErrorReadAhead
-	}
-
-	// if no retry options are set default to retry.Attempts(1)
-	if len(config.RetryOptions) == 0 {
-		config.RetryOptions = []retry.Option{retry.Attempts(1)}
-	}
-
-	defaults := []ClientMiddleware{
-		MonitorClient(config.Slug + transport.WithRetrySlugSuffix),
-		PrometheusClientMetrics(config.Slug + transport.WithRetrySlugSuffix),
-		Retries(config.MaxErrorReadAhead, config.RetryOptions...),
-		MonitorClient(config.Slug),
-		PrometheusClientMetrics(config.Slug),
-	}
-
-	// prepend middleware to ensure Retires with ClientErrorWrapper is still
-	// applied first
-	if config.CircuitBreaker != nil {
-		defaults = append([]ClientMiddleware{CircuitBreaker(*config.CircuitBreaker)}, defaults...)
-	}
-	middleware = append(middleware, defaults...)
+	middleware = append(middleware, DefaultClientMiddleware(DefaultClientMiddlewareArgs{
+		Slug:               config.Slug,
+		RetryOptions:       config.retryOptions(),
+		MaxErrorReadAhead:  config.MaxErrorReadAhead,
+		BreakerConfig:      config.CircuitBreaker,
+		MaxConcurrency:     config.MaxConcurrency,
+		Hedge:              config.Hedge,
+		RetryBudget:        config.RetryBudget,
+		DecompressResponse: config.DecompressResponse,
+		Cache:              config.Cache,
+		EdgeContextImpl:    config.EdgeContextImpl,
+		HeaderSignature:    config.HeaderSignature,
+	})...)
 
 	return &http.Client{
 		Transport: WrapTransport(&httpTransport, middleware...),
@@ -198,13 +325,53 @@ func CircuitBreaker(config breakerbp.Config) ClientMiddleware {
 // Retries provides a retry middleware by ensuring certain HTTP responses are
 // wrapped in errors. Retries wraps the ClientErrorWrapper middleware, e.g. if
 // you are using Retries there is no need to also use ClientErrorWrapper.
+//
+// It's RetriesWithBudget without a RetryBudget.
 func Retries(limit int, retryOptions ...retry.Option) ClientMiddleware {
+	return RetriesWithBudget(limit, nil, retryOptions...)
+}
+
+// retryBudgetContextKey is the context key of the RetryBudget the original
+// request already deposited into.
+type retryBudgetContextKey struct{}
+
+// depositRetryBudget deposits into budget for the original request,
+// unless an outer middleware already did that for the same budget.
+func depositRetryBudget(req *http.Request, budget *RetryBudget) *http.Request {
+	if deposited, _ := req.Context().Value(retryBudgetContextKey{}).(*RetryBudget); deposited == budget {
+		return req
+	}
+	budget.Deposit()
+	return req.WithContext(context.WithValue(req.Context(), retryBudgetContextKey{}, budget))
+}
+
+// RetriesWithBudget is Retries with every retry withdrawing from budget.
+//
+// The original request deposits into budget,
+// and a request is no longer retried once budget is exhausted,
+// in which case ErrRetryBudgetExhausted is returned along with the error of
+// the last attempt.
+//
+// Sharing the same budget with the Hedge middleware caps the total number of
+// extra attempts of both. In that case every original request only deposits
+// once.
+//
+// If budget is nil, it's the same as Retries.
+func RetriesWithBudget(limit int, budget *RetryBudget, retryOptions ...retry.Option) ClientMiddleware {
 	if len(retryOptions) == 0 {
 		retryOptions = []retry.Option{retry.Attempts(1)}
 	}
 	return func(next http.RoundTripper) http.RoundTripper {
 		return roundTripperFunc(func(req *http.Request) (resp *http.Response, err error) {
+			if budget != nil {
+				req = depositRetryBudget(req, budget)
+			}
+			var attempted bool
 			err = retrybp.Do(req.Context(), func() error {
+				if attempted && budget != nil && !budget.Withdraw() {
+					return retry.Unrecoverable(ErrRetryBudgetExhausted)
+				}
+				attempted = true
 				// include ClientErrorWrapper to ensure retry is applied for
 				// some HTTP 5xx responses
 				resp, err = ClientErrorWrapper(limit)(next).RoundTrip(req)
@@ -328,3 +495,162 @@ func PrometheusClientMetrics(serverSlug string) ClientMiddleware {
 		})
 	}
 }
+
+// DefaultHeaderSignatureExpiresIn is the default expiration duration used when
+// signing the span and edge context headers sent by the client middlewares.
+const DefaultHeaderSignatureExpiresIn = time.Minute
+
+// InjectSpanHeadersArgs are the args to be passed into InjectSpanHeaders.
+type InjectSpanHeadersArgs struct {
+	// Optional. If set, the span headers will be signed and the signature set
+	// as the "X-Span-Signature" header, so servers using TrustHeaderSignature
+	// as their HeaderTrustHandler will trust them.
+	Signer *TrustHeaderSignature
+
+	// The expiration duration of the signature.
+	//
+	// Default to DefaultHeaderSignatureExpiresIn if <= 0.
+	SignatureExpiresIn time.Duration
+}
+
+// InjectSpanHeaders is a middleware that sets the span headers of the span
+// attached to the request context onto the outgoing request,
+// so the server can continue the same trace.
+//
+// It should be used after MonitorClient so the headers are populated from the
+// client span.
+// If there's no span attached to the request context,
+// the request is sent as-is.
+func InjectSpanHeaders(args InjectSpanHeadersArgs) ClientMiddleware {
+	if args.SignatureExpiresIn <= 0 {
+		args.SignatureExpiresIn = DefaultHeaderSignatureExpiresIn
+	}
+	return func(next http.RoundTripper) http.RoundTripper {
+		return roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			span := opentracing.SpanFromContext(req.Context())
+			if span == nil {
+				return next.RoundTrip(req)
+			}
+			headers := spanHeadersFromSpan(tracing.AsSpan(span))
+
+			// RoundTrippers should not modify the original request.
+			req = req.Clone(req.Context())
+			for k, v := range headers.AsMap() {
+				if v != "" {
+					req.Header.Set(k, v)
+				}
+			}
+			if args.Signer != nil {
+				signature, err := args.Signer.SignSpanHeaders(headers, args.SignatureExpiresIn)
+				if err != nil {
+					return nil, fmt.Errorf("httpbp: failed to sign span headers: %w", err)
+				}
+				req.Header.Set(SpanSignatureHeader, signature)
+			}
+			return next.RoundTrip(req)
+		})
+	}
+}
+
+func spanHeadersFromSpan(span *tracing.Span) SpanHeaders {
+	sampled := "0"
+	if span.Sampled() {
+		sampled = spanSampledTrue
+	}
+	return SpanHeaders{
+		TraceID:  span.TraceID(),
+		ParentID: span.ParentID(),
+		SpanID:   span.ID(),
+		Flags:    strconv.FormatInt(span.Flags(), 10),
+		Sampled:  sampled,
+	}
+}
+
+// ForwardEdgeRequestContextArgs are the args to be passed into
+// ForwardEdgeRequestContext.
+type ForwardEdgeRequestContextArgs struct {
+	// The edgecontext implementation to use. Optional.
+	// If not set, the global one from ecinterface.Get will be used instead.
+	EdgeContextImpl ecinterface.Interface
+
+	// Optional. If set, the edge context header will be signed and the
+	// signature set as the "X-Edge-Request-Signature" header, so servers using
+	// TrustHeaderSignature as their HeaderTrustHandler will trust it.
+	Signer *TrustHeaderSignature
+
+	// The expiration duration of the signature.
+	//
+	// Default to DefaultHeaderSignatureExpiresIn if <= 0.
+	SignatureExpiresIn time.Duration
+}
+
+// ForwardEdgeRequestContext is a middleware that forwards the edge request
+// context set on the request context to the HTTP service being called,
+// via the "X-Edge-Request" header, if one is set.
+//
+// It's the HTTP counterpart of thriftbp.ForwardEdgeRequestContext.
+func ForwardEdgeRequestContext(args ForwardEdgeRequestContextArgs) ClientMiddleware {
+	if args.EdgeContextImpl == nil {
+		args.EdgeContextImpl = ecinterface.Get()
+	}
+	if args.SignatureExpiresIn <= 0 {
+		args.SignatureExpiresIn = DefaultHeaderSignatureExpiresIn
+	}
+	return func(next http.RoundTripper) http.RoundTripper {
+		return roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			header, ok := args.EdgeContextImpl.ContextToHeader(req.Context())
+			if !ok {
+				return next.RoundTrip(req)
+			}
+
+			// RoundTrippers should not modify the original request.
+			req = req.Clone(req.Context())
+			req.Header.Set(EdgeContextHeader, encodeEdgeContextHeader([]byte(header)))
+			if args.Signer != nil {
+				signature, err := args.Signer.SignEdgeContextHeader(
+					EdgeContextHeaders{EdgeRequest: header},
+					args.SignatureExpiresIn,
+				)
+				if err != nil {
+					return nil, fmt.Errorf("httpbp: failed to sign edge context header: %w", err)
+				}
+				req.Header.Set(EdgeContextSignatureHeader, signature)
+			}
+			return next.RoundTrip(req)
+		})
+	}
+}
+
+// SetDeadlineBudget is the client middleware implementing Phase 1 of Baseplate
+// deadline propagation.
+//
+// It sets the "Deadline-Budget" header from the deadline of the request
+// context, if any.
+func SetDeadlineBudget(next http.RoundTripper) http.RoundTripper {
+	return roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		ctx := req.Context()
+		if ctx.Err() != nil {
+			// Deadline already passed, no need to even try
+			return nil, ctx.Err()
+		}
+
+		if deadline, ok := ctx.Deadline(); ok {
+			// Round up to the next millisecond.
+			// In the scenario that the caller set a 10ms timeout and send the
+			// request, by the time we get into this middleware function it's
+			// definitely gonna be less than 10ms.
+			// If we use round down then we are only gonna send 9 over the wire.
+			timeout := time.Until(deadline) + time.Millisecond - 1
+			ms := timeout.Milliseconds()
+			if ms < 1 {
+				// Make sure we give it at least 1ms.
+				ms = 1
+			}
+
+			// RoundTrippers should not modify the original request.
+			req = req.Clone(ctx)
+			req.Header.Set(DeadlineBudgetHeader, strconv.FormatInt(ms, 10))
+		}
+		return next.RoundTrip(req)
+	})
+}
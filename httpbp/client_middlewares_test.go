@@ -103,6 +103,38 @@ func TestNewClient(t *testing.T) {
 	})
 }
 
+func TestNewClientRetriesFromConfig(t *testing.T) {
+	var requests int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt64(&requests, 1) < 3 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		io.WriteString(w, "foo")
+	}))
+	defer server.Close()
+
+	client, err := NewClient(ClientConfig{
+		Slug: "test",
+		Retries: &RetryConfig{
+			Attempts:     3,
+			InitialDelay: time.Millisecond,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := client.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	DrainAndClose(resp.Body)
+	if got := atomic.LoadInt64(&requests); got != 3 {
+		t.Errorf("Expected 3 requests, got %d", got)
+	}
+}
+
 func TestNewClientConcurrency(t *testing.T) {
 	var request uint64
 	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -417,3 +449,59 @@ func TestCircuitBreaker(t *testing.T) {
 		t.Errorf("Expected the third request to return %v, got %v", gobreaker.ErrOpenState, err)
 	}
 }
+
+func TestSetDeadlineBudget(t *testing.T) {
+	var header string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header = r.Header.Get(DeadlineBudgetHeader)
+	}))
+	defer server.Close()
+
+	client := &http.Client{
+		Transport: WrapTransport(nil, SetDeadlineBudget),
+	}
+
+	t.Run("no-deadline", func(t *testing.T) {
+		resp, err := client.Get(server.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		DrainAndClose(resp.Body)
+		if header != "" {
+			t.Errorf("Expected no %s header, got %q", DeadlineBudgetHeader, header)
+		}
+	})
+
+	t.Run("deadline", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+		defer cancel()
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, server.URL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		DrainAndClose(resp.Body)
+		if header != "5000" && header != "4999" {
+			t.Errorf("Expected %s header to be about 5000, got %q", DeadlineBudgetHeader, header)
+		}
+		if v := req.Header.Get(DeadlineBudgetHeader); v != "" {
+			t.Errorf("Expected the original request to be untouched, got %s header %q", DeadlineBudgetHeader, v)
+		}
+	})
+
+	t.Run("deadline-passed", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, server.URL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = client.Do(req)
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("Expected context.Canceled, got %v", err)
+		}
+	})
+}
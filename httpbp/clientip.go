@@ -0,0 +1,306 @@
+package httpbp
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/opentracing/opentracing-go"
+)
+
+// Headers used by the proxies to forward the client address.
+const (
+	ForwardedHeader       = "Forwarded"
+	XForwardedForHeader   = "X-Forwarded-For"
+	XForwardedProtoHeader = "X-Forwarded-Proto"
+	XRealIPHeader         = "X-Real-IP"
+)
+
+// Span tags set by InjectClientAddr.
+const (
+	ClientIPTag     = "http.client_ip"
+	ClientSchemeTag = "http.scheme"
+)
+
+// PrivateNetworkCIDRs are the loopback and private network CIDRs,
+// which can be used with ParseTrustedProxies when all the proxies are inside
+// the private network.
+var PrivateNetworkCIDRs = []string{
+	"127.0.0.0/8",
+	"10.0.0.0/8",
+	"172.16.0.0/12",
+	"192.168.0.0/16",
+	"::1/128",
+	"fc00::/7",
+}
+
+// TrustedProxies is the list of networks of the trusted proxies,
+// whose forwarded client address headers can be trusted.
+//
+// Can be deserialized from YAML as a list of CIDRs or IPs, e.g.
+//
+//     trustedProxies:
+//       - 10.0.0.0/8
+//       - 192.168.1.1
+type TrustedProxies []*net.IPNet
+
+// ParseTrustedProxies parses the given CIDRs or IPs into TrustedProxies.
+func ParseTrustedProxies(cidrs ...string) (TrustedProxies, error) {
+	proxies := make(TrustedProxies, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		cidr = strings.TrimSpace(cidr)
+		if !strings.Contains(cidr, "/") {
+			ip := net.ParseIP(cidr)
+			if ip == nil {
+				return nil, fmt.Errorf("httpbp: invalid trusted proxy IP %q", cidr)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			proxies = append(proxies, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("httpbp: invalid trusted proxy CIDR %q: %w", cidr, err)
+		}
+		proxies = append(proxies, network)
+	}
+	return proxies, nil
+}
+
+// UnmarshalYAML implements yaml.Unmarshaler.
+func (p *TrustedProxies) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var cidrs []string
+	if err := unmarshal(&cidrs); err != nil {
+		return err
+	}
+	proxies, err := ParseTrustedProxies(cidrs...)
+	if err != nil {
+		return err
+	}
+	*p = proxies
+	return nil
+}
+
+// Trust returns whether ip belongs to a trusted proxy.
+func (p TrustedProxies) Trust(ip net.IP) bool {
+	for _, network := range p {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// InjectClientAddrArgs are the args to be passed into InjectClientAddr.
+type InjectClientAddrArgs struct {
+	// The proxies to trust the forwarded client address headers from.
+	//
+	// If empty, the headers are never trusted and the client address is always
+	// the remote address of the connection.
+	TrustedProxies TrustedProxies
+
+	// The headers to resolve the client address from, in the order of
+	// preference. Only the first one present in the request is used,
+	// even if it's empty or invalid, in which case the client address is the
+	// remote address of the connection:
+	// the later headers are not set by the trusted proxies and could be set by
+	// the client itself.
+	//
+	// Optional. Default to ForwardedHeader, XForwardedForHeader and
+	// XRealIPHeader.
+	Headers []string
+}
+
+type clientAddrContextKey struct{}
+
+type clientAddr struct {
+	ip     net.IP
+	scheme string
+}
+
+// ClientIP returns the client IP resolved by InjectClientAddr.
+//
+// It returns false when InjectClientAddr is not used.
+func ClientIP(ctx context.Context) (net.IP, bool) {
+	addr, ok := ctx.Value(clientAddrContextKey{}).(clientAddr)
+	if !ok || addr.ip == nil {
+		return nil, false
+	}
+	return addr.ip, true
+}
+
+// ClientScheme returns the client scheme ("http" or "https") resolved by
+// InjectClientAddr.
+//
+// It returns false when InjectClientAddr is not used.
+func ClientScheme(ctx context.Context) (string, bool) {
+	addr, ok := ctx.Value(clientAddrContextKey{}).(clientAddr)
+	if !ok {
+		return "", false
+	}
+	return addr.scheme, true
+}
+
+// InjectClientAddr returns a Middleware that resolves the IP and scheme of the
+// client, to be read with ClientIP and ClientScheme.
+//
+// The forwarded headers are only used when the request comes from a trusted
+// proxy.
+// In such case the hops in the headers are walked from the closest one,
+// and the first hop that is not a trusted proxy is the client,
+// so the clients can't spoof their addresses by sending the headers
+// themselves.
+// The scheme is from the "proto" parameter of the Forwarded header,
+// or the X-Forwarded-Proto header.
+//
+// It also sets ClientIPTag and ClientSchemeTag on the server span,
+// so it should be used after InjectServerSpan, e.g. in ServerArgs.Middlewares.
+//
+// The resolved client address is not put into the edge request context,
+// as ecinterface.Interface is opaque to httpbp,
+// so it's not forwarded to the upstream services by
+// ForwardEdgeRequestContext.
+// Services that need it there should set it with their edgecontext
+// implementation in a Middleware applied after InjectClientAddr,
+// reading it with ClientIP.
+func InjectClientAddr(args InjectClientAddrArgs) Middleware {
+	if len(args.Headers) == 0 {
+		args.Headers = []string{ForwardedHeader, XForwardedForHeader, XRealIPHeader}
+	}
+	return func(name string, next HandlerFunc) HandlerFunc {
+		return func(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+			addr := resolveClientAddr(r, args)
+			ctx = context.WithValue(ctx, clientAddrContextKey{}, addr)
+			if span := opentracing.SpanFromContext(ctx); span != nil {
+				if addr.ip != nil {
+					span.SetTag(ClientIPTag, addr.ip.String())
+				}
+				span.SetTag(ClientSchemeTag, addr.scheme)
+			}
+			return next(ctx, w, r)
+		}
+	}
+}
+
+// forwardedHop is a single hop in the forwarded headers.
+type forwardedHop struct {
+	ip    net.IP
+	proto string
+}
+
+func resolveClientAddr(r *http.Request, args InjectClientAddrArgs) clientAddr {
+	addr := clientAddr{
+		ip:     parseHostIP(r.RemoteAddr),
+		scheme: "http",
+	}
+	if r.TLS != nil {
+		addr.scheme = "https"
+	}
+	if addr.ip == nil || !args.TrustedProxies.Trust(addr.ip) {
+		return addr
+	}
+
+	var hops []forwardedHop
+	for _, header := range args.Headers {
+		if _, ok := r.Header[http.CanonicalHeaderKey(header)]; !ok {
+			continue
+		}
+		switch http.CanonicalHeaderKey(header) {
+		case ForwardedHeader:
+			hops = parseForwarded(r.Header.Values(ForwardedHeader))
+		case XRealIPHeader:
+			hops = []forwardedHop{{
+				ip:    parseHostIP(r.Header.Get(XRealIPHeader)),
+				proto: r.Header.Get(XForwardedProtoHeader),
+			}}
+		default:
+			hops = parseForwardedFor(r.Header.Values(header), r.Header.Values(XForwardedProtoHeader))
+		}
+		break
+	}
+
+	// Walk from the closest hop, stop at the first untrusted or unknown one.
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := hops[i]
+		if hop.ip == nil {
+			break
+		}
+		addr.ip = hop.ip
+		if proto := strings.ToLower(hop.proto); proto == "http" || proto == "https" {
+			addr.scheme = proto
+		}
+		if !args.TrustedProxies.Trust(hop.ip) {
+			break
+		}
+	}
+	return addr
+}
+
+// parseForwardedFor parses the X-Forwarded-For and X-Forwarded-Proto headers.
+//
+// The protos are only matched with the hops when they have the same length,
+// otherwise the first proto is used for all the hops.
+func parseForwardedFor(values, protoValues []string) []forwardedHop {
+	fors := splitHeaderValues(values)
+	protos := splitHeaderValues(protoValues)
+	hops := make([]forwardedHop, len(fors))
+	for i, v := range fors {
+		hops[i].ip = parseHostIP(v)
+		switch {
+		case len(protos) == len(fors):
+			hops[i].proto = protos[i]
+		case len(protos) > 0:
+			hops[i].proto = protos[0]
+		}
+	}
+	return hops
+}
+
+// parseForwarded parses the Forwarded header, see RFC 7239.
+func parseForwarded(values []string) []forwardedHop {
+	elements := splitHeaderValues(values)
+	hops := make([]forwardedHop, len(elements))
+	for i, element := range elements {
+		for _, pair := range strings.Split(element, ";") {
+			j := strings.IndexByte(pair, '=')
+			if j < 0 {
+				continue
+			}
+			value := strings.Trim(strings.TrimSpace(pair[j+1:]), `"`)
+			switch strings.ToLower(strings.TrimSpace(pair[:j])) {
+			case "for":
+				hops[i].ip = parseHostIP(value)
+			case "proto":
+				hops[i].proto = value
+			}
+		}
+	}
+	return hops
+}
+
+func splitHeaderValues(values []string) []string {
+	var parts []string
+	for _, v := range values {
+		for _, part := range strings.Split(v, ",") {
+			if part = strings.TrimSpace(part); part != "" {
+				parts = append(parts, part)
+			}
+		}
+	}
+	return parts
+}
+
+// parseHostIP parses the IP from "ip", "ip:port", "[ipv6]" or "[ipv6]:port",
+// and returns nil if it's not an IP.
+func parseHostIP(s string) net.IP {
+	s = strings.TrimSpace(s)
+	if host, _, err := net.SplitHostPort(s); err == nil {
+		s = host
+	}
+	return net.ParseIP(strings.TrimSuffix(strings.TrimPrefix(s, "["), "]"))
+}
@@ -0,0 +1,253 @@
+package httpbp_test
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/reddit/baseplate.go/httpbp"
+	"github.com/reddit/baseplate.go/tracing/tracingtest"
+)
+
+func TestInjectClientAddr(t *testing.T) {
+	t.Parallel()
+
+	proxies, err := httpbp.ParseTrustedProxies("10.0.0.0/8", "192.168.1.1", "fc00::/7")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name           string
+		remoteAddr     string
+		tls            bool
+		header         http.Header
+		headers        []string
+		expectedIP     string
+		expectedScheme string
+	}{
+		{
+			name:           "untrusted-remote",
+			remoteAddr:     "1.2.3.4:1234",
+			header:         http.Header{"X-Forwarded-For": {"5.6.7.8"}},
+			expectedIP:     "1.2.3.4",
+			expectedScheme: "http",
+		},
+		{
+			name:           "untrusted-remote-tls",
+			remoteAddr:     "1.2.3.4:1234",
+			tls:            true,
+			header:         http.Header{"X-Forwarded-Proto": {"http"}},
+			expectedIP:     "1.2.3.4",
+			expectedScheme: "https",
+		},
+		{
+			name:           "no-header",
+			remoteAddr:     "10.0.0.1:1234",
+			expectedIP:     "10.0.0.1",
+			expectedScheme: "http",
+		},
+		{
+			name:       "x-forwarded-for",
+			remoteAddr: "10.0.0.1:1234",
+			header: http.Header{
+				"X-Forwarded-For":   {"5.6.7.8"},
+				"X-Forwarded-Proto": {"https"},
+			},
+			expectedIP:     "5.6.7.8",
+			expectedScheme: "https",
+		},
+		{
+			name:       "x-forwarded-for-spoofed",
+			remoteAddr: "10.0.0.1:1234",
+			header: http.Header{
+				"X-Forwarded-For": {"9.9.9.9, 5.6.7.8", "192.168.1.1"},
+			},
+			expectedIP:     "5.6.7.8",
+			expectedScheme: "http",
+		},
+		{
+			name:       "x-forwarded-for-all-trusted",
+			remoteAddr: "10.0.0.1:1234",
+			header: http.Header{
+				"X-Forwarded-For": {"10.1.1.1, 10.2.2.2"},
+			},
+			expectedIP:     "10.1.1.1",
+			expectedScheme: "http",
+		},
+		{
+			name:       "x-forwarded-for-invalid",
+			remoteAddr: "10.0.0.1:1234",
+			header: http.Header{
+				"X-Forwarded-For": {"5.6.7.8, garbage, 10.2.2.2"},
+			},
+			expectedIP:     "10.2.2.2",
+			expectedScheme: "http",
+		},
+		{
+			name:       "x-real-ip",
+			remoteAddr: "10.0.0.1:1234",
+			header: http.Header{
+				"X-Real-Ip": {"5.6.7.8"},
+			},
+			expectedIP:     "5.6.7.8",
+			expectedScheme: "http",
+		},
+		{
+			name:       "forwarded",
+			remoteAddr: "[fc00::1]:1234",
+			header: http.Header{
+				"Forwarded": {`for=9.9.9.9;proto=http, for="[2001:db8::1]:4711";proto=https`, "for=10.0.0.2"},
+				// Ignored as Forwarded is preferred.
+				"X-Forwarded-For": {"5.6.7.8"},
+			},
+			expectedIP:     "2001:db8::1",
+			expectedScheme: "https",
+		},
+		{
+			name:       "forwarded-obfuscated",
+			remoteAddr: "10.0.0.1:1234",
+			header: http.Header{
+				"Forwarded": {"for=_hidden, for=10.0.0.2"},
+			},
+			expectedIP:     "10.0.0.2",
+			expectedScheme: "http",
+		},
+		{
+			name:       "preferred-header-empty",
+			remoteAddr: "10.0.0.1:1234",
+			header: http.Header{
+				"Forwarded":       {""},
+				"X-Forwarded-For": {"5.6.7.8"},
+			},
+			expectedIP:     "10.0.0.1",
+			expectedScheme: "http",
+		},
+		{
+			name:       "custom-headers",
+			remoteAddr: "10.0.0.1:1234",
+			header: http.Header{
+				"Forwarded":   {"for=9.9.9.9"},
+				"X-Client-Ip": {"5.6.7.8"},
+				"X-Real-Ip":   {"6.6.6.6"},
+			},
+			headers:        []string{"X-Client-IP"},
+			expectedIP:     "5.6.7.8",
+			expectedScheme: "http",
+		},
+	}
+	for _, _c := range cases {
+		c := _c
+		t.Run(c.name, func(t *testing.T) {
+			t.Parallel()
+
+			var ip, scheme string
+			handle := httpbp.Wrap(
+				"test",
+				func(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+					if clientIP, ok := httpbp.ClientIP(ctx); ok {
+						ip = clientIP.String()
+					}
+					scheme, _ = httpbp.ClientScheme(ctx)
+					return nil
+				},
+				httpbp.InjectClientAddr(httpbp.InjectClientAddrArgs{
+					TrustedProxies: proxies,
+					Headers:        c.headers,
+				}),
+			)
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.RemoteAddr = c.remoteAddr
+			r.Header = c.header
+			if r.Header == nil {
+				r.Header = make(http.Header)
+			}
+			if c.tls {
+				r.TLS = &tls.ConnectionState{}
+			} else {
+				r.TLS = nil
+			}
+			if err := handle(r.Context(), httptest.NewRecorder(), r); err != nil {
+				t.Fatal(err)
+			}
+			if ip != c.expectedIP {
+				t.Errorf("Expected client IP %q, got %q", c.expectedIP, ip)
+			}
+			if scheme != c.expectedScheme {
+				t.Errorf("Expected client scheme %q, got %q", c.expectedScheme, scheme)
+			}
+		})
+	}
+}
+
+func TestInjectClientAddrSpanTags(t *testing.T) {
+	recorder := tracingtest.Record(t)
+
+	const name = "client-addr"
+	proxies, err := httpbp.ParseTrustedProxies(httpbp.PrivateNetworkCIDRs...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rateLimitKey string
+	handle := httpbp.Wrap(
+		name,
+		func(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+			rateLimitKey = httpbp.RateLimitByClientIP(ctx, r)
+			return nil
+		},
+		httpbp.InjectServerSpan(httpbp.NeverTrustHeaders{}),
+		httpbp.InjectClientAddr(httpbp.InjectClientAddrArgs{
+			TrustedProxies: proxies,
+		}),
+	)
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.RemoteAddr = "127.0.0.1:1234"
+	r.Header.Set(httpbp.XForwardedForHeader, "5.6.7.8")
+	if err := handle(r.Context(), httptest.NewRecorder(), r); err != nil {
+		t.Fatal(err)
+	}
+
+	if rateLimitKey != "5.6.7.8" {
+		t.Errorf("Expected RateLimitByClientIP to use the client IP, got %q", rateLimitKey)
+	}
+	span := recorder.MustFind(t, name)
+	if ip := span.Tags[httpbp.ClientIPTag]; ip != "5.6.7.8" {
+		t.Errorf("Expected span tag %s to be %q, got %q", httpbp.ClientIPTag, "5.6.7.8", ip)
+	}
+	if scheme := span.Tags[httpbp.ClientSchemeTag]; scheme != "http" {
+		t.Errorf("Expected span tag %s to be %q, got %q", httpbp.ClientSchemeTag, "http", scheme)
+	}
+}
+
+func TestTrustedProxiesYAML(t *testing.T) {
+	t.Parallel()
+
+	var cfg struct {
+		TrustedProxies httpbp.TrustedProxies `yaml:"trustedProxies"`
+	}
+	if err := yaml.Unmarshal([]byte("trustedProxies:\n  - 10.0.0.0/8\n  - 192.168.1.1\n"), &cfg); err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.TrustedProxies) != 2 {
+		t.Fatalf("Expected 2 trusted proxies, got %v", cfg.TrustedProxies)
+	}
+	for ip, expected := range map[string]bool{
+		"10.1.2.3":    true,
+		"192.168.1.1": true,
+		"192.168.1.2": false,
+		"1.2.3.4":     false,
+	} {
+		if got := cfg.TrustedProxies.Trust(net.ParseIP(ip)); got != expected {
+			t.Errorf("Expected Trust(%s) to be %v, got %v", ip, expected, got)
+		}
+	}
+
+	if err := yaml.Unmarshal([]byte("trustedProxies:\n  - foo\n"), &cfg); err == nil {
+		t.Error("Expected an error for invalid CIDR, got nil")
+	}
+}
@@ -0,0 +1,448 @@
+package httpbp
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/andybalholm/brotli"
+)
+
+// Compression related headers and encodings.
+const (
+	AcceptEncodingHeader  = "Accept-Encoding"
+	ContentEncodingHeader = "Content-Encoding"
+	ContentLengthHeader   = "Content-Length"
+
+	GzipEncoding   = "gzip"
+	BrotliEncoding = "br"
+)
+
+// DefaultCompressionMinSize is the default CompressionConfig.MinSize.
+const DefaultCompressionMinSize = 1024
+
+// DefaultCompressionContentTypes is the default
+// CompressionConfig.ContentTypes.
+var DefaultCompressionContentTypes = []string{
+	"application/json",
+	"application/javascript",
+	"application/xml",
+	"image/svg+xml",
+	"text/*",
+}
+
+// The compression level of brotli, which is a lot slower than gzip on higher
+// levels, and that's not worth it for dynamic responses.
+const brotliLevel = 4
+
+// CompressionConfig is the configuration of the CompressResponse middleware.
+//
+// Can be deserialized from YAML.
+type CompressionConfig struct {
+	// Responses smaller than MinSize bytes are not compressed.
+	//
+	// Optional. Default to DefaultCompressionMinSize if <= 0.
+	MinSize int `yaml:"minSize"`
+
+	// The media types of the responses to compress.
+	// Use "type/*" to match all subtypes.
+	//
+	// Optional. Default to DefaultCompressionContentTypes.
+	ContentTypes []string `yaml:"contentTypes"`
+
+	// The supported encodings, in the order of preference when the client
+	// accepts several with the same quality.
+	//
+	// Optional. Default to brotli ("br") then gzip.
+	Encodings []string `yaml:"encodings"`
+}
+
+var (
+	gzipWriterPool = sync.Pool{
+		New: func() interface{} {
+			return gzip.NewWriter(io.Discard)
+		},
+	}
+
+	brotliWriterPool = sync.Pool{
+		New: func() interface{} {
+			return brotli.NewWriterLevel(io.Discard, brotliLevel)
+		},
+	}
+)
+
+// compressor is the common interface of gzip.Writer and brotli.Writer.
+type compressor interface {
+	io.WriteCloser
+
+	Flush() error
+	Reset(w io.Writer)
+}
+
+func getCompressor(encoding string, w io.Writer) compressor {
+	var c compressor
+	switch encoding {
+	case GzipEncoding:
+		c = gzipWriterPool.Get().(*gzip.Writer)
+	case BrotliEncoding:
+		c = brotliWriterPool.Get().(*brotli.Writer)
+	default:
+		return nil
+	}
+	c.Reset(w)
+	return c
+}
+
+func putCompressor(c compressor) {
+	c.Reset(io.Discard)
+	switch c := c.(type) {
+	case *gzip.Writer:
+		gzipWriterPool.Put(c)
+	case *brotli.Writer:
+		brotliWriterPool.Put(c)
+	}
+}
+
+// negotiateEncoding returns the encoding from supported with the highest
+// quality in the "Accept-Encoding" header, or empty string if none of them is
+// acceptable.
+func negotiateEncoding(header string, supported []string) string {
+	if header == "" {
+		return ""
+	}
+	qualities := make(map[string]float64)
+	for _, part := range strings.Split(header, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		name, q := part, 1.0
+		if i := strings.Index(part, ";"); i >= 0 {
+			name = strings.TrimSpace(part[:i])
+			param := strings.TrimSpace(part[i+1:])
+			if strings.HasPrefix(param, "q=") {
+				v, err := strconv.ParseFloat(param[2:], 64)
+				if err != nil {
+					continue
+				}
+				q = v
+			}
+		}
+		qualities[strings.ToLower(name)] = q
+	}
+
+	var best string
+	var bestQ float64
+	for _, encoding := range supported {
+		q, ok := qualities[encoding]
+		if !ok {
+			q, ok = qualities["*"]
+		}
+		if ok && q > bestQ {
+			best, bestQ = encoding, q
+		}
+	}
+	return best
+}
+
+// mediaTypeMatcher matches media types against a list of "type/subtype" or
+// "type/*" entries.
+type mediaTypeMatcher struct {
+	types    map[string]bool
+	prefixes []string
+}
+
+func newMediaTypeMatcher(types []string) mediaTypeMatcher {
+	m := mediaTypeMatcher{types: make(map[string]bool, len(types))}
+	for _, t := range types {
+		t = strings.ToLower(t)
+		if strings.HasSuffix(t, "/*") {
+			m.prefixes = append(m.prefixes, strings.TrimSuffix(t, "*"))
+		} else {
+			m.types[t] = true
+		}
+	}
+	return m
+}
+
+func (m mediaTypeMatcher) match(contentType string) bool {
+	t, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	t = strings.ToLower(t)
+	if m.types[t] {
+		return true
+	}
+	for _, prefix := range m.prefixes {
+		if strings.HasPrefix(t, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// compressWriter is the http.ResponseWriter used by CompressResponse.
+//
+// It buffers the response until either minSize bytes are written,
+// the response is flushed, or the handler returns,
+// then decides whether to compress the response.
+// The status code is only written to the underlying http.ResponseWriter
+// at that time.
+type compressWriter struct {
+	http.ResponseWriter
+
+	encoding string
+	minSize  int
+	types    mediaTypeMatcher
+
+	code        int
+	buf         bytes.Buffer
+	decided     bool
+	compressor  compressor
+	writeCalled bool
+}
+
+func (w *compressWriter) WriteHeader(code int) {
+	if w.code == 0 {
+		w.code = code
+	}
+}
+
+func (w *compressWriter) Write(p []byte) (int, error) {
+	w.writeCalled = true
+	if w.decided {
+		if w.compressor != nil {
+			return w.compressor.Write(p)
+		}
+		return w.ResponseWriter.Write(p)
+	}
+	n, _ := w.buf.Write(p)
+	if w.buf.Len() >= w.minSize {
+		if err := w.decide(true); err != nil {
+			return 0, err
+		}
+	}
+	return n, nil
+}
+
+// Flush implements http.Flusher.
+func (w *compressWriter) Flush() {
+	if !w.decided {
+		w.decide(w.buf.Len() >= w.minSize)
+	}
+	if w.compressor != nil {
+		w.compressor.Flush()
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack implements http.Hijacker.
+//
+// Nothing is compressed after the connection is hijacked,
+// the handler takes over the connection as-is.
+func (w *compressWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("httpbp: underlying http.ResponseWriter does not implement http.Hijacker")
+	}
+	w.decided = true
+	return h.Hijack()
+}
+
+// shouldCompress checks whether the response can be compressed with the
+// headers and status set by the handler.
+func (w *compressWriter) shouldCompress() bool {
+	switch w.code {
+	case http.StatusNoContent, http.StatusNotModified, http.StatusPartialContent:
+		return false
+	}
+	h := w.Header()
+	if h.Get(ContentEncodingHeader) != "" {
+		return false
+	}
+	contentType := h.Get(ContentTypeHeader)
+	if contentType == "" {
+		contentType = http.DetectContentType(w.buf.Bytes())
+		h.Set(ContentTypeHeader, contentType)
+	}
+	return w.types.match(contentType)
+}
+
+// decide writes the status code and the buffered response to the underlying
+// http.ResponseWriter, compressed if large enough and eligible.
+func (w *compressWriter) decide(largeEnough bool) error {
+	w.decided = true
+	if w.code == 0 {
+		w.code = http.StatusOK
+	}
+
+	h := w.Header()
+	if largeEnough && w.shouldCompress() {
+		h.Set(ContentEncodingHeader, w.encoding)
+		h.Del(ContentLengthHeader)
+		w.compressor = getCompressor(w.encoding, w.ResponseWriter)
+	}
+	w.ResponseWriter.WriteHeader(w.code)
+
+	if w.buf.Len() == 0 {
+		return nil
+	}
+	var err error
+	if w.compressor != nil {
+		_, err = w.compressor.Write(w.buf.Bytes())
+	} else {
+		_, err = w.ResponseWriter.Write(w.buf.Bytes())
+	}
+	w.buf.Reset()
+	return err
+}
+
+// finish writes the remaining buffered response and closes the compressor.
+//
+// If nothing was written by the handler, nothing will be written to the
+// underlying http.ResponseWriter either,
+// so the error response can still be written.
+func (w *compressWriter) finish() error {
+	if !w.decided {
+		if w.code == 0 && !w.writeCalled {
+			return nil
+		}
+		if err := w.decide(false); err != nil {
+			return err
+		}
+	}
+	if w.compressor == nil {
+		return nil
+	}
+	defer putCompressor(w.compressor)
+	return w.compressor.Close()
+}
+
+// CompressResponse returns a Middleware that compresses the responses with
+// either brotli or gzip, as negotiated by the "Accept-Encoding" request header.
+//
+// Only the responses with at least MinSize bytes and a Content-Type matching
+// ContentTypes are compressed.
+// If the handler doesn't set the "Content-Type" header,
+// it will be detected from the response body.
+// Responses with "Content-Encoding" header already set are not compressed.
+//
+// Since the response is buffered up to MinSize bytes before the decision is
+// made, the status code is only written to the next http.ResponseWriter after
+// that, so it should be used after (inside) RecordStatusCode and
+// PrometheusServerMetrics, e.g. via ServerArgs.Middlewares or
+// Endpoint.Middlewares, so those still see the correct status code and
+// response size.
+func CompressResponse(cfg CompressionConfig) Middleware {
+	if cfg.MinSize <= 0 {
+		cfg.MinSize = DefaultCompressionMinSize
+	}
+	if len(cfg.ContentTypes) == 0 {
+		cfg.ContentTypes = DefaultCompressionContentTypes
+	}
+	if len(cfg.Encodings) == 0 {
+		cfg.Encodings = []string{BrotliEncoding, GzipEncoding}
+	}
+	types := newMediaTypeMatcher(cfg.ContentTypes)
+
+	return func(name string, next HandlerFunc) HandlerFunc {
+		return func(ctx context.Context, w http.ResponseWriter, r *http.Request) (err error) {
+			// The response could be different with other "Accept-Encoding" headers.
+			w.Header().Add(VaryHeader, AcceptEncodingHeader)
+			encoding := negotiateEncoding(r.Header.Get(AcceptEncodingHeader), cfg.Encodings)
+			if encoding == "" || r.Method == http.MethodHead {
+				return next(ctx, w, r)
+			}
+
+			cw := &compressWriter{
+				ResponseWriter: w,
+				encoding:       encoding,
+				minSize:        cfg.MinSize,
+				types:          types,
+			}
+			defer func() {
+				if e := cw.finish(); e != nil && err == nil {
+					err = fmt.Errorf("httpbp: failed to write compressed response: %w", e)
+				}
+			}()
+			return next(ctx, cw, r)
+		}
+	}
+}
+
+// decompressedBody is the response body decoded by DecompressResponse.
+type decompressedBody struct {
+	io.Reader
+
+	body io.ReadCloser
+}
+
+func (b decompressedBody) Close() error {
+	return b.body.Close()
+}
+
+// DecompressResponse is a client middleware that requests compressed responses
+// via the "Accept-Encoding" header, and transparently decompresses brotli and
+// gzip encoded responses.
+//
+// It's a no-op for requests with "Accept-Encoding" header already set,
+// in which case the caller is expected to handle the encoding.
+//
+// It's the client counterpart of CompressResponse.
+//
+// It's not included in DefaultClientMiddleware unless
+// ClientConfig.DecompressResponse is set, as it replaces the transparent gzip
+// decompression of http.Transport.
+func DecompressResponse(next http.RoundTripper) http.RoundTripper {
+	return roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		if req.Header.Get(AcceptEncodingHeader) != "" {
+			return next.RoundTrip(req)
+		}
+
+		// RoundTrippers should not modify the original request.
+		req = req.Clone(req.Context())
+		req.Header.Set(AcceptEncodingHeader, BrotliEncoding+", "+GzipEncoding)
+		resp, err := next.RoundTrip(req)
+		if err != nil {
+			return resp, err
+		}
+
+		var reader io.Reader
+		switch strings.ToLower(resp.Header.Get(ContentEncodingHeader)) {
+		default:
+			return resp, nil
+		case BrotliEncoding:
+			reader = brotli.NewReader(resp.Body)
+		case GzipEncoding:
+			gr, err := gzip.NewReader(resp.Body)
+			if err != nil && !errors.Is(err, io.EOF) {
+				DrainAndClose(resp.Body)
+				return nil, fmt.Errorf("httpbp: failed to decompress gzip response: %w", err)
+			}
+			if gr == nil {
+				// Empty body.
+				return resp, nil
+			}
+			reader = gr
+		}
+		resp.Body = decompressedBody{Reader: reader, body: resp.Body}
+		resp.Header.Del(ContentEncodingHeader)
+		resp.Header.Del(ContentLengthHeader)
+		resp.ContentLength = -1
+		resp.Uncompressed = true
+		return resp, nil
+	})
+}
@@ -0,0 +1,370 @@
+package httpbp_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+
+	"github.com/reddit/baseplate.go/httpbp"
+)
+
+func decompress(t *testing.T, encoding string, body []byte) string {
+	t.Helper()
+
+	var reader io.Reader
+	switch encoding {
+	case "":
+		return string(body)
+	case httpbp.GzipEncoding:
+		r, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		reader = r
+	case httpbp.BrotliEncoding:
+		reader = brotli.NewReader(bytes.NewReader(body))
+	default:
+		t.Fatalf("Unexpected encoding %q", encoding)
+	}
+	decoded, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(decoded)
+}
+
+func TestCompressResponse(t *testing.T) {
+	t.Parallel()
+
+	large := strings.Repeat("hello, world! ", 100)
+
+	cases := []struct {
+		name           string
+		cfg            httpbp.CompressionConfig
+		acceptEncoding string
+		contentType    string
+		code           int
+		body           string
+		expected       string
+	}{
+		{
+			name:           "gzip",
+			acceptEncoding: "gzip, deflate",
+			contentType:    httpbp.JSONContentType,
+			body:           large,
+			expected:       httpbp.GzipEncoding,
+		},
+		{
+			name:           "brotli-preferred",
+			acceptEncoding: "gzip, deflate, br",
+			contentType:    httpbp.PlainTextContentType,
+			body:           large,
+			expected:       httpbp.BrotliEncoding,
+		},
+		{
+			name:           "quality",
+			acceptEncoding: "gzip;q=1.0, br;q=0.5",
+			contentType:    httpbp.PlainTextContentType,
+			body:           large,
+			expected:       httpbp.GzipEncoding,
+		},
+		{
+			name:           "wildcard-encoding",
+			acceptEncoding: "*",
+			contentType:    httpbp.PlainTextContentType,
+			body:           large,
+			expected:       httpbp.BrotliEncoding,
+		},
+		{
+			name:           "not-accepted",
+			acceptEncoding: "br;q=0, deflate",
+			contentType:    httpbp.PlainTextContentType,
+			body:           large,
+		},
+		{
+			name:        "no-accept-encoding",
+			contentType: httpbp.PlainTextContentType,
+			body:        large,
+		},
+		{
+			name:           "too-small",
+			acceptEncoding: "gzip",
+			contentType:    httpbp.PlainTextContentType,
+			body:           "hello, world!",
+		},
+		{
+			name: "min-size",
+			cfg: httpbp.CompressionConfig{
+				MinSize: 10,
+			},
+			acceptEncoding: "gzip",
+			contentType:    httpbp.PlainTextContentType,
+			body:           "hello, world!",
+			expected:       httpbp.GzipEncoding,
+		},
+		{
+			name:           "content-type-not-compressible",
+			acceptEncoding: "gzip",
+			contentType:    "image/png",
+			body:           large,
+		},
+		{
+			name: "content-types",
+			cfg: httpbp.CompressionConfig{
+				ContentTypes: []string{"image/*"},
+			},
+			acceptEncoding: "gzip",
+			contentType:    "image/png",
+			body:           large,
+			expected:       httpbp.GzipEncoding,
+		},
+		{
+			name:           "detected-content-type",
+			acceptEncoding: "gzip",
+			body:           large,
+			expected:       httpbp.GzipEncoding,
+		},
+		{
+			name:           "status-code",
+			acceptEncoding: "gzip",
+			contentType:    httpbp.JSONContentType,
+			code:           http.StatusCreated,
+			body:           large,
+			expected:       httpbp.GzipEncoding,
+		},
+		{
+			name:           "no-content",
+			acceptEncoding: "gzip",
+			code:           http.StatusNoContent,
+		},
+	}
+	for _, _c := range cases {
+		c := _c
+		t.Run(c.name, func(t *testing.T) {
+			t.Parallel()
+
+			handle := httpbp.Wrap(
+				"test",
+				func(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+					if c.contentType != "" {
+						w.Header().Set(httpbp.ContentTypeHeader, c.contentType)
+					}
+					if c.code != 0 {
+						w.WriteHeader(c.code)
+					}
+					// Write in small chunks to exercise the buffering.
+					for body := c.body; len(body) > 0; {
+						n := 100
+						if n > len(body) {
+							n = len(body)
+						}
+						if _, err := io.WriteString(w, body[:n]); err != nil {
+							return err
+						}
+						body = body[n:]
+					}
+					return nil
+				},
+				httpbp.CompressResponse(c.cfg),
+			)
+			req := httptest.NewRequest(http.MethodGet, "/test", nil)
+			if c.acceptEncoding != "" {
+				req.Header.Set(httpbp.AcceptEncodingHeader, c.acceptEncoding)
+			}
+			w := httptest.NewRecorder()
+			if err := handle(req.Context(), w, req); err != nil {
+				t.Fatal(err)
+			}
+
+			expectedCode := c.code
+			if expectedCode == 0 {
+				expectedCode = http.StatusOK
+			}
+			if w.Code != expectedCode {
+				t.Errorf("Expected code %d, got %d", expectedCode, w.Code)
+			}
+			encoding := w.Header().Get(httpbp.ContentEncodingHeader)
+			if encoding != c.expected {
+				t.Errorf("Expected %s %q, got %q", httpbp.ContentEncodingHeader, c.expected, encoding)
+			}
+			if body := decompress(t, encoding, w.Body.Bytes()); body != c.body {
+				t.Errorf("Expected body %q, got %q", c.body, body)
+			}
+			if vary := w.Header().Get(httpbp.VaryHeader); vary != httpbp.AcceptEncodingHeader {
+				t.Errorf("Expected %s header %q, got %q", httpbp.VaryHeader, httpbp.AcceptEncodingHeader, vary)
+			}
+		})
+	}
+}
+
+func TestCompressResponseError(t *testing.T) {
+	t.Parallel()
+
+	handler := httpbp.NewHandler(
+		"test",
+		func(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+			return httpbp.JSONError(
+				httpbp.BadRequest().WithDetails(map[string]string{
+					"foo": strings.Repeat("bar", 1000),
+				}),
+				errors.New("bad request"),
+			)
+		},
+		httpbp.CompressResponse(httpbp.CompressionConfig{}),
+	)
+	req := httptest.NewRequest(http.MethodGet, "/test", nil)
+	req.Header.Set(httpbp.AcceptEncodingHeader, httpbp.GzipEncoding)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected code %d, got %d", http.StatusBadRequest, w.Code)
+	}
+	if encoding := w.Header().Get(httpbp.ContentEncodingHeader); encoding != "" {
+		t.Errorf("Expected error response to not be compressed, got %q", encoding)
+	}
+}
+
+func TestDecompressResponse(t *testing.T) {
+	t.Parallel()
+
+	body := strings.Repeat("hello, world! ", 100)
+	handle := httpbp.Wrap(
+		"test",
+		func(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+			w.Header().Set(httpbp.ContentTypeHeader, httpbp.PlainTextContentType)
+			_, err := io.WriteString(w, body)
+			return err
+		},
+		httpbp.CompressResponse(httpbp.CompressionConfig{}),
+	)
+	var acceptEncoding string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		acceptEncoding = r.Header.Get(httpbp.AcceptEncodingHeader)
+		if err := handle(r.Context(), w, r); err != nil {
+			t.Error(err)
+		}
+	}))
+	defer server.Close()
+
+	client := &http.Client{
+		Transport: httpbp.WrapTransport(nil, httpbp.DecompressResponse),
+	}
+	resp, err := client.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if acceptEncoding != "br, gzip" {
+		t.Errorf("Expected %s %q, got %q", httpbp.AcceptEncodingHeader, "br, gzip", acceptEncoding)
+	}
+	if !resp.Uncompressed {
+		t.Error("Expected response to be marked as uncompressed")
+	}
+	if encoding := resp.Header.Get(httpbp.ContentEncodingHeader); encoding != "" {
+		t.Errorf("Expected %s header to be removed, got %q", httpbp.ContentEncodingHeader, encoding)
+	}
+	got, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != body {
+		t.Errorf("Expected body %q, got %q", body, got)
+	}
+}
+
+func TestNewClientDecompressResponse(t *testing.T) {
+	t.Parallel()
+
+	acceptEncoding := make(chan string, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		acceptEncoding <- r.Header.Get(httpbp.AcceptEncodingHeader)
+	}))
+	defer server.Close()
+
+	for _, c := range []struct {
+		name       string
+		decompress bool
+		expected   string
+	}{
+		{
+			name:     "default",
+			expected: "gzip",
+		},
+		{
+			name:       "enabled",
+			decompress: true,
+			expected:   "br, gzip",
+		},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			client, err := httpbp.NewClient(httpbp.ClientConfig{
+				Slug:               "test",
+				DecompressResponse: c.decompress,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp, err := client.Get(server.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if got := <-acceptEncoding; got != c.expected {
+				t.Errorf("Expected %s %q, got %q", httpbp.AcceptEncodingHeader, c.expected, got)
+			}
+		})
+	}
+}
+
+func TestCompressResponseHijack(t *testing.T) {
+	t.Parallel()
+
+	const body = "hijacked"
+	handle := httpbp.Wrap(
+		"test",
+		func(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+			conn, rw, err := w.(http.Hijacker).Hijack()
+			if err != nil {
+				return err
+			}
+			defer conn.Close()
+			rw.WriteString("HTTP/1.1 200 OK\r\nContent-Length: 8\r\nConnection: close\r\n\r\n" + body)
+			return rw.Flush()
+		},
+		httpbp.CompressResponse(httpbp.CompressionConfig{}),
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := handle(r.Context(), w, r); err != nil {
+			t.Error(err)
+		}
+	}))
+	defer server.Close()
+
+	req, err := http.NewRequest(http.MethodGet, server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set(httpbp.AcceptEncodingHeader, httpbp.GzipEncoding)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	got, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != body {
+		t.Errorf("Expected body %q, got %q", body, got)
+	}
+}
@@ -1,20 +1,94 @@
 package httpbp
 
 import (
+	"time"
+
 	"github.com/avast/retry-go"
 
 	"github.com/reddit/baseplate.go/breakerbp"
+	"github.com/reddit/baseplate.go/ecinterface"
 	"github.com/reddit/baseplate.go/errorsbp"
+	"github.com/reddit/baseplate.go/retrybp"
 )
 
 // ClientConfig provides the configuration for a HTTP client including its
 // middlewares.
+//
+// Can be deserialized from YAML, e.g.
+//
+//     slug: my-service
+//     limitErrorReading: 1024
+//     maxConnections: 100
+//     maxConcurrency: 50
+//     retries:
+//       attempts: 3
+//       initialDelay: 10ms
+//       maxDelay: 100ms
+//       maxJitter: 5ms
+//     circuitBreaker:
+//       minRequestsToTrip: 10
+//       failureThreshold: 0.5
+//     hedge:
+//       methods:
+//         - GET
+//       percentile: 0.95
+//       budgetRatio: 0.1
+//     decompressResponse: true
 type ClientConfig struct {
 	Slug              string            `yaml:"slug"`
 	MaxErrorReadAhead int               `yaml:"limitErrorReading"`
 	MaxConnections    int               `yaml:"maxConnections"`
 	CircuitBreaker    *breakerbp.Config `yaml:"circuitBreaker"`
-	RetryOptions      []retry.Option
+
+	// The max number of concurrent in-flight requests,
+	// see MaxConcurrency middleware.
+	//
+	// Optional. If <= 0, the number of in-flight requests is not limited.
+	MaxConcurrency int64 `yaml:"maxConcurrency"`
+
+	// The default retry behavior of the client.
+	//
+	// Optional. It's ignored when RetryOptions is set.
+	Retries *RetryConfig `yaml:"retries"`
+
+	// Send a second copy of slow idempotent requests,
+	// see Hedge middleware.
+	//
+	// Optional. If nil, requests are not hedged.
+	Hedge *HedgeConfig `yaml:"hedge"`
+
+	// The RetryBudget shared by the retried and the hedged requests,
+	// see RetriesWithBudget.
+	//
+	// Optional. If nil, the budget configured by Hedge is used,
+	// or retries are not capped by any budget when Hedge is also nil.
+	RetryBudget *RetryBudget `yaml:"-"`
+
+	// Request brotli or gzip compressed responses and decompress them,
+	// see DecompressResponse middleware.
+	//
+	// Optional. If false, only the transparent gzip decompression of
+	// http.Transport is used.
+	DecompressResponse bool `yaml:"decompressResponse"`
+
+	// Cache the responses in a RFC 7234 private cache,
+	// see Cache middleware.
+	//
+	// Optional. If nil, responses are not cached.
+	Cache *CacheConfig `yaml:"-"`
+
+	// The default retry options of the client.
+	//
+	// Optional. When set, Retries is ignored.
+	RetryOptions []retry.Option `yaml:"-"`
+
+	// The edgecontext implementation to use. Optional.
+	// If not set, the global one from ecinterface.Get will be used instead.
+	EdgeContextImpl ecinterface.Interface `yaml:"-"`
+
+	// Optional. If set, the span and edge context headers sent by the client
+	// will be signed with it.
+	HeaderSignature *TrustHeaderSignature `yaml:"-"`
 }
 
 // Validate checks ClientConfig for any missing or erroneous values.
@@ -29,5 +103,51 @@ func (c ClientConfig) Validate() error {
 	if c.MaxConnections < 0 {
 		batch.Add(ErrConfigInvalidMaxConnections)
 	}
+	if c.MaxConcurrency < 0 {
+		batch.Add(ErrConfigInvalidMaxConcurrency)
+	}
 	return batch.Compile()
 }
+
+// retryOptions returns the retry options to be used by the Retries middleware,
+// from RetryOptions or Retries.
+func (c ClientConfig) retryOptions() []retry.Option {
+	if len(c.RetryOptions) > 0 {
+		return c.RetryOptions
+	}
+	if c.Retries != nil {
+		return c.Retries.Options()
+	}
+	return nil
+}
+
+// RetryConfig is the YAML friendly configuration of the retry behavior of a
+// HTTP client.
+type RetryConfig struct {
+	// The max number of attempts, including the first one.
+	//
+	// If <= 1, requests are not retried.
+	Attempts uint `yaml:"attempts"`
+
+	// The backoff delays between attempts,
+	// see retrybp.CappedExponentialBackoffArgs for more details.
+	InitialDelay time.Duration `yaml:"initialDelay"`
+	MaxDelay     time.Duration `yaml:"maxDelay"`
+	MaxJitter    time.Duration `yaml:"maxJitter"`
+}
+
+// Options returns the retry options represented by the RetryConfig.
+func (c RetryConfig) Options() []retry.Option {
+	attempts := c.Attempts
+	if attempts < 1 {
+		attempts = 1
+	}
+	return []retry.Option{
+		retry.Attempts(attempts),
+		retrybp.CappedExponentialBackoff(retrybp.CappedExponentialBackoffArgs{
+			InitialDelay: c.InitialDelay,
+			MaxDelay:     c.MaxDelay,
+			MaxJitter:    c.MaxJitter,
+		}),
+	}
+}
@@ -0,0 +1,104 @@
+package httpbp_test
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/reddit/baseplate.go/breakerbp"
+	"github.com/reddit/baseplate.go/configbp"
+	"github.com/reddit/baseplate.go/httpbp"
+)
+
+func TestClientConfig(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name     string
+		raw      string
+		expected httpbp.ClientConfig
+		options  int
+	}{
+		{
+			name: "slug-only",
+			raw: `
+slug: test
+`,
+			expected: httpbp.ClientConfig{
+				Slug: "test",
+			},
+		},
+		{
+			name: "all",
+			raw: `
+slug: test
+limitErrorReading: 2048
+maxConnections: 100
+maxConcurrency: 50
+retries:
+ attempts: 3
+ initialDelay: 10ms
+ maxDelay: 100ms
+ maxJitter: 5ms
+circuitBreaker:
+ minRequestsToTrip: 10
+ failureThreshold: 0.5
+`,
+			expected: httpbp.ClientConfig{
+				Slug:              "test",
+				MaxErrorReadAhead: 2048,
+				MaxConnections:    100,
+				MaxConcurrency:    50,
+				Retries: &httpbp.RetryConfig{
+					Attempts:     3,
+					InitialDelay: time.Millisecond * 10,
+					MaxDelay:     time.Millisecond * 100,
+					MaxJitter:    time.Millisecond * 5,
+				},
+				CircuitBreaker: &breakerbp.Config{
+					MinRequestsToTrip: 10,
+					FailureThreshold:  0.5,
+				},
+			},
+			options: 2,
+		},
+	}
+
+	for _, _c := range cases {
+		c := _c
+		t.Run(
+			c.name,
+			func(t *testing.T) {
+				var cfg httpbp.ClientConfig
+				if err := configbp.ParseStrictYAML(strings.NewReader(c.raw), &cfg); err != nil {
+					t.Fatal(err)
+				}
+				if !reflect.DeepEqual(c.expected, cfg) {
+					t.Errorf("client config mismatch:\n\nexpected %#v\n\ngot %#v\n\n", c.expected, cfg)
+				}
+				if err := cfg.Validate(); err != nil {
+					t.Errorf("Validate returned error: %v", err)
+				}
+				if cfg.Retries != nil {
+					if got := len(cfg.Retries.Options()); got != c.options {
+						t.Errorf("Expected %d retry options, got %d", c.options, got)
+					}
+				}
+			},
+		)
+	}
+}
+
+func TestClientConfigValidate(t *testing.T) {
+	t.Parallel()
+
+	err := httpbp.ClientConfig{
+		Slug:           "test",
+		MaxConcurrency: -1,
+	}.Validate()
+	if !errors.Is(err, httpbp.ErrConfigInvalidMaxConcurrency) {
+		t.Errorf("Expected %v, got %v", httpbp.ErrConfigInvalidMaxConcurrency, err)
+	}
+}
@@ -0,0 +1,270 @@
+package httpbp
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CORS related headers.
+const (
+	OriginHeader                        = "Origin"
+	AccessControlRequestMethodHeader    = "Access-Control-Request-Method"
+	AccessControlRequestHeadersHeader   = "Access-Control-Request-Headers"
+	AccessControlAllowOriginHeader      = "Access-Control-Allow-Origin"
+	AccessControlAllowMethodsHeader     = "Access-Control-Allow-Methods"
+	AccessControlAllowHeadersHeader     = "Access-Control-Allow-Headers"
+	AccessControlAllowCredentialsHeader = "Access-Control-Allow-Credentials"
+	AccessControlExposeHeadersHeader    = "Access-Control-Expose-Headers"
+	AccessControlMaxAgeHeader           = "Access-Control-Max-Age"
+	VaryHeader                          = "Vary"
+)
+
+const corsWildcard = "*"
+
+// CORSConfig is the configuration of the CORS middleware.
+//
+// Can be deserialized from YAML.
+type CORSConfig struct {
+	// The origins allowed to make cross-origin requests,
+	// e.g. "https://www.reddit.com".
+	//
+	// Each entry can contain at most one "*" wildcard,
+	// e.g. "https://*.reddit.com",
+	// and a single "*" entry allows all origins.
+	AllowedOrigins []string `yaml:"allowedOrigins"`
+
+	// The methods allowed in cross-origin requests.
+	//
+	// Optional. When used via Endpoint.CORS it defaults to Endpoint.Methods,
+	// otherwise it defaults to GET, HEAD and POST.
+	AllowedMethods []string `yaml:"allowedMethods"`
+
+	// The non-simple request headers allowed in cross-origin requests.
+	//
+	// A single "*" entry allows all headers requested.
+	AllowedHeaders []string `yaml:"allowedHeaders"`
+
+	// The response headers exposed to the browser.
+	ExposedHeaders []string `yaml:"exposedHeaders"`
+
+	// Whether to allow requests with credentials (cookies, etc.).
+	//
+	// When set to true, the allowed origin is always sent back explicitly,
+	// even if all origins are allowed.
+	AllowCredentials bool `yaml:"allowCredentials"`
+
+	// How long the preflight results can be cached by the browser.
+	//
+	// Optional. If <= 0, no "Access-Control-Max-Age" header will be sent.
+	// It's truncated to seconds.
+	MaxAge time.Duration `yaml:"maxAge"`
+}
+
+// originPattern is a parsed entry of CORSConfig.AllowedOrigins.
+type originPattern struct {
+	prefix   string
+	suffix   string
+	wildcard bool
+}
+
+func newOriginPattern(s string) originPattern {
+	s = strings.ToLower(s)
+	i := strings.Index(s, corsWildcard)
+	if i < 0 {
+		return originPattern{prefix: s}
+	}
+	return originPattern{
+		prefix:   s[:i],
+		suffix:   s[i+1:],
+		wildcard: true,
+	}
+}
+
+func (p originPattern) match(origin string) bool {
+	if !p.wildcard {
+		return origin == p.prefix
+	}
+	return len(origin) >= len(p.prefix)+len(p.suffix) &&
+		strings.HasPrefix(origin, p.prefix) &&
+		strings.HasSuffix(origin, p.suffix)
+}
+
+// cors is the parsed CORSConfig.
+type cors struct {
+	allowAllOrigins  bool
+	origins          []originPattern
+	methods          map[string]bool
+	allowedMethods   string
+	allowAllHeaders  bool
+	headers          map[string]bool
+	allowedHeaders   string
+	exposedHeaders   string
+	allowCredentials bool
+	maxAge           string
+
+	// varyOrigin is true when the response depends on the Origin header even
+	// for the requests without it, as the allowed origin is echoed back.
+	varyOrigin bool
+}
+
+func newCORS(cfg CORSConfig) *cors {
+	c := &cors{
+		methods:          make(map[string]bool),
+		headers:          make(map[string]bool),
+		exposedHeaders:   strings.Join(cfg.ExposedHeaders, ","),
+		allowCredentials: cfg.AllowCredentials,
+	}
+	for _, origin := range cfg.AllowedOrigins {
+		if origin == corsWildcard {
+			c.allowAllOrigins = true
+			continue
+		}
+		c.origins = append(c.origins, newOriginPattern(origin))
+	}
+
+	methods := cfg.AllowedMethods
+	if len(methods) == 0 {
+		methods = []string{http.MethodGet, http.MethodHead, http.MethodPost}
+	}
+	allowed := make([]string, 0, len(methods))
+	for _, m := range methods {
+		m = strings.ToUpper(m)
+		if !c.methods[m] {
+			c.methods[m] = true
+			allowed = append(allowed, m)
+		}
+	}
+	c.allowedMethods = strings.Join(allowed, ",")
+
+	allowed = make([]string, 0, len(cfg.AllowedHeaders))
+	for _, h := range cfg.AllowedHeaders {
+		if h == corsWildcard {
+			c.allowAllHeaders = true
+			continue
+		}
+		c.headers[http.CanonicalHeaderKey(h)] = true
+		allowed = append(allowed, http.CanonicalHeaderKey(h))
+	}
+	c.allowedHeaders = strings.Join(allowed, ",")
+	c.varyOrigin = !c.allowAllOrigins || c.allowCredentials
+
+	if seconds := int64(cfg.MaxAge / time.Second); seconds > 0 {
+		c.maxAge = strconv.FormatInt(seconds, 10)
+	}
+	return c
+}
+
+func (c *cors) originAllowed(origin string) bool {
+	if c.allowAllOrigins {
+		return true
+	}
+	origin = strings.ToLower(origin)
+	for _, p := range c.origins {
+		if p.match(origin) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *cors) headersAllowed(requested string) bool {
+	if c.allowAllHeaders {
+		return true
+	}
+	for _, h := range strings.Split(requested, ",") {
+		h = strings.TrimSpace(h)
+		if h != "" && !c.headers[http.CanonicalHeaderKey(h)] {
+			return false
+		}
+	}
+	return true
+}
+
+func (c *cors) setAllowOrigin(h http.Header, origin string) {
+	if c.allowAllOrigins && !c.allowCredentials {
+		h.Set(AccessControlAllowOriginHeader, corsWildcard)
+	} else {
+		h.Set(AccessControlAllowOriginHeader, origin)
+	}
+	if c.allowCredentials {
+		h.Set(AccessControlAllowCredentialsHeader, "true")
+	}
+}
+
+// preflight writes the response to a preflight request.
+//
+// The CORS headers are only set when the request is allowed.
+func (c *cors) preflight(w http.ResponseWriter, r *http.Request) {
+	h := w.Header()
+	h.Add(VaryHeader, OriginHeader)
+	h.Add(VaryHeader, AccessControlRequestMethodHeader)
+	h.Add(VaryHeader, AccessControlRequestHeadersHeader)
+
+	origin := r.Header.Get(OriginHeader)
+	method := strings.ToUpper(r.Header.Get(AccessControlRequestMethodHeader))
+	requestedHeaders := r.Header.Get(AccessControlRequestHeadersHeader)
+	if c.originAllowed(origin) && c.methods[method] && c.headersAllowed(requestedHeaders) {
+		c.setAllowOrigin(h, origin)
+		h.Set(AccessControlAllowMethodsHeader, c.allowedMethods)
+		if c.allowAllHeaders {
+			if requestedHeaders != "" {
+				h.Set(AccessControlAllowHeadersHeader, requestedHeaders)
+			}
+		} else if c.allowedHeaders != "" {
+			h.Set(AccessControlAllowHeadersHeader, c.allowedHeaders)
+		}
+		if c.maxAge != "" {
+			h.Set(AccessControlMaxAgeHeader, c.maxAge)
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// CORS returns a Middleware that implements Cross-Origin Resource Sharing with
+// the given config.
+//
+// Preflight requests (OPTIONS requests with the
+// "Access-Control-Request-Method" header) are answered directly by the
+// middleware without calling the next HandlerFunc,
+// so it should be used before SupportedMethods.
+// The easiest way to do that is to use Endpoint.CORS,
+// or ServerArgs.Middlewares to apply to all the endpoints.
+//
+// For other requests with an allowed "Origin" header,
+// the CORS response headers are set before calling the next HandlerFunc.
+// Unless all origins are allowed without credentials, "Vary: Origin" is added
+// to all the responses, including the ones to requests without "Origin"
+// header, so shared caches keep the responses for different origins apart.
+func CORS(cfg CORSConfig) Middleware {
+	c := newCORS(cfg)
+	return func(name string, next HandlerFunc) HandlerFunc {
+		return func(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+			origin := r.Header.Get(OriginHeader)
+			if origin == "" {
+				if c.varyOrigin {
+					// So shared caches don't serve this response to the
+					// cross-origin requests.
+					w.Header().Add(VaryHeader, OriginHeader)
+				}
+				return next(ctx, w, r)
+			}
+			if r.Method == http.MethodOptions && r.Header.Get(AccessControlRequestMethodHeader) != "" {
+				c.preflight(w, r)
+				return nil
+			}
+
+			h := w.Header()
+			h.Add(VaryHeader, OriginHeader)
+			if c.originAllowed(origin) {
+				c.setAllowOrigin(h, origin)
+				if c.exposedHeaders != "" {
+					h.Set(AccessControlExposeHeadersHeader, c.exposedHeaders)
+				}
+			}
+			return next(ctx, w, r)
+		}
+	}
+}
@@ -0,0 +1,363 @@
+package httpbp_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/reddit/baseplate.go"
+	"github.com/reddit/baseplate.go/ecinterface"
+	"github.com/reddit/baseplate.go/httpbp"
+)
+
+func TestCORS(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name     string
+		cfg      httpbp.CORSConfig
+		method   string
+		headers  map[string]string
+		expected map[string]string
+		called   bool
+	}{
+		{
+			name: "no-origin",
+			cfg: httpbp.CORSConfig{
+				AllowedOrigins: []string{"*"},
+			},
+			method: http.MethodGet,
+			expected: map[string]string{
+				httpbp.AccessControlAllowOriginHeader: "",
+				httpbp.VaryHeader:                     "",
+			},
+			called: true,
+		},
+		{
+			name: "no-origin-echoed",
+			cfg: httpbp.CORSConfig{
+				AllowedOrigins: []string{"https://www.reddit.com"},
+			},
+			method: http.MethodGet,
+			expected: map[string]string{
+				httpbp.AccessControlAllowOriginHeader: "",
+				httpbp.VaryHeader:                     httpbp.OriginHeader,
+			},
+			called: true,
+		},
+		{
+			name: "no-origin-credentials",
+			cfg: httpbp.CORSConfig{
+				AllowedOrigins:   []string{"*"},
+				AllowCredentials: true,
+			},
+			method: http.MethodGet,
+			expected: map[string]string{
+				httpbp.AccessControlAllowOriginHeader: "",
+				httpbp.VaryHeader:                     httpbp.OriginHeader,
+			},
+			called: true,
+		},
+		{
+			name: "all-origins",
+			cfg: httpbp.CORSConfig{
+				AllowedOrigins: []string{"*"},
+				ExposedHeaders: []string{"X-Foo"},
+			},
+			method: http.MethodGet,
+			headers: map[string]string{
+				httpbp.OriginHeader: "https://www.reddit.com",
+			},
+			expected: map[string]string{
+				httpbp.AccessControlAllowOriginHeader:   "*",
+				httpbp.AccessControlExposeHeadersHeader: "X-Foo",
+				httpbp.VaryHeader:                       httpbp.OriginHeader,
+			},
+			called: true,
+		},
+		{
+			name: "credentials",
+			cfg: httpbp.CORSConfig{
+				AllowedOrigins:   []string{"*"},
+				AllowCredentials: true,
+			},
+			method: http.MethodGet,
+			headers: map[string]string{
+				httpbp.OriginHeader: "https://www.reddit.com",
+			},
+			expected: map[string]string{
+				httpbp.AccessControlAllowOriginHeader:      "https://www.reddit.com",
+				httpbp.AccessControlAllowCredentialsHeader: "true",
+			},
+			called: true,
+		},
+		{
+			name: "wildcard-origin",
+			cfg: httpbp.CORSConfig{
+				AllowedOrigins: []string{"https://*.reddit.com"},
+			},
+			method: http.MethodGet,
+			headers: map[string]string{
+				httpbp.OriginHeader: "https://www.Reddit.com",
+			},
+			expected: map[string]string{
+				httpbp.AccessControlAllowOriginHeader: "https://www.Reddit.com",
+			},
+			called: true,
+		},
+		{
+			name: "origin-not-allowed",
+			cfg: httpbp.CORSConfig{
+				AllowedOrigins: []string{"https://*.reddit.com"},
+			},
+			method: http.MethodGet,
+			headers: map[string]string{
+				httpbp.OriginHeader: "https://reddit.com.evil.com",
+			},
+			expected: map[string]string{
+				httpbp.AccessControlAllowOriginHeader: "",
+			},
+			called: true,
+		},
+		{
+			name: "preflight",
+			cfg: httpbp.CORSConfig{
+				AllowedOrigins: []string{"https://www.reddit.com"},
+				AllowedMethods: []string{http.MethodGet, http.MethodPut},
+				AllowedHeaders: []string{"x-foo", "X-Bar"},
+				MaxAge:         time.Minute,
+			},
+			method: http.MethodOptions,
+			headers: map[string]string{
+				httpbp.OriginHeader:                      "https://www.reddit.com",
+				httpbp.AccessControlRequestMethodHeader:  http.MethodPut,
+				httpbp.AccessControlRequestHeadersHeader: "X-Foo",
+			},
+			expected: map[string]string{
+				httpbp.AccessControlAllowOriginHeader:  "https://www.reddit.com",
+				httpbp.AccessControlAllowMethodsHeader: "GET,PUT",
+				httpbp.AccessControlAllowHeadersHeader: "X-Foo,X-Bar",
+				httpbp.AccessControlMaxAgeHeader:       "60",
+			},
+		},
+		{
+			name: "preflight-all-headers",
+			cfg: httpbp.CORSConfig{
+				AllowedOrigins: []string{"*"},
+				AllowedHeaders: []string{"*"},
+			},
+			method: http.MethodOptions,
+			headers: map[string]string{
+				httpbp.OriginHeader:                      "https://www.reddit.com",
+				httpbp.AccessControlRequestMethodHeader:  http.MethodPost,
+				httpbp.AccessControlRequestHeadersHeader: "X-Foo, X-Bar",
+			},
+			expected: map[string]string{
+				httpbp.AccessControlAllowOriginHeader:  "*",
+				httpbp.AccessControlAllowMethodsHeader: "GET,HEAD,POST",
+				httpbp.AccessControlAllowHeadersHeader: "X-Foo, X-Bar",
+				httpbp.AccessControlMaxAgeHeader:       "",
+			},
+		},
+		{
+			name: "preflight-method-not-allowed",
+			cfg: httpbp.CORSConfig{
+				AllowedOrigins: []string{"*"},
+			},
+			method: http.MethodOptions,
+			headers: map[string]string{
+				httpbp.OriginHeader:                     "https://www.reddit.com",
+				httpbp.AccessControlRequestMethodHeader: http.MethodDelete,
+			},
+			expected: map[string]string{
+				httpbp.AccessControlAllowOriginHeader:  "",
+				httpbp.AccessControlAllowMethodsHeader: "",
+			},
+		},
+		{
+			name: "preflight-header-not-allowed",
+			cfg: httpbp.CORSConfig{
+				AllowedOrigins: []string{"*"},
+				AllowedHeaders: []string{"X-Foo"},
+			},
+			method: http.MethodOptions,
+			headers: map[string]string{
+				httpbp.OriginHeader:                      "https://www.reddit.com",
+				httpbp.AccessControlRequestMethodHeader:  http.MethodGet,
+				httpbp.AccessControlRequestHeadersHeader: "X-Bar",
+			},
+			expected: map[string]string{
+				httpbp.AccessControlAllowOriginHeader: "",
+			},
+		},
+	}
+	for _, _c := range cases {
+		c := _c
+		t.Run(c.name, func(t *testing.T) {
+			t.Parallel()
+
+			var called bool
+			handle := httpbp.Wrap(
+				"test",
+				func(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+					called = true
+					return nil
+				},
+				httpbp.CORS(c.cfg),
+			)
+			req := httptest.NewRequest(c.method, "/test", nil)
+			for k, v := range c.headers {
+				req.Header.Set(k, v)
+			}
+			w := httptest.NewRecorder()
+			if err := handle(req.Context(), w, req); err != nil {
+				t.Fatal(err)
+			}
+
+			if called != c.called {
+				t.Errorf("Expected next handler called to be %v, got %v", c.called, called)
+			}
+			if !c.called && w.Code != http.StatusNoContent {
+				t.Errorf("Expected preflight response code %d, got %d", http.StatusNoContent, w.Code)
+			}
+			for k, v := range c.expected {
+				if got := w.Header().Get(k); got != v {
+					t.Errorf("Expected %s header to be %q, got %q", k, v, got)
+				}
+			}
+		})
+	}
+}
+
+func TestEndpointCORS(t *testing.T) {
+	store := newSecretsStore(t)
+	defer store.Close()
+
+	bp := baseplate.NewTestBaseplate(baseplate.NewTestBaseplateArgs{
+		Config:          baseplate.Config{Addr: ":8080"},
+		Store:           store,
+		EdgeContextImpl: ecinterface.Mock(),
+	})
+
+	const pattern = "/test"
+	args, err := httpbp.ServerArgs{
+		Baseplate: bp,
+		Endpoints: map[httpbp.Pattern]httpbp.Endpoint{
+			pattern: {
+				Name:    "test",
+				Methods: []string{http.MethodPut},
+				Handle: func(context.Context, http.ResponseWriter, *http.Request) error {
+					return nil
+				},
+				CORS: &httpbp.CORSConfig{
+					AllowedOrigins: []string{"*"},
+				},
+			},
+		},
+	}.SetupEndpoints()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodOptions, pattern, nil)
+	req.Header.Set(httpbp.OriginHeader, "https://www.reddit.com")
+	req.Header.Set(httpbp.AccessControlRequestMethodHeader, http.MethodPut)
+	w := httptest.NewRecorder()
+	args.EndpointRegistry.ServeHTTP(w, req)
+
+	if w.Code != http.StatusNoContent {
+		t.Errorf("Expected preflight response code %d, got %d", http.StatusNoContent, w.Code)
+	}
+	if got := w.Header().Get(httpbp.AccessControlAllowMethodsHeader); got != http.MethodPut {
+		t.Errorf("Expected allowed methods to default to the endpoint methods, got %q", got)
+	}
+
+	req = httptest.NewRequest(http.MethodOptions, pattern, nil)
+	w = httptest.NewRecorder()
+	args.EndpointRegistry.ServeHTTP(w, req)
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected non-preflight OPTIONS request to be rejected with %d, got %d", http.StatusMethodNotAllowed, w.Code)
+	}
+}
+
+func TestRouterCORS(t *testing.T) {
+	store := newSecretsStore(t)
+	defer store.Close()
+
+	bp := baseplate.NewTestBaseplate(baseplate.NewTestBaseplateArgs{
+		Config:          baseplate.Config{Addr: ":8080"},
+		Store:           store,
+		EdgeContextImpl: ecinterface.Mock(),
+	})
+
+	handle := func(context.Context, http.ResponseWriter, *http.Request) error {
+		return nil
+	}
+	const origin = "https://www.reddit.com"
+	args, err := httpbp.ServerArgs{
+		Baseplate:        bp,
+		EndpointRegistry: httpbp.NewRouter(),
+		Endpoints: map[httpbp.Pattern]httpbp.Endpoint{
+			"GET /items/{id}": {
+				Handle: handle,
+			},
+			"PUT /items/{id}": {
+				Handle: handle,
+				CORS: &httpbp.CORSConfig{
+					AllowedOrigins: []string{origin},
+				},
+			},
+		},
+	}.SetupEndpoints()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name           string
+		requested      string
+		expectedCode   int
+		expectedOrigin string
+		expectedAllow  string
+	}{
+		{
+			name:           "allowed",
+			requested:      http.MethodPut,
+			expectedCode:   http.StatusNoContent,
+			expectedOrigin: origin,
+			expectedAllow:  http.MethodPut,
+		},
+		{
+			name:         "not-allowed",
+			requested:    http.MethodDelete,
+			expectedCode: http.StatusNoContent,
+		},
+		{
+			name:         "not-preflight",
+			expectedCode: http.StatusMethodNotAllowed,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodOptions, "/items/foo", nil)
+			req.Header.Set(httpbp.OriginHeader, origin)
+			if c.requested != "" {
+				req.Header.Set(httpbp.AccessControlRequestMethodHeader, c.requested)
+			}
+			w := httptest.NewRecorder()
+			args.EndpointRegistry.ServeHTTP(w, req)
+
+			if w.Code != c.expectedCode {
+				t.Errorf("Expected code %d, got %d", c.expectedCode, w.Code)
+			}
+			if got := w.Header().Get(httpbp.AccessControlAllowOriginHeader); got != c.expectedOrigin {
+				t.Errorf("Expected %s header %q, got %q", httpbp.AccessControlAllowOriginHeader, c.expectedOrigin, got)
+			}
+			if got := w.Header().Get(httpbp.AccessControlAllowMethodsHeader); got != c.expectedAllow {
+				t.Errorf("Expected %s header %q, got %q", httpbp.AccessControlAllowMethodsHeader, c.expectedAllow, got)
+			}
+		})
+	}
+}
@@ -70,6 +70,17 @@ var (
 	// ErrConcurrencyLimit is returned by the max concurrency middleware if
 	// there are too many requests in-flight.
 	ErrConcurrencyLimit = errors.New("hit concurrency limit")
+
+	// ErrRetryBudgetExhausted is returned by the retries middleware when a
+	// request is not retried because its RetryBudget is exhausted.
+	ErrRetryBudgetExhausted = errors.New("retry budget exhausted")
+
+	// ErrAbandonRequest is returned by AbandonCanceledRequests when the client
+	// has gone away.
+	//
+	// No error response will be written when a HandlerFunc returns an error
+	// wrapping ErrAbandonRequest.
+	ErrAbandonRequest = errors.New("request abandoned")
 )
 
 // ClientConfig errors are returned if the configuration validation fails.
@@ -77,6 +88,7 @@ var (
 	ErrConfigMissingSlug              = errors.New("slug cannot be empty")
 	ErrConfigInvalidMaxErrorReadAhead = errors.New("maxErrorReadAhead value needs to be positive")
 	ErrConfigInvalidMaxConnections    = errors.New("maxConnections value needs to be positive")
+	ErrConfigInvalidMaxConcurrency    = errors.New("maxConcurrency value needs to be positive")
 )
 
 // HTTPError is an error that and can be returned by an  HTTPHandler to return a
@@ -180,6 +192,9 @@ type ErrorResponse struct {
 	code         int
 	raw          string
 	templateName string
+	retryAfter   time.Duration
+	problemType  string
+	problemTitle string
 }
 
 // WithDetails can be used to set the Details on an ErrorResponse in a way that
@@ -250,6 +265,7 @@ func (r *ErrorResponse) WithTemplateName(name string) *ErrorResponse {
 func (r *ErrorResponse) Retryable(w http.ResponseWriter, retryAfter time.Duration) *ErrorResponse {
 	after := strconv.FormatFloat(float64(retryAfter)/float64(time.Second), 'f', -1, 64)
 	w.Header().Set(RetryAfterHeader, after)
+	r.retryAfter = retryAfter
 	return r
 }
 
@@ -4,6 +4,7 @@ import (
 	"context"
 	"errors"
 	"net/http"
+	"sync/atomic"
 
 	"github.com/reddit/baseplate.go/log"
 )
@@ -25,15 +26,41 @@ import (
 // there are not any errors.  If you return an HTTPError, it will use that to
 // return a custom error response, otherwise it returns a generic, plain-text
 // http.StatusInternalServerError (500) error message.
+// The only exception is after a Stream was created, as the response is already
+// being streamed to the client, in which case the error is only reported to the
+// middlewares (e.g. the server span and metrics).
 type HandlerFunc func(context.Context, http.ResponseWriter, *http.Request) error
 
 type handler struct {
 	handle HandlerFunc
 }
 
+// responseCommittedContextKey is the context key of the flag set by
+// newStream once the response headers are written,
+// so handler doesn't write an error response into the stream.
+type responseCommittedContextKey struct{}
+
+// commitResponse marks the response of the request of ctx as committed.
+func commitResponse(ctx context.Context) {
+	if committed, ok := ctx.Value(responseCommittedContextKey{}).(*int32); ok {
+		atomic.StoreInt32(committed, 1)
+	}
+}
+
 func (h handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	ctx := r.Context()
+	committed := new(int32)
+	ctx := context.WithValue(r.Context(), responseCommittedContextKey{}, committed)
+	r = r.WithContext(ctx)
 	if err := h.handle(ctx, w, r); err != nil {
+		if errors.Is(err, ErrAbandonRequest) {
+			// The client is gone, no one is reading the response.
+			return
+		}
+		if atomic.LoadInt32(committed) != 0 {
+			// The response is already being streamed,
+			// the error was reported to the middlewares.
+			return
+		}
 		var httpErr HTTPError
 		if errors.As(err, &httpErr) {
 			err = WriteResponse(w, httpErr.ContentWriter(), httpErr.Response())
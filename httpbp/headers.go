@@ -10,6 +10,7 @@ import (
 
 	"github.com/reddit/baseplate.go/secrets"
 	"github.com/reddit/baseplate.go/signing"
+	"github.com/reddit/baseplate.go/transport"
 )
 
 const (
@@ -44,6 +45,12 @@ const (
 	// TraceIDHeader is the key use to get the trace ID from the HTTP
 	// request headers.
 	TraceIDHeader = "X-Trace"
+
+	// DeadlineBudgetHeader is the key use to get the remaining timeout of the
+	// caller, in milliseconds, from the HTTP request headers.
+	//
+	// Unlike the other headers it's shared with Thrift.
+	DeadlineBudgetHeader = transport.HeaderDeadlineBudget
 )
 
 // Headers is an interface to collect all of the HTTP headers for a particular
@@ -0,0 +1,394 @@
+package httpbp
+
+import (
+	"context"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/opentracing/opentracing-go"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Span tags set by the Hedge middleware.
+const (
+	HedgeSentTag = "hedge.sent"
+	HedgeWonTag  = "hedge.won"
+)
+
+// Default values of HedgeConfig.
+const (
+	DefaultHedgePercentile  = 0.95
+	DefaultHedgeMinDelay    = 10 * time.Millisecond
+	DefaultHedgeBudgetRatio = 0.1
+	DefaultHedgeBudgetBurst = 10
+)
+
+const (
+	// The number of latency samples kept to calculate the hedge delay.
+	hedgeLatencyWindow = 1000
+	// The min number of latency samples required before hedging with a
+	// percentile based delay.
+	hedgeMinSamples = 20
+	// How often (in samples) the percentile is recalculated.
+	hedgeRecalculateEvery = 50
+
+	hedgeWonLabel = "hedge_won"
+)
+
+var (
+	hedgedRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: promNamespace,
+		Subsystem: subsystemClient,
+		Name:      "hedged_requests_total",
+		Help:      "The number of requests a hedged request was sent for",
+	}, []string{serverSlugLabel, hedgeWonLabel})
+
+	hedgeBudgetExhausted = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: promNamespace,
+		Subsystem: subsystemClient,
+		Name:      "hedge_budget_exhausted_total",
+		Help:      "The number of hedged requests not sent because of the retry budget",
+	}, []string{serverSlugLabel})
+)
+
+// RetryBudget caps the number of extra attempts (e.g. hedged requests and
+// retries, see Hedge and RetriesWithBudget) to a ratio of the original
+// requests.
+//
+// Every original request deposits Ratio tokens into the budget,
+// up to Burst tokens, and every extra attempt withdraws one token.
+//
+// It's safe for concurrent use.
+type RetryBudget struct {
+	ratio float64
+	burst float64
+
+	lock   sync.Mutex
+	tokens float64
+}
+
+// NewRetryBudget creates a new RetryBudget, starting with burst tokens.
+func NewRetryBudget(ratio float64, burst int) *RetryBudget {
+	return &RetryBudget{
+		ratio:  ratio,
+		burst:  float64(burst),
+		tokens: float64(burst),
+	}
+}
+
+// Deposit is called for every original request.
+func (b *RetryBudget) Deposit() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.tokens = math.Min(b.tokens+b.ratio, b.burst)
+}
+
+// Withdraw is called before every extra attempt,
+// and returns false if the budget is exhausted.
+func (b *RetryBudget) Withdraw() bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// HedgeConfig is the configuration of the Hedge middleware.
+//
+// Can be deserialized from YAML.
+type HedgeConfig struct {
+	// The methods of the requests to hedge,
+	// they should only be the idempotent ones.
+	//
+	// Optional. Default to GET, HEAD and OPTIONS.
+	Methods []string `yaml:"methods"`
+
+	// The fixed delay before sending the hedged request.
+	//
+	// Optional. If <= 0, the delay is the Percentile of the recent latencies.
+	Delay time.Duration `yaml:"delay"`
+
+	// The percentile of the recent latencies used as the delay when Delay is not
+	// set, in the range of (0, 1).
+	//
+	// Optional. Default to DefaultHedgePercentile.
+	// Requests are not hedged until there are enough latencies recorded.
+	Percentile float64 `yaml:"percentile"`
+
+	// The min delay when using Percentile.
+	//
+	// Optional. Default to DefaultHedgeMinDelay.
+	MinDelay time.Duration `yaml:"minDelay"`
+
+	// The ratio and burst of the RetryBudget capping the hedged requests,
+	// see NewRetryBudget.
+	//
+	// Optional. Default to DefaultHedgeBudgetRatio and DefaultHedgeBudgetBurst.
+	// Ignored when Budget is set.
+	BudgetRatio float64 `yaml:"budgetRatio"`
+	BudgetBurst int     `yaml:"budgetBurst"`
+
+	// Optional, the RetryBudget to share with other clients,
+	// or with the retries of the same client (see RetriesWithBudget).
+	Budget *RetryBudget `yaml:"-"`
+}
+
+// budget returns cfg.Budget, or a new RetryBudget configured by cfg.
+func (cfg HedgeConfig) budget() *RetryBudget {
+	if cfg.Budget != nil {
+		return cfg.Budget
+	}
+	ratio := cfg.BudgetRatio
+	if ratio <= 0 {
+		ratio = DefaultHedgeBudgetRatio
+	}
+	burst := cfg.BudgetBurst
+	if burst <= 0 {
+		burst = DefaultHedgeBudgetBurst
+	}
+	return NewRetryBudget(ratio, burst)
+}
+
+// latencyWindow keeps the recent latencies to calculate the percentile.
+type latencyWindow struct {
+	percentile float64
+
+	lock    sync.Mutex
+	samples []time.Duration
+	next    int
+	added   int
+	cached  time.Duration
+}
+
+func (lw *latencyWindow) add(d time.Duration) {
+	lw.lock.Lock()
+	defer lw.lock.Unlock()
+	if len(lw.samples) < hedgeLatencyWindow {
+		lw.samples = append(lw.samples, d)
+	} else {
+		lw.samples[lw.next] = d
+		lw.next = (lw.next + 1) % hedgeLatencyWindow
+	}
+	lw.added++
+	if lw.added%hedgeRecalculateEvery == 0 || len(lw.samples) == hedgeMinSamples {
+		sorted := make([]time.Duration, len(lw.samples))
+		copy(sorted, lw.samples)
+		sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+		lw.cached = sorted[int(float64(len(sorted)-1)*lw.percentile)]
+	}
+}
+
+// get returns the percentile of the recent latencies,
+// or false if there are not enough samples yet.
+func (lw *latencyWindow) get() (time.Duration, bool) {
+	lw.lock.Lock()
+	defer lw.lock.Unlock()
+	if len(lw.samples) < hedgeMinSamples {
+		return 0, false
+	}
+	return lw.cached, true
+}
+
+// hedgeResult is the result of a single attempt of a hedged request.
+type hedgeResult struct {
+	resp   *http.Response
+	err    error
+	hedge  bool
+	cancel context.CancelFunc
+	start  time.Time
+}
+
+func (r hedgeResult) success() bool {
+	return r.err == nil && r.resp.StatusCode < http.StatusInternalServerError
+}
+
+// discard cancels the attempt and drains the response.
+func (r hedgeResult) discard() {
+	r.cancel()
+	if r.resp != nil {
+		DrainAndClose(r.resp.Body)
+	}
+}
+
+// cancelOnClose cancels the context of the winning attempt after its response
+// body is closed.
+type cancelOnClose struct {
+	io.ReadCloser
+
+	cancel context.CancelFunc
+}
+
+func (b cancelOnClose) Close() error {
+	defer b.cancel()
+	return b.ReadCloser.Close()
+}
+
+// Hedge returns a ClientMiddleware that sends a second copy of slow requests,
+// to cut the tail latency caused by a few slow upstream replicas.
+//
+// Only requests with the methods in cfg.Methods and a replayable body are
+// hedged.
+// The hedged request is sent after cfg.Delay,
+// or the cfg.Percentile of the recent latencies,
+// if the retry budget allows it.
+// The first successful (no error and a status code < 500) response is
+// returned,
+// and the other attempt is canceled and its response is drained and closed
+// with DrainAndClose.
+//
+// It sets HedgeSentTag and HedgeWonTag on the span in the request context,
+// and reports the httpbp_client_hedged_requests_total and
+// httpbp_client_hedge_budget_exhausted_total prometheus metrics with the given
+// slug.
+func Hedge(slug string, cfg HedgeConfig) ClientMiddleware {
+	if len(cfg.Methods) == 0 {
+		cfg.Methods = []string{http.MethodGet, http.MethodHead, http.MethodOptions}
+	}
+	methods := make(map[string]bool, len(cfg.Methods))
+	for _, m := range cfg.Methods {
+		methods[strings.ToUpper(m)] = true
+	}
+	if cfg.Percentile <= 0 || cfg.Percentile >= 1 {
+		cfg.Percentile = DefaultHedgePercentile
+	}
+	if cfg.MinDelay <= 0 {
+		cfg.MinDelay = DefaultHedgeMinDelay
+	}
+	budget := cfg.budget()
+	latencies := &latencyWindow{percentile: cfg.Percentile}
+
+	delay := func() (time.Duration, bool) {
+		if cfg.Delay > 0 {
+			return cfg.Delay, true
+		}
+		d, ok := latencies.get()
+		if d < cfg.MinDelay {
+			d = cfg.MinDelay
+		}
+		return d, ok
+	}
+
+	return func(next http.RoundTripper) http.RoundTripper {
+		return roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			if !methods[req.Method] || (req.Body != nil && req.Body != http.NoBody && req.GetBody == nil) {
+				return next.RoundTrip(req)
+			}
+			req = depositRetryBudget(req, budget)
+			hedgeDelay, ok := delay()
+			if !ok {
+				start := time.Now()
+				resp, err := next.RoundTrip(req)
+				if err == nil {
+					latencies.add(time.Since(start))
+				}
+				return resp, err
+			}
+
+			results := make(chan hedgeResult, 2)
+			var cancels []context.CancelFunc
+			send := func(req *http.Request, hedge bool) {
+				ctx, cancel := context.WithCancel(req.Context())
+				cancels = append(cancels, cancel)
+				start := time.Now()
+				go func() {
+					resp, err := next.RoundTrip(req.WithContext(ctx))
+					results <- hedgeResult{
+						resp:   resp,
+						err:    err,
+						hedge:  hedge,
+						cancel: cancel,
+						start:  start,
+					}
+				}()
+			}
+			send(req, false)
+			pending := 1
+
+			timer := time.NewTimer(hedgeDelay)
+			defer timer.Stop()
+			var hedged bool
+			var last *hedgeResult
+			var winner hedgeResult
+			for winner.resp == nil && pending > 0 {
+				select {
+				case <-timer.C:
+					if budget.Withdraw() {
+						hedgeReq := req.Clone(req.Context())
+						if req.GetBody != nil {
+							body, err := req.GetBody()
+							if err != nil {
+								continue
+							}
+							hedgeReq.Body = body
+						}
+						send(hedgeReq, true)
+						pending++
+						hedged = true
+					} else {
+						hedgeBudgetExhausted.With(prometheus.Labels{serverSlugLabel: slug}).Inc()
+					}
+				case r := <-results:
+					pending--
+					if r.success() {
+						winner = r
+						continue
+					}
+					if last != nil {
+						last.discard()
+					}
+					last = &r
+				}
+			}
+			if winner.resp == nil {
+				// All attempts failed, return the last one.
+				winner = *last
+			} else if last != nil {
+				last.discard()
+			}
+			if pending > 0 {
+				// Cancel the loser and drain it in the background.
+				for i, cancel := range cancels {
+					// cancels[0] is the primary attempt, cancels[1] is the hedged one.
+					if winner.hedge != (i == 1) {
+						cancel()
+					}
+				}
+				go func() {
+					for ; pending > 0; pending-- {
+						(<-results).discard()
+					}
+				}()
+			}
+
+			if winner.err == nil {
+				latencies.add(time.Since(winner.start))
+				winner.resp.Body = cancelOnClose{
+					ReadCloser: winner.resp.Body,
+					cancel:     winner.cancel,
+				}
+			} else {
+				winner.cancel()
+			}
+			if span := opentracing.SpanFromContext(req.Context()); span != nil {
+				span.SetTag(HedgeSentTag, hedged)
+				span.SetTag(HedgeWonTag, hedged && winner.hedge)
+			}
+			if hedged {
+				hedgedRequests.With(prometheus.Labels{
+					serverSlugLabel: slug,
+					hedgeWonLabel:   strconv.FormatBool(winner.hedge),
+				}).Inc()
+			}
+			return winner.resp, winner.err
+		})
+	}
+}
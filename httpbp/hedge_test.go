@@ -0,0 +1,282 @@
+package httpbp_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/avast/retry-go"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/reddit/baseplate.go/httpbp"
+	"github.com/reddit/baseplate.go/prometheusbp/promtest"
+)
+
+// newHedgeServer returns a server that responds to the slow requests after
+// they are canceled or after a second, and responds to the other requests
+// immediately.
+func newHedgeServer(t *testing.T, slow func(n int64) bool) (server *httptest.Server, requests *int64, canceled chan struct{}) {
+	t.Helper()
+
+	requests = new(int64)
+	canceled = make(chan struct{}, 2)
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt64(requests, 1)
+		if slow(n) {
+			select {
+			case <-r.Context().Done():
+				canceled <- struct{}{}
+				return
+			case <-time.After(time.Second):
+			}
+		}
+		io.WriteString(w, r.Method)
+	}))
+	t.Cleanup(server.Close)
+	return server, requests, canceled
+}
+
+func firstSlow(n int64) bool {
+	return n == 1
+}
+
+func TestHedge(t *testing.T) {
+	t.Parallel()
+
+	t.Run("hedge-won", func(t *testing.T) {
+		t.Parallel()
+
+		const slug = "hedge-won"
+		server, requests, canceled := newHedgeServer(t, firstSlow)
+		client := &http.Client{
+			Transport: httpbp.WrapTransport(
+				http.DefaultTransport,
+				httpbp.Hedge(slug, httpbp.HedgeConfig{Delay: 10 * time.Millisecond}),
+			),
+		}
+
+		won := promtest.NewGatheredMetricTest(t, "httpbp_client_hedged_requests_total", prometheus.Labels{
+			"http_slug": slug,
+			"hedge_won": "true",
+		})
+		start := time.Now()
+		resp, err := client.Get(server.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(body) != http.MethodGet {
+			t.Errorf("Expected body %q, got %q", http.MethodGet, body)
+		}
+		if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+			t.Errorf("Expected the hedged response, took %v", elapsed)
+		}
+		if n := atomic.LoadInt64(requests); n != 2 {
+			t.Errorf("Expected 2 requests, got %d", n)
+		}
+		select {
+		case <-canceled:
+		case <-time.After(5 * time.Second):
+			t.Error("Expected the first request to be canceled")
+		}
+		won.CheckDelta(1)
+	})
+
+	t.Run("fast", func(t *testing.T) {
+		t.Parallel()
+
+		var requests int64
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt64(&requests, 1)
+		}))
+		defer server.Close()
+		client := &http.Client{
+			Transport: httpbp.WrapTransport(
+				http.DefaultTransport,
+				httpbp.Hedge("hedge-fast", httpbp.HedgeConfig{Delay: time.Second}),
+			),
+		}
+
+		resp, err := client.Get(server.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		httpbp.DrainAndClose(resp.Body)
+		if n := atomic.LoadInt64(&requests); n != 1 {
+			t.Errorf("Expected 1 request, got %d", n)
+		}
+	})
+
+	t.Run("method", func(t *testing.T) {
+		t.Parallel()
+
+		server, requests, _ := newHedgeServer(t, firstSlow)
+		client := &http.Client{
+			Transport: httpbp.WrapTransport(
+				http.DefaultTransport,
+				httpbp.Hedge("hedge-method", httpbp.HedgeConfig{Delay: 10 * time.Millisecond}),
+			),
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, server.URL, strings.NewReader("body"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp, err := client.Do(req); err == nil {
+			httpbp.DrainAndClose(resp.Body)
+			t.Error("Expected the POST request to time out without hedging")
+		}
+		if n := atomic.LoadInt64(requests); n != 1 {
+			t.Errorf("Expected 1 request, got %d", n)
+		}
+	})
+
+	t.Run("budget", func(t *testing.T) {
+		t.Parallel()
+
+		const slug = "hedge-budget"
+		server, requests, _ := newHedgeServer(t, func(n int64) bool {
+			return n != 2
+		})
+		client := &http.Client{
+			Transport: httpbp.WrapTransport(
+				http.DefaultTransport,
+				httpbp.Hedge(slug, httpbp.HedgeConfig{
+					Delay:  10 * time.Millisecond,
+					Budget: httpbp.NewRetryBudget(0, 1),
+				}),
+			),
+		}
+
+		exhausted := promtest.NewGatheredMetricTest(t, "httpbp_client_hedge_budget_exhausted_total", prometheus.Labels{
+			"http_slug": slug,
+		})
+		// The first request is hedged and takes the only token,
+		// the second one is slow but not hedged.
+		resp, err := client.Get(server.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		httpbp.DrainAndClose(resp.Body)
+		resp, err = client.Get(server.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		httpbp.DrainAndClose(resp.Body)
+		if n := atomic.LoadInt64(requests); n != 3 {
+			t.Errorf("Expected 3 requests, got %d", n)
+		}
+		exhausted.CheckDelta(1)
+	})
+}
+
+func TestRetryBudget(t *testing.T) {
+	t.Parallel()
+
+	budget := httpbp.NewRetryBudget(0.5, 2)
+	for i := 0; i < 2; i++ {
+		if !budget.Withdraw() {
+			t.Fatalf("Expected withdraw #%d to succeed", i)
+		}
+	}
+	if budget.Withdraw() {
+		t.Fatal("Expected the budget to be exhausted")
+	}
+	budget.Deposit()
+	if budget.Withdraw() {
+		t.Fatal("Expected half a token to not be enough")
+	}
+	budget.Deposit()
+	if !budget.Withdraw() {
+		t.Fatal("Expected withdraw to succeed after 2 deposits")
+	}
+}
+
+func TestRetryBudgetSharedWithHedge(t *testing.T) {
+	t.Parallel()
+
+	var requests int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch atomic.AddInt64(&requests, 1) {
+		case 1:
+			// The first request is slow and hedged.
+			select {
+			case <-r.Context().Done():
+				return
+			case <-time.After(time.Second):
+			}
+		case 2:
+			// The hedged request.
+		default:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	client, err := httpbp.NewClient(httpbp.ClientConfig{
+		Slug:        "retry-budget-shared",
+		Retries:     &httpbp.RetryConfig{Attempts: 3},
+		Hedge:       &httpbp.HedgeConfig{Delay: 50 * time.Millisecond},
+		RetryBudget: httpbp.NewRetryBudget(0, 1),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The hedged request takes the only token.
+	resp, err := client.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	httpbp.DrainAndClose(resp.Body)
+	if n := atomic.LoadInt64(&requests); n != 2 {
+		t.Errorf("Expected 2 requests after the hedged one, got %d", n)
+	}
+
+	// So the failed request is not retried.
+	_, err = client.Get(server.URL)
+	if !errors.Is(err, httpbp.ErrRetryBudgetExhausted) {
+		t.Errorf("Expected error %v, got %v", httpbp.ErrRetryBudgetExhausted, err)
+	}
+	if n := atomic.LoadInt64(&requests); n != 3 {
+		t.Errorf("Expected 3 requests after the failed one, got %d", n)
+	}
+}
+
+func TestRetriesWithBudget(t *testing.T) {
+	t.Parallel()
+
+	var requests int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&requests, 1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	t.Cleanup(server.Close)
+
+	client := &http.Client{
+		Transport: httpbp.WrapTransport(
+			http.DefaultTransport,
+			httpbp.RetriesWithBudget(0, httpbp.NewRetryBudget(0, 2), retry.Attempts(5), retry.Delay(0)),
+		),
+	}
+	_, err := client.Get(server.URL)
+	if !errors.Is(err, httpbp.ErrRetryBudgetExhausted) {
+		t.Errorf("Expected error %v, got %v", httpbp.ErrRetryBudgetExhausted, err)
+	}
+	// The original request and the 2 retries allowed by the budget.
+	if n := atomic.LoadInt64(&requests); n != 3 {
+		t.Errorf("Expected 3 requests, got %d", n)
+	}
+}
@@ -0,0 +1,253 @@
+package httpbptest
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"mime"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/reddit/baseplate.go/httpbp"
+)
+
+// DefaultSignatureExpiresIn is the default value of
+// Client.SignatureExpiresIn.
+const DefaultSignatureExpiresIn = time.Minute
+
+// Client sends requests carrying trusted Baseplate headers to a test server
+// created by httpbp.NewTestBaseplateServer.
+//
+// Example:
+//
+//     _, ts, err := httpbp.NewTestBaseplateServer(args)
+//     if err != nil {
+//         t.Fatal(err)
+//     }
+//     defer ts.Close()
+//
+//     client := httpbptest.Client{Server: ts, Signer: &signer}
+//     resp := client.Do(t, httpbptest.RequestArgs{
+//         Method: http.MethodGet,
+//         Path:   "/foo",
+//         Span:   &httpbp.SpanHeaders{TraceID: "1", SpanID: "2", Sampled: "1"},
+//     })
+//     resp.CheckStatus(t, http.StatusNotFound)
+//     resp.CheckError(t, httpbp.NotFound())
+type Client struct {
+	// Server is the test server to send the requests to.
+	Server *httptest.Server
+
+	// Signer is used to sign the span and edge context headers,
+	// it should use the same secrets as the HeaderTrustHandler of the server.
+	//
+	// If Signer is nil the headers are sent without signatures,
+	// which only works when the server uses httpbp.AlwaysTrustHeaders.
+	Signer *httpbp.TrustHeaderSignature
+
+	// SignatureExpiresIn is how long the signatures are valid for.
+	//
+	// Optional, default to DefaultSignatureExpiresIn.
+	SignatureExpiresIn time.Duration
+}
+
+// RequestArgs are the arguments used to build a test request.
+type RequestArgs struct {
+	// The HTTP method and the path of the request, relative to the URL of the
+	// test server.
+	Method string
+	Path   string
+
+	// Optional request body and headers.
+	Body   io.Reader
+	Header http.Header
+
+	// Span, if set, is sent as the span headers of the request.
+	Span *httpbp.SpanHeaders
+
+	// EdgeContext, if set, is sent as the raw edge request context header.
+	EdgeContext string
+
+	// Deadline, if set, is sent as the deadline budget header,
+	// rounded down to milliseconds.
+	Deadline time.Duration
+}
+
+// NewRequest builds a request from args, signing the span and edge context
+// headers with c.Signer.
+func (c Client) NewRequest(tb testing.TB, args RequestArgs) *http.Request {
+	tb.Helper()
+
+	r, err := http.NewRequest(args.Method, c.Server.URL+args.Path, args.Body)
+	if err != nil {
+		tb.Fatalf("Failed to create request: %v", err)
+	}
+	for key, values := range args.Header {
+		r.Header[key] = append([]string(nil), values...)
+	}
+
+	expiresIn := c.SignatureExpiresIn
+	if expiresIn <= 0 {
+		expiresIn = DefaultSignatureExpiresIn
+	}
+	if args.Span != nil {
+		for key, value := range args.Span.AsMap() {
+			if value != "" {
+				r.Header.Set(key, value)
+			}
+		}
+		if c.Signer != nil {
+			signature, err := c.Signer.SignSpanHeaders(*args.Span, expiresIn)
+			if err != nil {
+				tb.Fatalf("Failed to sign span headers: %v", err)
+			}
+			r.Header.Set(httpbp.SpanSignatureHeader, signature)
+		}
+	}
+	if args.EdgeContext != "" {
+		r.Header.Set(
+			httpbp.EdgeContextHeader,
+			base64.StdEncoding.EncodeToString([]byte(args.EdgeContext)),
+		)
+		if c.Signer != nil {
+			signature, err := c.Signer.SignEdgeContextHeader(
+				httpbp.EdgeContextHeaders{EdgeRequest: args.EdgeContext},
+				expiresIn,
+			)
+			if err != nil {
+				tb.Fatalf("Failed to sign edge context header: %v", err)
+			}
+			r.Header.Set(httpbp.EdgeContextSignatureHeader, signature)
+		}
+	}
+	if args.Deadline > 0 {
+		r.Header.Set(
+			httpbp.DeadlineBudgetHeader,
+			strconv.FormatInt(args.Deadline.Milliseconds(), 10),
+		)
+	}
+	return r
+}
+
+// Do builds a request from args, sends it to the test server and reads the
+// response.
+func (c Client) Do(tb testing.TB, args RequestArgs) *Response {
+	tb.Helper()
+
+	resp, err := c.Server.Client().Do(c.NewRequest(tb, args))
+	if err != nil {
+		tb.Fatalf("Request %s %s failed: %v", args.Method, args.Path, err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		tb.Fatalf("Failed to read the response body of %s %s: %v", args.Method, args.Path, err)
+	}
+	return &Response{
+		Response: resp,
+		RawBody:  body,
+	}
+}
+
+// Response is a response read by Client.Do.
+type Response struct {
+	*http.Response
+
+	// RawBody is the full response body.
+	// The Body of the embedded *http.Response is already closed.
+	RawBody []byte
+}
+
+// CheckStatus fails the test if the status code of the response is not code.
+func (r *Response) CheckStatus(tb testing.TB, code int) {
+	tb.Helper()
+
+	if r.StatusCode != code {
+		tb.Errorf("Expected status code %d, got %d with body %q", code, r.StatusCode, r.RawBody)
+	}
+}
+
+// CheckContentType fails the test if the media type of the Content-Type
+// header of the response is not the media type of contentType,
+// parameters like charset are ignored.
+//
+// Example:
+//
+//     resp.CheckContentType(t, httpbp.JSONContentType)
+func (r *Response) CheckContentType(tb testing.TB, contentType string) {
+	tb.Helper()
+
+	expected, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		tb.Fatalf("Failed to parse Content-Type %q: %v", contentType, err)
+	}
+	got, _, err := mime.ParseMediaType(r.Header.Get(httpbp.ContentTypeHeader))
+	if err != nil {
+		tb.Errorf("Failed to parse Content-Type %q: %v", r.Header.Get(httpbp.ContentTypeHeader), err)
+		return
+	}
+	if got != expected {
+		tb.Errorf("Expected Content-Type %q, got %q", expected, got)
+	}
+}
+
+// DecodeJSON decodes the JSON response body into v.
+func (r *Response) DecodeJSON(tb testing.TB, v interface{}) {
+	tb.Helper()
+
+	if err := json.Unmarshal(r.RawBody, v); err != nil {
+		tb.Fatalf("Failed to decode the response body %q: %v", r.RawBody, err)
+	}
+}
+
+// ErrorResponse decodes the error response body.
+//
+// Both the httpbp.JSONError and the RFC 7807 httpbp.ProblemError formats are
+// supported, based on the Content-Type header of the response.
+// The test fails if the body is not a valid error response.
+func (r *Response) ErrorResponse(tb testing.TB) *httpbp.ErrorResponse {
+	tb.Helper()
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get(httpbp.ContentTypeHeader))
+	if mediaType == httpbp.ProblemJSONContentType {
+		var problem httpbp.ProblemDetails
+		r.DecodeJSON(tb, &problem)
+		return httpbp.NewErrorResponse(
+			problem.Status,
+			problem.Reason,
+			problem.Detail,
+		).WithDetails(problem.Details)
+	}
+
+	var wrapper httpbp.ErrorResponseJSONWrapper
+	r.DecodeJSON(tb, &wrapper)
+	if wrapper.Error == nil {
+		tb.Fatalf("No error in the response body %q", r.RawBody)
+	}
+	return httpbp.NewErrorResponse(
+		r.StatusCode,
+		wrapper.Error.Reason,
+		wrapper.Error.Explanation,
+	).WithDetails(wrapper.Error.Details)
+}
+
+// CheckError fails the test if the reason of the error response is not the
+// reason of expected.
+//
+// Use CheckStatus to check the status code.
+//
+// Example:
+//
+//     resp.CheckStatus(t, http.StatusBadRequest)
+//     resp.CheckError(t, httpbp.BadRequest())
+func (r *Response) CheckError(tb testing.TB, expected *httpbp.ErrorResponse) {
+	tb.Helper()
+
+	if got := r.ErrorResponse(tb); got.Reason != expected.Reason {
+		tb.Errorf("Expected error reason %q, got %q", expected.Reason, got.Reason)
+	}
+}
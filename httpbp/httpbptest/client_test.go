@@ -0,0 +1,201 @@
+package httpbptest_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/reddit/baseplate.go"
+	"github.com/reddit/baseplate.go/ecinterface"
+	"github.com/reddit/baseplate.go/httpbp"
+	"github.com/reddit/baseplate.go/httpbp/httpbptest"
+	"github.com/reddit/baseplate.go/secrets"
+	"github.com/reddit/baseplate.go/tracing/tracingtest"
+)
+
+const (
+	edgeContextSecretPath = "secret/http/edge-context-signature"
+	spanSecretPath        = "secret/http/span-signature"
+)
+
+var testSecrets = map[string]secrets.GenericSecret{
+	edgeContextSecretPath: {
+		Type:     secrets.VersionedType,
+		Current:  "YWJjZGVmZ2hpamtsbW5vcHFyc3R1dnd4eXowMTIzNDU=",
+		Encoding: secrets.Base64Encoding,
+	},
+	spanSecretPath: {
+		Type:     secrets.VersionedType,
+		Current:  "Y2RvVXhNMVdsTXJma3BDaHRGZ0dPYkVGSg==",
+		Encoding: secrets.Base64Encoding,
+	},
+}
+
+type echoResponse struct {
+	EdgeContext string `json:"edge_context"`
+	HasDeadline bool   `json:"has_deadline"`
+}
+
+func newTestClient(t *testing.T) httpbptest.Client {
+	t.Helper()
+
+	store, _, err := secrets.NewTestSecrets(context.Background(), testSecrets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+
+	signer := httpbp.NewTrustHeaderSignature(httpbp.TrustHeaderSignatureArgs{
+		SecretsStore:          store,
+		EdgeContextSecretPath: edgeContextSecretPath,
+		SpanSecretPath:        spanSecretPath,
+	})
+	ecImpl := ecinterface.Mock()
+	_, ts, err := httpbp.NewTestBaseplateServer(httpbp.ServerArgs{
+		Baseplate: baseplate.NewTestBaseplate(baseplate.NewTestBaseplateArgs{
+			Config:          baseplate.Config{Addr: ":8080"},
+			Store:           store,
+			EdgeContextImpl: ecImpl,
+		}),
+		TrustHandler: signer,
+		Endpoints: map[httpbp.Pattern]httpbp.Endpoint{
+			"/echo": {
+				Name:    "echo",
+				Methods: []string{http.MethodGet},
+				Handle: func(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+					header, _ := ecImpl.ContextToHeader(ctx)
+					_, hasDeadline := ctx.Deadline()
+					return httpbp.WriteJSON(w, httpbp.Response{
+						Body: echoResponse{
+							EdgeContext: header,
+							HasDeadline: hasDeadline,
+						},
+					})
+				},
+			},
+			"/json-error": {
+				Name:    "json-error",
+				Methods: []string{http.MethodGet},
+				Handle: func(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+					return httpbp.JSONError(
+						httpbp.BadRequest().WithDetails(map[string]string{"foo": "required"}),
+						errors.New("bad request"),
+					)
+				},
+			},
+			"/problem": {
+				Name:    "problem",
+				Methods: []string{http.MethodGet},
+				Handle: func(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+					return httpbp.ProblemError(httpbp.Conflict(), errors.New("conflict"), r.URL.Path)
+				},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(ts.Close)
+
+	return httpbptest.Client{
+		Server: ts,
+		Signer: &signer,
+	}
+}
+
+func TestClient(t *testing.T) {
+	client := newTestClient(t)
+
+	t.Run("trusted", func(t *testing.T) {
+		recorder := tracingtest.Record(t)
+		metrics := httpbptest.NewEndpointMetrics(t, "echo")
+		span := &httpbp.SpanHeaders{
+			TraceID: "12345",
+			SpanID:  "67890",
+			Sampled: "1",
+		}
+
+		resp := client.Do(t, httpbptest.RequestArgs{
+			Method:      http.MethodGet,
+			Path:        "/echo",
+			Span:        span,
+			EdgeContext: "edge-context",
+			Deadline:    time.Minute,
+		})
+		resp.CheckStatus(t, http.StatusOK)
+		resp.CheckContentType(t, httpbp.JSONContentType)
+
+		var body echoResponse
+		resp.DecodeJSON(t, &body)
+		if body.EdgeContext != "edge-context" {
+			t.Errorf("Expected edge context %q, got %q", "edge-context", body.EdgeContext)
+		}
+		if !body.HasDeadline {
+			t.Error("Expected the request context to have a deadline")
+		}
+
+		httpbptest.CheckServerSpan(t, recorder, "echo", span)
+		metrics.CheckRequests(http.StatusOK, 1)
+		metrics.CheckActiveRequests(0)
+	})
+
+	t.Run("untrusted", func(t *testing.T) {
+		recorder := tracingtest.Record(t)
+		untrusted := client
+		untrusted.Signer = nil
+
+		resp := untrusted.Do(t, httpbptest.RequestArgs{
+			Method:      http.MethodGet,
+			Path:        "/echo",
+			Span:        &httpbp.SpanHeaders{TraceID: "12345", SpanID: "67890"},
+			EdgeContext: "edge-context",
+		})
+		resp.CheckStatus(t, http.StatusOK)
+
+		var body echoResponse
+		resp.DecodeJSON(t, &body)
+		if body.EdgeContext != "" {
+			t.Errorf("Expected no edge context, got %q", body.EdgeContext)
+		}
+		if body.HasDeadline {
+			t.Error("Expected the request context to have no deadline")
+		}
+
+		if span := httpbptest.CheckServerSpan(t, recorder, "echo", nil); span.TraceID == "12345" {
+			t.Error("Expected the untrusted span headers to be ignored")
+		}
+	})
+
+	t.Run("json-error", func(t *testing.T) {
+		metrics := httpbptest.NewEndpointMetrics(t, "json-error")
+
+		resp := client.Do(t, httpbptest.RequestArgs{
+			Method: http.MethodGet,
+			Path:   "/json-error",
+		})
+		resp.CheckStatus(t, http.StatusBadRequest)
+		resp.CheckContentType(t, httpbp.JSONContentType)
+		resp.CheckError(t, httpbp.BadRequest())
+		if details := resp.ErrorResponse(t).Details; details["foo"] != "required" {
+			t.Errorf("Expected error details %v, got %v", map[string]string{"foo": "required"}, details)
+		}
+
+		metrics.CheckRequests(http.StatusBadRequest, 1)
+		metrics.CheckRequests(http.StatusOK, 0)
+	})
+
+	t.Run("problem", func(t *testing.T) {
+		resp := client.Do(t, httpbptest.RequestArgs{
+			Method: http.MethodGet,
+			Path:   "/problem",
+		})
+		resp.CheckStatus(t, http.StatusConflict)
+		resp.CheckContentType(t, httpbp.ProblemJSONContentType)
+		resp.CheckError(t, httpbp.Conflict())
+		if got := resp.ErrorResponse(t).Explanation; got != httpbp.Conflict().Explanation {
+			t.Errorf("Expected explanation %q, got %q", httpbp.Conflict().Explanation, got)
+		}
+	})
+}
@@ -0,0 +1,2 @@
+// Package httpbptest provides test utilities for services built with httpbp.
+package httpbptest
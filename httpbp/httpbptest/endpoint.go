@@ -0,0 +1,109 @@
+package httpbptest
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/reddit/baseplate.go/httpbp"
+	"github.com/reddit/baseplate.go/prometheusbp/promtest"
+	"github.com/reddit/baseplate.go/tracing"
+	"github.com/reddit/baseplate.go/tracing/tracingtest"
+)
+
+// The httpbp server metrics checked by EndpointMetrics.
+const (
+	serverRequestsMetric       = "http_server_requests_total"
+	serverActiveRequestsMetric = "http_server_active_requests"
+
+	endpointLabel = "http_endpoint"
+	codeLabel     = "http_response_code"
+)
+
+// CheckServerSpan fails the test if recorder did not record a server span
+// for the endpoint name, and returns the span.
+//
+// When span is non-nil, the server span is also expected to continue the
+// trace of the span headers, which only happens when the server trusts them:
+// it must have the same trace id, and the span id of the headers as its
+// parent id.
+//
+// Example:
+//
+//     recorder := tracingtest.Record(t)
+//     span := &httpbp.SpanHeaders{TraceID: "1", SpanID: "2", Sampled: "1"}
+//     client.Do(t, httpbptest.RequestArgs{Method: http.MethodGet, Path: "/foo", Span: span})
+//     httpbptest.CheckServerSpan(t, recorder, "foo", span)
+func CheckServerSpan(tb testing.TB, recorder *tracingtest.Recorder, name string, span *httpbp.SpanHeaders) tracing.FinishedSpan {
+	tb.Helper()
+
+	got := recorder.MustFind(tb, name)
+	if got.Type != tracing.SpanTypeServer {
+		tb.Errorf("Expected span %q to be a server span, got %v", name, got.Type)
+	}
+	if span == nil {
+		return got
+	}
+	if got.TraceID != span.TraceID {
+		tb.Errorf("Expected span %q to have trace id %q, got %q", name, span.TraceID, got.TraceID)
+	}
+	if got.ParentID != span.SpanID {
+		tb.Errorf("Expected span %q to have parent id %q, got %q", name, span.SpanID, got.ParentID)
+	}
+	return got
+}
+
+// EndpointMetrics is a snapshot of the httpbp server metrics of an endpoint,
+// used to check the changes made by the requests sent after it was taken.
+//
+// The metrics are global, so tests using the same endpoint name should not
+// run in parallel.
+//
+// Example:
+//
+//     metrics := httpbptest.NewEndpointMetrics(t, "foo")
+//     client.Do(t, httpbptest.RequestArgs{Method: http.MethodGet, Path: "/foo"})
+//     metrics.CheckRequests(http.StatusOK, 1)
+//     metrics.CheckActiveRequests(0)
+type EndpointMetrics struct {
+	tb       testing.TB
+	endpoint string
+	requests *promtest.GatheredMetricTest
+}
+
+// NewEndpointMetrics takes a snapshot of the server metrics of the endpoint
+// name.
+func NewEndpointMetrics(tb testing.TB, name string) *EndpointMetrics {
+	tb.Helper()
+
+	return &EndpointMetrics{
+		tb:       tb,
+		endpoint: name,
+		requests: promtest.NewGatheredMetricTest(tb, serverRequestsMetric, prometheus.Labels{
+			endpointLabel: name,
+		}),
+	}
+}
+
+// CheckRequests fails the test if the number of requests of the endpoint
+// responded with code did not change by exactly delta.
+//
+// The test also fails if no request was ever recorded by the server metrics.
+func (m *EndpointMetrics) CheckRequests(code int, delta float64) {
+	m.tb.Helper()
+
+	m.requests.With(prometheus.Labels{codeLabel: strconv.Itoa(code)}).CheckDelta(delta)
+}
+
+// CheckActiveRequests fails the test if the current number of active requests
+// of the endpoint is not expected.
+//
+// The test also fails if no request was ever recorded by the server metrics.
+func (m *EndpointMetrics) CheckActiveRequests(expected float64) {
+	m.tb.Helper()
+
+	promtest.NewGatheredMetricTest(m.tb, serverActiveRequestsMetric, prometheus.Labels{
+		endpointLabel: m.endpoint,
+	}).CheckValue(expected)
+}
@@ -0,0 +1,68 @@
+package httpbptest
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/reddit/baseplate.go/httpbp"
+)
+
+// UpdateOpenAPIEnv is the environment variable that, when set to a non-empty
+// value, makes CheckOpenAPIDocument write the generated document to the golden
+// file instead of comparing against it.
+const UpdateOpenAPIEnv = "HTTPBPTEST_UPDATE_OPENAPI"
+
+// CheckOpenAPIDocument fails the test if the JSON serialization of doc is
+// different from the content of the golden file at path.
+//
+// Run the test with UpdateOpenAPIEnv set to update the golden file after
+// intended changes, for example:
+//
+//     HTTPBPTEST_UPDATE_OPENAPI=1 go test ./...
+//
+// Example:
+//
+//     func TestOpenAPI(t *testing.T) {
+//         doc, err := httpbp.NewOpenAPIDocument(info, endpoints)
+//         if err != nil {
+//             t.Fatal(err)
+//         }
+//         httpbptest.CheckOpenAPIDocument(t, doc, "testdata/openapi.json")
+//     }
+func CheckOpenAPIDocument(tb testing.TB, doc *httpbp.OpenAPIDocument, path string) {
+	tb.Helper()
+
+	generated, err := json.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		tb.Fatalf("Failed to serialize the OpenAPI document: %v", err)
+	}
+	generated = append(generated, '\n')
+
+	if os.Getenv(UpdateOpenAPIEnv) != "" {
+		if err := os.WriteFile(path, generated, 0644); err != nil {
+			tb.Fatalf("Failed to update the OpenAPI document %q: %v", path, err)
+		}
+		return
+	}
+
+	golden, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		tb.Fatalf("OpenAPI document %q does not exist, run the test with %s=1 to generate it", path, UpdateOpenAPIEnv)
+	}
+	if err != nil {
+		tb.Fatalf("Failed to read the OpenAPI document %q: %v", path, err)
+	}
+	if !bytes.Equal(golden, generated) {
+		tb.Errorf(
+			"OpenAPI document changed from %q (-want +got):\n%s\nRun the test with %s=1 if the change is intended.",
+			path,
+			cmp.Diff(string(golden), string(generated)),
+			UpdateOpenAPIEnv,
+		)
+	}
+}
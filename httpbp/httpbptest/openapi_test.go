@@ -0,0 +1,85 @@
+package httpbptest_test
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/reddit/baseplate.go/httpbp"
+	"github.com/reddit/baseplate.go/httpbp/httpbptest"
+)
+
+type pingResponse struct {
+	Message string `json:"message"`
+}
+
+func newOpenAPIDocument(t *testing.T, description string) *httpbp.OpenAPIDocument {
+	t.Helper()
+
+	doc, err := httpbp.NewOpenAPIDocument(
+		httpbp.OpenAPIInfo{
+			Title:       "ping",
+			Description: description,
+			Version:     "1.0.0",
+		},
+		map[httpbp.Pattern]httpbp.Endpoint{
+			"GET /ping": {
+				Name: "ping",
+				Handle: func(context.Context, http.ResponseWriter, *http.Request) error {
+					return nil
+				},
+				Doc: &httpbp.EndpointDoc{
+					Response: pingResponse{},
+				},
+			},
+		},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return doc
+}
+
+// errorRecorder is a testing.TB that records the failures instead of failing
+// the test.
+type errorRecorder struct {
+	testing.TB
+
+	failures []string
+}
+
+func (r *errorRecorder) Errorf(format string, args ...interface{}) {
+	r.failures = append(r.failures, fmt.Sprintf(format, args...))
+}
+
+func TestCheckOpenAPIDocument(t *testing.T) {
+	httpbptest.CheckOpenAPIDocument(t, newOpenAPIDocument(t, ""), "testdata/openapi.json")
+
+	recorder := &errorRecorder{TB: t}
+	httpbptest.CheckOpenAPIDocument(recorder, newOpenAPIDocument(t, "changed"), "testdata/openapi.json")
+	if len(recorder.failures) != 1 {
+		t.Errorf("Expected the changed document to fail the check, got %q", recorder.failures)
+	}
+}
+
+func TestCheckOpenAPIDocumentUpdate(t *testing.T) {
+	t.Setenv(httpbptest.UpdateOpenAPIEnv, "1")
+
+	path := filepath.Join(t.TempDir(), "openapi.json")
+	httpbptest.CheckOpenAPIDocument(t, newOpenAPIDocument(t, ""), path)
+
+	generated, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	golden, err := os.ReadFile("testdata/openapi.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(generated) != string(golden) {
+		t.Errorf("Expected the updated document to be %s, got %s", golden, generated)
+	}
+}
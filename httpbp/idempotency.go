@@ -0,0 +1,509 @@
+package httpbp
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+
+	"github.com/reddit/baseplate.go/log"
+)
+
+const (
+	// IdempotencyKeyHeader is the request header with the client generated key
+	// identifying the retries of the same request.
+	IdempotencyKeyHeader = "Idempotency-Key"
+
+	// IdempotentReplayedHeader is the header set to "true" on the responses
+	// replayed by the Idempotency middleware.
+	IdempotentReplayedHeader = "Idempotent-Replayed"
+)
+
+// Default values of IdempotencyArgs.
+const (
+	DefaultIdempotencyTTL             = 24 * time.Hour
+	DefaultIdempotencyLockTimeout     = time.Minute
+	DefaultIdempotencyMaxResponseSize = 1 << 20
+	DefaultIdempotencyMaxRequestSize  = 1 << 20
+)
+
+// DefaultIdempotencyRedisKeyPrefix is the default key prefix used by
+// RedisIdempotencyStore.
+const DefaultIdempotencyRedisKeyPrefix = "httpbp:idempotency:"
+
+// maxIdempotencyKeyLength is the max length of the Idempotency-Key header.
+const maxIdempotencyKeyLength = 255
+
+// IdempotentResponse is a response stored by the Idempotency middleware.
+type IdempotentResponse struct {
+	StatusCode int         `json:"status"`
+	Header     http.Header `json:"header"`
+	Body       []byte      `json:"body"`
+
+	// The hash of the method, the URI and the body of the request,
+	// to detect the reuse of a key with a different request.
+	RequestHash string `json:"requestHash,omitempty"`
+}
+
+// IdempotencyStore defines the storage of the Idempotency middleware.
+type IdempotencyStore interface {
+	// Begin marks the request identified by key as in progress for lockTimeout,
+	// unless there's already a request with the same key.
+	//
+	// It shall return true when the request is marked as in progress by this
+	// call,
+	// the stored response when a request with the same key is already
+	// completed,
+	// or false with a nil response when a request with the same key is still in
+	// progress.
+	Begin(ctx context.Context, key string, lockTimeout time.Duration) (resp *IdempotentResponse, ok bool, err error)
+
+	// Complete stores the response of the request identified by key for ttl,
+	// replacing the in progress mark.
+	Complete(ctx context.Context, key string, resp *IdempotentResponse, ttl time.Duration) error
+
+	// Abort removes the in progress mark of the request identified by key,
+	// so it can be retried.
+	Abort(ctx context.Context, key string) error
+}
+
+// IdempotencyArgs are the args to be passed into Idempotency.
+type IdempotencyArgs struct {
+	// The storage of the responses.
+	//
+	// Optional. Default to a MemoryIdempotencyStore shared by all the endpoints.
+	Store IdempotencyStore
+
+	// The function to extract the caller key from the request,
+	// used to scope the Idempotency-Key headers by the caller.
+	//
+	// Optional. Default to the subject of the bearer token verified by
+	// BearerAuth (see ClaimsFromContext), falling back to the client IP
+	// (see RateLimitByClientIP) for the requests without one.
+	// With the IP fallback, a retry from a different IP (e.g. a mobile client
+	// switching networks) is executed again,
+	// so it should be set when the callers are authenticated otherwise,
+	// e.g. to RateLimitByEdgeContextUser.
+	// When it returns an empty key, the Idempotency-Key header is scoped by the
+	// endpoint only.
+	KeyFunc RateLimitKeyFunc
+
+	// The methods of the requests to honor the Idempotency-Key header.
+	//
+	// Optional. Default to POST and PATCH.
+	Methods []string
+
+	// How long to replay the stored responses.
+	//
+	// Optional. Default to DefaultIdempotencyTTL.
+	TTL time.Duration
+
+	// How long a request is considered in progress,
+	// in case the server dies before it's completed.
+	// It should be longer than the timeout of the endpoints.
+	//
+	// Optional. Default to DefaultIdempotencyLockTimeout.
+	LockTimeout time.Duration
+
+	// The max size of a response body to be stored.
+	// Larger responses are not stored, so the retries will be executed again.
+	//
+	// Optional. Default to DefaultIdempotencyMaxResponseSize.
+	MaxResponseSize int
+
+	// The max size of a request body to be hashed.
+	// Requests with an Idempotency-Key header and a larger body are rejected
+	// with a PayloadTooLarge error.
+	//
+	// Optional. Default to DefaultIdempotencyMaxRequestSize.
+	MaxRequestSize int64
+
+	// The logger to be called when the store returns an error.
+	// In such case the request is executed without the idempotency guarantee.
+	//
+	// Optional. If nil, log.DefaultWrapper will be used.
+	Logger log.Wrapper
+}
+
+// Idempotency returns a Middleware that honors the Idempotency-Key header,
+// so the retries of non-idempotent requests (e.g. from the Retries client
+// middleware) are only executed once.
+//
+// The first request with a key is executed and its response (status code,
+// headers and body) is stored,
+// keyed by the endpoint name, the caller key returned by args.KeyFunc and the
+// Idempotency-Key header.
+// The following requests with the same key within the TTL are not executed,
+// the stored response is replayed instead with IdempotentReplayedHeader set.
+// Requests with the same key arriving while the first one is still in
+// progress are rejected with a Conflict error,
+// and requests reusing the key of a completed request with a different method,
+// URI or body are rejected with an UnprocessableEntity error.
+// The request body is read in full to be hashed,
+// up to args.MaxRequestSize.
+//
+// The responses are only stored when the HandlerFunc returns nil and the
+// status code is < 500, otherwise the key is released so the request can be
+// retried.
+// Requests without the Idempotency-Key header are executed as usual.
+func Idempotency(args IdempotencyArgs) Middleware {
+	if args.Store == nil {
+		args.Store = NewMemoryIdempotencyStore()
+	}
+	if args.KeyFunc == nil {
+		args.KeyFunc = idempotencyCallerKey
+	}
+	if len(args.Methods) == 0 {
+		args.Methods = []string{http.MethodPost, http.MethodPatch}
+	}
+	methods := make(map[string]bool, len(args.Methods))
+	for _, m := range args.Methods {
+		methods[strings.ToUpper(m)] = true
+	}
+	if args.TTL <= 0 {
+		args.TTL = DefaultIdempotencyTTL
+	}
+	if args.LockTimeout <= 0 {
+		args.LockTimeout = DefaultIdempotencyLockTimeout
+	}
+	if args.MaxResponseSize <= 0 {
+		args.MaxResponseSize = DefaultIdempotencyMaxResponseSize
+	}
+	if args.MaxRequestSize <= 0 {
+		args.MaxRequestSize = DefaultIdempotencyMaxRequestSize
+	}
+	return func(name string, next HandlerFunc) HandlerFunc {
+		return func(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+			key := r.Header.Get(IdempotencyKeyHeader)
+			if key == "" || !methods[r.Method] {
+				return next(ctx, w, r)
+			}
+			if len(key) > maxIdempotencyKeyLength {
+				return RawError(
+					BadRequest(),
+					fmt.Errorf("httpbp: %s header longer than %d", IdempotencyKeyHeader, maxIdempotencyKeyLength),
+					PlainTextContentType,
+				)
+			}
+
+			hash, err := hashIdempotentRequest(r, args.MaxRequestSize)
+			if errors.Is(err, ErrRequestBodyTooLarge) {
+				return RawError(
+					PayloadTooLarge(),
+					fmt.Errorf("httpbp: request body with %s is larger than the limit %d of %q", IdempotencyKeyHeader, args.MaxRequestSize, name),
+					PlainTextContentType,
+				)
+			}
+			if err != nil {
+				return RawError(
+					BadRequest(),
+					fmt.Errorf("httpbp: failed to read request body: %w", err),
+					PlainTextContentType,
+				)
+			}
+
+			key = name + ":" + args.KeyFunc(ctx, r) + ":" + key
+			stored, ok, err := args.Store.Begin(ctx, key, args.LockTimeout)
+			if err != nil {
+				args.Logger.Log(ctx, "httpbp: idempotency store failed: "+err.Error())
+				return next(ctx, w, r)
+			}
+			if stored != nil && stored.RequestHash != "" && stored.RequestHash != hash {
+				return RawError(
+					UnprocessableEntity(),
+					fmt.Errorf("httpbp: %s %q is reused with a different request", IdempotencyKeyHeader, key),
+					PlainTextContentType,
+				)
+			}
+			if stored != nil {
+				h := w.Header()
+				for k, v := range stored.Header {
+					h[k] = v
+				}
+				h.Set(IdempotentReplayedHeader, "true")
+				w.WriteHeader(stored.StatusCode)
+				_, err := w.Write(stored.Body)
+				return err
+			}
+			if !ok {
+				return RawError(
+					Conflict(),
+					fmt.Errorf("httpbp: request with %s %q is in progress", IdempotencyKeyHeader, key),
+					PlainTextContentType,
+				)
+			}
+
+			recorder := &idempotencyRecorder{
+				ResponseWriter: w,
+				max:            args.MaxResponseSize,
+			}
+			err = next(ctx, recorder, r)
+			if err != nil || recorder.tooLarge || recorder.status() >= http.StatusInternalServerError {
+				if abortErr := args.Store.Abort(ctx, key); abortErr != nil {
+					args.Logger.Log(ctx, "httpbp: idempotency store failed: "+abortErr.Error())
+				}
+				return err
+			}
+			resp := recorder.response()
+			resp.RequestHash = hash
+			if err := args.Store.Complete(ctx, key, resp, args.TTL); err != nil {
+				args.Logger.Log(ctx, "httpbp: idempotency store failed: "+err.Error())
+			}
+			return nil
+		}
+	}
+}
+
+// idempotencyCallerKey is the default IdempotencyArgs.KeyFunc.
+func idempotencyCallerKey(ctx context.Context, r *http.Request) string {
+	if claims, ok := ClaimsFromContext(ctx); ok && claims.Subject != "" {
+		return "sub:" + claims.Subject
+	}
+	return "ip:" + RateLimitByClientIP(ctx, r)
+}
+
+// hashIdempotentRequest returns the hash of the method, the URI and the body of
+// r, replacing r.Body with a copy of the read body.
+//
+// It returns ErrRequestBodyTooLarge if the body is larger than maxBytes.
+func hashIdempotentRequest(r *http.Request, maxBytes int64) (string, error) {
+	if r.ContentLength > maxBytes {
+		return "", ErrRequestBodyTooLarge
+	}
+	var body []byte
+	if r.Body != nil && r.Body != http.NoBody {
+		var err error
+		body, err = io.ReadAll(&limitedBody{ReadCloser: r.Body, n: maxBytes})
+		r.Body.Close()
+		if err != nil {
+			return "", err
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+	}
+	h := sha256.New()
+	io.WriteString(h, r.Method+" "+r.URL.RequestURI()+"\n")
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// idempotencyRecorder records the response written by the HandlerFunc.
+type idempotencyRecorder struct {
+	http.ResponseWriter
+
+	max         int
+	code        int
+	header      http.Header
+	body        bytes.Buffer
+	tooLarge    bool
+	wroteHeader bool
+}
+
+func (r *idempotencyRecorder) WriteHeader(code int) {
+	if !r.wroteHeader {
+		r.wroteHeader = true
+		r.code = code
+		r.header = r.ResponseWriter.Header().Clone()
+	}
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *idempotencyRecorder) Write(p []byte) (int, error) {
+	if !r.wroteHeader {
+		r.WriteHeader(http.StatusOK)
+	}
+	if !r.tooLarge {
+		if r.body.Len()+len(p) > r.max {
+			r.tooLarge = true
+			r.body = bytes.Buffer{}
+		} else {
+			r.body.Write(p)
+		}
+	}
+	return r.ResponseWriter.Write(p)
+}
+
+func (r *idempotencyRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (r *idempotencyRecorder) status() int {
+	if !r.wroteHeader {
+		return http.StatusOK
+	}
+	return r.code
+}
+
+func (r *idempotencyRecorder) response() *IdempotentResponse {
+	header := r.header
+	if !r.wroteHeader {
+		header = r.ResponseWriter.Header().Clone()
+	}
+	return &IdempotentResponse{
+		StatusCode: r.status(),
+		Header:     header,
+		Body:       r.body.Bytes(),
+	}
+}
+
+// MemoryIdempotencyStore is an IdempotencyStore keeping the responses in
+// memory.
+//
+// It's only suitable when the retries are always routed to the same server
+// instance.
+// Use RedisIdempotencyStore to share the responses among the instances.
+//
+// It's safe for concurrent use.
+type MemoryIdempotencyStore struct {
+	lock      sync.Mutex
+	entries   map[string]*memoryIdempotencyEntry
+	lastSweep time.Time
+}
+
+type memoryIdempotencyEntry struct {
+	// nil when the request is in progress.
+	resp      *IdempotentResponse
+	expiresAt time.Time
+}
+
+// memoryIdempotencySweepInterval is the interval MemoryIdempotencyStore drops
+// the expired entries.
+const memoryIdempotencySweepInterval = time.Minute
+
+// NewMemoryIdempotencyStore creates a new, empty MemoryIdempotencyStore.
+func NewMemoryIdempotencyStore() *MemoryIdempotencyStore {
+	return &MemoryIdempotencyStore{
+		entries:   make(map[string]*memoryIdempotencyEntry),
+		lastSweep: time.Now(),
+	}
+}
+
+// Begin implements IdempotencyStore.
+//
+// It never returns an error.
+func (s *MemoryIdempotencyStore) Begin(_ context.Context, key string, lockTimeout time.Duration) (*IdempotentResponse, bool, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	now := time.Now()
+	if now.Sub(s.lastSweep) >= memoryIdempotencySweepInterval {
+		for k, e := range s.entries {
+			if !now.Before(e.expiresAt) {
+				delete(s.entries, k)
+			}
+		}
+		s.lastSweep = now
+	}
+
+	if e, ok := s.entries[key]; ok && now.Before(e.expiresAt) {
+		return e.resp, false, nil
+	}
+	s.entries[key] = &memoryIdempotencyEntry{
+		expiresAt: now.Add(lockTimeout),
+	}
+	return nil, true, nil
+}
+
+// Complete implements IdempotencyStore.
+//
+// It never returns an error.
+func (s *MemoryIdempotencyStore) Complete(_ context.Context, key string, resp *IdempotentResponse, ttl time.Duration) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.entries[key] = &memoryIdempotencyEntry{
+		resp:      resp,
+		expiresAt: time.Now().Add(ttl),
+	}
+	return nil
+}
+
+// Abort implements IdempotencyStore.
+//
+// It never returns an error.
+func (s *MemoryIdempotencyStore) Abort(_ context.Context, key string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	delete(s.entries, key)
+	return nil
+}
+
+// RedisIdempotencyStore is an IdempotencyStore keeping the responses in redis,
+// so they are shared among all the server instances.
+//
+// The in progress requests are stored as empty values.
+type RedisIdempotencyStore struct {
+	// The redis client, usually created by redisbp.NewMonitoredClient.
+	Client redis.Cmdable
+
+	// The prefix of the redis keys of the responses.
+	//
+	// Optional. Default to DefaultIdempotencyRedisKeyPrefix.
+	KeyPrefix string
+}
+
+func (s RedisIdempotencyStore) key(key string) string {
+	if s.KeyPrefix == "" {
+		return DefaultIdempotencyRedisKeyPrefix + key
+	}
+	return s.KeyPrefix + key
+}
+
+// Begin implements IdempotencyStore.
+func (s RedisIdempotencyStore) Begin(ctx context.Context, key string, lockTimeout time.Duration) (*IdempotentResponse, bool, error) {
+	key = s.key(key)
+	ok, err := s.Client.SetNX(ctx, key, "", lockTimeout).Result()
+	if err != nil {
+		return nil, false, err
+	}
+	if ok {
+		return nil, true, nil
+	}
+	value, err := s.Client.Get(ctx, key).Bytes()
+	if errors.Is(err, redis.Nil) {
+		// Expired in between, treat it as in progress.
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	if len(value) == 0 {
+		return nil, false, nil
+	}
+	var resp IdempotentResponse
+	if err := json.Unmarshal(value, &resp); err != nil {
+		return nil, false, fmt.Errorf("httpbp: failed to decode stored response: %w", err)
+	}
+	return &resp, false, nil
+}
+
+// Complete implements IdempotencyStore.
+func (s RedisIdempotencyStore) Complete(ctx context.Context, key string, resp *IdempotentResponse, ttl time.Duration) error {
+	value, err := json.Marshal(resp)
+	if err != nil {
+		return fmt.Errorf("httpbp: failed to encode response: %w", err)
+	}
+	return s.Client.Set(ctx, s.key(key), value, ttl).Err()
+}
+
+// Abort implements IdempotencyStore.
+func (s RedisIdempotencyStore) Abort(ctx context.Context, key string) error {
+	return s.Client.Del(ctx, s.key(key)).Err()
+}
+
+var (
+	_ IdempotencyStore = (*MemoryIdempotencyStore)(nil)
+	_ IdempotencyStore = RedisIdempotencyStore{}
+)
@@ -0,0 +1,285 @@
+package httpbp_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+
+	"github.com/reddit/baseplate.go/httpbp"
+)
+
+func TestIdempotency(t *testing.T) {
+	t.Parallel()
+
+	newStores := map[string]func(t *testing.T) httpbp.IdempotencyStore{
+		"memory": func(t *testing.T) httpbp.IdempotencyStore {
+			return httpbp.NewMemoryIdempotencyStore()
+		},
+		"redis": func(t *testing.T) httpbp.IdempotencyStore {
+			s, err := miniredis.Run()
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(s.Close)
+			client := redis.NewClient(&redis.Options{Addr: s.Addr()})
+			t.Cleanup(func() { client.Close() })
+			return httpbp.RedisIdempotencyStore{Client: client}
+		},
+	}
+	for storeName, _newStore := range newStores {
+		newStore := _newStore
+		t.Run(storeName, func(t *testing.T) {
+			t.Parallel()
+
+			var executed int64
+			// When non-nil, the handler blocks until it's closed.
+			var block chan struct{}
+			var started chan struct{}
+			handle := httpbp.Wrap(
+				"create",
+				func(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+					n := atomic.AddInt64(&executed, 1)
+					if block != nil {
+						close(started)
+						<-block
+					}
+					if r.Header.Get("X-Fail") != "" {
+						return httpbp.JSONError(httpbp.InternalServerError(), nil)
+					}
+					w.Header().Set("X-Count", strconv.FormatInt(n, 10))
+					w.WriteHeader(http.StatusCreated)
+					_, err := io.WriteString(w, "created "+strconv.FormatInt(n, 10))
+					return err
+				},
+				httpbp.Idempotency(httpbp.IdempotencyArgs{
+					Store:   newStore(t),
+					KeyFunc: httpbp.RateLimitByHeader("X-Caller"),
+				}),
+			)
+
+			call := func(method, key string, header http.Header) (*httptest.ResponseRecorder, error) {
+				req := httptest.NewRequest(method, "/", strings.NewReader(header.Get("X-Body")))
+				for k, v := range header {
+					req.Header[k] = v
+				}
+				if key != "" {
+					req.Header.Set(httpbp.IdempotencyKeyHeader, key)
+				}
+				w := httptest.NewRecorder()
+				return w, handle(req.Context(), w, req)
+			}
+			expect := func(w *httptest.ResponseRecorder, err error, body string, replayed bool) {
+				t.Helper()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if w.Code != http.StatusCreated {
+					t.Errorf("Expected code %d, got %d", http.StatusCreated, w.Code)
+				}
+				if w.Body.String() != body {
+					t.Errorf("Expected body %q, got %q", body, w.Body.String())
+				}
+				if got := w.Header().Get(httpbp.IdempotentReplayedHeader) == "true"; got != replayed {
+					t.Errorf("Expected replayed to be %v, got %v", replayed, got)
+				}
+			}
+
+			w, err := call(http.MethodPost, "foo", nil)
+			expect(w, err, "created 1", false)
+			w, err = call(http.MethodPost, "foo", nil)
+			expect(w, err, "created 1", true)
+			if count := w.Header().Get("X-Count"); count != "1" {
+				t.Errorf("Expected the stored headers to be replayed, got X-Count %q", count)
+			}
+
+			// Requests without the key or with other methods are always executed.
+			w, err = call(http.MethodPost, "", nil)
+			expect(w, err, "created 2", false)
+			w, err = call(http.MethodPut, "foo", nil)
+			expect(w, err, "created 3", false)
+
+			// Failed requests are not stored.
+			if _, err := call(http.MethodPost, "bar", http.Header{"X-Fail": {"1"}}); err == nil {
+				t.Error("Expected the failed request to return an error")
+			}
+			w, err = call(http.MethodPost, "bar", nil)
+			expect(w, err, "created 5", false)
+
+			// Concurrent duplicates are rejected.
+			block = make(chan struct{})
+			started = make(chan struct{})
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				call(http.MethodPost, "baz", nil)
+			}()
+			<-started
+			_, err = call(http.MethodPost, "baz", nil)
+			var httpErr httpbp.HTTPError
+			if !errors.As(err, &httpErr) {
+				t.Fatalf("Expected HTTPError, got %v", err)
+			}
+			if code := httpErr.Response().Code; code != http.StatusConflict {
+				t.Errorf("Expected code %d, got %d", http.StatusConflict, code)
+			}
+			close(block)
+			<-done
+			block = nil
+
+			// The keys are scoped by the caller.
+			w, err = call(http.MethodPost, "foo", http.Header{"X-Caller": {"other"}})
+			expect(w, err, "created 7", false)
+			w, err = call(http.MethodPost, "foo", http.Header{"X-Caller": {"other"}})
+			expect(w, err, "created 7", true)
+
+			// Reusing a key with a different request is rejected.
+			w, err = call(http.MethodPost, "qux", http.Header{"X-Body": {"foo"}})
+			expect(w, err, "created 8", false)
+			w, err = call(http.MethodPost, "qux", http.Header{"X-Body": {"foo"}})
+			expect(w, err, "created 8", true)
+			_, err = call(http.MethodPost, "qux", http.Header{"X-Body": {"bar"}})
+			if !errors.As(err, &httpErr) {
+				t.Fatalf("Expected HTTPError, got %v", err)
+			}
+			if code := httpErr.Response().Code; code != http.StatusUnprocessableEntity {
+				t.Errorf("Expected code %d, got %d", http.StatusUnprocessableEntity, code)
+			}
+
+			if n := atomic.LoadInt64(&executed); n != 8 {
+				t.Errorf("Expected 8 executions, got %d", n)
+			}
+		})
+	}
+}
+
+func TestIdempotencyMaxRequestSize(t *testing.T) {
+	t.Parallel()
+
+	handle := httpbp.Wrap(
+		"create",
+		func(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+			_, err := io.Copy(w, r.Body)
+			return err
+		},
+		httpbp.Idempotency(httpbp.IdempotencyArgs{
+			MaxRequestSize: 4,
+		}),
+	)
+
+	for _, c := range []struct {
+		name          string
+		body          string
+		contentLength int64
+		expectedCode  int
+	}{
+		{
+			name:          "within-limit",
+			body:          "1234",
+			contentLength: 4,
+		},
+		{
+			name:          "content-length",
+			body:          "12345",
+			contentLength: 5,
+			expectedCode:  http.StatusRequestEntityTooLarge,
+		},
+		{
+			name:          "chunked",
+			body:          "12345",
+			contentLength: -1,
+			expectedCode:  http.StatusRequestEntityTooLarge,
+		},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(c.body))
+			req.ContentLength = c.contentLength
+			req.Header.Set(httpbp.IdempotencyKeyHeader, c.name)
+			w := httptest.NewRecorder()
+			err := handle(req.Context(), w, req)
+			if c.expectedCode == 0 {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if w.Body.String() != c.body {
+					t.Errorf("Expected the body %q to be passed to the handler, got %q", c.body, w.Body.String())
+				}
+				return
+			}
+			var httpErr httpbp.HTTPError
+			if !errors.As(err, &httpErr) {
+				t.Fatalf("Expected HTTPError, got %v", err)
+			}
+			if code := httpErr.Response().Code; code != c.expectedCode {
+				t.Errorf("Expected code %d, got %d", c.expectedCode, code)
+			}
+		})
+	}
+}
+
+func TestIdempotencyDefaultKeyFunc(t *testing.T) {
+	t.Parallel()
+
+	store := newSecretsStore(t)
+	defer store.Close()
+	secret, err := store.GetVersionedSecret(bearerSecretPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var executed int64
+	handle := httpbp.Wrap(
+		"create",
+		func(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+			n := atomic.AddInt64(&executed, 1)
+			_, err := io.WriteString(w, "created "+strconv.FormatInt(n, 10))
+			return err
+		},
+		httpbp.BearerAuth(httpbp.BearerAuthArgs{
+			SecretsStore:   store,
+			HMACSecretPath: bearerSecretPath,
+		}),
+		httpbp.Idempotency(httpbp.IdempotencyArgs{}),
+	)
+	token := func(subject string) string {
+		return "Bearer " + signToken(t, httpbp.AlgHS256, "", []byte(secret.Current), map[string]interface{}{
+			"sub": subject,
+			"exp": time.Now().Add(time.Hour).Unix(),
+		})
+	}
+	call := func(remoteAddr, authorization string) string {
+		t.Helper()
+
+		req := httptest.NewRequest(http.MethodPost, "/", nil)
+		req.RemoteAddr = remoteAddr
+		req.Header.Set(httpbp.AuthorizationHeader, authorization)
+		req.Header.Set(httpbp.IdempotencyKeyHeader, "foo")
+		w := httptest.NewRecorder()
+		if err := handle(req.Context(), w, req); err != nil {
+			t.Fatal(err)
+		}
+		return w.Body.String()
+	}
+
+	// The same caller retrying from a different IP is replayed.
+	first := call("10.0.0.1:1234", token("t2_foo"))
+	if retry := call("10.0.0.2:1234", token("t2_foo")); retry != first {
+		t.Errorf("Expected the retry from another IP to be replayed as %q, got %q", first, retry)
+	}
+	// Other callers don't share the key.
+	if other := call("10.0.0.1:1234", token("t2_bar")); other == first {
+		t.Errorf("Expected the request of another caller to be executed, got %q", other)
+	}
+	if n := atomic.LoadInt64(&executed); n != 2 {
+		t.Errorf("Expected 2 executions, got %d", n)
+	}
+}
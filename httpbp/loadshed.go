@@ -0,0 +1,365 @@
+package httpbp
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Default values of ConcurrencyLimitConfig and LoadShedArgs.
+const (
+	DefaultLoadShedQueueTimeout = 100 * time.Millisecond
+	DefaultLoadShedRetryAfter   = time.Second
+	DefaultAdaptiveTolerance    = 2.0
+	DefaultAdaptiveWindow       = 100
+)
+
+// GlobalLoadShedEndpoint is the http_endpoint label value of the metrics of
+// the global limit of LoadShed.
+const GlobalLoadShedEndpoint = "*"
+
+// The reasons of shed requests, reported as the value of the shed_reason
+// label.
+const (
+	shedReasonLabel = "shed_reason"
+
+	shedReasonEndpointLimit = "endpoint_limit"
+	shedReasonGlobalLimit   = "global_limit"
+	shedReasonQueueTimeout  = "queue_timeout"
+)
+
+const (
+	// The smoothing factor of the adaptive limit.
+	adaptiveSmoothing = 0.2
+	// The number of windows averaged by the long term latency.
+	adaptiveLongWindows = 20
+)
+
+var (
+	loadShedInFlight = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: promNamespace,
+		Subsystem: subsystemServer,
+		Name:      "concurrency_in_flight",
+		Help:      "The number of in-flight requests admitted by the load shed middleware",
+	}, []string{endpointLabel})
+
+	loadShedQueued = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: promNamespace,
+		Subsystem: subsystemServer,
+		Name:      "concurrency_queued",
+		Help:      "The number of requests waiting in the queue of the load shed middleware",
+	}, []string{endpointLabel})
+
+	loadShedLimit = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: promNamespace,
+		Subsystem: subsystemServer,
+		Name:      "concurrency_limit",
+		Help:      "The current in-flight limit of the load shed middleware",
+	}, []string{endpointLabel})
+
+	loadShedRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: promNamespace,
+		Subsystem: subsystemServer,
+		Name:      "shed_requests_total",
+		Help:      "The number of requests rejected by the load shed middleware",
+	}, []string{endpointLabel, shedReasonLabel})
+)
+
+// ConcurrencyLimitConfig is the configuration of an in-flight requests limit.
+//
+// Can be deserialized from YAML.
+type ConcurrencyLimitConfig struct {
+	// The max number of in-flight requests.
+	//
+	// If <= 0, requests are not limited.
+	MaxInFlight int `yaml:"maxInFlight"`
+
+	// The max number of requests waiting for an in-flight slot when the limit
+	// is reached. Requests over it are rejected immediately.
+	//
+	// Optional. If <= 0, requests are rejected as soon as the limit is reached.
+	MaxQueue int `yaml:"maxQueue"`
+
+	// How long a request waits in the queue before it's rejected.
+	//
+	// Optional. Default to DefaultLoadShedQueueTimeout.
+	QueueTimeout time.Duration `yaml:"queueTimeout"`
+
+	// When true, the limit is adjusted between MinInFlight and MaxInFlight
+	// based on the observed latency:
+	// it's lowered when the recent latency grows over Tolerance times the long
+	// term latency,
+	// and raised back when the latency recovers.
+	Adaptive bool `yaml:"adaptive"`
+
+	// The min limit when Adaptive is true.
+	//
+	// Optional. Default to 1.
+	MinInFlight int `yaml:"minInFlight"`
+
+	// The tolerated ratio of the recent latency to the long term latency when
+	// Adaptive is true.
+	//
+	// Optional. Default to DefaultAdaptiveTolerance.
+	Tolerance float64 `yaml:"tolerance"`
+
+	// The number of requests the recent latency is averaged over, and the limit
+	// is adjusted every, when Adaptive is true.
+	//
+	// Optional. Default to DefaultAdaptiveWindow.
+	Window int `yaml:"window"`
+}
+
+// LoadShedArgs are the args to be passed into LoadShed.
+type LoadShedArgs struct {
+	// The limit shared by all the endpoints.
+	Global ConcurrencyLimitConfig
+
+	// The limits by endpoint name.
+	// Endpoints not in it are only limited by Global.
+	Endpoints map[string]ConcurrencyLimitConfig
+
+	// The "Retry-After" header of the rejected requests.
+	//
+	// Optional. Default to DefaultLoadShedRetryAfter.
+	RetryAfter time.Duration
+}
+
+// LoadShed returns a Middleware that limits the number of in-flight requests,
+// per endpoint and globally,
+// so an overloaded server rejects the excess requests early instead of
+// queueing them until they all time out.
+//
+// When a limit is reached the request waits in a short queue if configured,
+// and is rejected with a ServiceUnavailable error with "Retry-After" header
+// when the queue is full or the request times out in the queue.
+// The endpoint limit is checked before the global one.
+//
+// The in-flight, queued and shed requests are reported by the
+// httpbp_server_concurrency_in_flight, httpbp_server_concurrency_queued and
+// httpbp_server_shed_requests_total prometheus metrics,
+// and the current limits by httpbp_server_concurrency_limit.
+// The metrics of the global limit use GlobalLoadShedEndpoint as the endpoint.
+//
+// It should be used after InjectServerSpan, e.g. in ServerArgs.Middlewares.
+// The middleware returned by each LoadShed call has its own global limit,
+// so it should be created once and used for all the endpoints.
+func LoadShed(args LoadShedArgs) Middleware {
+	if args.RetryAfter <= 0 {
+		args.RetryAfter = DefaultLoadShedRetryAfter
+	}
+	global := newConcurrencyLimiter(GlobalLoadShedEndpoint, args.Global)
+	return func(name string, next HandlerFunc) HandlerFunc {
+		endpoint := newConcurrencyLimiter(name, args.Endpoints[name])
+		if endpoint == nil && global == nil {
+			return next
+		}
+		shed := func(w http.ResponseWriter, reason string, cause error) error {
+			loadShedRequests.With(prometheus.Labels{
+				endpointLabel:   name,
+				shedReasonLabel: reason,
+			}).Inc()
+			return RawError(
+				ServiceUnavailable().Retryable(w, args.RetryAfter),
+				fmt.Errorf("httpbp: request to %q shed: %w", name, cause),
+				PlainTextContentType,
+			)
+		}
+		return func(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+			releaseEndpoint, reason, err := endpoint.acquire(ctx, shedReasonEndpointLimit)
+			if err != nil {
+				if reason == "" {
+					return err
+				}
+				return shed(w, reason, err)
+			}
+			releaseGlobal, reason, err := global.acquire(ctx, shedReasonGlobalLimit)
+			if err != nil {
+				releaseEndpoint(0)
+				if reason == "" {
+					return err
+				}
+				return shed(w, reason, err)
+			}
+
+			start := time.Now()
+			defer func() {
+				latency := time.Since(start)
+				releaseGlobal(latency)
+				releaseEndpoint(latency)
+			}()
+			return next(ctx, w, r)
+		}
+	}
+}
+
+var (
+	errConcurrencyLimit = fmt.Errorf("concurrency limit reached")
+	errQueueTimeout     = fmt.Errorf("timed out in queue")
+)
+
+// concurrencyLimiter limits the number of in-flight requests.
+//
+// A nil *concurrencyLimiter does not limit anything.
+type concurrencyLimiter struct {
+	cfg      ConcurrencyLimitConfig
+	inFlight prometheus.Gauge
+	queued   prometheus.Gauge
+	limitG   prometheus.Gauge
+
+	lock    sync.Mutex
+	limit   float64
+	active  int
+	waiters *list.List
+
+	// The adaptive limit state.
+	samples     int
+	sum         time.Duration
+	maxActive   int
+	longLatency float64
+}
+
+func newConcurrencyLimiter(endpoint string, cfg ConcurrencyLimitConfig) *concurrencyLimiter {
+	if cfg.MaxInFlight <= 0 {
+		return nil
+	}
+	if cfg.QueueTimeout <= 0 {
+		cfg.QueueTimeout = DefaultLoadShedQueueTimeout
+	}
+	if cfg.MinInFlight <= 0 {
+		cfg.MinInFlight = 1
+	}
+	if cfg.MinInFlight > cfg.MaxInFlight {
+		cfg.MinInFlight = cfg.MaxInFlight
+	}
+	if cfg.Tolerance <= 1 {
+		cfg.Tolerance = DefaultAdaptiveTolerance
+	}
+	if cfg.Window <= 0 {
+		cfg.Window = DefaultAdaptiveWindow
+	}
+	labels := prometheus.Labels{endpointLabel: endpoint}
+	l := &concurrencyLimiter{
+		cfg:      cfg,
+		inFlight: loadShedInFlight.With(labels),
+		queued:   loadShedQueued.With(labels),
+		limitG:   loadShedLimit.With(labels),
+		limit:    float64(cfg.MaxInFlight),
+		waiters:  list.New(),
+	}
+	l.limitG.Set(l.limit)
+	return l
+}
+
+// acquire takes an in-flight slot, waiting in the queue if needed.
+//
+// When it fails, it returns the shed reason along with the error,
+// or an empty reason if the context is canceled while waiting.
+// The returned release function must be called with the latency of the
+// request when it's done.
+func (l *concurrencyLimiter) acquire(ctx context.Context, limitReason string) (release func(time.Duration), reason string, err error) {
+	if l == nil {
+		return func(time.Duration) {}, "", nil
+	}
+
+	l.lock.Lock()
+	if l.active < int(l.limit) && l.waiters.Len() == 0 {
+		l.admit()
+		l.lock.Unlock()
+		return l.release, "", nil
+	}
+	if l.waiters.Len() >= l.cfg.MaxQueue {
+		l.lock.Unlock()
+		return nil, limitReason, errConcurrencyLimit
+	}
+	ready := make(chan struct{})
+	elem := l.waiters.PushBack(ready)
+	l.queued.Inc()
+	l.lock.Unlock()
+
+	timer := time.NewTimer(l.cfg.QueueTimeout)
+	defer timer.Stop()
+	select {
+	case <-ready:
+		return l.release, "", nil
+	case <-timer.C:
+		reason, err = shedReasonQueueTimeout, errQueueTimeout
+	case <-ctx.Done():
+		reason, err = "", ctx.Err()
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	select {
+	case <-ready:
+		// Admitted in the meantime.
+		return l.release, "", nil
+	default:
+	}
+	l.waiters.Remove(elem)
+	l.queued.Dec()
+	return nil, reason, err
+}
+
+// admit must be called with the lock held.
+func (l *concurrencyLimiter) admit() {
+	l.active++
+	l.inFlight.Inc()
+	if l.active > l.maxActive {
+		l.maxActive = l.active
+	}
+}
+
+func (l *concurrencyLimiter) release(latency time.Duration) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.active--
+	l.inFlight.Dec()
+	if l.cfg.Adaptive && latency > 0 {
+		l.observe(latency)
+	}
+	for l.waiters.Len() > 0 && l.active < int(l.limit) {
+		ready := l.waiters.Remove(l.waiters.Front()).(chan struct{})
+		l.queued.Dec()
+		l.admit()
+		close(ready)
+	}
+}
+
+// observe adjusts the adaptive limit with a simplified gradient algorithm.
+//
+// It must be called with the lock held.
+func (l *concurrencyLimiter) observe(latency time.Duration) {
+	l.samples++
+	l.sum += latency
+	if l.samples < l.cfg.Window {
+		return
+	}
+	shortLatency := float64(l.sum) / float64(l.samples)
+	appLimited := float64(l.maxActive) < l.limit/2
+	l.samples, l.sum, l.maxActive = 0, 0, l.active
+
+	if l.longLatency == 0 {
+		l.longLatency = shortLatency
+		return
+	}
+	l.longLatency += (shortLatency - l.longLatency) / adaptiveLongWindows
+
+	gradient := math.Max(0.5, math.Min(1, l.cfg.Tolerance*l.longLatency/shortLatency))
+	newLimit := l.limit*gradient + math.Sqrt(l.limit)
+	if appLimited {
+		// Don't grow the limit when it's not used.
+		newLimit = math.Min(newLimit, l.limit)
+	}
+	l.limit = l.limit*(1-adaptiveSmoothing) + newLimit*adaptiveSmoothing
+	l.limit = math.Max(float64(l.cfg.MinInFlight), math.Min(float64(l.cfg.MaxInFlight), l.limit))
+	l.limitG.Set(math.Floor(l.limit))
+}
@@ -0,0 +1,266 @@
+package httpbp_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/reddit/baseplate.go/httpbp"
+	"github.com/reddit/baseplate.go/prometheusbp/promtest"
+)
+
+// blockingHandler returns a handler blocking until release is closed,
+// and a channel receiving a value whenever a request starts.
+func blockingHandler() (handle httpbp.HandlerFunc, started <-chan struct{}, release chan struct{}) {
+	startedCh := make(chan struct{}, 10)
+	release = make(chan struct{})
+	handle = func(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+		startedCh <- struct{}{}
+		<-release
+		return nil
+	}
+	return handle, startedCh, release
+}
+
+func callLoadShed(handle httpbp.HandlerFunc) (*httptest.ResponseRecorder, error) {
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	w := httptest.NewRecorder()
+	return w, handle(r.Context(), w, r)
+}
+
+func checkShed(t *testing.T, w *httptest.ResponseRecorder, err error) {
+	t.Helper()
+
+	var httpErr httpbp.HTTPError
+	if !errors.As(err, &httpErr) {
+		t.Fatalf("Expected an HTTPError, got %v", err)
+	}
+	if code := httpErr.Response().Code; code != http.StatusServiceUnavailable {
+		t.Errorf("Expected code %d, got %d", http.StatusServiceUnavailable, code)
+	}
+	if retryAfter := w.Header().Get(httpbp.RetryAfterHeader); retryAfter != "2" {
+		t.Errorf("Expected Retry-After %q, got %q", "2", retryAfter)
+	}
+}
+
+func TestLoadShed(t *testing.T) {
+	t.Parallel()
+
+	t.Run("endpoint-limit", func(t *testing.T) {
+		t.Parallel()
+
+		const name = "load-shed-endpoint"
+		shed := promtest.NewGatheredMetricTest(t, "httpbp_server_shed_requests_total", prometheus.Labels{
+			"http_endpoint": name,
+			"shed_reason":   "endpoint_limit",
+		})
+
+		handle, started, release := blockingHandler()
+		handle = httpbp.Wrap(name, handle, httpbp.LoadShed(httpbp.LoadShedArgs{
+			Endpoints: map[string]httpbp.ConcurrencyLimitConfig{
+				name: {MaxInFlight: 1},
+			},
+			RetryAfter: 2 * time.Second,
+		}))
+
+		done := make(chan error, 1)
+		go func() {
+			_, err := callLoadShed(handle)
+			done <- err
+		}()
+		<-started
+		promtest.NewGatheredMetricTest(t, "httpbp_server_concurrency_in_flight", prometheus.Labels{"http_endpoint": name}).CheckValue(1)
+
+		w, err := callLoadShed(handle)
+		checkShed(t, w, err)
+		shed.CheckDelta(1)
+
+		close(release)
+		if err := <-done; err != nil {
+			t.Fatal(err)
+		}
+		if _, err := callLoadShed(handle); err != nil {
+			t.Errorf("Expected the request to be admitted after release, got %v", err)
+		}
+	})
+
+	t.Run("queue", func(t *testing.T) {
+		t.Parallel()
+
+		const name = "load-shed-queue"
+		handle, started, release := blockingHandler()
+		handle = httpbp.Wrap(name, handle, httpbp.LoadShed(httpbp.LoadShedArgs{
+			Endpoints: map[string]httpbp.ConcurrencyLimitConfig{
+				name: {
+					MaxInFlight:  1,
+					MaxQueue:     1,
+					QueueTimeout: 10 * time.Second,
+				},
+			},
+			RetryAfter: 2 * time.Second,
+		}))
+
+		done := make(chan error, 2)
+		for i := 0; i < 2; i++ {
+			go func() {
+				_, err := callLoadShed(handle)
+				done <- err
+			}()
+		}
+		<-started
+		queued := promtest.NewGatheredMetricTest(t, "httpbp_server_concurrency_queued", prometheus.Labels{"http_endpoint": name})
+		for queued.Value() != 1 {
+			time.Sleep(time.Millisecond)
+		}
+
+		// The queue is full.
+		w, err := callLoadShed(handle)
+		checkShed(t, w, err)
+
+		close(release)
+		for i := 0; i < 2; i++ {
+			if err := <-done; err != nil {
+				t.Errorf("Expected the queued request to be admitted, got %v", err)
+			}
+		}
+	})
+
+	t.Run("queue-timeout", func(t *testing.T) {
+		t.Parallel()
+
+		const name = "load-shed-queue-timeout"
+		shed := promtest.NewGatheredMetricTest(t, "httpbp_server_shed_requests_total", prometheus.Labels{
+			"http_endpoint": name,
+			"shed_reason":   "queue_timeout",
+		})
+
+		handle, started, release := blockingHandler()
+		defer close(release)
+		handle = httpbp.Wrap(name, handle, httpbp.LoadShed(httpbp.LoadShedArgs{
+			Endpoints: map[string]httpbp.ConcurrencyLimitConfig{
+				name: {
+					MaxInFlight:  1,
+					MaxQueue:     1,
+					QueueTimeout: 10 * time.Millisecond,
+				},
+			},
+			RetryAfter: 2 * time.Second,
+		}))
+
+		go callLoadShed(handle)
+		<-started
+
+		w, err := callLoadShed(handle)
+		checkShed(t, w, err)
+		shed.CheckDelta(1)
+		promtest.NewGatheredMetricTest(t, "httpbp_server_concurrency_queued", prometheus.Labels{"http_endpoint": name}).CheckValue(0)
+	})
+
+	t.Run("global-limit", func(t *testing.T) {
+		t.Parallel()
+
+		const (
+			name1 = "load-shed-global-1"
+			name2 = "load-shed-global-2"
+		)
+		shed := promtest.NewGatheredMetricTest(t, "httpbp_server_shed_requests_total", prometheus.Labels{
+			"http_endpoint": name2,
+			"shed_reason":   "global_limit",
+		})
+
+		mw := httpbp.LoadShed(httpbp.LoadShedArgs{
+			Global:     httpbp.ConcurrencyLimitConfig{MaxInFlight: 1},
+			RetryAfter: 2 * time.Second,
+		})
+		handle, started, release := blockingHandler()
+		defer close(release)
+		handle1 := httpbp.Wrap(name1, handle, mw)
+		handle2 := httpbp.Wrap(name2, handle, mw)
+
+		go callLoadShed(handle1)
+		<-started
+
+		w, err := callLoadShed(handle2)
+		checkShed(t, w, err)
+		shed.CheckDelta(1)
+	})
+
+	t.Run("canceled", func(t *testing.T) {
+		t.Parallel()
+
+		const name = "load-shed-canceled"
+		handle, started, release := blockingHandler()
+		defer close(release)
+		handle = httpbp.Wrap(name, handle, httpbp.LoadShed(httpbp.LoadShedArgs{
+			Endpoints: map[string]httpbp.ConcurrencyLimitConfig{
+				name: {
+					MaxInFlight:  1,
+					MaxQueue:     1,
+					QueueTimeout: 10 * time.Second,
+				},
+			},
+		}))
+
+		go callLoadShed(handle)
+		<-started
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		if err := handle(ctx, httptest.NewRecorder(), r); !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("Expected %v, got %v", context.DeadlineExceeded, err)
+		}
+	})
+}
+
+func TestLoadShedAdaptive(t *testing.T) {
+	t.Parallel()
+
+	const (
+		name = "load-shed-adaptive"
+		max  = 100
+	)
+	var slow bool
+	handle := httpbp.Wrap(
+		name,
+		func(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+			if slow {
+				time.Sleep(5 * time.Millisecond)
+			}
+			return nil
+		},
+		httpbp.LoadShed(httpbp.LoadShedArgs{
+			Endpoints: map[string]httpbp.ConcurrencyLimitConfig{
+				name: {
+					MaxInFlight: max,
+					Adaptive:    true,
+					Window:      10,
+				},
+			},
+		}),
+	)
+	limit := promtest.NewGatheredMetricTest(t, "httpbp_server_concurrency_limit", prometheus.Labels{"http_endpoint": name})
+
+	// The first windows establish the baseline latency.
+	for i := 0; i < 20; i++ {
+		if _, err := callLoadShed(handle); err != nil {
+			t.Fatal(err)
+		}
+	}
+	limit.CheckValue(max)
+
+	slow = true
+	for i := 0; i < 50; i++ {
+		if _, err := callLoadShed(handle); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if v := limit.Value(); v >= max {
+		t.Errorf("Expected limit to be lowered under %d with increased latency, got %v", max, v)
+	}
+}
@@ -67,17 +67,21 @@ type DefaultMiddlewareArgs struct {
 // DefaultMiddleware returns a slice of all the default Middleware for a
 // Baseplate HTTP server. The default middleware are (in order):
 //
-//	1. InjectServerSpan
-//	2. InjectEdgeRequestContext
-//	3. RecordStatusCode
-//  4. PrometheusServerMetrics
+//	1. ExtractDeadlineBudget
+//	2. InjectServerSpan
+//	3. InjectEdgeRequestContext
+//	4. AbandonCanceledRequests
+//	5. RecordStatusCode
+//	6. PrometheusServerMetrics
 func DefaultMiddleware(args DefaultMiddlewareArgs) []Middleware {
 	if args.TrustHandler == nil {
 		args.TrustHandler = NeverTrustHeaders{}
 	}
 	return []Middleware{
+		ExtractDeadlineBudget,
 		InjectServerSpan(args.TrustHandler),
 		InjectEdgeRequestContext(InjectEdgeRequestContextArgs(args)),
+		AbandonCanceledRequests,
 		RecordStatusCode(),
 		PrometheusServerMetrics(""),
 	}
@@ -152,6 +156,9 @@ func InjectServerSpan(truster HeaderTrustHandler) Middleware {
 	return func(name string, next HandlerFunc) HandlerFunc {
 		return func(ctx context.Context, w http.ResponseWriter, r *http.Request) (err error) {
 			ctx, span := StartSpanFromTrustedRequest(ctx, name, truster, r)
+			if template, ok := RouteTemplate(ctx); ok {
+				span.SetTag(RouteTag, template)
+			}
 			defer func() {
 				span.FinishWithOptions(tracing.FinishOptions{
 					Ctx: ctx,
@@ -236,6 +243,50 @@ func InjectEdgeRequestContext(args InjectEdgeRequestContextArgs) Middleware {
 	}
 }
 
+// ExtractDeadlineBudget is the server middleware implementing Phase 1 of
+// Baseplate deadline propagation.
+//
+// It sets the timeout of the context passed to the next HandlerFunc from the
+// "Deadline-Budget" request header,
+// only if the passed in deadline is at least 1ms.
+//
+// ExtractDeadlineBudget should generally not be used directly, instead use the
+// NewBaseplateServer function which will automatically include
+// ExtractDeadlineBudget as one of the Middlewares to wrap your handlers in.
+func ExtractDeadlineBudget(name string, next HandlerFunc) HandlerFunc {
+	return func(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+		if s := r.Header.Get(DeadlineBudgetHeader); s != "" {
+			v, err := strconv.ParseInt(s, 10, 64)
+			if err == nil && v >= 1 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, time.Millisecond*time.Duration(v))
+				defer cancel()
+			}
+		}
+		return next(ctx, w, r)
+	}
+}
+
+// AbandonCanceledRequests transforms context.Canceled errors into
+// ErrAbandonRequest errors, when the request was canceled by the client
+// closing the connection.
+//
+// This helps the server to not try to write the error back to the client
+// that's no longer there.
+//
+// AbandonCanceledRequests should generally not be used directly, instead use
+// the NewBaseplateServer function which will automatically include
+// AbandonCanceledRequests as one of the Middlewares to wrap your handlers in.
+func AbandonCanceledRequests(name string, next HandlerFunc) HandlerFunc {
+	return func(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+		err := next(ctx, w, r)
+		if errors.Is(err, context.Canceled) && r.Context().Err() != nil {
+			return fmt.Errorf("%w: %v", ErrAbandonRequest, err)
+		}
+		return err
+	}
+}
+
 // SupportedMethods returns a middleware that checks if the request is made
 // using one of the given HTTP methods.
 //
@@ -330,6 +381,13 @@ func (r *statusCodeRecorder) WriteHeader(code int) {
 	}
 }
 
+// Flush implements http.Flusher.
+func (r *statusCodeRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
 func (r *statusCodeRecorder) getCode(err error) int {
 	return errorCodeForMetrics(r.code, err)
 }
@@ -508,3 +566,10 @@ func (rr *responseRecorder) WriteHeader(code int) {
 	rr.ResponseWriter.WriteHeader(code)
 	rr.responseCode = code
 }
+
+// Flush implements http.Flusher.
+func (rr *responseRecorder) Flush() {
+	if f, ok := rr.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
@@ -9,6 +9,7 @@ import (
 	"sort"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/reddit/baseplate.go/ecinterface"
 	"github.com/reddit/baseplate.go/httpbp"
@@ -323,3 +324,137 @@ func TestSupportedMethods(t *testing.T) {
 		)
 	}
 }
+
+func TestExtractDeadlineBudget(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name     string
+		header   string
+		expected time.Duration
+	}{
+		{
+			name: "no-header",
+		},
+		{
+			name:   "invalid",
+			header: "foo",
+		},
+		{
+			name:   "zero",
+			header: "0",
+		},
+		{
+			name:     "valid",
+			header:   "5000",
+			expected: time.Second * 5,
+		},
+	}
+	for _, _c := range cases {
+		c := _c
+		t.Run(c.name, func(t *testing.T) {
+			t.Parallel()
+
+			req := newRequest(t, "")
+			if c.header != "" {
+				req.Header.Set(httpbp.DeadlineBudgetHeader, c.header)
+			}
+			var deadline time.Time
+			var ok bool
+			handle := httpbp.Wrap(
+				"test",
+				func(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+					deadline, ok = ctx.Deadline()
+					return nil
+				},
+				httpbp.ExtractDeadlineBudget,
+			)
+			handle(req.Context(), httptest.NewRecorder(), req)
+
+			if c.expected == 0 {
+				if ok {
+					t.Errorf("Expected no deadline, got %v", deadline)
+				}
+				return
+			}
+			if !ok {
+				t.Fatal("Expected deadline to be set")
+			}
+			if timeout := time.Until(deadline); timeout > c.expected || timeout < c.expected-time.Second {
+				t.Errorf("Expected timeout to be about %v, got %v", c.expected, timeout)
+			}
+		})
+	}
+}
+
+func TestAbandonCanceledRequests(t *testing.T) {
+	t.Parallel()
+
+	canceled := func() context.Context {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		return ctx
+	}
+
+	cases := []struct {
+		name     string
+		ctx      context.Context
+		err      error
+		abandon  bool
+		expected int
+	}{
+		{
+			name:     "not-canceled",
+			ctx:      context.Background(),
+			err:      context.Canceled,
+			expected: http.StatusInternalServerError,
+		},
+		{
+			name:    "canceled",
+			ctx:     canceled(),
+			err:     context.Canceled,
+			abandon: true,
+		},
+		{
+			name:     "other-error",
+			ctx:      canceled(),
+			err:      errors.New("foo"),
+			expected: http.StatusInternalServerError,
+		},
+	}
+	for _, _c := range cases {
+		c := _c
+		t.Run(c.name, func(t *testing.T) {
+			t.Parallel()
+
+			req := newRequest(t, "").WithContext(c.ctx)
+			w := httptest.NewRecorder()
+			var err error
+			handler := httpbp.NewHandler(
+				"test",
+				newTestHandler(testHandlerPlan{err: c.err}),
+				func(name string, next httpbp.HandlerFunc) httpbp.HandlerFunc {
+					return func(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+						err = next(ctx, w, r)
+						return err
+					}
+				},
+				httpbp.AbandonCanceledRequests,
+			)
+			handler.ServeHTTP(w, req)
+
+			if abandoned := errors.Is(err, httpbp.ErrAbandonRequest); abandoned != c.abandon {
+				t.Errorf("Expected abandoned to be %v, got error %v", c.abandon, err)
+			}
+			if c.abandon {
+				if w.Body.Len() != 0 {
+					t.Errorf("Expected no response written, got %q", w.Body.String())
+				}
+				return
+			}
+			if w.Code != c.expected {
+				t.Errorf("Expected code %d, got %d", c.expected, w.Code)
+			}
+		})
+	}
+}
@@ -0,0 +1,592 @@
+package httpbp
+
+import (
+	"context"
+	"encoding"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// OpenAPIVersion is the version of the OpenAPI specification the documents
+// generated by NewOpenAPIDocument conform to.
+const OpenAPIVersion = "3.0.3"
+
+// DefaultOpenAPIPath is the default OpenAPIConfig.Path.
+const DefaultOpenAPIPath = "/openapi.json"
+
+// The media type of the request and response bodies in the OpenAPI document.
+const openAPIJSONMediaType = "application/json"
+
+// ParameterLocation is the location of a request parameter.
+type ParameterLocation string
+
+// ParameterLocation values.
+const (
+	ParameterInPath   ParameterLocation = "path"
+	ParameterInQuery  ParameterLocation = "query"
+	ParameterInHeader ParameterLocation = "header"
+	ParameterInCookie ParameterLocation = "cookie"
+)
+
+// ParameterDoc documents a request parameter of an Endpoint.
+type ParameterDoc struct {
+	// The name of the parameter, required.
+	Name string
+
+	// Where the parameter is, required.
+	In ParameterLocation
+
+	// Optional, human readable description of the parameter.
+	Description string
+
+	// Whether the parameter is required.
+	//
+	// Path parameters are always required.
+	Required bool
+
+	// A value of the type of the parameter, e.g. int64(0).
+	//
+	// Optional. Default to string.
+	Type interface{}
+}
+
+// EndpointDoc is the optional documentation of an Endpoint,
+// used to generate the OpenAPI document.
+type EndpointDoc struct {
+	// Optional, short summary and longer description of the endpoint.
+	Summary     string
+	Description string
+
+	// Optional tags to group the endpoints.
+	Tags []string
+
+	// Whether the endpoint is deprecated.
+	Deprecated bool
+
+	// A value of the type of the JSON request body, e.g. MyRequest{}.
+	//
+	// Optional. If nil, the endpoint is documented as having no request body.
+	Request interface{}
+
+	// A value of the type of the JSON response body, e.g. MyResponse{}.
+	//
+	// Optional. If nil, the endpoint is documented as having no response body.
+	Response interface{}
+
+	// The status code of the successful response.
+	//
+	// Optional. Default to http.StatusOK.
+	ResponseCode int
+
+	// The request parameters.
+	//
+	// Path parameters in the Pattern that are not listed are documented as
+	// strings automatically.
+	Parameters []ParameterDoc
+
+	// The error responses the endpoint could return, e.g. BadRequest().
+	//
+	// They are documented as returned by JSONError.
+	Errors []*ErrorResponse
+}
+
+// OpenAPIDocument is an OpenAPI 3 document.
+//
+// It's generated by NewOpenAPIDocument and is meant to be serialized into
+// JSON.
+type OpenAPIDocument struct {
+	OpenAPI    string                                  `json:"openapi"`
+	Info       OpenAPIInfo                             `json:"info"`
+	Paths      map[string]map[string]*OpenAPIOperation `json:"paths"`
+	Components OpenAPIComponents                       `json:"components"`
+}
+
+// OpenAPIInfo is the metadata of the OpenAPI document.
+//
+// Can be deserialized from YAML.
+type OpenAPIInfo struct {
+	Title       string `json:"title" yaml:"title"`
+	Description string `json:"description,omitempty" yaml:"description"`
+	Version     string `json:"version" yaml:"version"`
+}
+
+// OpenAPIComponents holds the reusable schemas of the OpenAPI document.
+type OpenAPIComponents struct {
+	Schemas map[string]*OpenAPISchema `json:"schemas,omitempty"`
+}
+
+// OpenAPIOperation documents a single method of a path.
+type OpenAPIOperation struct {
+	OperationID string                      `json:"operationId,omitempty"`
+	Summary     string                      `json:"summary,omitempty"`
+	Description string                      `json:"description,omitempty"`
+	Tags        []string                    `json:"tags,omitempty"`
+	Deprecated  bool                        `json:"deprecated,omitempty"`
+	Parameters  []OpenAPIParameter          `json:"parameters,omitempty"`
+	RequestBody *OpenAPIRequestBody         `json:"requestBody,omitempty"`
+	Responses   map[string]*OpenAPIResponse `json:"responses"`
+}
+
+// OpenAPIParameter documents a request parameter.
+type OpenAPIParameter struct {
+	Name        string         `json:"name"`
+	In          string         `json:"in"`
+	Description string         `json:"description,omitempty"`
+	Required    bool           `json:"required,omitempty"`
+	Schema      *OpenAPISchema `json:"schema"`
+}
+
+// OpenAPIRequestBody documents a request body.
+type OpenAPIRequestBody struct {
+	Required bool                        `json:"required"`
+	Content  map[string]OpenAPIMediaType `json:"content"`
+}
+
+// OpenAPIResponse documents a response.
+type OpenAPIResponse struct {
+	Description string                      `json:"description"`
+	Content     map[string]OpenAPIMediaType `json:"content,omitempty"`
+}
+
+// OpenAPIMediaType documents the body of a media type.
+type OpenAPIMediaType struct {
+	Schema *OpenAPISchema `json:"schema"`
+}
+
+// OpenAPISchema is the subset of the OpenAPI schema object used by the
+// generated documents.
+type OpenAPISchema struct {
+	Ref                  string                    `json:"$ref,omitempty"`
+	Type                 string                    `json:"type,omitempty"`
+	Format               string                    `json:"format,omitempty"`
+	Nullable             bool                      `json:"nullable,omitempty"`
+	Items                *OpenAPISchema            `json:"items,omitempty"`
+	Properties           map[string]*OpenAPISchema `json:"properties,omitempty"`
+	AdditionalProperties *OpenAPISchema            `json:"additionalProperties,omitempty"`
+	Required             []string                  `json:"required,omitempty"`
+}
+
+// OpenAPIConfig is the configuration of the OpenAPI document served by the
+// server.
+//
+// Can be deserialized from YAML.
+type OpenAPIConfig struct {
+	// The path to serve the OpenAPI document at.
+	//
+	// Optional. Default to DefaultOpenAPIPath.
+	Path string `yaml:"path"`
+
+	// The metadata of the document.
+	Info OpenAPIInfo `yaml:"info"`
+}
+
+// NewOpenAPIDocument generates an OpenAPI 3 document from the given endpoints.
+//
+// All the endpoints are included,
+// and EndpointDoc is used to document the request and response bodies,
+// parameters and errors.
+// The named struct types used in the request and response bodies are
+// registered as reusable schemas in the components, by their type names.
+// The JSON field names and "omitempty" options are respected.
+//
+// The generated document is deterministic, so it can be compared against a
+// previously generated one to detect changes,
+// see httpbptest.CheckOpenAPIDocument.
+//
+// The errors are documented as JSON, as written by JSONError.
+// Use NewNegotiatedOpenAPIDocument instead for servers with
+// ServerArgs.NegotiateErrors.
+func NewOpenAPIDocument(info OpenAPIInfo, endpoints map[Pattern]Endpoint) (*OpenAPIDocument, error) {
+	return newOpenAPIDocument(info, endpoints, []string{jsonMediaType})
+}
+
+// NewNegotiatedOpenAPIDocument is NewOpenAPIDocument for servers with
+// ServerArgs.NegotiateErrors,
+// documenting the errors with all the content types NegotiateError can choose
+// from with the given templates:
+// JSON, problem details, and HTML when templates is non-nil.
+//
+// NewBaseplateServer uses it to serve the document when
+// ServerArgs.NegotiateErrors is true.
+func NewNegotiatedOpenAPIDocument(info OpenAPIInfo, endpoints map[Pattern]Endpoint, templates *template.Template) (*OpenAPIDocument, error) {
+	return newOpenAPIDocument(info, endpoints, negotiatedErrorMediaTypes(templates))
+}
+
+func newOpenAPIDocument(info OpenAPIInfo, endpoints map[Pattern]Endpoint, errorMediaTypes []string) (*OpenAPIDocument, error) {
+	g := newSchemaGenerator()
+	g.errorMediaTypes = errorMediaTypes
+	doc := &OpenAPIDocument{
+		OpenAPI: OpenAPIVersion,
+		Info:    info,
+		Paths:   make(map[string]map[string]*OpenAPIOperation),
+	}
+
+	patterns := make([]string, 0, len(endpoints))
+	for pattern := range endpoints {
+		patterns = append(patterns, string(pattern))
+	}
+	sort.Strings(patterns)
+
+	// Count the operations by names to make sure the operation ids are unique.
+	names := make(map[string]int)
+	type namedOperation struct {
+		name      string
+		method    string
+		operation *OpenAPIOperation
+	}
+	var operations []namedOperation
+
+	for _, pattern := range patterns {
+		endpoint, err := endpoints[Pattern(pattern)].withPatternDefaults(Pattern(pattern))
+		if err != nil {
+			return nil, err
+		}
+		_, path := parsePattern(pattern)
+		methods := make([]string, 0, len(endpoint.Methods))
+		for _, method := range endpoint.Methods {
+			if method != http.MethodHead {
+				methods = append(methods, method)
+			}
+		}
+		for _, method := range methods {
+			operation, err := g.operation(path, method, endpoint.Doc)
+			if err != nil {
+				return nil, fmt.Errorf("httpbp: failed to generate the OpenAPI document of %q: %w", pattern, err)
+			}
+			if doc.Paths[path] == nil {
+				doc.Paths[path] = make(map[string]*OpenAPIOperation)
+			}
+			doc.Paths[path][strings.ToLower(method)] = operation
+			names[endpoint.Name]++
+			operations = append(operations, namedOperation{
+				name:      endpoint.Name,
+				method:    method,
+				operation: operation,
+			})
+		}
+	}
+	for _, op := range operations {
+		op.operation.OperationID = op.name
+		if names[op.name] > 1 {
+			op.operation.OperationID = op.name + "_" + strings.ToLower(op.method)
+		}
+	}
+
+	doc.Components.Schemas = g.schemas
+	return doc, nil
+}
+
+// schemaGenerator generates OpenAPISchemas from go types, registering the
+// named struct types in the components.
+type schemaGenerator struct {
+	schemas map[string]*OpenAPISchema
+	names   map[reflect.Type]string
+
+	// The media types the errors are documented with.
+	errorMediaTypes []string
+}
+
+func newSchemaGenerator() *schemaGenerator {
+	return &schemaGenerator{
+		schemas: make(map[string]*OpenAPISchema),
+		names:   make(map[reflect.Type]string),
+	}
+}
+
+var (
+	timeType          = reflect.TypeOf(time.Time{})
+	textMarshalerType = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+	jsonMarshalerType = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+)
+
+func (g *schemaGenerator) operation(path, method string, doc *EndpointDoc) (*OpenAPIOperation, error) {
+	if doc == nil {
+		doc = &EndpointDoc{}
+	}
+	op := &OpenAPIOperation{
+		Summary:     doc.Summary,
+		Description: doc.Description,
+		Tags:        doc.Tags,
+		Deprecated:  doc.Deprecated,
+		Responses:   make(map[string]*OpenAPIResponse),
+	}
+
+	declared := make(map[string]bool)
+	for _, p := range doc.Parameters {
+		schema := &OpenAPISchema{Type: "string"}
+		if p.Type != nil {
+			var err error
+			schema, err = g.schema(reflect.TypeOf(p.Type))
+			if err != nil {
+				return nil, fmt.Errorf("parameter %q: %w", p.Name, err)
+			}
+		}
+		if p.In == ParameterInPath {
+			declared[p.Name] = true
+		}
+		op.Parameters = append(op.Parameters, OpenAPIParameter{
+			Name:        p.Name,
+			In:          string(p.In),
+			Description: p.Description,
+			Required:    p.Required || p.In == ParameterInPath,
+			Schema:      schema,
+		})
+	}
+	for _, segment := range strings.Split(path, "/") {
+		if !isParamSegment(segment) {
+			continue
+		}
+		name := segment[1 : len(segment)-1]
+		if !declared[name] {
+			op.Parameters = append(op.Parameters, OpenAPIParameter{
+				Name:     name,
+				In:       string(ParameterInPath),
+				Required: true,
+				Schema:   &OpenAPISchema{Type: "string"},
+			})
+		}
+	}
+
+	if doc.Request != nil {
+		schema, err := g.schema(reflect.TypeOf(doc.Request))
+		if err != nil {
+			return nil, fmt.Errorf("request: %w", err)
+		}
+		op.RequestBody = &OpenAPIRequestBody{
+			Required: true,
+			Content: map[string]OpenAPIMediaType{
+				openAPIJSONMediaType: {Schema: schema},
+			},
+		}
+	}
+
+	code := doc.ResponseCode
+	if code == 0 {
+		code = http.StatusOK
+	}
+	resp := &OpenAPIResponse{Description: http.StatusText(code)}
+	if doc.Response != nil {
+		schema, err := g.schema(reflect.TypeOf(doc.Response))
+		if err != nil {
+			return nil, fmt.Errorf("response: %w", err)
+		}
+		resp.Content = map[string]OpenAPIMediaType{
+			openAPIJSONMediaType: {Schema: schema},
+		}
+	}
+	op.Responses[strconv.Itoa(code)] = resp
+
+	if len(doc.Errors) > 0 {
+		content, err := g.errorContent()
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range doc.Errors {
+			key := strconv.Itoa(e.code)
+			description := e.Reason + ": " + e.Explanation
+			if existing, ok := op.Responses[key]; ok {
+				existing.Description += "\n" + description
+				continue
+			}
+			op.Responses[key] = &OpenAPIResponse{
+				Description: description,
+				Content:     content,
+			}
+		}
+	}
+	return op, nil
+}
+
+// errorContent returns the content of the error responses,
+// with the schemas of the formats written by JSONError, ProblemError and
+// HTMLError.
+func (g *schemaGenerator) errorContent() (map[string]OpenAPIMediaType, error) {
+	content := make(map[string]OpenAPIMediaType, len(g.errorMediaTypes))
+	for _, mediaType := range g.errorMediaTypes {
+		switch mediaType {
+		case jsonMediaType:
+			schema, err := g.schema(reflect.TypeOf(ErrorResponseJSONWrapper{}))
+			if err != nil {
+				return nil, err
+			}
+			content[mediaType] = OpenAPIMediaType{Schema: schema}
+		case problemMediaType:
+			schema, err := g.schema(reflect.TypeOf(ProblemDetails{}))
+			if err != nil {
+				return nil, err
+			}
+			content[mediaType] = OpenAPIMediaType{Schema: schema}
+		case htmlMediaType:
+			content[mediaType] = OpenAPIMediaType{Schema: &OpenAPISchema{Type: "string"}}
+		}
+	}
+	return content, nil
+}
+
+// schema returns the schema of the given type,
+// which is a reference for named struct types.
+func (g *schemaGenerator) schema(t reflect.Type) (*OpenAPISchema, error) {
+	if t.Kind() == reflect.Ptr {
+		schema, err := g.schema(t.Elem())
+		if err != nil {
+			return nil, err
+		}
+		if schema.Ref != "" {
+			// Siblings of $ref are ignored, so nullable can't be set on it.
+			return schema, nil
+		}
+		schema.Nullable = true
+		return schema, nil
+	}
+
+	switch {
+	case t == timeType:
+		return &OpenAPISchema{Type: "string", Format: "date-time"}, nil
+	case t.Implements(jsonMarshalerType):
+		// The JSON format is unknown.
+		return &OpenAPISchema{}, nil
+	case t.Implements(textMarshalerType):
+		return &OpenAPISchema{Type: "string"}, nil
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		return &OpenAPISchema{Type: "boolean"}, nil
+	case reflect.Int8, reflect.Int16, reflect.Int32, reflect.Uint8, reflect.Uint16:
+		return &OpenAPISchema{Type: "integer", Format: "int32"}, nil
+	case reflect.Int, reflect.Int64, reflect.Uint, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return &OpenAPISchema{Type: "integer", Format: "int64"}, nil
+	case reflect.Float32:
+		return &OpenAPISchema{Type: "number", Format: "float"}, nil
+	case reflect.Float64:
+		return &OpenAPISchema{Type: "number", Format: "double"}, nil
+	case reflect.String:
+		return &OpenAPISchema{Type: "string"}, nil
+	case reflect.Interface:
+		return &OpenAPISchema{}, nil
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			// Encoded as base64 strings by encoding/json.
+			return &OpenAPISchema{Type: "string", Format: "byte"}, nil
+		}
+		items, err := g.schema(t.Elem())
+		if err != nil {
+			return nil, err
+		}
+		return &OpenAPISchema{Type: "array", Items: items}, nil
+	case reflect.Map:
+		values, err := g.schema(t.Elem())
+		if err != nil {
+			return nil, err
+		}
+		return &OpenAPISchema{Type: "object", AdditionalProperties: values}, nil
+	case reflect.Struct:
+		if t.Name() == "" {
+			return g.structSchema(t)
+		}
+		return g.ref(t)
+	}
+	return nil, fmt.Errorf("unsupported type %v", t)
+}
+
+// ref registers the named struct type in the components and returns a
+// reference to it.
+func (g *schemaGenerator) ref(t reflect.Type) (*OpenAPISchema, error) {
+	name, ok := g.names[t]
+	if !ok {
+		name = t.Name()
+		for i := 2; g.schemas[name] != nil; i++ {
+			name = t.Name() + strconv.Itoa(i)
+		}
+		g.names[t] = name
+		// Register a placeholder first to support recursive types.
+		placeholder := &OpenAPISchema{}
+		g.schemas[name] = placeholder
+		schema, err := g.structSchema(t)
+		if err != nil {
+			return nil, err
+		}
+		*placeholder = *schema
+	}
+	return &OpenAPISchema{Ref: "#/components/schemas/" + name}, nil
+}
+
+func (g *schemaGenerator) structSchema(t reflect.Type) (*OpenAPISchema, error) {
+	schema := &OpenAPISchema{
+		Type:       "object",
+		Properties: make(map[string]*OpenAPISchema),
+	}
+	if err := g.addFields(schema, t); err != nil {
+		return nil, err
+	}
+	sort.Strings(schema.Required)
+	return schema, nil
+}
+
+// addFields adds the JSON fields of the struct type t to the schema,
+// with the fields of embedded structs promoted.
+func (g *schemaGenerator) addFields(schema *OpenAPISchema, t reflect.Type) error {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := field.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, options := tag, ""
+		if idx := strings.Index(tag, ","); idx >= 0 {
+			name, options = tag[:idx], tag[idx+1:]
+		}
+
+		if field.Anonymous && name == "" {
+			ft := field.Type
+			if ft.Kind() == reflect.Ptr {
+				ft = ft.Elem()
+			}
+			if ft.Kind() == reflect.Struct {
+				if err := g.addFields(schema, ft); err != nil {
+					return err
+				}
+				continue
+			}
+		}
+		if field.PkgPath != "" {
+			// Unexported.
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+
+		fieldSchema, err := g.schema(field.Type)
+		if err != nil {
+			return fmt.Errorf("field %s.%s: %w", t.Name(), field.Name, err)
+		}
+		schema.Properties[name] = fieldSchema
+		if !strings.Contains(","+options+",", ",omitempty,") && field.Type.Kind() != reflect.Ptr {
+			schema.Required = append(schema.Required, name)
+		}
+	}
+	return nil
+}
+
+// openAPIEndpoint returns the Endpoint serving the OpenAPI document.
+func openAPIEndpoint(doc *OpenAPIDocument) (Endpoint, error) {
+	body, err := json.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return Endpoint{}, fmt.Errorf("httpbp: failed to serialize the OpenAPI document: %w", err)
+	}
+	return Endpoint{
+		Name:    "openapi",
+		Methods: []string{http.MethodGet},
+		Handle: func(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+			return WriteRawContent(w, Response{Body: body}, JSONContentType)
+		},
+	}, nil
+}
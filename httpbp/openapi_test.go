@@ -0,0 +1,375 @@
+package httpbp_test
+
+import (
+	"context"
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/reddit/baseplate.go"
+	"github.com/reddit/baseplate.go/ecinterface"
+	"github.com/reddit/baseplate.go/httpbp"
+)
+
+type openAPIBase struct {
+	ID string `json:"id"`
+}
+
+type openAPIUser struct {
+	openAPIBase
+
+	Name      string            `json:"name"`
+	Email     *string           `json:"email"`
+	Age       int32             `json:"age,omitempty"`
+	Tags      []string          `json:"tags,omitempty"`
+	Labels    map[string]string `json:"labels,omitempty"`
+	Friends   []*openAPIUser    `json:"friends,omitempty"`
+	CreatedAt time.Time         `json:"created_at"`
+	Avatar    []byte            `json:"avatar,omitempty"`
+	Internal  string            `json:"-"`
+
+	secret string
+}
+
+type openAPIUpdateUser struct {
+	Name string `json:"name"`
+}
+
+func openAPIEndpoints() map[httpbp.Pattern]httpbp.Endpoint {
+	handle := func(context.Context, http.ResponseWriter, *http.Request) error {
+		return nil
+	}
+	return map[httpbp.Pattern]httpbp.Endpoint{
+		"GET /v1/users/{id}": {
+			Name:   "get-user",
+			Handle: handle,
+			Doc: &httpbp.EndpointDoc{
+				Summary:  "Get a user.",
+				Tags:     []string{"users"},
+				Response: openAPIUser{},
+				Parameters: []httpbp.ParameterDoc{
+					{
+						Name:        "fields",
+						In:          httpbp.ParameterInQuery,
+						Description: "The fields to return.",
+					},
+					{
+						Name: "limit",
+						In:   httpbp.ParameterInQuery,
+						Type: 0,
+					},
+				},
+				Errors: []*httpbp.ErrorResponse{
+					httpbp.NotFound(),
+				},
+			},
+		},
+		"PUT /v1/users/{id}": {
+			Name:   "update-user",
+			Handle: handle,
+			Doc: &httpbp.EndpointDoc{
+				Request:      &openAPIUpdateUser{},
+				ResponseCode: http.StatusNoContent,
+				Errors: []*httpbp.ErrorResponse{
+					httpbp.BadRequest(),
+					httpbp.NotFound(),
+				},
+			},
+		},
+		"/health": {
+			Name:    "health",
+			Methods: []string{http.MethodGet, http.MethodPost},
+			Handle:  handle,
+		},
+	}
+}
+
+func TestNewOpenAPIDocument(t *testing.T) {
+	t.Parallel()
+
+	doc, err := httpbp.NewOpenAPIDocument(
+		httpbp.OpenAPIInfo{Title: "test", Version: "1.0.0"},
+		openAPIEndpoints(),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if doc.OpenAPI != httpbp.OpenAPIVersion {
+		t.Errorf("Expected openapi version %q, got %q", httpbp.OpenAPIVersion, doc.OpenAPI)
+	}
+
+	getUser := doc.Paths["/v1/users/{id}"]["get"]
+	if getUser == nil {
+		t.Fatalf("Expected the get-user operation, got paths %#v", doc.Paths)
+	}
+	if getUser.OperationID != "get-user" {
+		t.Errorf("Expected operation id %q, got %q", "get-user", getUser.OperationID)
+	}
+	expectedParams := []httpbp.OpenAPIParameter{
+		{
+			Name:        "fields",
+			In:          "query",
+			Description: "The fields to return.",
+			Schema:      &httpbp.OpenAPISchema{Type: "string"},
+		},
+		{
+			Name:   "limit",
+			In:     "query",
+			Schema: &httpbp.OpenAPISchema{Type: "integer", Format: "int64"},
+		},
+		{
+			Name:     "id",
+			In:       "path",
+			Required: true,
+			Schema:   &httpbp.OpenAPISchema{Type: "string"},
+		},
+	}
+	if !reflect.DeepEqual(getUser.Parameters, expectedParams) {
+		t.Errorf("Expected parameters %#v, got %#v", expectedParams, getUser.Parameters)
+	}
+	userRef := "#/components/schemas/openAPIUser"
+	if ref := getUser.Responses["200"].Content["application/json"].Schema.Ref; ref != userRef {
+		t.Errorf("Expected response schema %q, got %q", userRef, ref)
+	}
+	if resp := getUser.Responses["404"]; resp == nil || resp.Content["application/json"].Schema.Ref != "#/components/schemas/ErrorResponseJSONWrapper" {
+		t.Errorf("Expected 404 error response, got %#v", resp)
+	}
+
+	updateUser := doc.Paths["/v1/users/{id}"]["put"]
+	if updateUser == nil {
+		t.Fatalf("Expected the update-user operation, got paths %#v", doc.Paths)
+	}
+	if updateUser.RequestBody == nil || updateUser.RequestBody.Content["application/json"].Schema.Ref != "#/components/schemas/openAPIUpdateUser" {
+		t.Errorf("Expected request body of openAPIUpdateUser, got %#v", updateUser.RequestBody)
+	}
+	for _, code := range []string{"204", "400", "404"} {
+		if updateUser.Responses[code] == nil {
+			t.Errorf("Expected response %s, got %#v", code, updateUser.Responses)
+		}
+	}
+
+	for _, method := range []string{"get", "post"} {
+		op := doc.Paths["/health"][method]
+		if op == nil {
+			t.Errorf("Expected %s /health operation, got %#v", method, doc.Paths["/health"])
+			continue
+		}
+		if expected := "health_" + method; op.OperationID != expected {
+			t.Errorf("Expected operation id %q, got %q", expected, op.OperationID)
+		}
+	}
+	if _, ok := doc.Paths["/health"]["head"]; ok {
+		t.Error("Expected HEAD operation to be omitted")
+	}
+
+	user := doc.Components.Schemas["openAPIUser"]
+	if user == nil {
+		t.Fatalf("Expected openAPIUser schema, got %#v", doc.Components.Schemas)
+	}
+	expectedRequired := []string{"created_at", "id", "name"}
+	if !reflect.DeepEqual(user.Required, expectedRequired) {
+		t.Errorf("Expected required fields %q, got %q", expectedRequired, user.Required)
+	}
+	expectedProperties := map[string]*httpbp.OpenAPISchema{
+		"id":    {Type: "string"},
+		"name":  {Type: "string"},
+		"email": {Type: "string", Nullable: true},
+		"age":   {Type: "integer", Format: "int32"},
+		"tags": {
+			Type:  "array",
+			Items: &httpbp.OpenAPISchema{Type: "string"},
+		},
+		"labels": {
+			Type:                 "object",
+			AdditionalProperties: &httpbp.OpenAPISchema{Type: "string"},
+		},
+		"friends": {
+			Type:  "array",
+			Items: &httpbp.OpenAPISchema{Ref: userRef},
+		},
+		"created_at": {Type: "string", Format: "date-time"},
+		"avatar":     {Type: "string", Format: "byte"},
+	}
+	if !reflect.DeepEqual(user.Properties, expectedProperties) {
+		got, _ := json.Marshal(user.Properties)
+		t.Errorf("Unexpected openAPIUser properties: %s", got)
+	}
+}
+
+func TestNewOpenAPIDocumentUnsupportedType(t *testing.T) {
+	t.Parallel()
+
+	_, err := httpbp.NewOpenAPIDocument(httpbp.OpenAPIInfo{}, map[httpbp.Pattern]httpbp.Endpoint{
+		"POST /foo": {
+			Name: "foo",
+			Handle: func(context.Context, http.ResponseWriter, *http.Request) error {
+				return nil
+			},
+			Doc: &httpbp.EndpointDoc{
+				Request: struct {
+					C chan int `json:"c"`
+				}{},
+			},
+		},
+	})
+	if err == nil {
+		t.Error("Expected an error for unsupported types, got nil")
+	}
+}
+
+func TestNewNegotiatedOpenAPIDocument(t *testing.T) {
+	for _, c := range []struct {
+		label     string
+		templates *template.Template
+		expected  map[string]string
+	}{
+		{
+			label: "no-templates",
+			expected: map[string]string{
+				"application/json":            "#/components/schemas/ErrorResponseJSONWrapper",
+				httpbp.ProblemJSONContentType: "#/components/schemas/ProblemDetails",
+			},
+		},
+		{
+			label:     "templates",
+			templates: template.Must(template.New("error").Parse("{{.Reason}}")),
+			expected: map[string]string{
+				"application/json":            "#/components/schemas/ErrorResponseJSONWrapper",
+				httpbp.ProblemJSONContentType: "#/components/schemas/ProblemDetails",
+				"text/html":                   "",
+			},
+		},
+	} {
+		t.Run(c.label, func(t *testing.T) {
+			doc, err := httpbp.NewNegotiatedOpenAPIDocument(
+				httpbp.OpenAPIInfo{Title: "test", Version: "1.0.0"},
+				openAPIEndpoints(),
+				c.templates,
+			)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp := doc.Paths["/v1/users/{id}"]["get"].Responses["404"]
+			if resp == nil {
+				t.Fatal("Expected the 404 response to be documented")
+			}
+			if len(resp.Content) != len(c.expected) {
+				t.Errorf("Expected content types %v, got %v", c.expected, resp.Content)
+			}
+			for contentType, ref := range c.expected {
+				media, ok := resp.Content[contentType]
+				if !ok || media.Schema == nil {
+					t.Errorf("Expected content type %q to be documented, got %v", contentType, resp.Content)
+					continue
+				}
+				if media.Schema.Ref != ref {
+					t.Errorf("Expected the schema of %q to be %q, got %q", contentType, ref, media.Schema.Ref)
+				}
+			}
+			if _, ok := doc.Components.Schemas["ProblemDetails"]; !ok {
+				t.Error("Expected ProblemDetails to be registered in the components")
+			}
+			if resp := doc.Paths["/v1/users/{id}"]["get"].Responses["200"]; len(resp.Content) != 1 {
+				t.Errorf("Expected the success response to only be documented as JSON, got %v", resp.Content)
+			}
+		})
+	}
+}
+
+func TestServerArgsOpenAPI(t *testing.T) {
+	store := newSecretsStore(t)
+	defer store.Close()
+
+	bp := baseplate.NewTestBaseplate(baseplate.NewTestBaseplateArgs{
+		Config:          baseplate.Config{Addr: ":8080"},
+		Store:           store,
+		EdgeContextImpl: ecinterface.Mock(),
+	})
+
+	info := httpbp.OpenAPIInfo{Title: "test", Version: "1.0.0"}
+	args, err := httpbp.ServerArgs{
+		Baseplate:        bp,
+		EndpointRegistry: httpbp.NewRouter(),
+		Endpoints:        openAPIEndpoints(),
+		OpenAPI: &httpbp.OpenAPIConfig{
+			Info: info,
+		},
+	}.SetupEndpoints()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, httpbp.DefaultOpenAPIPath, nil)
+	w := httptest.NewRecorder()
+	args.EndpointRegistry.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected code %d, got %d", http.StatusOK, w.Code)
+	}
+	if contentType := w.Header().Get(httpbp.ContentTypeHeader); contentType != httpbp.JSONContentType {
+		t.Errorf("Expected content type %q, got %q", httpbp.JSONContentType, contentType)
+	}
+
+	var served httpbp.OpenAPIDocument
+	if err := json.Unmarshal(w.Body.Bytes(), &served); err != nil {
+		t.Fatal(err)
+	}
+	expected, err := httpbp.NewOpenAPIDocument(info, openAPIEndpoints())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(&served, expected) {
+		t.Errorf("Expected served document %#v, got %#v", expected, served)
+	}
+	if _, ok := served.Paths[httpbp.DefaultOpenAPIPath]; ok {
+		t.Error("Expected the OpenAPI endpoint to not be documented")
+	}
+}
+
+func TestServerArgsOpenAPINegotiateErrors(t *testing.T) {
+	store := newSecretsStore(t)
+	defer store.Close()
+
+	bp := baseplate.NewTestBaseplate(baseplate.NewTestBaseplateArgs{
+		Config:          baseplate.Config{Addr: ":8080"},
+		Store:           store,
+		EdgeContextImpl: ecinterface.Mock(),
+	})
+
+	info := httpbp.OpenAPIInfo{Title: "test", Version: "1.0.0"}
+	args, err := httpbp.ServerArgs{
+		Baseplate:        bp,
+		EndpointRegistry: httpbp.NewRouter(),
+		Endpoints:        openAPIEndpoints(),
+		NegotiateErrors:  true,
+		OpenAPI: &httpbp.OpenAPIConfig{
+			Info: info,
+		},
+	}.SetupEndpoints()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, httpbp.DefaultOpenAPIPath, nil)
+	w := httptest.NewRecorder()
+	args.EndpointRegistry.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected code %d, got %d", http.StatusOK, w.Code)
+	}
+
+	var served httpbp.OpenAPIDocument
+	if err := json.Unmarshal(w.Body.Bytes(), &served); err != nil {
+		t.Fatal(err)
+	}
+	expected, err := httpbp.NewNegotiatedOpenAPIDocument(info, openAPIEndpoints(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(&served, expected) {
+		t.Errorf("Expected served document %#v, got %#v", expected, served)
+	}
+}
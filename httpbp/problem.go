@@ -0,0 +1,321 @@
+package httpbp
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// ProblemJSONContentType is the Content-Type header for RFC 7807 problem
+	// details.
+	ProblemJSONContentType = "application/problem+json"
+
+	// ProblemTypeBlank is the default problem type,
+	// meaning the problem has no additional semantics beyond the status code.
+	ProblemTypeBlank = "about:blank"
+)
+
+// The media types negotiated by NegotiateError.
+const (
+	jsonMediaType    = "application/json"
+	problemMediaType = ProblemJSONContentType
+	htmlMediaType    = "text/html"
+)
+
+// ProblemDetails is the RFC 7807 representation of an ErrorResponse.
+//
+// ProblemDetails should not be used directly, it is used automatically by
+// ProblemError and ProblemJSONContentWriter.
+// It is exported to provide documentation for the final response format.
+type ProblemDetails struct {
+	// A URI reference identifying the problem type.
+	//
+	// ProblemTypeBlank unless set by ErrorResponse.WithProblemType.
+	Type string `json:"type"`
+
+	// A short summary of the problem type.
+	//
+	// The status text of the status code unless set by
+	// ErrorResponse.WithProblemType.
+	Title string `json:"title"`
+
+	// The HTTP status code.
+	Status int `json:"status"`
+
+	// The ErrorResponse.Explanation.
+	Detail string `json:"detail,omitempty"`
+
+	// A URI reference identifying the specific occurrence of the problem,
+	// usually the request path.
+	Instance string `json:"instance,omitempty"`
+
+	// The ErrorResponse.Reason.
+	Reason string `json:"reason,omitempty"`
+
+	// The ErrorResponse.Details.
+	Details map[string]string `json:"details,omitempty"`
+
+	// Whether and after how many seconds the request may be retried,
+	// set by ErrorResponse.Retryable.
+	Retryable  bool    `json:"retryable,omitempty"`
+	RetryAfter float64 `json:"retry_after,omitempty"`
+}
+
+// NewProblemDetails returns the RFC 7807 representation of resp,
+// with the given instance URI reference.
+func NewProblemDetails(resp *ErrorResponse, instance string) ProblemDetails {
+	p := ProblemDetails{
+		Type:     resp.problemType,
+		Title:    resp.problemTitle,
+		Status:   resp.code,
+		Detail:   resp.Explanation,
+		Instance: instance,
+		Reason:   resp.Reason,
+	}
+	if p.Type == "" {
+		p.Type = ProblemTypeBlank
+	}
+	if p.Title == "" {
+		p.Title = http.StatusText(resp.code)
+	}
+	if len(resp.Details) > 0 {
+		p.Details = resp.Details
+	}
+	if resp.retryAfter > 0 {
+		p.Retryable = true
+		p.RetryAfter = resp.retryAfter.Seconds()
+	}
+	return p
+}
+
+// WithProblemType is used to set the type URI and title of the problem when
+// using a problem+json content writer.
+//
+// This is ignored when using any other content writer.
+//
+// This returns an ErrorResponse so it can be chained in a call to
+// `ProblemError`:
+//
+//	return httpbp.ProblemError(
+//		httpbp.Forbidden().WithProblemType(
+//			"https://example.com/probs/out-of-credit",
+//			"You do not have enough credit.",
+//		),
+//		errors.New("example"),
+//		r.URL.Path,
+//	)
+func (r *ErrorResponse) WithProblemType(uri, title string) *ErrorResponse {
+	r.problemType = uri
+	r.problemTitle = title
+	return r
+}
+
+// ProblemJSONContentWriter returns a ContentWriter for writing RFC 7807
+// problem details.
+//
+// When using a problem+json ContentWriter, your Response.Body should be a
+// ProblemDetails or an ErrorResponse, which is converted by
+// NewProblemDetails without an instance.
+// If it is not, an error will be returned.
+func ProblemJSONContentWriter() ContentWriter {
+	return contentWriter{
+		contentType: ProblemJSONContentType,
+		write: func(w io.Writer, body interface{}) error {
+			var p ProblemDetails
+			switch b := body.(type) {
+			default:
+				return fmt.Errorf("httpbp: %#v is not a ProblemDetails or ErrorResponse", body)
+			case ProblemDetails:
+				p = b
+			case *ProblemDetails:
+				p = *b
+			case ErrorResponse:
+				p = NewProblemDetails(&b, "")
+			case *ErrorResponse:
+				p = NewProblemDetails(b, "")
+			}
+			return json.NewEncoder(w).Encode(p)
+		},
+	}
+}
+
+// ProblemError returns the given error as an HTTPError that will write RFC 7807
+// problem details, with the given instance URI reference (e.g. r.URL.Path).
+func ProblemError(resp *ErrorResponse, cause error, instance string) HTTPError {
+	return newHTTPError(resp.code, NewProblemDetails(resp, instance), cause, ProblemJSONContentWriter())
+}
+
+// NegotiateError returns the given error as an HTTPError that will write JSON,
+// RFC 7807 problem details or HTML,
+// whichever is preferred by the "Accept" header of the request.
+//
+// JSON is written as in JSONError and it's the default when the request does
+// not have an "Accept" header or accepts none of them.
+// Problem details are written as in ProblemError with the request path as the
+// instance.
+// HTML is written as in HTMLError, and it's only considered when templates is
+// non-nil.
+//
+// It only applies to the errors it's called with. To negotiate all the errors
+// of a server, including the ones from the built-in middlewares,
+// use ServerArgs.NegotiateErrors instead.
+func NegotiateError(r *http.Request, resp *ErrorResponse, cause error, templates *template.Template) HTTPError {
+	switch negotiateMediaType(r.Header.Get("Accept"), negotiatedErrorMediaTypes(templates)) {
+	case problemMediaType:
+		return ProblemError(resp, cause, r.URL.Path)
+	case htmlMediaType:
+		return HTMLError(resp, cause, templates)
+	default:
+		return JSONError(resp, cause)
+	}
+}
+
+// negotiatedErrorMediaTypes returns the media types NegotiateError chooses
+// from, in the order of preference.
+func negotiatedErrorMediaTypes(templates *template.Template) []string {
+	supported := []string{jsonMediaType, problemMediaType}
+	if templates != nil {
+		supported = append(supported, htmlMediaType)
+	}
+	return supported
+}
+
+// NegotiateErrors returns a Middleware that rewrites the HTTPErrors returned by
+// the next HandlerFunc with NegotiateError,
+// so they are written in the format preferred by the "Accept" header of the
+// request regardless of the format they were created with.
+//
+// It applies to the HTTPErrors created by JSONError, HTMLError, RawError and
+// ProblemError, including the ones from the built-in middlewares
+// (e.g. SupportedMethods, RateLimit, LoadShed, Idempotency and the recovered
+// panics) applied after it. Other errors are returned unchanged.
+//
+// NewBaseplateServer applies it to all the endpoints when
+// ServerArgs.NegotiateErrors is true.
+func NegotiateErrors(templates *template.Template) Middleware {
+	return func(name string, next HandlerFunc) HandlerFunc {
+		return func(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+			err := next(ctx, w, r)
+			var httpErr HTTPError
+			if err == nil || !errors.As(err, &httpErr) {
+				return err
+			}
+			resp := errorResponseOf(httpErr.Response())
+			if resp == nil {
+				return err
+			}
+			cause := err
+			if err == httpErr {
+				cause = httpErr.Unwrap()
+			}
+			return NegotiateError(r, resp, cause, templates)
+		}
+	}
+}
+
+// errorResponseOf returns the ErrorResponse written by an HTTPError,
+// or nil if it's not written from an ErrorResponse.
+func errorResponseOf(resp Response) *ErrorResponse {
+	switch b := resp.Body.(type) {
+	case *ErrorResponse:
+		return b
+	case ErrorResponse:
+		return &b
+	case ErrorResponseJSONWrapper:
+		return b.Error
+	case *ErrorResponseJSONWrapper:
+		return b.Error
+	case ProblemDetails:
+		return b.errorResponse()
+	case *ProblemDetails:
+		return b.errorResponse()
+	}
+	return nil
+}
+
+// errorResponse is the reverse of NewProblemDetails.
+func (p ProblemDetails) errorResponse() *ErrorResponse {
+	resp := NewErrorResponse(p.Status, p.Reason, p.Detail).WithDetails(p.Details)
+	if p.Type != ProblemTypeBlank || p.Title != http.StatusText(p.Status) {
+		resp.WithProblemType(p.Type, p.Title)
+	}
+	if p.Retryable {
+		resp.retryAfter = time.Duration(p.RetryAfter * float64(time.Second))
+	}
+	return resp
+}
+
+// negotiateMediaType returns the media type in supported preferred by the
+// Accept header.
+//
+// Ties are broken by the order of supported.
+// It returns the first one in supported when none of them is acceptable.
+func negotiateMediaType(header string, supported []string) string {
+	type mediaRange struct {
+		typ, subtype string
+		q            float64
+	}
+	var ranges []mediaRange
+	for _, part := range strings.Split(header, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(v, 64); err != nil {
+				continue
+			}
+		}
+		i := strings.IndexByte(mediaType, '/')
+		if i < 0 {
+			continue
+		}
+		ranges = append(ranges, mediaRange{
+			typ:     mediaType[:i],
+			subtype: mediaType[i+1:],
+			q:       q,
+		})
+	}
+	if len(ranges) == 0 {
+		return supported[0]
+	}
+
+	best := supported[0]
+	var bestQ float64
+	for _, mediaType := range supported {
+		i := strings.IndexByte(mediaType, '/')
+		typ, subtype := mediaType[:i], mediaType[i+1:]
+		// The q of the most specific matching range.
+		q, specificity := 0.0, -1
+		for _, r := range ranges {
+			var s int
+			switch {
+			case r.typ == typ && r.subtype == subtype:
+				s = 2
+			case r.typ == typ && r.subtype == "*":
+				s = 1
+			case r.typ == "*" && r.subtype == "*":
+				s = 0
+			default:
+				continue
+			}
+			if s > specificity {
+				q, specificity = r.q, s
+			}
+		}
+		if q > bestQ {
+			best, bestQ = mediaType, q
+		}
+	}
+	return best
+}
@@ -0,0 +1,309 @@
+package httpbp_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"html/template"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/reddit/baseplate.go"
+	"github.com/reddit/baseplate.go/ecinterface"
+	"github.com/reddit/baseplate.go/httpbp"
+	"github.com/reddit/baseplate.go/httpbp/httpbptest"
+)
+
+func TestProblemError(t *testing.T) {
+	t.Parallel()
+
+	cause := errors.New("test")
+	w := httptest.NewRecorder()
+	err := httpbp.ProblemError(
+		httpbp.BadRequest().WithDetails(map[string]string{
+			"name": "name is required",
+		}).Retryable(w, 1500*time.Millisecond),
+		cause,
+		"/v1/users",
+	)
+	if !errors.Is(err, cause) {
+		t.Errorf("Expected the error to wrap %v, got %v", cause, err)
+	}
+	if err := httpbp.WriteResponse(w, err.ContentWriter(), err.Response()); err != nil {
+		t.Fatal(err)
+	}
+
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected code %d, got %d", http.StatusBadRequest, w.Code)
+	}
+	if contentType := w.Header().Get(httpbp.ContentTypeHeader); contentType != httpbp.ProblemJSONContentType {
+		t.Errorf("Expected content type %q, got %q", httpbp.ProblemJSONContentType, contentType)
+	}
+	var body map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]interface{}{
+		"type":     httpbp.ProblemTypeBlank,
+		"title":    "Bad Request",
+		"status":   float64(http.StatusBadRequest),
+		"detail":   httpbp.BadRequest().Explanation,
+		"instance": "/v1/users",
+		"reason":   "BAD_REQUEST",
+		"details": map[string]interface{}{
+			"name": "name is required",
+		},
+		"retryable":   true,
+		"retry_after": 1.5,
+	}
+	if !reflect.DeepEqual(body, expected) {
+		t.Errorf("Expected body %#v, got %#v", expected, body)
+	}
+}
+
+func TestProblemJSONContentWriter(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name     string
+		body     interface{}
+		expected httpbp.ProblemDetails
+	}{
+		{
+			name: "error-response",
+			body: httpbp.NotFound(),
+			expected: httpbp.ProblemDetails{
+				Type:   httpbp.ProblemTypeBlank,
+				Title:  "Not Found",
+				Status: http.StatusNotFound,
+				Detail: httpbp.NotFound().Explanation,
+				Reason: "NOT_FOUND",
+			},
+		},
+		{
+			name: "problem-type",
+			body: httpbp.Forbidden().WithProblemType("https://example.com/probs/out-of-credit", "Out of credit."),
+			expected: httpbp.ProblemDetails{
+				Type:   "https://example.com/probs/out-of-credit",
+				Title:  "Out of credit.",
+				Status: http.StatusForbidden,
+				Detail: httpbp.Forbidden().Explanation,
+				Reason: "FORBIDDEN",
+			},
+		},
+		{
+			name: "problem-details",
+			body: httpbp.ProblemDetails{
+				Type:   httpbp.ProblemTypeBlank,
+				Title:  "Teapot",
+				Status: http.StatusTeapot,
+			},
+			expected: httpbp.ProblemDetails{
+				Type:   httpbp.ProblemTypeBlank,
+				Title:  "Teapot",
+				Status: http.StatusTeapot,
+			},
+		},
+	}
+	for _, _c := range cases {
+		c := _c
+		t.Run(c.name, func(t *testing.T) {
+			t.Parallel()
+
+			var sb strings.Builder
+			if err := httpbp.ProblemJSONContentWriter().WriteBody(&sb, c.body); err != nil {
+				t.Fatal(err)
+			}
+			var got httpbp.ProblemDetails
+			if err := json.Unmarshal([]byte(sb.String()), &got); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, c.expected) {
+				t.Errorf("Expected %#v, got %#v", c.expected, got)
+			}
+		})
+	}
+
+	t.Run("unsupported", func(t *testing.T) {
+		t.Parallel()
+
+		var sb strings.Builder
+		if err := httpbp.ProblemJSONContentWriter().WriteBody(&sb, "foo"); err == nil {
+			t.Error("Expected an error for unsupported body, got nil")
+		}
+	})
+}
+
+func TestNegotiateError(t *testing.T) {
+	t.Parallel()
+
+	tmpl, err := httpbp.RegisterDefaultErrorTemplate(template.New("test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		accept    string
+		templates *template.Template
+		expected  string
+	}{
+		{
+			accept:    "",
+			templates: tmpl,
+			expected:  httpbp.JSONContentType,
+		},
+		{
+			accept:    "*/*",
+			templates: tmpl,
+			expected:  httpbp.JSONContentType,
+		},
+		{
+			accept:    "application/problem+json",
+			templates: tmpl,
+			expected:  httpbp.ProblemJSONContentType,
+		},
+		{
+			accept:    "application/json;q=0.5, application/problem+json",
+			templates: tmpl,
+			expected:  httpbp.ProblemJSONContentType,
+		},
+		{
+			accept:    "application/*",
+			templates: tmpl,
+			expected:  httpbp.JSONContentType,
+		},
+		{
+			accept:    "text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8",
+			templates: tmpl,
+			expected:  httpbp.HTMLContentType,
+		},
+		{
+			accept:    "text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8",
+			templates: nil,
+			expected:  httpbp.JSONContentType,
+		},
+		{
+			accept:    "image/png",
+			templates: tmpl,
+			expected:  httpbp.JSONContentType,
+		},
+	}
+	for _, _c := range cases {
+		c := _c
+		t.Run(c.accept, func(t *testing.T) {
+			t.Parallel()
+
+			r := httptest.NewRequest(http.MethodGet, "/foo", nil)
+			if c.accept != "" {
+				r.Header.Set("Accept", c.accept)
+			}
+			httpErr := httpbp.NegotiateError(r, httpbp.NotFound(), nil, c.templates)
+			if code := httpErr.Response().Code; code != http.StatusNotFound {
+				t.Errorf("Expected code %d, got %d", http.StatusNotFound, code)
+			}
+			if contentType := httpErr.ContentWriter().ContentType(); contentType != c.expected {
+				t.Errorf("Expected content type %q, got %q", c.expected, contentType)
+			}
+
+			w := httptest.NewRecorder()
+			if err := httpbp.WriteResponse(w, httpErr.ContentWriter(), httpErr.Response()); err != nil {
+				t.Fatal(err)
+			}
+			if c.expected == httpbp.ProblemJSONContentType && !strings.Contains(w.Body.String(), `"instance":"/foo"`) {
+				t.Errorf("Expected the request path as instance, got %s", w.Body.String())
+			}
+		})
+	}
+}
+
+func TestNegotiateErrors(t *testing.T) {
+	store := newSecretsStore(t)
+	defer store.Close()
+
+	_, ts, err := httpbp.NewTestBaseplateServer(httpbp.ServerArgs{
+		Baseplate: baseplate.NewTestBaseplate(baseplate.NewTestBaseplateArgs{
+			Config:          baseplate.Config{Addr: ":8080"},
+			Store:           store,
+			EdgeContextImpl: ecinterface.Mock(),
+		}),
+		NegotiateErrors: true,
+		Endpoints: map[httpbp.Pattern]httpbp.Endpoint{
+			"/bad": {
+				Name:    "bad",
+				Methods: []string{http.MethodGet},
+				Handle: func(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+					return httpbp.JSONError(
+						httpbp.BadRequest().WithDetails(map[string]string{"foo": "required"}),
+						errors.New("bad request"),
+					)
+				},
+			},
+			"/panic": {
+				Name:    "panic",
+				Methods: []string{http.MethodGet},
+				Handle: func(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+					panic("test panic")
+				},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ts.Close()
+	client := httpbptest.Client{Server: ts}
+
+	cases := []struct {
+		label        string
+		method       string
+		path         string
+		accept       string
+		expectedCode int
+		expectedType string
+	}{
+		{
+			label:        "handler",
+			method:       http.MethodGet,
+			path:         "/bad",
+			accept:       httpbp.ProblemJSONContentType,
+			expectedCode: http.StatusBadRequest,
+			expectedType: httpbp.ProblemJSONContentType,
+		},
+		{
+			label:        "supported-methods",
+			method:       http.MethodPost,
+			path:         "/bad",
+			accept:       httpbp.ProblemJSONContentType,
+			expectedCode: http.StatusMethodNotAllowed,
+			expectedType: httpbp.ProblemJSONContentType,
+		},
+		{
+			label:        "panic",
+			method:       http.MethodGet,
+			path:         "/panic",
+			accept:       "",
+			expectedCode: http.StatusInternalServerError,
+			expectedType: httpbp.JSONContentType,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.label, func(t *testing.T) {
+			header := make(http.Header)
+			if c.accept != "" {
+				header.Set("Accept", c.accept)
+			}
+			resp := client.Do(t, httpbptest.RequestArgs{
+				Method: c.method,
+				Path:   c.path,
+				Header: header,
+			})
+			resp.CheckStatus(t, c.expectedCode)
+			resp.CheckContentType(t, c.expectedType)
+			resp.CheckError(t, httpbp.ErrorForCode(c.expectedCode))
+		})
+	}
+}
@@ -115,6 +115,7 @@ const (
 	// Note that this is not used by prometheus metrics defined in Baseplate spec.
 	promNamespace   = "httpbp"
 	subsystemServer = "server"
+	subsystemClient = "client"
 )
 
 var (
@@ -0,0 +1,354 @@
+package httpbp
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/reddit/baseplate.go/log"
+)
+
+// DefaultRateLimitRedisKeyPrefix is the default key prefix used by
+// RedisRateLimitStore.
+const DefaultRateLimitRedisKeyPrefix = "httpbp:ratelimit:"
+
+var rateLimitedRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: promNamespace,
+	Subsystem: subsystemServer,
+	Name:      "rate_limited_total",
+	Help:      "The number of requests rejected by the rate limit middleware",
+}, []string{endpointLabel})
+
+// RateLimitConfig is the configuration of a token bucket rate limit.
+//
+// Can be deserialized from YAML.
+type RateLimitConfig struct {
+	// The number of tokens refilled into the bucket per second,
+	// which is the sustained number of requests allowed per second.
+	//
+	// If <= 0, requests are not rate limited.
+	Rate float64 `yaml:"rate"`
+
+	// The max number of tokens in the bucket,
+	// which is the max number of requests allowed in a burst.
+	//
+	// If < 1, 1 will be used instead.
+	Burst int `yaml:"burst"`
+}
+
+func (c RateLimitConfig) burst() float64 {
+	if c.Burst < 1 {
+		return 1
+	}
+	return float64(c.Burst)
+}
+
+// RateLimitStore defines the storage of the rate limit token buckets.
+type RateLimitStore interface {
+	// Take takes one token from the bucket identified by key,
+	// creating a full bucket if it does not exist yet.
+	//
+	// If there's no token left, it shall return false along with the duration
+	// until the next token is available.
+	Take(ctx context.Context, key string, limit RateLimitConfig) (ok bool, retryAfter time.Duration, err error)
+}
+
+// RateLimitKeyFunc extracts the key identifying the caller from the request.
+//
+// Requests with an empty key are not rate limited.
+type RateLimitKeyFunc func(ctx context.Context, r *http.Request) string
+
+// RateLimitByClientIP is a RateLimitKeyFunc that uses the client IP resolved
+// by InjectClientAddr as the key,
+// or the IP of the remote address of the request if it's not used.
+func RateLimitByClientIP(ctx context.Context, r *http.Request) string {
+	if ip, ok := ClientIP(ctx); ok {
+		return ip.String()
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// RateLimitByHeader returns a RateLimitKeyFunc that uses the value of the given
+// request header as the key.
+func RateLimitByHeader(header string) RateLimitKeyFunc {
+	return func(ctx context.Context, r *http.Request) string {
+		return r.Header.Get(header)
+	}
+}
+
+// RateLimitByEdgeContextUser returns a RateLimitKeyFunc that uses the user id
+// from the edge request context as the key.
+//
+// As ecinterface.Interface is opaque, userID is the function provided by the
+// edgecontext implementation to get the user id from the context,
+// it shall return false when the request is not from a logged in user.
+// Such requests are not rate limited.
+//
+// It must be used after InjectEdgeRequestContext.
+func RateLimitByEdgeContextUser(userID func(ctx context.Context) (string, bool)) RateLimitKeyFunc {
+	return func(ctx context.Context, r *http.Request) string {
+		id, ok := userID(ctx)
+		if !ok {
+			return ""
+		}
+		return id
+	}
+}
+
+// RateLimitArgs are the args to be passed into RateLimit.
+type RateLimitArgs struct {
+	// The rate limit applied to all endpoints without one in Endpoints.
+	Default RateLimitConfig
+
+	// The rate limits by endpoint name.
+	Endpoints map[string]RateLimitConfig
+
+	// The function to extract the caller key from the request.
+	//
+	// Optional. Default to RateLimitByClientIP.
+	KeyFunc RateLimitKeyFunc
+
+	// The storage of the token buckets.
+	//
+	// Optional. Default to a MemoryRateLimitStore shared by all the endpoints.
+	Store RateLimitStore
+
+	// The logger to be called when the store returns an error.
+	// In such case the request is allowed.
+	//
+	// Optional. If nil, log.DefaultWrapper will be used.
+	Logger log.Wrapper
+}
+
+// RateLimit returns a Middleware that rate limits the requests with token
+// buckets, keyed by endpoint name and the caller key extracted by KeyFunc.
+//
+// Requests over the rate limit are rejected with a TooManyRequests error,
+// with "Retry-After" header set to the number of seconds until the next token
+// is available.
+// They are also counted by the httpbp_server_rate_limited_total prometheus
+// counter.
+func RateLimit(args RateLimitArgs) Middleware {
+	if args.KeyFunc == nil {
+		args.KeyFunc = RateLimitByClientIP
+	}
+	if args.Store == nil {
+		args.Store = NewMemoryRateLimitStore()
+	}
+	return func(name string, next HandlerFunc) HandlerFunc {
+		limit, ok := args.Endpoints[name]
+		if !ok {
+			limit = args.Default
+		}
+		if limit.Rate <= 0 {
+			return next
+		}
+		counter := rateLimitedRequests.With(prometheus.Labels{
+			endpointLabel: name,
+		})
+		return func(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+			key := args.KeyFunc(ctx, r)
+			if key == "" {
+				return next(ctx, w, r)
+			}
+			ok, retryAfter, err := args.Store.Take(ctx, name+":"+key, limit)
+			if err != nil {
+				args.Logger.Log(ctx, "httpbp: rate limit store failed: "+err.Error())
+				return next(ctx, w, r)
+			}
+			if !ok {
+				counter.Inc()
+				return RawError(
+					TooManyRequests().Retryable(w, retryAfterSeconds(retryAfter)),
+					fmt.Errorf("httpbp: %q is rate limited on %q", key, name),
+					PlainTextContentType,
+				)
+			}
+			return next(ctx, w, r)
+		}
+	}
+}
+
+// retryAfterSeconds rounds d up to the next whole second,
+// as "Retry-After" header only supports integer seconds.
+func retryAfterSeconds(d time.Duration) time.Duration {
+	if d < time.Second {
+		return time.Second
+	}
+	return time.Duration(math.Ceil(d.Seconds())) * time.Second
+}
+
+// tokenBucket is the state of a single token bucket.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+
+	// The time the bucket will be full again, since when it's the same as a
+	// missing bucket.
+	fullAt time.Time
+}
+
+// take refills the bucket to now and takes one token if available.
+func (b *tokenBucket) take(now time.Time, limit RateLimitConfig) (bool, time.Duration) {
+	burst := limit.burst()
+	if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.tokens = math.Min(burst, b.tokens+elapsed.Seconds()*limit.Rate)
+	}
+	b.last = now
+	defer func() {
+		b.fullAt = now.Add(time.Duration((burst - b.tokens) / limit.Rate * float64(time.Second)))
+	}()
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / limit.Rate * float64(time.Second))
+}
+
+// MemoryRateLimitStore is a RateLimitStore keeping the token buckets in
+// memory.
+//
+// It's only suitable when each server instance enforces the rate limits on
+// its own.
+// Use RedisRateLimitStore to share the rate limits among the instances.
+//
+// It's safe for concurrent use.
+type MemoryRateLimitStore struct {
+	lock      sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+// memoryRateLimitSweepInterval is the interval MemoryRateLimitStore drops the
+// full buckets, which are the same as missing ones.
+const memoryRateLimitSweepInterval = time.Minute
+
+// NewMemoryRateLimitStore creates a new, empty MemoryRateLimitStore.
+func NewMemoryRateLimitStore() *MemoryRateLimitStore {
+	return &MemoryRateLimitStore{
+		buckets:   make(map[string]*tokenBucket),
+		lastSweep: time.Now(),
+	}
+}
+
+// Take implements RateLimitStore.
+//
+// It never returns an error.
+func (s *MemoryRateLimitStore) Take(_ context.Context, key string, limit RateLimitConfig) (bool, time.Duration, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	now := time.Now()
+	if now.Sub(s.lastSweep) >= memoryRateLimitSweepInterval {
+		for k, b := range s.buckets {
+			if !now.Before(b.fullAt) {
+				delete(s.buckets, k)
+			}
+		}
+		s.lastSweep = now
+	}
+
+	b, ok := s.buckets[key]
+	if !ok {
+		b = &tokenBucket{
+			tokens: limit.burst(),
+			last:   now,
+		}
+		s.buckets[key] = b
+	}
+	ok, retryAfter := b.take(now, limit)
+	return ok, retryAfter, nil
+}
+
+// rateLimitScript implements the token bucket atomically in redis.
+//
+// KEYS[1] is the bucket key,
+// ARGV are the rate (tokens per second), the burst, and the current time in
+// milliseconds.
+//
+// It returns {1, 0} when the token is taken,
+// and {0, retryAfterMillis} otherwise.
+var rateLimitScript = redis.NewScript(`
+local rate = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+
+local state = redis.call("HMGET", KEYS[1], "tokens", "ts")
+local tokens = tonumber(state[1]) or burst
+local ts = tonumber(state[2]) or now
+if now > ts then
+	tokens = math.min(burst, tokens + (now - ts) / 1000 * rate)
+	ts = now
+end
+
+local ok = 0
+local wait = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+	ok = 1
+else
+	wait = math.ceil((1 - tokens) / rate * 1000)
+end
+
+redis.call("HMSET", KEYS[1], "tokens", tostring(tokens), "ts", tostring(ts))
+redis.call("PEXPIRE", KEYS[1], math.ceil(burst / rate * 1000) + 1000)
+return {ok, wait}
+`)
+
+// RedisRateLimitStore is a RateLimitStore keeping the token buckets in redis,
+// so the rate limits are shared among all the server instances.
+//
+// The buckets are updated atomically by a lua script,
+// using the clock of the server instances.
+type RedisRateLimitStore struct {
+	// The redis client, usually created by redisbp.NewMonitoredClient.
+	Client redis.Cmdable
+
+	// The prefix of the redis keys of the buckets.
+	//
+	// Optional. Default to DefaultRateLimitRedisKeyPrefix.
+	KeyPrefix string
+}
+
+// Take implements RateLimitStore.
+func (s RedisRateLimitStore) Take(ctx context.Context, key string, limit RateLimitConfig) (bool, time.Duration, error) {
+	prefix := s.KeyPrefix
+	if prefix == "" {
+		prefix = DefaultRateLimitRedisKeyPrefix
+	}
+	result, err := rateLimitScript.Run(
+		ctx,
+		s.Client,
+		[]string{prefix + key},
+		limit.Rate,
+		limit.burst(),
+		time.Now().UnixNano()/int64(time.Millisecond),
+	).Result()
+	if err != nil {
+		return false, 0, err
+	}
+	values, _ := result.([]interface{})
+	if len(values) != 2 {
+		return false, 0, fmt.Errorf("httpbp: unexpected rate limit script result %v", result)
+	}
+	ok, _ := values[0].(int64)
+	wait, _ := values[1].(int64)
+	return ok == 1, time.Duration(wait) * time.Millisecond, nil
+}
+
+var (
+	_ RateLimitStore = (*MemoryRateLimitStore)(nil)
+	_ RateLimitStore = RedisRateLimitStore{}
+)
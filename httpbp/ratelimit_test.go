@@ -0,0 +1,116 @@
+package httpbp_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+
+	"github.com/reddit/baseplate.go/httpbp"
+)
+
+func TestRateLimit(t *testing.T) {
+	t.Parallel()
+
+	const header = "X-Client"
+
+	newStores := map[string]func(t *testing.T) httpbp.RateLimitStore{
+		"memory": func(t *testing.T) httpbp.RateLimitStore {
+			return httpbp.NewMemoryRateLimitStore()
+		},
+		"redis": func(t *testing.T) httpbp.RateLimitStore {
+			s, err := miniredis.Run()
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(s.Close)
+			client := redis.NewClient(&redis.Options{Addr: s.Addr()})
+			t.Cleanup(func() { client.Close() })
+			return httpbp.RedisRateLimitStore{Client: client}
+		},
+	}
+	for storeName, _newStore := range newStores {
+		newStore := _newStore
+		t.Run(storeName, func(t *testing.T) {
+			t.Parallel()
+
+			middleware := httpbp.RateLimit(httpbp.RateLimitArgs{
+				Default: httpbp.RateLimitConfig{
+					// One token every 10 seconds so the buckets are not refilled
+					// during the test.
+					Rate:  0.1,
+					Burst: 2,
+				},
+				Endpoints: map[string]httpbp.RateLimitConfig{
+					"unlimited": {},
+				},
+				KeyFunc: httpbp.RateLimitByHeader(header),
+				Store:   newStore(t),
+			})
+			newHandler := func(name string) httpbp.HandlerFunc {
+				return httpbp.Wrap(
+					name,
+					func(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+						return nil
+					},
+					middleware,
+				)
+			}
+			limited := newHandler("limited")
+			unlimited := newHandler("unlimited")
+
+			call := func(handle httpbp.HandlerFunc, client string) (*httptest.ResponseRecorder, error) {
+				req := newRequest(t, "")
+				if client != "" {
+					req.Header.Set(header, client)
+				}
+				w := httptest.NewRecorder()
+				return w, handle(req.Context(), w, req)
+			}
+
+			for i := 0; i < 2; i++ {
+				if _, err := call(limited, "foo"); err != nil {
+					t.Fatalf("Request #%d expected to be allowed, got %v", i, err)
+				}
+			}
+
+			w, err := call(limited, "foo")
+			var httpErr httpbp.HTTPError
+			if !errors.As(err, &httpErr) {
+				t.Fatalf("Expected HTTPError, got %v", err)
+			}
+			if code := httpErr.Response().Code; code != http.StatusTooManyRequests {
+				t.Errorf("Expected code %d, got %d", http.StatusTooManyRequests, code)
+			}
+			if retryAfter := w.Header().Get(httpbp.RetryAfterHeader); retryAfter != "10" {
+				t.Errorf("Expected %s header to be %q, got %q", httpbp.RetryAfterHeader, "10", retryAfter)
+			}
+
+			if _, err := call(limited, "bar"); err != nil {
+				t.Errorf("Expected other clients to be allowed, got %v", err)
+			}
+			if _, err := call(limited, ""); err != nil {
+				t.Errorf("Expected requests without key to be allowed, got %v", err)
+			}
+			for i := 0; i < 5; i++ {
+				if _, err := call(unlimited, "foo"); err != nil {
+					t.Fatalf("Expected endpoint without rate limit to be allowed, got %v", err)
+				}
+			}
+		})
+	}
+}
+
+func TestRateLimitByClientIP(t *testing.T) {
+	t.Parallel()
+
+	req := newRequest(t, "")
+	req.RemoteAddr = "10.0.0.1:12345"
+	if got := httpbp.RateLimitByClientIP(req.Context(), req); got != "10.0.0.1" {
+		t.Errorf("Expected %q, got %q", "10.0.0.1", got)
+	}
+}
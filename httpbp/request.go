@@ -0,0 +1,243 @@
+package httpbp
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// ErrRequestBodyTooLarge is the error returned when reading from a request
+// body limited by LimitRequestBody beyond the limit.
+var ErrRequestBodyTooLarge = errors.New("httpbp: request body too large")
+
+var errTrailingJSONData = errors.New("httpbp: unexpected data after the JSON value")
+
+// BodyDetailsKey is the key used in ErrorResponse.Details by DecodeJSON for
+// errors not related to a specific field.
+const BodyDetailsKey = "body"
+
+// limitedBody is an io.ReadCloser that returns ErrRequestBodyTooLarge after
+// reading more than n bytes.
+type limitedBody struct {
+	io.ReadCloser
+
+	n int64
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if b.n < 0 {
+		return 0, ErrRequestBodyTooLarge
+	}
+	// Read one more byte than allowed to detect bodies over the limit.
+	if int64(len(p)) > b.n+1 {
+		p = p[:b.n+1]
+	}
+	n, err := b.ReadCloser.Read(p)
+	b.n -= int64(n)
+	if b.n < 0 {
+		return n + int(b.n), ErrRequestBodyTooLarge
+	}
+	return n, err
+}
+
+// LimitRequestBody returns a Middleware that caps the size of the request body
+// to maxBytes.
+//
+// Requests with a Content-Length larger than maxBytes are rejected with a
+// PayloadTooLarge error directly.
+// For other requests, reading beyond maxBytes from the request body returns
+// ErrRequestBodyTooLarge, which DecodeJSON also converts into a
+// PayloadTooLarge error.
+//
+// It's usually added to Endpoint.Middlewares so each endpoint can have its
+// own limit.
+func LimitRequestBody(maxBytes int64) Middleware {
+	return func(name string, next HandlerFunc) HandlerFunc {
+		return func(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+			if r.ContentLength > maxBytes {
+				return RawError(
+					PayloadTooLarge(),
+					fmt.Errorf("httpbp: request body of %d bytes is larger than the limit %d of %q", r.ContentLength, maxBytes, name),
+					PlainTextContentType,
+				)
+			}
+			if r.Body != nil && r.Body != http.NoBody {
+				r.Body = &limitedBody{ReadCloser: r.Body, n: maxBytes}
+			}
+			return next(ctx, w, r)
+		}
+	}
+}
+
+// RequireContentType returns a Middleware that rejects requests with a body
+// whose Content-Type is not one of the given media types (e.g.
+// "application/json") with an UnsupportedMediaType error.
+//
+// Media type parameters (e.g. "charset=utf-8") are ignored during the
+// comparison.
+// Requests without a body are not checked.
+func RequireContentType(mediaType string, additional ...string) Middleware {
+	supported := make(map[string]bool, len(additional)+1)
+	supported[strings.ToLower(mediaType)] = true
+	for _, t := range additional {
+		supported[strings.ToLower(t)] = true
+	}
+
+	return func(name string, next HandlerFunc) HandlerFunc {
+		return func(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+			if !hasBody(r) {
+				return next(ctx, w, r)
+			}
+			header := r.Header.Get(ContentTypeHeader)
+			t, _, err := mime.ParseMediaType(header)
+			if err != nil || !supported[strings.ToLower(t)] {
+				return RawError(
+					UnsupportedMediaType(),
+					fmt.Errorf("httpbp: Content-Type %q is not supported by %q", header, name),
+					PlainTextContentType,
+				)
+			}
+			return next(ctx, w, r)
+		}
+	}
+}
+
+func hasBody(r *http.Request) bool {
+	if r.Body == nil || r.Body == http.NoBody {
+		return false
+	}
+	return r.ContentLength != 0 || len(r.TransferEncoding) > 0
+}
+
+// Validator defines the optional interface implemented by the request structs
+// decoded by DecodeJSON.
+type Validator interface {
+	// Validate returns a non-nil error if the decoded request is invalid.
+	//
+	// Return ValidationErrors to report the invalid fields to the client.
+	Validate() error
+}
+
+// ValidationErrors is an error mapping the invalid fields of a request to their
+// error messages.
+//
+// When returned (or wrapped) by Validator.Validate, DecodeJSON uses it as
+// the ErrorResponse.Details of the BadRequest error.
+// The messages are returned to the client and should be something you are
+// comfortable presenting to an end-user.
+type ValidationErrors map[string]string
+
+func (e ValidationErrors) Error() string {
+	fields := make([]string, 0, len(e))
+	for field, msg := range e {
+		fields = append(fields, field+": "+msg)
+	}
+	sort.Strings(fields)
+	return "httpbp: invalid request: " + strings.Join(fields, "; ")
+}
+
+// DecodeJSON decodes the JSON request body strictly into v,
+// then calls v.Validate if v implements Validator.
+//
+// Strictly means that unknown fields and trailing data after the JSON value
+// are rejected.
+//
+// The returned error is an HTTPError that can be returned from the
+// HandlerFunc directly:
+//
+// - BadRequest with field-level details if the body is not valid JSON,
+// does not match v, or fails the validation.
+//
+// - PayloadTooLarge if the body is larger than the limit set by
+// LimitRequestBody.
+//
+// Example:
+//
+//     var req MyRequest
+//     if err := httpbp.DecodeJSON(r, &req); err != nil {
+//         return err
+//     }
+func DecodeJSON(r *http.Request, v interface{}) error {
+	if r.Body == nil || r.Body == http.NoBody {
+		return JSONError(
+			BadRequest().WithDetails(map[string]string{
+				BodyDetailsKey: "The request body is empty.",
+			}),
+			errors.New("httpbp: empty request body"),
+		)
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(v)
+	if err == nil {
+		if _, e := decoder.Token(); !errors.Is(e, io.EOF) {
+			err = errTrailingJSONData
+			if errors.Is(e, ErrRequestBodyTooLarge) {
+				err = e
+			}
+		}
+	}
+	if err != nil {
+		if errors.Is(err, ErrRequestBodyTooLarge) {
+			return JSONError(PayloadTooLarge(), err)
+		}
+		return JSONError(BadRequest().WithDetails(jsonErrorDetails(err)), err)
+	}
+
+	if validator, ok := v.(Validator); ok {
+		if err := validator.Validate(); err != nil {
+			var ve ValidationErrors
+			if !errors.As(err, &ve) {
+				ve = ValidationErrors{BodyDetailsKey: err.Error()}
+			}
+			return JSONError(BadRequest().WithDetails(ve), err)
+		}
+	}
+	return nil
+}
+
+// jsonErrorDetails converts the error returned by json.Decoder into
+// ErrorResponse.Details.
+func jsonErrorDetails(err error) map[string]string {
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case errors.Is(err, errTrailingJSONData):
+		return map[string]string{
+			BodyDetailsKey: "Unexpected data after the JSON value.",
+		}
+	case errors.As(err, &syntaxErr):
+		return map[string]string{
+			BodyDetailsKey: fmt.Sprintf("Invalid JSON at offset %d.", syntaxErr.Offset),
+		}
+	case errors.As(err, &typeErr) && typeErr.Field != "":
+		return map[string]string{
+			typeErr.Field: fmt.Sprintf("Expected %s, got %s.", typeErr.Type, typeErr.Value),
+		}
+	case errors.Is(err, io.ErrUnexpectedEOF), errors.Is(err, io.EOF):
+		return map[string]string{
+			BodyDetailsKey: "Unexpected end of JSON input.",
+		}
+	}
+
+	// Unknown fields are only reported via the error string, in the format of:
+	//
+	//     json: unknown field "foo"
+	const unknownFieldPrefix = `json: unknown field "`
+	if msg := err.Error(); strings.HasPrefix(msg, unknownFieldPrefix) {
+		field := strings.TrimSuffix(strings.TrimPrefix(msg, unknownFieldPrefix), `"`)
+		return map[string]string{
+			field: "Unknown field.",
+		}
+	}
+	return map[string]string{
+		BodyDetailsKey: "Invalid request body.",
+	}
+}
@@ -0,0 +1,247 @@
+package httpbp_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/reddit/baseplate.go/httpbp"
+)
+
+type decodeTestRequest struct {
+	Name  string `json:"name"`
+	Count int    `json:"count"`
+}
+
+func (r decodeTestRequest) Validate() error {
+	if r.Count < 0 {
+		return httpbp.ValidationErrors{
+			"count": "Must not be negative.",
+		}
+	}
+	if r.Name == "invalid" {
+		return errors.New("invalid name")
+	}
+	return nil
+}
+
+func newBodyRequest(t testing.TB, contentType, body string) *http.Request {
+	t.Helper()
+
+	req, err := http.NewRequest(http.MethodPost, "localhost:9090", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if contentType != "" {
+		req.Header.Set(httpbp.ContentTypeHeader, contentType)
+	}
+	return req
+}
+
+func checkHTTPError(t testing.TB, err error, code int, details map[string]string) {
+	t.Helper()
+
+	var httpErr httpbp.HTTPError
+	if !errors.As(err, &httpErr) {
+		t.Fatalf("Expected HTTPError, got %#v", err)
+	}
+	resp := httpErr.Response()
+	if resp.Code != code {
+		t.Errorf("Expected code %d, got %d", code, resp.Code)
+	}
+	if details == nil {
+		return
+	}
+	body, ok := resp.Body.(httpbp.ErrorResponseJSONWrapper)
+	if !ok {
+		t.Fatalf("Expected ErrorResponseJSONWrapper body, got %#v", resp.Body)
+	}
+	if !reflect.DeepEqual(body.Error.Details, details) {
+		t.Errorf("Expected details %v, got %v", details, body.Error.Details)
+	}
+}
+
+func TestDecodeJSON(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name     string
+		body     string
+		limit    int64
+		expected decodeTestRequest
+		code     int
+		details  map[string]string
+	}{
+		{
+			name:     "valid",
+			body:     `{"name": "foo", "count": 1}`,
+			expected: decodeTestRequest{Name: "foo", Count: 1},
+		},
+		{
+			name:    "empty",
+			code:    http.StatusBadRequest,
+			details: map[string]string{httpbp.BodyDetailsKey: "The request body is empty."},
+		},
+		{
+			name:    "syntax",
+			body:    `{"name": }`,
+			code:    http.StatusBadRequest,
+			details: map[string]string{httpbp.BodyDetailsKey: "Invalid JSON at offset 10."},
+		},
+		{
+			name:    "type",
+			body:    `{"count": "foo"}`,
+			code:    http.StatusBadRequest,
+			details: map[string]string{"count": "Expected int, got string."},
+		},
+		{
+			name:    "unknown-field",
+			body:    `{"foo": 1}`,
+			code:    http.StatusBadRequest,
+			details: map[string]string{"foo": "Unknown field."},
+		},
+		{
+			name:    "trailing-data",
+			body:    `{"name": "foo"} {}`,
+			code:    http.StatusBadRequest,
+			details: map[string]string{httpbp.BodyDetailsKey: "Unexpected data after the JSON value."},
+		},
+		{
+			name:    "validation-errors",
+			body:    `{"count": -1}`,
+			code:    http.StatusBadRequest,
+			details: map[string]string{"count": "Must not be negative."},
+		},
+		{
+			name:    "validation-error",
+			body:    `{"name": "invalid"}`,
+			code:    http.StatusBadRequest,
+			details: map[string]string{httpbp.BodyDetailsKey: "invalid name"},
+		},
+		{
+			name:  "too-large",
+			body:  `{"name": "foo", "count": 1}`,
+			limit: 10,
+			code:  http.StatusRequestEntityTooLarge,
+		},
+	}
+	for _, _c := range cases {
+		c := _c
+		t.Run(c.name, func(t *testing.T) {
+			t.Parallel()
+
+			req := newBodyRequest(t, "application/json", c.body)
+			// Hide the Content-Length so the body limit is only enforced on read.
+			req.ContentLength = -1
+
+			var got decodeTestRequest
+			var middlewares []httpbp.Middleware
+			if c.limit > 0 {
+				middlewares = append(middlewares, httpbp.LimitRequestBody(c.limit))
+			}
+			handle := httpbp.Wrap(
+				"test",
+				func(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+					return httpbp.DecodeJSON(r, &got)
+				},
+				middlewares...,
+			)
+			err := handle(req.Context(), httptest.NewRecorder(), req)
+			if c.code == 0 {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got != c.expected {
+					t.Errorf("Expected %+v, got %+v", c.expected, got)
+				}
+				return
+			}
+			checkHTTPError(t, err, c.code, c.details)
+		})
+	}
+}
+
+func TestLimitRequestBody(t *testing.T) {
+	t.Parallel()
+
+	handle := httpbp.Wrap(
+		"test",
+		func(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+			return nil
+		},
+		httpbp.LimitRequestBody(4),
+	)
+
+	req := newBodyRequest(t, "", "12345")
+	checkHTTPError(t, handle(req.Context(), httptest.NewRecorder(), req), http.StatusRequestEntityTooLarge, nil)
+
+	req = newBodyRequest(t, "", "1234")
+	if err := handle(req.Context(), httptest.NewRecorder(), req); err != nil {
+		t.Errorf("Expected body within the limit to be allowed, got %v", err)
+	}
+}
+
+func TestRequireContentType(t *testing.T) {
+	t.Parallel()
+
+	handle := httpbp.Wrap(
+		"test",
+		func(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+			return nil
+		},
+		httpbp.RequireContentType("application/json"),
+	)
+
+	cases := []struct {
+		name        string
+		contentType string
+		body        string
+		allowed     bool
+	}{
+		{
+			name:        "match",
+			contentType: "application/json",
+			body:        "{}",
+			allowed:     true,
+		},
+		{
+			name:        "params",
+			contentType: "Application/JSON; charset=utf-8",
+			body:        "{}",
+			allowed:     true,
+		},
+		{
+			name:        "mismatch",
+			contentType: "text/plain",
+			body:        "{}",
+		},
+		{
+			name: "missing",
+			body: "{}",
+		},
+		{
+			name:    "no-body",
+			allowed: true,
+		},
+	}
+	for _, _c := range cases {
+		c := _c
+		t.Run(c.name, func(t *testing.T) {
+			t.Parallel()
+
+			req := newBodyRequest(t, c.contentType, c.body)
+			err := handle(req.Context(), httptest.NewRecorder(), req)
+			if c.allowed {
+				if err != nil {
+					t.Errorf("Expected request to be allowed, got %v", err)
+				}
+				return
+			}
+			checkHTTPError(t, err, http.StatusUnsupportedMediaType, nil)
+		})
+	}
+}
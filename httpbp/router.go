@@ -0,0 +1,445 @@
+package httpbp
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	pathpkg "path"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// RouteTag is the span tag set by InjectServerSpan to the route template of
+// the request matched by Router.
+const RouteTag = "http.route"
+
+// The endpoint names used by the default NotFound and MethodNotAllowed handlers
+// of Router set up by NewBaseplateServer.
+const (
+	NotFoundEndpointName         = "notFound"
+	MethodNotAllowedEndpointName = "methodNotAllowed"
+)
+
+type routeContextKey struct{}
+
+// routeMatch is the result of a Router lookup stored in the request context.
+type routeMatch struct {
+	template string
+	params   map[string]string
+}
+
+// PathParam returns the value of the path parameter with the given name from
+// the route matched by Router, or empty string if there's no such parameter.
+//
+// For example, with the pattern "/v1/users/{id}", a request to "/v1/users/foo"
+// will have PathParam(ctx, "id") returning "foo".
+func PathParam(ctx context.Context, name string) string {
+	m, _ := ctx.Value(routeContextKey{}).(*routeMatch)
+	if m == nil {
+		return ""
+	}
+	return m.params[name]
+}
+
+// RouteTemplate returns the template of the route matched by Router (e.g.
+// "/v1/users/{id}"), without the method.
+//
+// It returns false if the request was not routed by a Router.
+func RouteTemplate(ctx context.Context) (string, bool) {
+	m, _ := ctx.Value(routeContextKey{}).(*routeMatch)
+	if m == nil {
+		return "", false
+	}
+	return m.template, true
+}
+
+// parsePattern splits a pattern in the format of "[METHOD ]/path" into the
+// method (could be empty) and the path.
+func parsePattern(pattern string) (method, path string) {
+	pattern = strings.TrimSpace(pattern)
+	if i := strings.IndexAny(pattern, " \t"); i >= 0 {
+		return strings.ToUpper(pattern[:i]), strings.TrimSpace(pattern[i+1:])
+	}
+	return "", pattern
+}
+
+// route is the handlers registered to the same path template.
+type route struct {
+	template string
+	params   []string
+	handlers map[string]http.Handler
+	fallback http.Handler
+	allow    string
+}
+
+func (rt *route) handler(method string) http.Handler {
+	if h, ok := rt.handlers[method]; ok {
+		return h
+	}
+	if method == http.MethodHead {
+		if h, ok := rt.handlers[http.MethodGet]; ok {
+			return h
+		}
+	}
+	return rt.fallback
+}
+
+// preflightHandler returns the handler of an Endpoint with CORS to answer the
+// preflight request of the requested method,
+// or nil if there's none or an OPTIONS handler is registered.
+//
+// The handler of the requested method is preferred,
+// otherwise the first one in the order of the methods is used.
+func (rt *route) preflightHandler(requested string) http.Handler {
+	if _, ok := rt.handlers[http.MethodOptions]; ok {
+		return nil
+	}
+	if h, ok := rt.handlers[strings.ToUpper(requested)].(corsHandler); ok {
+		return h
+	}
+	methods := make([]string, 0, len(rt.handlers))
+	for method := range rt.handlers {
+		methods = append(methods, method)
+	}
+	sort.Strings(methods)
+	for _, method := range methods {
+		if h, ok := rt.handlers[method].(corsHandler); ok {
+			return h
+		}
+	}
+	return nil
+}
+
+func (rt *route) updateAllow() {
+	allowed := make([]string, 0, len(rt.handlers)+1)
+	for method := range rt.handlers {
+		allowed = append(allowed, method)
+	}
+	if _, ok := rt.handlers[http.MethodGet]; ok {
+		if _, ok := rt.handlers[http.MethodHead]; !ok {
+			allowed = append(allowed, http.MethodHead)
+		}
+	}
+	sort.Strings(allowed)
+	rt.allow = strings.Join(allowed, ",")
+}
+
+// routeNode is a node of the path segments tree of Router.
+type routeNode struct {
+	static map[string]*routeNode
+	param  *routeNode
+
+	// The route ending exactly at this node, e.g. "/foo".
+	exact *route
+	// The route matching everything under this node, e.g. "/foo/".
+	subtree *route
+}
+
+func (n *routeNode) child(segment string) *routeNode {
+	if isParamSegment(segment) {
+		if n.param == nil {
+			n.param = &routeNode{}
+		}
+		return n.param
+	}
+	if n.static == nil {
+		n.static = make(map[string]*routeNode)
+	}
+	c, ok := n.static[segment]
+	if !ok {
+		c = &routeNode{}
+		n.static[segment] = c
+	}
+	return c
+}
+
+// lookup returns the route matching the given path segments,
+// preferring static segments over parameters, and longer matches over
+// subtrees.
+//
+// values are the values of the path parameters matched so far.
+func (n *routeNode) lookup(segments []string, values []string) (*route, []string, bool) {
+	if len(segments) == 0 {
+		if n.exact != nil {
+			return n.exact, values, false
+		}
+		return nil, nil, false
+	}
+
+	segment := segments[0]
+	if c, ok := n.static[segment]; ok {
+		if rt, v, dir := c.lookup(segments[1:], values); rt != nil {
+			return rt, v, dir
+		}
+	}
+	if n.param != nil && segment != "" {
+		if rt, v, dir := n.param.lookup(segments[1:], append(values, segment)); rt != nil {
+			return rt, v, dir
+		}
+	}
+	if n.subtree != nil {
+		// dir is true when the request is for the subtree root itself,
+		// e.g. "/foo/" for the pattern "/foo/".
+		return n.subtree, values, len(segments) == 1 && segment == ""
+	}
+	return nil, nil, false
+}
+
+func isParamSegment(segment string) bool {
+	return len(segment) > 2 && strings.HasPrefix(segment, "{") && strings.HasSuffix(segment, "}")
+}
+
+// Router is an EndpointRegistry that supports path parameters and routing
+// requests to different handlers by methods.
+//
+// Router is opt-in, set it as ServerArgs.EndpointRegistry to use it:
+//
+//     args.EndpointRegistry = httpbp.NewRouter()
+//
+// The patterns are in the format of "[METHOD ]/path", for example:
+//
+//     /v1/users
+//     GET /v1/users/{id}
+//     POST /v1/users/{id}
+//     /static/
+//
+// Path segments in the format of "{name}" match any non-empty segment,
+// and their values can be read using PathParam.
+// Static segments take precedence over parameters.
+//
+// Like http.ServeMux, a pattern ending with a slash matches all the paths under
+// it that are not matched by longer patterns, and requests to the path without
+// the trailing slash are redirected to it.
+// Requests to paths with "." or ".." elements or repeated slashes are
+// redirected to the cleaned paths, like http.ServeMux.
+// Unlike http.ServeMux, host-specific patterns are not supported,
+// patterns are always matched against the path of the request.
+//
+// When a pattern has a method, only requests with that method (or HEAD for
+// GET) are routed to the handler.
+// Requests to a path with methods registered but not the one requested are
+// rejected with 405 Method Not Allowed, with the "Allow" header set to the
+// registered methods.
+// A pattern without method is used for all the methods not registered
+// explicitly on the same path.
+// CORS preflight requests (OPTIONS requests with the
+// "Access-Control-Request-Method" header) to a path without OPTIONS handler
+// are routed to the handler of an Endpoint with CORS on the same path,
+// preferably the one of the requested method.
+//
+// The route template (the path part of the pattern) matched is available to
+// the handlers via RouteTemplate,
+// and it's used by InjectServerSpan to set the RouteTag.
+//
+// When used by NewBaseplateServer, the not found and method not allowed
+// responses are handled by endpoints named NotFoundEndpointName and
+// MethodNotAllowedEndpointName wrapped in the default middlewares,
+// so they are traced and counted by the server metrics like other endpoints.
+type Router struct {
+	// NotFound handles the requests not matching any pattern.
+	//
+	// Optional, default to http.NotFound.
+	NotFound http.Handler
+
+	// MethodNotAllowed handles the requests matching a path but not its
+	// methods. The "Allow" header is already set when it's called.
+	//
+	// Optional, default to a plain text 405 response.
+	MethodNotAllowed http.Handler
+
+	lock sync.RWMutex
+	root routeNode
+}
+
+// NewRouter creates a new Router.
+func NewRouter() *Router {
+	return &Router{}
+}
+
+// Handle registers the handler for the given pattern.
+//
+// It panics if the pattern is invalid or a handler already exists for it.
+func (rr *Router) Handle(pattern string, handler http.Handler) {
+	method, path := parsePattern(pattern)
+	if method != "" && !allHTTPMethods[method] {
+		panic(fmt.Sprintf("httpbp: invalid method %q in pattern %q", method, pattern))
+	}
+	if !strings.HasPrefix(path, "/") {
+		panic(fmt.Sprintf("httpbp: pattern %q must start with \"/\"", pattern))
+	}
+	if handler == nil {
+		panic(fmt.Sprintf("httpbp: nil handler for pattern %q", pattern))
+	}
+
+	rr.lock.Lock()
+	defer rr.lock.Unlock()
+
+	trimmed := path[1:]
+	subtree := trimmed == "" || strings.HasSuffix(trimmed, "/")
+	trimmed = strings.TrimSuffix(trimmed, "/")
+	node := &rr.root
+	var params []string
+	if trimmed != "" {
+		for _, segment := range strings.Split(trimmed, "/") {
+			if isParamSegment(segment) {
+				params = append(params, segment[1:len(segment)-1])
+			}
+			node = node.child(segment)
+		}
+	}
+
+	target := &node.exact
+	if subtree {
+		target = &node.subtree
+	}
+	if *target == nil {
+		*target = &route{template: path, params: params}
+	}
+	rt := *target
+	if rt.template != path {
+		panic(fmt.Sprintf("httpbp: pattern %q conflicts with %q", pattern, rt.template))
+	}
+	if method == "" {
+		if rt.fallback != nil {
+			panic(fmt.Sprintf("httpbp: multiple registrations for %q", pattern))
+		}
+		rt.fallback = handler
+		return
+	}
+	if rt.handlers == nil {
+		rt.handlers = make(map[string]http.Handler)
+	}
+	if _, ok := rt.handlers[method]; ok {
+		panic(fmt.Sprintf("httpbp: multiple registrations for %q", pattern))
+	}
+	rt.handlers[method] = handler
+	rt.updateAllow()
+}
+
+func (rr *Router) lookup(path string) (*route, []string, bool) {
+	rr.lock.RLock()
+	defer rr.lock.RUnlock()
+	return rr.root.lookup(strings.Split(path[1:], "/"), nil)
+}
+
+// ServeHTTP implements http.Handler.
+func (rr *Router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.RequestURI == "*" {
+		if r.ProtoAtLeast(1, 1) {
+			w.Header().Set("Connection", "close")
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	path := r.URL.Path
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	if r.Method != http.MethodConnect {
+		if clean := cleanPath(path); clean != path {
+			u := &url.URL{Path: clean, RawQuery: r.URL.RawQuery}
+			http.Redirect(w, r, u.String(), http.StatusMovedPermanently)
+			return
+		}
+	}
+	rt, values, _ := rr.lookup(path)
+	if (rt == nil || strings.HasSuffix(rt.template, "/")) && !strings.HasSuffix(path, "/") {
+		// Redirect "/foo" to "/foo/" when the latter is registered.
+		if dirRoute, _, dir := rr.lookup(path + "/"); dir && dirRoute != rt {
+			u := &url.URL{Path: path + "/", RawQuery: r.URL.RawQuery}
+			http.Redirect(w, r, u.String(), http.StatusMovedPermanently)
+			return
+		}
+	}
+	if rt == nil {
+		if rr.NotFound != nil {
+			rr.NotFound.ServeHTTP(w, r)
+			return
+		}
+		http.NotFound(w, r)
+		return
+	}
+
+	h := rt.handler(r.Method)
+	if requested := r.Header.Get(AccessControlRequestMethodHeader); r.Method == http.MethodOptions && requested != "" {
+		if preflight := rt.preflightHandler(requested); preflight != nil {
+			h = preflight
+		}
+	}
+	if h == nil {
+		w.Header().Set(AllowHeader, rt.allow)
+		if rr.MethodNotAllowed != nil {
+			rr.MethodNotAllowed.ServeHTTP(w, r)
+			return
+		}
+		code := http.StatusMethodNotAllowed
+		http.Error(w, http.StatusText(code), code)
+		return
+	}
+
+	m := &routeMatch{template: rt.template}
+	if len(rt.params) > 0 {
+		m.params = make(map[string]string, len(rt.params))
+		for i, name := range rt.params {
+			m.params[name] = values[i]
+		}
+	}
+	r = r.WithContext(context.WithValue(r.Context(), routeContextKey{}, m))
+	h.ServeHTTP(w, r)
+}
+
+// setDefaultErrorHandlers sets the NotFound and MethodNotAllowed handlers not
+// set yet to endpoints wrapped in the default middlewares.
+func (rr *Router) setDefaultErrorHandlers(args ServerArgs) {
+	wrappers := DefaultMiddleware(DefaultMiddlewareArgs{
+		TrustHandler:    args.TrustHandler,
+		EdgeContextImpl: args.Baseplate.EdgeContextImpl(),
+		Logger:          args.Logger,
+	})
+	if args.NegotiateErrors {
+		wrappers = append(wrappers, NegotiateErrors(args.ErrorTemplates))
+	}
+	if rr.NotFound == nil {
+		rr.NotFound = NewHandler(
+			NotFoundEndpointName,
+			func(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+				return RawError(
+					NotFound(),
+					fmt.Errorf("no route for %q", r.URL.Path),
+					PlainTextContentType,
+				)
+			},
+			wrappers...,
+		)
+	}
+	if rr.MethodNotAllowed == nil {
+		rr.MethodNotAllowed = NewHandler(
+			MethodNotAllowedEndpointName,
+			func(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+				return RawError(
+					MethodNotAllowed(),
+					fmt.Errorf("method %q is not supported by %q", r.Method, r.URL.Path),
+					PlainTextContentType,
+				)
+			},
+			wrappers...,
+		)
+	}
+}
+
+// cleanPath returns the canonical path of p, eliminating . and .. elements
+// and repeated slashes, while keeping the trailing slash.
+func cleanPath(p string) string {
+	np := pathpkg.Clean(p)
+	if strings.HasSuffix(p, "/") && np != "/" {
+		np += "/"
+	}
+	return np
+}
+
+var (
+	_ EndpointRegistry = (*Router)(nil)
+)
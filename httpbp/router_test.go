@@ -0,0 +1,361 @@
+package httpbp_test
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/reddit/baseplate.go"
+	"github.com/reddit/baseplate.go/ecinterface"
+	"github.com/reddit/baseplate.go/httpbp"
+	"github.com/reddit/baseplate.go/httpbp/httpbptest"
+	"github.com/reddit/baseplate.go/tracing/tracingtest"
+)
+
+// routeEchoHandler writes the route template and the "id" path parameter.
+func routeEchoHandler(label string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		template, _ := httpbp.RouteTemplate(r.Context())
+		fmt.Fprintf(w, "%s %s id=%s", label, template, httpbp.PathParam(r.Context(), "id"))
+	})
+}
+
+func TestRouter(t *testing.T) {
+	t.Parallel()
+
+	router := httpbp.NewRouter()
+	router.Handle("GET /v1/users/{id}", routeEchoHandler("get-user"))
+	router.Handle("PUT /v1/users/{id}", routeEchoHandler("put-user"))
+	router.Handle("/v1/users/me", routeEchoHandler("me"))
+	router.Handle("POST /v1/users", routeEchoHandler("create-user"))
+	router.Handle("/v1/items/{id}", routeEchoHandler("item"))
+	router.Handle("DELETE /v1/items/{id}", routeEchoHandler("delete-item"))
+	router.Handle("/static/", routeEchoHandler("static"))
+
+	cases := []struct {
+		method   string
+		path     string
+		code     int
+		body     string
+		allow    string
+		location string
+	}{
+		{
+			method: http.MethodGet,
+			path:   "/v1/users/foo",
+			code:   http.StatusOK,
+			body:   "get-user /v1/users/{id} id=foo",
+		},
+		{
+			method: http.MethodHead,
+			path:   "/v1/users/foo",
+			code:   http.StatusOK,
+		},
+		{
+			method: http.MethodPut,
+			path:   "/v1/users/foo",
+			code:   http.StatusOK,
+			body:   "put-user /v1/users/{id} id=foo",
+		},
+		{
+			method: http.MethodPost,
+			path:   "/v1/users/foo",
+			code:   http.StatusMethodNotAllowed,
+			allow:  "GET,HEAD,PUT",
+		},
+		{
+			method: http.MethodPost,
+			path:   "/v1/users/me",
+			code:   http.StatusOK,
+			body:   "me /v1/users/me id=",
+		},
+		{
+			method: http.MethodPost,
+			path:   "/v1/users",
+			code:   http.StatusOK,
+			body:   "create-user /v1/users id=",
+		},
+		{
+			method: http.MethodGet,
+			path:   "/v1/users",
+			code:   http.StatusMethodNotAllowed,
+			allow:  "POST",
+		},
+		{
+			method: http.MethodGet,
+			path:   "/v1/items/bar",
+			code:   http.StatusOK,
+			body:   "item /v1/items/{id} id=bar",
+		},
+		{
+			method: http.MethodDelete,
+			path:   "/v1/items/bar",
+			code:   http.StatusOK,
+			body:   "delete-item /v1/items/{id} id=bar",
+		},
+		{
+			method: http.MethodGet,
+			path:   "/v1/users/",
+			code:   http.StatusNotFound,
+		},
+		{
+			method: http.MethodGet,
+			path:   "/v1/users/foo/bar",
+			code:   http.StatusNotFound,
+		},
+		{
+			method: http.MethodGet,
+			path:   "/static/js/main.js",
+			code:   http.StatusOK,
+			body:   "static /static/ id=",
+		},
+		{
+			method:   http.MethodGet,
+			path:     "/static?foo=bar",
+			code:     http.StatusMovedPermanently,
+			location: "/static/?foo=bar",
+		},
+		{
+			method:   http.MethodGet,
+			path:     "/v1//users/foo",
+			code:     http.StatusMovedPermanently,
+			location: "/v1/users/foo",
+		},
+		{
+			method:   http.MethodGet,
+			path:     "/v1/./users/foo?foo=bar",
+			code:     http.StatusMovedPermanently,
+			location: "/v1/users/foo?foo=bar",
+		},
+		{
+			method:   http.MethodGet,
+			path:     "/v1/items/../users/foo",
+			code:     http.StatusMovedPermanently,
+			location: "/v1/users/foo",
+		},
+		{
+			method:   http.MethodGet,
+			path:     "/static/js/../css/",
+			code:     http.StatusMovedPermanently,
+			location: "/static/css/",
+		},
+	}
+	for _, _c := range cases {
+		c := _c
+		t.Run(c.method+" "+c.path, func(t *testing.T) {
+			t.Parallel()
+
+			req := httptest.NewRequest(c.method, c.path, nil)
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+
+			if w.Code != c.code {
+				t.Errorf("Expected code %d, got %d", c.code, w.Code)
+			}
+			if c.body != "" {
+				if body := w.Body.String(); body != c.body {
+					t.Errorf("Expected body %q, got %q", c.body, body)
+				}
+			}
+			if allow := w.Header().Get(httpbp.AllowHeader); allow != c.allow {
+				t.Errorf("Expected %s header %q, got %q", httpbp.AllowHeader, c.allow, allow)
+			}
+			if location := w.Header().Get("Location"); location != c.location {
+				t.Errorf("Expected Location header %q, got %q", c.location, location)
+			}
+		})
+	}
+}
+
+func TestRouterHandlePanics(t *testing.T) {
+	t.Parallel()
+
+	cases := map[string][]string{
+		"invalid-method": {"FOO /foo"},
+		"relative-path":  {"foo"},
+		"duplicate":      {"/foo", "/foo"},
+		"duplicate-method": {
+			"GET /foo",
+			"GET /foo",
+		},
+		"conflicting-params": {
+			"/foo/{id}",
+			"/foo/{name}",
+		},
+	}
+	for _name, _patterns := range cases {
+		name := _name
+		patterns := _patterns
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			defer func() {
+				if recover() == nil {
+					t.Errorf("Expected Handle to panic with %q", patterns)
+				}
+			}()
+			router := httpbp.NewRouter()
+			for _, pattern := range patterns {
+				router.Handle(pattern, routeEchoHandler(name))
+			}
+		})
+	}
+}
+
+func TestServerArgsRoutes(t *testing.T) {
+	store := newSecretsStore(t)
+	defer store.Close()
+
+	bp := baseplate.NewTestBaseplate(baseplate.NewTestBaseplateArgs{
+		Config:          baseplate.Config{Addr: ":8080"},
+		Store:           store,
+		EdgeContextImpl: ecinterface.Mock(),
+	})
+
+	var names []string
+	recordName := func(name string, next httpbp.HandlerFunc) httpbp.HandlerFunc {
+		return func(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+			names = append(names, name)
+			return next(ctx, w, r)
+		}
+	}
+	handle := func(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+		return httpbp.WriteRawContent(w, httpbp.Response{
+			Body: r.Method + " " + httpbp.PathParam(ctx, "id"),
+		}, httpbp.PlainTextContentType)
+	}
+
+	args, err := httpbp.ServerArgs{
+		Baseplate:        bp,
+		EndpointRegistry: httpbp.NewRouter(),
+		Endpoints: map[httpbp.Pattern]httpbp.Endpoint{
+			"GET /v1/users/{id}": {
+				Handle: handle,
+			},
+			"PUT /v1/users/{id}": {
+				Name:   "update-user",
+				Handle: handle,
+			},
+		},
+		Middlewares: []httpbp.Middleware{recordName},
+	}.SetupEndpoints()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, method := range []string{http.MethodGet, http.MethodPut} {
+		req := httptest.NewRequest(method, "/v1/users/foo", nil)
+		w := httptest.NewRecorder()
+		args.EndpointRegistry.ServeHTTP(w, req)
+		if expected := method + " foo"; w.Body.String() != expected {
+			t.Errorf("Expected body %q, got %q", expected, w.Body.String())
+		}
+	}
+	expectedNames := []string{"/v1/users/{id}", "update-user"}
+	if len(names) != len(expectedNames) || names[0] != expectedNames[0] || names[1] != expectedNames[1] {
+		t.Errorf("Expected endpoint names %q, got %q", expectedNames, names)
+	}
+
+	req := httptest.NewRequest(http.MethodDelete, "/v1/users/foo", nil)
+	w := httptest.NewRecorder()
+	args.EndpointRegistry.ServeHTTP(w, req)
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected code %d, got %d", http.StatusMethodNotAllowed, w.Code)
+	}
+	if allow := w.Header().Get(httpbp.AllowHeader); allow != "GET,HEAD,PUT" {
+		t.Errorf("Expected %s header %q, got %q", httpbp.AllowHeader, "GET,HEAD,PUT", allow)
+	}
+
+	_, err = httpbp.ServerArgs{
+		Baseplate:        bp,
+		EndpointRegistry: httpbp.NewRouter(),
+		Endpoints: map[httpbp.Pattern]httpbp.Endpoint{
+			"GET /v1/users/{id}": {
+				Methods: []string{http.MethodPost},
+				Handle:  handle,
+			},
+		},
+	}.ValidateAndSetDefaults()
+	if err == nil {
+		t.Error("Expected an error for Methods not matching the pattern, got nil")
+	}
+
+	// Methods in patterns require Router.
+	_, err = httpbp.ServerArgs{
+		Baseplate: bp,
+		Endpoints: map[httpbp.Pattern]httpbp.Endpoint{
+			"GET /v1/users/{id}": {
+				Name:    "get-user",
+				Methods: []string{http.MethodGet},
+				Handle:  handle,
+			},
+		},
+	}.ValidateAndSetDefaults()
+	if err == nil {
+		t.Error("Expected an error for pattern with method without Router, got nil")
+	}
+}
+
+func TestServerArgsRoutesNotFound(t *testing.T) {
+	recorder := tracingtest.Record(t)
+	store := newSecretsStore(t)
+	defer store.Close()
+
+	bp := baseplate.NewTestBaseplate(baseplate.NewTestBaseplateArgs{
+		Config:          baseplate.Config{Addr: ":8080"},
+		Store:           store,
+		EdgeContextImpl: ecinterface.Mock(),
+	})
+	args, err := httpbp.ServerArgs{
+		Baseplate:        bp,
+		EndpointRegistry: httpbp.NewRouter(),
+		Endpoints: map[httpbp.Pattern]httpbp.Endpoint{
+			"GET /v1/users/{id}": {
+				Handle: func(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+					return nil
+				},
+			},
+		},
+	}.SetupEndpoints()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name   string
+		method string
+		path   string
+		code   int
+	}{
+		{
+			name:   httpbp.NotFoundEndpointName,
+			method: http.MethodGet,
+			path:   "/v1/items/foo",
+			code:   http.StatusNotFound,
+		},
+		{
+			name:   httpbp.MethodNotAllowedEndpointName,
+			method: http.MethodDelete,
+			path:   "/v1/users/foo",
+			code:   http.StatusMethodNotAllowed,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			recorder.Reset()
+			metrics := httpbptest.NewEndpointMetrics(t, c.name)
+
+			req := httptest.NewRequest(c.method, c.path, nil)
+			w := httptest.NewRecorder()
+			args.EndpointRegistry.ServeHTTP(w, req)
+
+			if w.Code != c.code {
+				t.Errorf("Expected code %d, got %d", c.code, w.Code)
+			}
+			httpbptest.CheckServerSpan(t, recorder, c.name, nil)
+			metrics.CheckRequests(c.code, 1)
+		})
+	}
+}
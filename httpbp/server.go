@@ -4,9 +4,14 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"html/template"
 	"net/http"
 	"net/http/httptest"
 	"sync"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 
 	"github.com/reddit/baseplate.go"
 	"github.com/reddit/baseplate.go/errorsbp"
@@ -29,7 +34,7 @@ var allHTTPMethods = map[string]bool{
 // the underlying HTTP server.
 //
 // *http.ServeMux implements this interface and is the default EndpointRegistry
-// used by NewBaseplateServer.
+// used by NewBaseplateServer. *Router also implements this interface.
 type EndpointRegistry interface {
 	http.Handler
 
@@ -45,26 +50,57 @@ type httpHandlerFactory struct {
 }
 
 func (f httpHandlerFactory) NewHandler(endpoint Endpoint) http.Handler {
-	// +2 because we always add SupportedMethods and recoverPanic
-	wrappers := make([]Middleware, 0, len(f.middlewares)+len(endpoint.Middlewares)+2)
+	// +3 because we always add SupportedMethods and recoverPanic,
+	// and optionally CORS
+	wrappers := make([]Middleware, 0, len(f.middlewares)+len(endpoint.Middlewares)+3)
 	wrappers = append(wrappers, f.middlewares...)
+	if endpoint.CORS != nil {
+		// CORS must be before SupportedMethods to answer preflight requests.
+		cfg := *endpoint.CORS
+		if len(cfg.AllowedMethods) == 0 {
+			cfg.AllowedMethods = endpoint.Methods
+		}
+		wrappers = append(wrappers, CORS(cfg))
+	}
 	wrappers = append(wrappers, SupportedMethods(endpoint.Methods[0], endpoint.Methods[1:]...))
 	wrappers = append(wrappers, endpoint.Middlewares...)
 	// Always inject recoverPanic as the final middleware in the chain. This
 	// allows it to capture any panics before other middlewares return and bubble
 	// up the panic as an error to those middlewares.
 	wrappers = append(wrappers, recoverPanic)
-	return NewHandler(endpoint.Name, endpoint.Handle, wrappers...)
+	handler := NewHandler(endpoint.Name, endpoint.Handle, wrappers...)
+	if endpoint.CORS != nil {
+		return corsHandler{handler}
+	}
+	return handler
+}
+
+// corsHandler is the http.Handler of an Endpoint with CORS.
+//
+// Router routes the preflight requests of a path without OPTIONS handler to
+// it.
+type corsHandler struct {
+	http.Handler
 }
 
 // Pattern is the pattern passed to a EndpointRegistry when registering an
 // Endpoint.
+//
+// With the default http.ServeMux, see http.ServeMux for the format of patterns.
+// With Router as the EndpointRegistry, patterns are in the format of
+// "[METHOD ]/path" and can contain path parameters,
+// e.g. "GET /v1/users/{id}". See Router for details.
 type Pattern string
 
 // Endpoint holds the values needed to create a new HandlerFunc.
 type Endpoint struct {
 	// Name is required, it is the "name" of the endpoint that will be passed
 	// to any Middleware wrapping the HandlerFunc.
+	//
+	// When registered via ServerArgs.Endpoints with Router as the
+	// EndpointRegistry, it defaults to the path part of the Pattern (the route
+	// template, e.g. "/v1/users/{id}"),
+	// so it's used in the span names and metrics instead of raw paths.
 	Name string
 
 	// Methods is the list of HTTP methods that the endpoint supports.  Methods
@@ -75,6 +111,10 @@ type Endpoint struct {
 	// to ensure that you are using methods that are supported and in the format
 	// we expect.
 	// If you add http.MethodGet, http.MethodHead will be supported automatically.
+	//
+	// When registered via ServerArgs.Endpoints with Router as the
+	// EndpointRegistry and a Pattern that has a method,
+	// it defaults to that method.
 	Methods []string
 
 	// Handle is required, it is the base HandlerFunc that will be wrapped
@@ -84,6 +124,19 @@ type Endpoint struct {
 	// Middlewares is an optional list of additional Middleware to wrap the
 	// given HandlerFunc.
 	Middlewares []Middleware
+
+	// CORS is the optional CORS config of the endpoint.
+	//
+	// When set, the CORS middleware will be applied before SupportedMethods,
+	// and CORS.AllowedMethods defaults to Methods.
+	// With Router as the EndpointRegistry and a Pattern that has a method,
+	// the preflight requests of the path are also routed to the endpoint,
+	// unless an OPTIONS endpoint is registered for the same path.
+	CORS *CORSConfig
+
+	// Doc is the optional documentation of the endpoint used to generate the
+	// OpenAPI document, see ServerArgs.OpenAPI.
+	Doc *EndpointDoc
 }
 
 // Validate checks for input errors on the Endpoint and returns an error
@@ -108,6 +161,34 @@ func (e Endpoint) Validate() error {
 	return err.Compile()
 }
 
+// withPatternDefaults sets the default Name and Methods of the Endpoint from
+// the Pattern it's registered with.
+//
+// It returns an error if the method in the pattern is invalid or not in
+// Methods.
+func (e Endpoint) withPatternDefaults(pattern Pattern) (Endpoint, error) {
+	method, path := parsePattern(string(pattern))
+	if e.Name == "" {
+		e.Name = path
+	}
+	if method == "" {
+		return e, nil
+	}
+	if !allHTTPMethods[method] {
+		return e, fmt.Errorf("httpbp: Pattern %q contains an invalid method", pattern)
+	}
+	if len(e.Methods) == 0 {
+		e.Methods = []string{method}
+		return e, nil
+	}
+	for _, m := range e.Methods {
+		if m == method {
+			return e, nil
+		}
+	}
+	return e, fmt.Errorf("httpbp: Endpoint.Methods of %q does not contain the method of the pattern", pattern)
+}
+
 // ServerArgs defines all of the arguments used to create a new HTTP
 // Baseplate server.
 type ServerArgs struct {
@@ -118,10 +199,23 @@ type ServerArgs struct {
 	// Endpoints is the mapping of endpoint patterns to Endpoint objects that
 	// the Server will handle.
 	//
+	// With Router as the EndpointRegistry, the same path can be mapped to
+	// different Endpoints by methods, e.g. "GET /v1/users/{id}" and
+	// "PUT /v1/users/{id}".
+	//
 	// While endpoints is not technically required, if none are provided, your
 	// server will not handle any Endpoints.
 	Endpoints map[Pattern]Endpoint
 
+	// WebSockets is the optional mapping of endpoint patterns to
+	// WebSocketEndpoint objects that the Server will upgrade to WebSocket
+	// connections.
+	//
+	// Only the span and edge request context middlewares and the
+	// WebSocketEndpoint.Middlewares are applied to them, not Middlewares.
+	// The open connections are closed when the server is closed.
+	WebSockets map[Pattern]WebSocketEndpoint
+
 	// EndpointRegistry is an optional argument that can be used to customize
 	// the EndpointRegistry used by the Baseplate HTTP server.
 	//
@@ -129,6 +223,8 @@ type ServerArgs struct {
 	//
 	// Most servers will not need to set this, it has been provided for cases
 	// where you need to use something other than http.ServeMux.
+	// Set it to NewRouter() to use methods and path parameters in Patterns,
+	// see Router for details.
 	//
 	// If you do customize this, you should use a new EndpointRegistry and
 	// register your endpoints using server.Handle rather than pre-registering
@@ -154,6 +250,29 @@ type ServerArgs struct {
 	// Logger is an optional arg to be called when the InjectEdgeRequestContext
 	// middleware failed to parse the edge request header for any reason.
 	Logger log.Wrapper
+
+	// NegotiateErrors is optional. When true, the HTTPErrors returned by the
+	// endpoints and the built-in middlewares are written as JSON,
+	// RFC 7807 problem details or HTML, whichever is preferred by the
+	// "Accept" header of the request, see NegotiateErrors middleware.
+	//
+	// When false, each HTTPError is written in the format it was created with,
+	// e.g. the errors from the built-in middlewares are written as plain text.
+	NegotiateErrors bool
+
+	// ErrorTemplates is optional, the templates used to write the HTML errors
+	// when NegotiateErrors is true.
+	//
+	// If nil, errors are never written as HTML.
+	ErrorTemplates *template.Template
+
+	// OpenAPI is optional. When set, an OpenAPI document generated from
+	// Endpoints will be served at OpenAPI.Path.
+	//
+	// See NewOpenAPIDocument for details. When NegotiateErrors is true,
+	// the errors are documented with all the negotiated content types,
+	// see NewNegotiatedOpenAPIDocument.
+	OpenAPI *OpenAPIConfig
 }
 
 // ValidateAndSetDefaults checks the ServerArgs for any errors and sets any
@@ -167,12 +286,48 @@ func (args ServerArgs) ValidateAndSetDefaults() (ServerArgs, error) {
 	if args.Baseplate == nil {
 		inputErrors.Add(errors.New("argument Baseplate must be non-nil"))
 	}
-	for _, endpoint := range args.Endpoints {
-		inputErrors.Add(endpoint.Validate())
-	}
 	if args.EndpointRegistry == nil {
 		args.EndpointRegistry = http.NewServeMux()
 	}
+	// Methods in patterns are only understood by Router.
+	_, isRouter := args.EndpointRegistry.(*Router)
+	checkPattern := func(pattern Pattern) error {
+		if method, _ := parsePattern(string(pattern)); method != "" && !isRouter {
+			return fmt.Errorf("httpbp: Pattern %q has a method, which requires Router as the EndpointRegistry", pattern)
+		}
+		return nil
+	}
+	if args.Endpoints != nil {
+		// Copy the map so the defaults are not set on the caller's map.
+		endpoints := make(map[Pattern]Endpoint, len(args.Endpoints))
+		for pattern, endpoint := range args.Endpoints {
+			if isRouter {
+				var err error
+				endpoint, err = endpoint.withPatternDefaults(pattern)
+				inputErrors.Add(err)
+			} else {
+				inputErrors.Add(checkPattern(pattern))
+			}
+			inputErrors.Add(endpoint.Validate())
+			endpoints[pattern] = endpoint
+		}
+		args.Endpoints = endpoints
+	}
+	if args.WebSockets != nil {
+		websockets := make(map[Pattern]WebSocketEndpoint, len(args.WebSockets))
+		for pattern, endpoint := range args.WebSockets {
+			if isRouter {
+				var err error
+				endpoint, err = endpoint.withPatternDefaults(pattern)
+				inputErrors.Add(err)
+			} else {
+				inputErrors.Add(checkPattern(pattern))
+			}
+			inputErrors.Add(endpoint.Validate())
+			websockets[pattern] = endpoint
+		}
+		args.WebSockets = websockets
+	}
 	if args.TrustHandler == nil {
 		args.TrustHandler = NeverTrustHeaders{}
 	}
@@ -196,12 +351,51 @@ func (args ServerArgs) SetupEndpoints() (ServerArgs, error) {
 		EdgeContextImpl: args.Baseplate.EdgeContextImpl(),
 		Logger:          args.Logger,
 	})
+	if args.NegotiateErrors {
+		wrappers = append(wrappers, NegotiateErrors(args.ErrorTemplates))
+	}
 	wrappers = append(wrappers, args.Middlewares...)
 
+	if router, ok := args.EndpointRegistry.(*Router); ok {
+		router.setDefaultErrorHandlers(args)
+	}
+
 	factory := httpHandlerFactory{middlewares: wrappers}
 	for pattern, endpoint := range args.Endpoints {
 		args.EndpointRegistry.Handle(string(pattern), factory.NewHandler(endpoint))
 	}
+
+	if len(args.WebSockets) > 0 {
+		conns := newWebSocketConns()
+		// Copy the slice so the callback is not added to the caller's slice.
+		args.OnShutdown = append(append([]func(){}, args.OnShutdown...), conns.closeAll)
+		wsFactory := httpHandlerFactory{middlewares: webSocketMiddleware(args)}
+		for pattern, endpoint := range args.WebSockets {
+			args.EndpointRegistry.Handle(string(pattern), wsFactory.newWebSocketHandler(endpoint, conns))
+		}
+	}
+
+	if args.OpenAPI != nil {
+		var doc *OpenAPIDocument
+		var err error
+		if args.NegotiateErrors {
+			doc, err = NewNegotiatedOpenAPIDocument(args.OpenAPI.Info, args.Endpoints, args.ErrorTemplates)
+		} else {
+			doc, err = NewOpenAPIDocument(args.OpenAPI.Info, args.Endpoints)
+		}
+		if err != nil {
+			return args, err
+		}
+		endpoint, err := openAPIEndpoint(doc)
+		if err != nil {
+			return args, err
+		}
+		path := args.OpenAPI.Path
+		if path == "" {
+			path = DefaultOpenAPIPath
+		}
+		args.EndpointRegistry.Handle(path, factory.NewHandler(endpoint))
+	}
 	return args, nil
 }
 
@@ -212,25 +406,68 @@ func (args ServerArgs) SetupEndpoints() (ServerArgs, error) {
 // default Baseplate Middleware as well as any additional Middleware
 // passed in. In addition, panics will be automatically recovered from, reported,
 // and passed up the middleware chain as an HTTPError with the status code 500.
+//
+// The timeouts, TLS and h2c support of the server are configured by the HTTP
+// section of the baseplate.Config, see baseplate.HTTPConfig.
 func NewBaseplateServer(args ServerArgs) (baseplate.Server, error) {
 	args, err := args.SetupEndpoints()
 	if err != nil {
 		return nil, err
 	}
 
+	cfg := args.Baseplate.GetConfig()
 	srv := &http.Server{
-		Addr:    args.Baseplate.GetConfig().Addr,
-		Handler: args.EndpointRegistry,
+		Addr:              cfg.Addr,
+		Handler:           args.EndpointRegistry,
+		ReadTimeout:       httpTimeout(cfg.HTTP.ReadTimeout, 0),
+		ReadHeaderTimeout: httpTimeout(cfg.HTTP.ReadHeaderTimeout, baseplate.DefaultHTTPReadHeaderTimeout),
+		WriteTimeout:      httpTimeout(cfg.HTTP.WriteTimeout, 0),
+		IdleTimeout:       httpTimeout(cfg.HTTP.IdleTimeout, baseplate.DefaultHTTPIdleTimeout),
+	}
+	stop := func() {}
+	switch {
+	case cfg.HTTP.TLS != nil:
+		ctx, cancel := context.WithTimeout(context.Background(), tlsLoadTimeout)
+		defer cancel()
+		srv.TLSConfig, stop, err = NewTLSConfig(ctx, *cfg.HTTP.TLS, args.Baseplate.Secrets(), args.Logger)
+		if err != nil {
+			return nil, err
+		}
+	case cfg.HTTP.H2C:
+		srv.Handler = h2c.NewHandler(srv.Handler, &http2.Server{
+			IdleTimeout: srv.IdleTimeout,
+		})
 	}
 	for _, f := range args.OnShutdown {
 		srv.RegisterOnShutdown(f)
 	}
-	return &server{args.Baseplate, srv}, nil
+	return &server{
+		bp:   args.Baseplate,
+		srv:  srv,
+		stop: stop,
+	}, nil
+}
+
+// tlsLoadTimeout is the max duration to wait for the TLS files to be available.
+const tlsLoadTimeout = 10 * time.Second
+
+// httpTimeout returns the http.Server timeout for the configured value,
+// where 0 means the default value and < 0 means no timeout.
+func httpTimeout(v, defaultValue time.Duration) time.Duration {
+	switch {
+	case v < 0:
+		return 0
+	case v == 0:
+		return defaultValue
+	default:
+		return v
+	}
 }
 
 type server struct {
-	bp  baseplate.Baseplate
-	srv *http.Server
+	bp   baseplate.Baseplate
+	srv  *http.Server
+	stop func()
 }
 
 func (s server) Baseplate() baseplate.Baseplate {
@@ -242,7 +479,13 @@ func (s server) Serve() error {
 	// "expected" error for it to return after being shutdown.
 	//
 	// https://golang.org/pkg/net/http/#Server.ListenAndServe
-	err := s.srv.ListenAndServe()
+	var err error
+	if s.srv.TLSConfig != nil {
+		// The certificate is provided by TLSConfig.GetCertificate.
+		err = s.srv.ListenAndServeTLS("", "")
+	} else {
+		err = s.srv.ListenAndServe()
+	}
 	if errors.Is(err, http.ErrServerClosed) {
 		return nil
 	}
@@ -251,6 +494,7 @@ func (s server) Serve() error {
 }
 
 func (s server) Close() error {
+	defer s.stop()
 	return s.srv.Shutdown(context.TODO())
 }
 
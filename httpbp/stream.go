@@ -0,0 +1,392 @@
+package httpbp
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/opentracing/opentracing-go"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/reddit/baseplate.go/tracing"
+)
+
+const (
+	// SSEContentType is the Content-Type header for Server-Sent Events streams.
+	SSEContentType = "text/event-stream"
+
+	// NDJSONContentType is the Content-Type header for newline delimited JSON
+	// streams.
+	NDJSONContentType = "application/x-ndjson"
+
+	// LastEventIDHeader is the header sent by the browsers when reconnecting to
+	// a Server-Sent Events stream.
+	LastEventIDHeader = "Last-Event-ID"
+)
+
+// DefaultStreamHeartbeatInterval is the default StreamConfig.HeartbeatInterval.
+const DefaultStreamHeartbeatInterval = 15 * time.Second
+
+// Span tags set by Stream.Close.
+const (
+	StreamBytesTag    = "stream.bytes"
+	StreamEventsTag   = "stream.events"
+	StreamDurationTag = "stream.duration_ms"
+)
+
+// Stream errors.
+var (
+	// ErrStreamingNotSupported is returned when creating a stream with a
+	// http.ResponseWriter that does not implement http.Flusher.
+	ErrStreamingNotSupported = errors.New("httpbp: http.ResponseWriter does not support flushing")
+
+	// ErrStreamClosed is returned when writing to a closed stream.
+	ErrStreamClosed = errors.New("httpbp: stream closed")
+
+	// ErrInvalidEvent is returned by SSEStream.Send when the event ID or type
+	// contains newlines.
+	ErrInvalidEvent = errors.New("httpbp: event ID and type must not contain newlines")
+)
+
+var (
+	streamLabels = []string{
+		endpointLabel,
+	}
+
+	streamActive = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: promNamespace,
+		Subsystem: subsystemServer,
+		Name:      "stream_active",
+		Help:      "The number of open streaming responses",
+	}, streamLabels)
+
+	streamBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: promNamespace,
+		Subsystem: subsystemServer,
+		Name:      "stream_bytes_total",
+		Help:      "The number of bytes written to streaming responses",
+	}, streamLabels)
+
+	streamEvents = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: promNamespace,
+		Subsystem: subsystemServer,
+		Name:      "stream_events_total",
+		Help:      "The number of events written to streaming responses, excluding heartbeats",
+	}, streamLabels)
+
+	streamDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: promNamespace,
+		Subsystem: subsystemServer,
+		Name:      "stream_duration_seconds",
+		Help:      "The duration of streaming responses",
+		// 100ms ~ 7.3h
+		Buckets: prometheus.ExponentialBuckets(0.1, 4, 10),
+	}, streamLabels)
+)
+
+// StreamConfig is the configuration of the streams created by NewSSEStream and
+// NewNDJSONStream.
+type StreamConfig struct {
+	// The interval of the heartbeats sent when nothing else is written to the
+	// stream, to keep the connection from being closed by proxies.
+	//
+	// Optional. Default to DefaultStreamHeartbeatInterval if 0,
+	// heartbeats are disabled if < 0.
+	HeartbeatInterval time.Duration
+}
+
+// Stream is the common part of SSEStream and NDJSONStream.
+//
+// It writes the response headers when created,
+// and flushes after every write so the client receives the data immediately.
+// Writes fail with the context error after the request context is canceled
+// (e.g. the client went away), and return ErrStreamClosed after Close is
+// called.
+//
+// Close must be called when the handler finishes writing to the stream,
+// which records the number of bytes and events written and the duration of the
+// stream in the server span (see StreamBytesTag, StreamEventsTag and
+// StreamDurationTag) and the httpbp_server_stream_* prometheus metrics.
+//
+// It's safe for concurrent use.
+type Stream struct {
+	ctx       context.Context
+	w         http.ResponseWriter
+	flusher   http.Flusher
+	heartbeat []byte
+	endpoint  string
+	span      *tracing.Span
+	start     time.Time
+	done      chan struct{}
+	wg        sync.WaitGroup
+
+	lock      sync.Mutex
+	closed    bool
+	err       error
+	bytes     int64
+	events    int64
+	lastWrite time.Time
+}
+
+func newStream(ctx context.Context, w http.ResponseWriter, cfg StreamConfig, contentType string, heartbeat []byte) (*Stream, error) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		return nil, ErrStreamingNotSupported
+	}
+
+	s := &Stream{
+		ctx:       ctx,
+		w:         w,
+		flusher:   flusher,
+		heartbeat: heartbeat,
+		start:     time.Now(),
+		done:      make(chan struct{}),
+	}
+	// The server span is named after the endpoint.
+	if span, ok := opentracing.SpanFromContext(ctx).(*tracing.Span); ok && span != nil {
+		s.span = span
+		s.endpoint = span.Name()
+	}
+	s.lastWrite = s.start
+
+	h := w.Header()
+	h.Set(ContentTypeHeader, contentType)
+	h.Set("Cache-Control", "no-cache")
+	// Disable response buffering on nginx.
+	h.Set("X-Accel-Buffering", "no")
+	h.Del(ContentLengthHeader)
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	commitResponse(ctx)
+	streamActive.With(prometheus.Labels{endpointLabel: s.endpoint}).Inc()
+
+	interval := cfg.HeartbeatInterval
+	if interval == 0 {
+		interval = DefaultStreamHeartbeatInterval
+	}
+	if interval > 0 {
+		s.wg.Add(1)
+		go s.sendHeartbeats(interval)
+	}
+	return s, nil
+}
+
+func (s *Stream) sendHeartbeats(interval time.Duration) {
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+			s.lock.Lock()
+			idle := time.Since(s.lastWrite) >= interval
+			s.lock.Unlock()
+			if idle {
+				if err := s.write(s.heartbeat, false); err != nil {
+					return
+				}
+			}
+		}
+	}
+}
+
+// write writes p to the stream and flushes it.
+func (s *Stream) write(p []byte, event bool) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.closed {
+		return ErrStreamClosed
+	}
+	if s.err != nil {
+		return s.err
+	}
+	if err := s.ctx.Err(); err != nil {
+		return err
+	}
+	n, err := s.w.Write(p)
+	s.bytes += int64(n)
+	if err != nil {
+		s.err = fmt.Errorf("httpbp: failed to write to stream: %w", err)
+		return s.err
+	}
+	s.flusher.Flush()
+	s.lastWrite = time.Now()
+	if event {
+		s.events++
+	}
+	return nil
+}
+
+// Context returns the context of the stream,
+// which is canceled when the client goes away.
+func (s *Stream) Context() context.Context {
+	return s.ctx
+}
+
+// Close stops the heartbeats and records the metrics of the stream.
+//
+// It does not close the underlying connection, which is done by the server
+// after the handler returns.
+// It's safe to be called multiple times, and it always returns nil.
+func (s *Stream) Close() error {
+	s.lock.Lock()
+	if s.closed {
+		s.lock.Unlock()
+		return nil
+	}
+	s.closed = true
+	s.lock.Unlock()
+
+	close(s.done)
+	s.wg.Wait()
+
+	duration := time.Since(s.start)
+	labels := prometheus.Labels{endpointLabel: s.endpoint}
+	streamActive.With(labels).Dec()
+	streamBytes.With(labels).Add(float64(s.bytes))
+	streamEvents.With(labels).Add(float64(s.events))
+	streamDuration.With(labels).Observe(duration.Seconds())
+	if s.span != nil {
+		s.span.SetTag(StreamBytesTag, s.bytes)
+		s.span.SetTag(StreamEventsTag, s.events)
+		s.span.SetTag(StreamDurationTag, duration.Milliseconds())
+	}
+	return nil
+}
+
+// Event is a single Server-Sent Event.
+type Event struct {
+	// The optional event ID, which will be sent back by the browsers in the
+	// "Last-Event-ID" header when reconnecting.
+	ID string
+
+	// The optional event type. The browsers default it to "message".
+	Event string
+
+	// The data of the event. Multiline data will be sent as multiple "data"
+	// fields, which the browsers join back with newlines.
+	Data string
+
+	// Optional, if > 0, it tells the browsers how long to wait before
+	// reconnecting after the connection is lost.
+	// It's truncated to milliseconds.
+	Retry time.Duration
+}
+
+// SSEStream is a Server-Sent Events stream.
+//
+// Heartbeats are sent as comments, which are ignored by the browsers.
+type SSEStream struct {
+	*Stream
+}
+
+// NewSSEStream writes the headers of a Server-Sent Events response and returns
+// the SSEStream to send the events.
+//
+// The ctx should be the one passed into the HandlerFunc,
+// and the HandlerFunc should call Close before returning, for example:
+//
+//     func (s *server) events(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+//         stream, err := httpbp.NewSSEStream(ctx, w, httpbp.StreamConfig{})
+//         if err != nil {
+//             return err
+//         }
+//         defer stream.Close()
+//
+//         for event := range s.subscribe(ctx, httpbp.LastEventID(r)) {
+//             if err := stream.Send(event); err != nil {
+//                 return err
+//             }
+//         }
+//         return nil
+//     }
+//
+// Errors returned after the stream is created can't be written to the client
+// anymore, so no error response is written for them,
+// but they are still reported to the span and the metrics.
+func NewSSEStream(ctx context.Context, w http.ResponseWriter, cfg StreamConfig) (*SSEStream, error) {
+	s, err := newStream(ctx, w, cfg, SSEContentType, []byte(":\n\n"))
+	if err != nil {
+		return nil, err
+	}
+	return &SSEStream{Stream: s}, nil
+}
+
+// Send sends the event to the client.
+func (s *SSEStream) Send(e Event) error {
+	if strings.ContainsAny(e.ID, "\r\n\x00") || strings.ContainsAny(e.Event, "\r\n") {
+		return ErrInvalidEvent
+	}
+
+	var sb strings.Builder
+	if e.ID != "" {
+		sb.WriteString("id: ")
+		sb.WriteString(e.ID)
+		sb.WriteString("\n")
+	}
+	if e.Event != "" {
+		sb.WriteString("event: ")
+		sb.WriteString(e.Event)
+		sb.WriteString("\n")
+	}
+	if e.Retry > 0 {
+		sb.WriteString("retry: ")
+		sb.WriteString(strconv.FormatInt(e.Retry.Milliseconds(), 10))
+		sb.WriteString("\n")
+	}
+	data := strings.ReplaceAll(e.Data, "\r\n", "\n")
+	for _, line := range strings.Split(data, "\n") {
+		sb.WriteString("data: ")
+		sb.WriteString(line)
+		sb.WriteString("\n")
+	}
+	sb.WriteString("\n")
+	return s.write([]byte(sb.String()), true)
+}
+
+// LastEventID returns the ID of the last Server-Sent Event received by the
+// client before reconnecting, or empty string if it's not a reconnection.
+func LastEventID(r *http.Request) string {
+	return r.Header.Get(LastEventIDHeader)
+}
+
+// NDJSONStream is a newline delimited JSON stream.
+//
+// Heartbeats are sent as empty lines, which should be skipped by the clients.
+type NDJSONStream struct {
+	*Stream
+}
+
+// NewNDJSONStream writes the headers of a newline delimited JSON response and
+// returns the NDJSONStream to write the values.
+//
+// See NewSSEStream for an example.
+func NewNDJSONStream(ctx context.Context, w http.ResponseWriter, cfg StreamConfig) (*NDJSONStream, error) {
+	s, err := newStream(ctx, w, cfg, NDJSONContentType, []byte("\n"))
+	if err != nil {
+		return nil, err
+	}
+	return &NDJSONStream{Stream: s}, nil
+}
+
+// Encode writes the JSON encoding of v as a single line to the stream.
+func (s *NDJSONStream) Encode(v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("httpbp: failed to encode %#v: %w", v, err)
+	}
+	return s.write(append(data, '\n'), true)
+}
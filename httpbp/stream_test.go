@@ -0,0 +1,220 @@
+package httpbp_test
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/reddit/baseplate.go/ecinterface"
+	"github.com/reddit/baseplate.go/httpbp"
+	"github.com/reddit/baseplate.go/prometheusbp/promtest"
+	"github.com/reddit/baseplate.go/tracing/tracingtest"
+)
+
+func newStreamServer(t *testing.T, name string, handle httpbp.HandlerFunc) *httptest.Server {
+	t.Helper()
+
+	server := httptest.NewServer(httpbp.NewHandler(
+		name,
+		handle,
+		httpbp.DefaultMiddleware(httpbp.DefaultMiddlewareArgs{
+			EdgeContextImpl: ecinterface.Mock(),
+		})...,
+	))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestSSEStream(t *testing.T) {
+	recorder := tracingtest.Record(t)
+
+	const name = "sse"
+	labels := prometheus.Labels{"http_endpoint": name}
+	events := promtest.NewGatheredMetricTest(t, "httpbp_server_stream_events_total", labels)
+	streamBytes := promtest.NewGatheredMetricTest(t, "httpbp_server_stream_bytes_total", labels)
+	server := newStreamServer(t, name, func(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+		stream, err := httpbp.NewSSEStream(ctx, w, httpbp.StreamConfig{
+			HeartbeatInterval: 10 * time.Millisecond,
+		})
+		if err != nil {
+			return err
+		}
+		defer stream.Close()
+
+		if err := stream.Send(httpbp.Event{
+			ID:    httpbp.LastEventID(r) + "1",
+			Event: "greeting",
+			Data:  "hello\nworld",
+			Retry: 3 * time.Second,
+		}); err != nil {
+			return err
+		}
+		// Wait for some heartbeats.
+		time.Sleep(50 * time.Millisecond)
+		if err := stream.Send(httpbp.Event{Data: "bye"}); err != nil {
+			return err
+		}
+		if err := stream.Send(httpbp.Event{ID: "invalid\n"}); !errors.Is(err, httpbp.ErrInvalidEvent) {
+			t.Errorf("Expected ErrInvalidEvent, got %v", err)
+		}
+		return nil
+	})
+
+	req, err := http.NewRequest(http.MethodGet, server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set(httpbp.LastEventIDHeader, "0")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if contentType := resp.Header.Get(httpbp.ContentTypeHeader); contentType != httpbp.SSEContentType {
+		t.Errorf("Expected content type %q, got %q", httpbp.SSEContentType, contentType)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const first = "id: 01\nevent: greeting\nretry: 3000\ndata: hello\ndata: world\n\n"
+	if !strings.HasPrefix(string(body), first) {
+		t.Errorf("Expected body to start with %q, got %q", first, body)
+	}
+	const last = "data: bye\n\n"
+	if !strings.HasSuffix(string(body), last) {
+		t.Errorf("Expected body to end with %q, got %q", last, body)
+	}
+	if !strings.Contains(string(body), ":\n\n") {
+		t.Errorf("Expected heartbeats in body, got %q", body)
+	}
+
+	events.CheckDelta(2)
+	streamBytes.CheckDelta(float64(len(body)))
+	span := recorder.MustFind(t, name)
+	if events := span.Tags[httpbp.StreamEventsTag]; events != "2" {
+		t.Errorf("Expected span tag %s to be %q, got %q", httpbp.StreamEventsTag, "2", events)
+	}
+	if _, ok := span.Tags[httpbp.StreamDurationTag]; !ok {
+		t.Errorf("Expected span tag %s, got %v", httpbp.StreamDurationTag, span.Tags)
+	}
+}
+
+func TestNDJSONStreamCanceled(t *testing.T) {
+	t.Parallel()
+
+	errCh := make(chan error, 1)
+	server := newStreamServer(t, "ndjson", func(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+		stream, err := httpbp.NewNDJSONStream(ctx, w, httpbp.StreamConfig{
+			HeartbeatInterval: -1,
+		})
+		if err != nil {
+			return err
+		}
+		defer stream.Close()
+
+		for i := 0; ; i++ {
+			if err := stream.Encode(map[string]int{"i": i}); err != nil {
+				errCh <- err
+				return err
+			}
+			time.Sleep(time.Millisecond)
+		}
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if contentType := resp.Header.Get(httpbp.ContentTypeHeader); contentType != httpbp.NDJSONContentType {
+		t.Errorf("Expected content type %q, got %q", httpbp.NDJSONContentType, contentType)
+	}
+	line, err := bufio.NewReader(resp.Body).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if line != `{"i":0}`+"\n" {
+		t.Errorf("Expected first line %q, got %q", `{"i":0}`, line)
+	}
+	cancel()
+
+	select {
+	case err := <-errCh:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("Expected context.Canceled after the client went away, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Stream not stopped after the client went away")
+	}
+}
+
+func TestStreamError(t *testing.T) {
+	recorder := tracingtest.Record(t)
+
+	const name = "stream-error"
+	streamErr := errors.New("test")
+	server := newStreamServer(t, name, func(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+		stream, err := httpbp.NewNDJSONStream(ctx, w, httpbp.StreamConfig{
+			HeartbeatInterval: -1,
+		})
+		if err != nil {
+			return err
+		}
+		defer stream.Close()
+
+		if err := stream.Encode(map[string]int{"n": 1}); err != nil {
+			return err
+		}
+		return httpbp.JSONError(httpbp.InternalServerError(), streamErr)
+	})
+
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected code %d, got %d", http.StatusOK, resp.StatusCode)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := "{\"n\":1}\n"; string(body) != expected {
+		t.Errorf("Expected no error response written into the stream, got body %q", body)
+	}
+	if span := recorder.MustFind(t, name); !errors.Is(span.Err, streamErr) {
+		t.Errorf("Expected the span error to be %v, got %v", streamErr, span.Err)
+	}
+}
+
+func TestStreamNotSupported(t *testing.T) {
+	t.Parallel()
+
+	// A http.ResponseWriter without http.Flusher.
+	var w struct {
+		http.ResponseWriter
+	}
+	w.ResponseWriter = httptest.NewRecorder()
+	if _, err := httpbp.NewSSEStream(context.Background(), w, httpbp.StreamConfig{}); !errors.Is(err, httpbp.ErrStreamingNotSupported) {
+		t.Errorf("Expected ErrStreamingNotSupported, got %v", err)
+	}
+}
@@ -0,0 +1,179 @@
+package httpbp
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/reddit/baseplate.go"
+	"github.com/reddit/baseplate.go/filewatcher"
+	"github.com/reddit/baseplate.go/log"
+	"github.com/reddit/baseplate.go/secrets"
+)
+
+var clientAuthTypes = map[string]tls.ClientAuthType{
+	"none":               tls.NoClientCert,
+	"request":            tls.RequestClientCert,
+	"require":            tls.RequireAnyClientCert,
+	"verify-if-given":    tls.VerifyClientCertIfGiven,
+	"require-and-verify": tls.RequireAndVerifyClientCert,
+}
+
+// NewTLSConfig returns a *tls.Config serving the certificate configured by cfg.
+//
+// The certificate is reloaded whenever the files or the secrets change,
+// and the previous certificate is kept being served when the new one is
+// invalid, e.g. when only one of the certificate and key files is updated.
+// When cfg.ClientCAFile is set the client CAs are reloaded the same way.
+//
+// store is only used when the certificate is loaded from secrets.
+// ctx is only used to wait for the files to be available.
+// The returned stop function stops watching the files.
+func NewTLSConfig(ctx context.Context, cfg baseplate.TLSConfig, store *secrets.Store, logger log.Wrapper) (_ *tls.Config, stop func(), err error) {
+	var watchers []*filewatcher.Result
+	stopWatchers := func() {
+		for _, w := range watchers {
+			w.Stop()
+		}
+	}
+	defer func() {
+		if err != nil {
+			stopWatchers()
+		}
+	}()
+	watch := func(path string, parser filewatcher.Parser) (*filewatcher.Result, error) {
+		w, err := filewatcher.New(ctx, filewatcher.Config{
+			Path:   path,
+			Parser: parser,
+			Logger: logger,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("httpbp: failed to load %q: %w", path, err)
+		}
+		watchers = append(watchers, w)
+		return w, nil
+	}
+
+	loader := new(certificateLoader)
+	switch {
+	case cfg.CertFile != "" && cfg.KeyFile != "":
+		cert, err := watch(cfg.CertFile, readAllParser)
+		if err != nil {
+			return nil, nil, err
+		}
+		key, err := watch(cfg.KeyFile, readAllParser)
+		if err != nil {
+			return nil, nil, err
+		}
+		loader.load = func() ([]byte, []byte, error) {
+			return cert.Get().([]byte), key.Get().([]byte), nil
+		}
+	case cfg.CertSecretPath != "" && cfg.KeySecretPath != "":
+		if store == nil {
+			return nil, nil, errors.New("httpbp: secrets store is required to load TLS certificate from secrets")
+		}
+		loader.load = func() ([]byte, []byte, error) {
+			cert, err := store.GetSimpleSecret(cfg.CertSecretPath)
+			if err != nil {
+				return nil, nil, err
+			}
+			key, err := store.GetSimpleSecret(cfg.KeySecretPath)
+			if err != nil {
+				return nil, nil, err
+			}
+			return cert.Value, key.Value, nil
+		}
+	default:
+		return nil, nil, errors.New("httpbp: TLS requires either CertFile and KeyFile, or CertSecretPath and KeySecretPath")
+	}
+	// Fail early on invalid certificates.
+	if _, err := loader.getCertificate(nil); err != nil {
+		return nil, nil, err
+	}
+
+	clientAuth := cfg.ClientAuth
+	if clientAuth == "" {
+		clientAuth = "none"
+		if cfg.ClientCAFile != "" {
+			clientAuth = "require-and-verify"
+		}
+	}
+	authType, ok := clientAuthTypes[clientAuth]
+	if !ok {
+		return nil, nil, fmt.Errorf("httpbp: invalid TLS client auth %q", cfg.ClientAuth)
+	}
+
+	tlsConfig := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: loader.getCertificate,
+		ClientAuth:     authType,
+	}
+	if cfg.ClientCAFile != "" {
+		clientCAs, err := watch(cfg.ClientCAFile, certPoolParser)
+		if err != nil {
+			return nil, nil, err
+		}
+		tlsConfig.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			c := tlsConfig.Clone()
+			c.GetConfigForClient = nil
+			c.ClientCAs = clientCAs.Get().(*x509.CertPool)
+			return c, nil
+		}
+	}
+	return tlsConfig, stopWatchers, nil
+}
+
+func readAllParser(r io.Reader) (interface{}, error) {
+	return io.ReadAll(r)
+}
+
+func certPoolParser(r io.Reader) (interface{}, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, errors.New("httpbp: no valid PEM certificate found")
+	}
+	return pool, nil
+}
+
+// certificateLoader parses the certificate returned by load whenever it
+// changes.
+type certificateLoader struct {
+	load func() (certPEM, keyPEM []byte, err error)
+
+	lock    sync.Mutex
+	certPEM []byte
+	keyPEM  []byte
+	cert    *tls.Certificate
+}
+
+// getCertificate implements tls.Config.GetCertificate.
+func (l *certificateLoader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	certPEM, keyPEM, err := l.load()
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if err == nil && l.cert != nil && bytes.Equal(certPEM, l.certPEM) && bytes.Equal(keyPEM, l.keyPEM) {
+		return l.cert, nil
+	}
+	if err == nil {
+		var cert tls.Certificate
+		if cert, err = tls.X509KeyPair(certPEM, keyPEM); err == nil {
+			l.certPEM, l.keyPEM, l.cert = certPEM, keyPEM, &cert
+			return l.cert, nil
+		}
+	}
+	if l.cert != nil {
+		// Keep serving the previous certificate.
+		return l.cert, nil
+	}
+	return nil, fmt.Errorf("httpbp: failed to load TLS certificate: %w", err)
+}
@@ -0,0 +1,361 @@
+package httpbp_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/net/http2"
+
+	"github.com/reddit/baseplate.go"
+	"github.com/reddit/baseplate.go/ecinterface"
+	"github.com/reddit/baseplate.go/httpbp"
+	"github.com/reddit/baseplate.go/secrets"
+)
+
+type testCert struct {
+	certPEM []byte
+	keyPEM  []byte
+	cert    *x509.Certificate
+	tls     tls.Certificate
+}
+
+// newTestCert returns a new certificate for 127.0.0.1,
+// signed by parent or self-signed when parent is nil.
+func newTestCert(t *testing.T, name string, parent *testCert) *testCert {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  parent == nil,
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	signer, signerKey := template, interface{}(key)
+	if parent != nil {
+		signer, signerKey = parent.cert, parent.tls.PrivateKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &testCert{
+		certPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		keyPEM:  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+	}
+	if c.cert, err = x509.ParseCertificate(der); err != nil {
+		t.Fatal(err)
+	}
+	if c.tls, err = tls.X509KeyPair(c.certPEM, c.keyPEM); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func (c *testCert) pool() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(c.cert)
+	return pool
+}
+
+func writeFile(t *testing.T, path string, data []byte) {
+	t.Helper()
+
+	// Write and rename to replace the file atomically.
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// serveTLS serves tlsConfig on a new listener and returns its address.
+func serveTLS(t *testing.T, tlsConfig *tls.Config) string {
+	t.Helper()
+
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", tlsConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}),
+	}
+	go srv.Serve(ln)
+	t.Cleanup(func() { srv.Close() })
+	return ln.Addr().String()
+}
+
+// peerCertName returns the common name of the certificate served at addr.
+func peerCertName(addr string, rootCAs *x509.CertPool, clientCert *tls.Certificate) (string, error) {
+	cfg := &tls.Config{RootCAs: rootCAs}
+	if clientCert != nil {
+		cfg.Certificates = []tls.Certificate{*clientCert}
+	}
+	conn, err := tls.Dial("tcp", addr, cfg)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	// The client certificate is only verified by the server after the
+	// handshake with TLS 1.3, so do a round trip to catch the error.
+	if _, err := conn.Write([]byte("GET / HTTP/1.1\r\nHost: test\r\n\r\n")); err != nil {
+		return "", err
+	}
+	if _, err := conn.Read(make([]byte, 1)); err != nil {
+		return "", err
+	}
+	return conn.ConnectionState().PeerCertificates[0].Subject.CommonName, nil
+}
+
+func TestNewTLSConfigFiles(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	ca := newTestCert(t, "ca", nil)
+	cert := newTestCert(t, "first", ca)
+	writeFile(t, certFile, cert.certPEM)
+	writeFile(t, keyFile, cert.keyPEM)
+
+	tlsConfig, stop, err := httpbp.NewTLSConfig(context.Background(), baseplate.TLSConfig{
+		CertFile: certFile,
+		KeyFile:  keyFile,
+	}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stop()
+	addr := serveTLS(t, tlsConfig)
+
+	if name, err := peerCertName(addr, ca.pool(), nil); err != nil {
+		t.Fatal(err)
+	} else if name != "first" {
+		t.Errorf("Expected certificate %q, got %q", "first", name)
+	}
+
+	// An invalid key pair keeps the previous certificate.
+	next := newTestCert(t, "second", ca)
+	writeFile(t, certFile, next.certPEM)
+	time.Sleep(100 * time.Millisecond)
+	if name, err := peerCertName(addr, ca.pool(), nil); err != nil {
+		t.Fatal(err)
+	} else if name != "first" {
+		t.Errorf("Expected certificate %q with mismatched key, got %q", "first", name)
+	}
+
+	writeFile(t, keyFile, next.keyPEM)
+	var name string
+	for i := 0; i < 100 && name != "second"; i++ {
+		time.Sleep(10 * time.Millisecond)
+		if name, err = peerCertName(addr, ca.pool(), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if name != "second" {
+		t.Errorf("Expected certificate %q after reload, got %q", "second", name)
+	}
+}
+
+func TestNewTLSConfigSecrets(t *testing.T) {
+	t.Parallel()
+
+	ca := newTestCert(t, "ca", nil)
+	cert := newTestCert(t, "first", ca)
+	raw := func(cert *testCert) map[string]secrets.GenericSecret {
+		return map[string]secrets.GenericSecret{
+			"secret/tls/cert": {Type: secrets.SimpleType, Value: string(cert.certPEM)},
+			"secret/tls/key":  {Type: secrets.SimpleType, Value: string(cert.keyPEM)},
+		}
+	}
+	store, fw, err := secrets.NewTestSecrets(context.Background(), raw(cert))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	tlsConfig, stop, err := httpbp.NewTLSConfig(context.Background(), baseplate.TLSConfig{
+		CertSecretPath: "secret/tls/cert",
+		KeySecretPath:  "secret/tls/key",
+	}, store, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stop()
+	addr := serveTLS(t, tlsConfig)
+
+	if name, err := peerCertName(addr, ca.pool(), nil); err != nil {
+		t.Fatal(err)
+	} else if name != "first" {
+		t.Errorf("Expected certificate %q, got %q", "first", name)
+	}
+
+	if err := secrets.UpdateTestSecrets(fw, raw(newTestCert(t, "second", ca))); err != nil {
+		t.Fatal(err)
+	}
+	if name, err := peerCertName(addr, ca.pool(), nil); err != nil {
+		t.Fatal(err)
+	} else if name != "second" {
+		t.Errorf("Expected certificate %q after rotation, got %q", "second", name)
+	}
+}
+
+func TestNewTLSConfigClientAuth(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	caFile := filepath.Join(dir, "ca.pem")
+	ca := newTestCert(t, "ca", nil)
+	cert := newTestCert(t, "server", ca)
+	writeFile(t, certFile, cert.certPEM)
+	writeFile(t, keyFile, cert.keyPEM)
+	clientCA := newTestCert(t, "client-ca", nil)
+	writeFile(t, caFile, clientCA.certPEM)
+
+	tlsConfig, stop, err := httpbp.NewTLSConfig(context.Background(), baseplate.TLSConfig{
+		CertFile:     certFile,
+		KeyFile:      keyFile,
+		ClientCAFile: caFile,
+	}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stop()
+	addr := serveTLS(t, tlsConfig)
+
+	if _, err := peerCertName(addr, ca.pool(), nil); err == nil {
+		t.Error("Expected an error without client certificate, got nil")
+	}
+	untrusted := newTestCert(t, "untrusted", ca)
+	if _, err := peerCertName(addr, ca.pool(), &untrusted.tls); err == nil {
+		t.Error("Expected an error with untrusted client certificate, got nil")
+	}
+	client := newTestCert(t, "client", clientCA)
+	if _, err := peerCertName(addr, ca.pool(), &client.tls); err != nil {
+		t.Errorf("Expected trusted client certificate to be accepted, got %v", err)
+	}
+}
+
+func TestNewTLSConfigErrors(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	cert := newTestCert(t, "server", nil)
+	writeFile(t, certFile, cert.certPEM)
+	writeFile(t, keyFile, cert.keyPEM)
+
+	for name, cfg := range map[string]baseplate.TLSConfig{
+		"empty":        {},
+		"invalid-key":  {CertFile: certFile, KeyFile: certFile},
+		"no-store":     {CertSecretPath: "secret/tls/cert", KeySecretPath: "secret/tls/key"},
+		"invalid-auth": {CertFile: certFile, KeyFile: keyFile, ClientAuth: "foo"},
+		"missing-ca":   {CertFile: certFile, KeyFile: keyFile, ClientCAFile: keyFile + ".missing"},
+		"invalid-ca":   {CertFile: certFile, KeyFile: keyFile, ClientCAFile: keyFile},
+	} {
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		if _, _, err := httpbp.NewTLSConfig(ctx, cfg, nil, nil); err == nil {
+			t.Errorf("%s: Expected an error, got nil", name)
+		}
+		cancel()
+	}
+}
+
+func TestNewBaseplateServerH2C(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	store := newSecretsStore(t)
+	defer store.Close()
+	bp := baseplate.NewTestBaseplate(baseplate.NewTestBaseplateArgs{
+		Config: baseplate.Config{
+			Addr: addr,
+			HTTP: baseplate.HTTPConfig{H2C: true},
+		},
+		Store:           store,
+		EdgeContextImpl: ecinterface.Mock(),
+	})
+	server, err := httpbp.NewBaseplateServer(httpbp.ServerArgs{
+		Baseplate:        bp,
+		EndpointRegistry: httpbp.NewRouter(),
+		Endpoints: map[httpbp.Pattern]httpbp.Endpoint{
+			"GET /proto": {
+				Handle: func(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+					return httpbp.WriteRawContent(w, httpbp.Response{Body: r.Proto}, httpbp.PlainTextContentType)
+				},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- server.Serve() }()
+	defer func() {
+		server.Close()
+		if err := <-done; err != nil {
+			t.Error(err)
+		}
+	}()
+
+	client := &http.Client{
+		Transport: &http2.Transport{
+			AllowHTTP: true,
+			DialTLS: func(network, addr string, _ *tls.Config) (net.Conn, error) {
+				return net.Dial(network, addr)
+			},
+		},
+	}
+	var resp *http.Response
+	for i := 0; i < 100; i++ {
+		if resp, err = client.Get("http://" + addr + "/proto"); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.ProtoMajor != 2 {
+		t.Errorf("Expected HTTP/2 response, got %s", resp.Proto)
+	}
+}
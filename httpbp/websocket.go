@@ -0,0 +1,673 @@
+package httpbp
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/opentracing/opentracing-go"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"golang.org/x/net/websocket"
+
+	"github.com/reddit/baseplate.go/errorsbp"
+	"github.com/reddit/baseplate.go/tracing"
+)
+
+// WebSocket errors.
+var (
+	// ErrWebSocketHijackNotSupported is returned when the http.ResponseWriter
+	// passed to a WebSocket endpoint does not implement http.Hijacker,
+	// usually because a middleware wrapped it.
+	ErrWebSocketHijackNotSupported = errors.New("httpbp: http.ResponseWriter does not support hijacking")
+
+	errWebSocketOrigin = errors.New("httpbp: websocket origin not allowed")
+)
+
+// Default keepalive values of WebSocketEndpoint.
+const (
+	DefaultWebSocketPingInterval = 30 * time.Second
+	DefaultWebSocketPongTimeout  = 10 * time.Second
+)
+
+// webSocketCloseTimeout is how long to wait for the close frame to be written
+// before closing a connection anyway.
+const webSocketCloseTimeout = time.Second
+
+// maxWebSocketCloseReason is the max size in bytes of a close reason,
+// so the close frame fits in a control frame.
+const maxWebSocketCloseReason = 123
+
+// WebSocketCloseCode is the status code of a WebSocket close frame,
+// as defined in RFC 6455 section 7.4.
+type WebSocketCloseCode uint16
+
+// WebSocket close codes.
+const (
+	WebSocketCloseNormal          WebSocketCloseCode = 1000
+	WebSocketCloseGoingAway       WebSocketCloseCode = 1001
+	WebSocketClosePolicyViolation WebSocketCloseCode = 1008
+	WebSocketCloseMessageTooBig   WebSocketCloseCode = 1009
+	WebSocketCloseInternalError   WebSocketCloseCode = 1011
+)
+
+const (
+	websocketDirectionLabel = "websocket_direction"
+
+	websocketDirectionReceived = "received"
+	websocketDirectionSent     = "sent"
+)
+
+var (
+	websocketConnections = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: promNamespace,
+		Subsystem: subsystemServer,
+		Name:      "websocket_connections",
+		Help:      "The number of open WebSocket connections",
+	}, []string{endpointLabel})
+
+	websocketMessages = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: promNamespace,
+		Subsystem: subsystemServer,
+		Name:      "websocket_messages_total",
+		Help:      "The number of WebSocket messages received and sent",
+	}, []string{endpointLabel, websocketDirectionLabel})
+)
+
+// WebSocketHandlerFunc handles a single WebSocket connection.
+//
+// The connection is closed when it returns, with WebSocketCloseNormal,
+// or WebSocketCloseInternalError if it returns an error.
+// The returned error is reported to the server span of the connection.
+type WebSocketHandlerFunc func(ctx context.Context, conn *WebSocketConn) error
+
+// WebSocketEndpoint holds the values needed to create a new WebSocket handler.
+//
+// The connection is upgraded after the span, edge request context and
+// Middlewares are applied,
+// and the server span lasts for the whole lifetime of the connection.
+//
+// The connections are kept alive with ping frames, so that idle connections
+// are not dropped by load balancers,
+// and closed when the peer stops responding to them.
+// The protocol is implemented by golang.org/x/net/websocket,
+// with the keepalive and close codes added by WebSocketConn.
+type WebSocketEndpoint struct {
+	// Name is the "name" of the endpoint that will be passed to any Middleware
+	// and used as the name of the server span.
+	//
+	// When registered via ServerArgs.WebSockets with Router as the
+	// EndpointRegistry, it defaults to the path part of the Pattern.
+	Name string
+
+	// Handle is required, it handles the upgraded connections.
+	Handle WebSocketHandlerFunc
+
+	// Middlewares is an optional list of additional Middleware to run before
+	// upgrading the connection, e.g. to authenticate the request.
+	//
+	// They must not wrap the http.ResponseWriter, or the connection can't be
+	// hijacked and ErrWebSocketHijackNotSupported is returned.
+	Middlewares []Middleware
+
+	// CheckOrigin returns whether the Origin header of the request is allowed.
+	//
+	// Optional. Defaults to allowing requests without Origin header,
+	// and requests with the same Origin host as the request host.
+	CheckOrigin func(r *http.Request) bool
+
+	// The max size in bytes of a received message.
+	//
+	// Optional. Defaults to websocket.DefaultMaxPayloadBytes.
+	MaxMessageSize int
+
+	// The interval between the ping frames sent to the peer.
+	//
+	// Optional. Defaults to DefaultWebSocketPingInterval.
+	// Negative values disable the pings and the PongTimeout.
+	PingInterval time.Duration
+
+	// How long to wait for a pong, or any other frame, after a ping before
+	// closing the connection as dead.
+	//
+	// Optional. Defaults to DefaultWebSocketPongTimeout.
+	PongTimeout time.Duration
+
+	// When true, every WebSocketConn.Receive and WebSocketConn.Send is wrapped in
+	// a child span of the server span.
+	MessageSpans bool
+}
+
+// Validate checks for input errors on the WebSocketEndpoint and returns an
+// error if any exist.
+func (e WebSocketEndpoint) Validate() error {
+	var err errorsbp.Batch
+	if e.Name == "" {
+		err.Add(errors.New("httpbp: WebSocketEndpoint.Name must be non-empty"))
+	}
+	if e.Handle == nil {
+		err.Add(errors.New("httpbp: WebSocketEndpoint.Handle must be non-nil"))
+	}
+	return err.Compile()
+}
+
+// withPatternDefaults sets the default Name of the WebSocketEndpoint from the
+// Pattern it's registered with.
+//
+// It returns an error if the pattern has a method other than GET.
+func (e WebSocketEndpoint) withPatternDefaults(pattern Pattern) (WebSocketEndpoint, error) {
+	method, path := parsePattern(string(pattern))
+	if e.Name == "" {
+		e.Name = path
+	}
+	if method != "" && method != http.MethodGet {
+		return e, fmt.Errorf("httpbp: WebSocket Pattern %q must use the GET method", pattern)
+	}
+	return e, nil
+}
+
+// WebSocketConn is an upgraded WebSocket connection.
+//
+// Receive and Send can be called concurrently with each other,
+// but not with themselves.
+//
+// The connection is read in the background, so that pings are answered and
+// close frames are handled even when the handler is not receiving.
+// Control frames queued behind a message are only handled after that message
+// is received.
+type WebSocketConn struct {
+	ctx          context.Context
+	cancel       context.CancelFunc
+	conn         *websocket.Conn
+	netConn      *webSocketNetConn
+	name         string
+	messageSpans bool
+	received     prometheus.Counter
+	sent         prometheus.Counter
+
+	messages chan webSocketMessage
+	readDone chan struct{}
+	readErr  error
+
+	// frameLock guards conn.PayloadType, which is only used to write control
+	// frames.
+	frameLock sync.Mutex
+
+	closeOnce sync.Once
+	closeErr  error
+}
+
+// webSocketMessage is a message read by WebSocketConn.readLoop.
+type webSocketMessage struct {
+	data []byte
+	err  error
+}
+
+var webSocketMessageCodec = websocket.Codec{
+	Unmarshal: func(data []byte, _ byte, v interface{}) error {
+		v.(*webSocketMessage).data = data
+		return nil
+	},
+}
+
+// Context returns the context of the connection,
+// which is canceled when the connection is closed by either side,
+// or when the peer stops responding to pings.
+func (c *WebSocketConn) Context() context.Context {
+	return c.ctx
+}
+
+// Request returns the upgraded request.
+func (c *WebSocketConn) Request() *http.Request {
+	return c.conn.Request()
+}
+
+// Receive receives a message into v.
+//
+// v must be a *string for text messages or a *[]byte for binary messages.
+//
+// It returns io.EOF after the peer closed the connection.
+func (c *WebSocketConn) Receive(v interface{}) error {
+	return c.do("receive", c.received, func() error {
+		data, err := c.next()
+		if err != nil {
+			return err
+		}
+		switch v := v.(type) {
+		case *string:
+			*v = string(data)
+		case *[]byte:
+			*v = data
+		default:
+			return websocket.ErrNotSupported
+		}
+		return nil
+	})
+}
+
+// Send sends v as a message.
+//
+// v must be a string for text messages or a []byte for binary messages.
+func (c *WebSocketConn) Send(v interface{}) error {
+	return c.do("send", c.sent, func() error {
+		return websocket.Message.Send(c.conn, v)
+	})
+}
+
+// ReceiveJSON receives a text message and decodes it into v as JSON.
+func (c *WebSocketConn) ReceiveJSON(v interface{}) error {
+	return c.do("receive", c.received, func() error {
+		data, err := c.next()
+		if err != nil {
+			return err
+		}
+		return json.Unmarshal(data, v)
+	})
+}
+
+// SendJSON encodes v as JSON and sends it as a text message.
+func (c *WebSocketConn) SendJSON(v interface{}) error {
+	return c.do("send", c.sent, func() error {
+		return websocket.JSON.Send(c.conn, v)
+	})
+}
+
+// Close sends a close frame with WebSocketCloseNormal and closes the
+// connection.
+//
+// It's called automatically when the WebSocketHandlerFunc returns.
+func (c *WebSocketConn) Close() error {
+	return c.CloseWithCode(WebSocketCloseNormal, "")
+}
+
+// CloseWithCode sends a close frame with code and reason and closes the
+// connection.
+//
+// reason is truncated to 123 bytes to fit in the close frame.
+// Only the first call has any effect.
+func (c *WebSocketConn) CloseWithCode(code WebSocketCloseCode, reason string) error {
+	c.closeOnce.Do(func() {
+		c.cancel()
+
+		if len(reason) > maxWebSocketCloseReason {
+			reason = reason[:maxWebSocketCloseReason]
+		}
+		payload := make([]byte, 2, 2+len(reason))
+		binary.BigEndian.PutUint16(payload, uint16(code))
+		payload = append(payload, reason...)
+
+		// Don't block on a peer that stopped reading.
+		c.netConn.SetWriteDeadline(time.Now().Add(webSocketCloseTimeout))
+		err := c.writeFrame(websocket.CloseFrame, payload)
+		if closeErr := c.netConn.Close(); err == nil {
+			err = closeErr
+		}
+		c.closeErr = err
+	})
+	return c.closeErr
+}
+
+// abort closes the connection without a close frame,
+// for when the peer is gone.
+func (c *WebSocketConn) abort() {
+	c.closeOnce.Do(func() {
+		c.cancel()
+		c.closeErr = c.netConn.Close()
+	})
+}
+
+// next returns the data of the next message read by readLoop.
+func (c *WebSocketConn) next() ([]byte, error) {
+	select {
+	case msg := <-c.messages:
+		return msg.data, msg.err
+	case <-c.readDone:
+		return nil, c.readErr
+	}
+}
+
+// readLoop reads the messages of the connection until it's closed.
+//
+// Pings are answered while reading, and the read deadline is extended by
+// every frame, so a peer that stops responding to pings times out the read.
+// Once reading fails the connection is closed, which cancels its context:
+// with a close frame in reply to the close frame of the peer,
+// or without when the peer is gone.
+func (c *WebSocketConn) readLoop() {
+	defer close(c.readDone)
+	for {
+		c.netConn.extendReadDeadline()
+		var msg webSocketMessage
+		err := webSocketMessageCodec.Receive(c.conn, &msg)
+		if errors.Is(err, websocket.ErrFrameTooLarge) {
+			// The connection is still usable, the frame is skipped by the next read.
+			msg.err, err = err, nil
+		}
+		if err != nil {
+			c.readErr = err
+			if errors.Is(err, io.EOF) {
+				c.Close()
+			} else {
+				c.abort()
+			}
+			return
+		}
+
+		// The handler may take a while to receive the message.
+		c.netConn.SetReadDeadline(time.Time{})
+		select {
+		case c.messages <- msg:
+		case <-c.ctx.Done():
+			c.readErr = net.ErrClosed
+			return
+		}
+	}
+}
+
+// keepAlive sends a ping every interval until the connection is closed.
+func (c *WebSocketConn) keepAlive(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.ctx.Done():
+			return
+		case <-ticker.C:
+			// A failed ping means the connection is broken,
+			// which the pending read will report.
+			if err := c.writeFrame(websocket.PingFrame, nil); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// writeFrame writes a frame of payloadType.
+//
+// It's only used for control frames, as messages are written by
+// websocket.Codec with their own payload type.
+func (c *WebSocketConn) writeFrame(payloadType byte, data []byte) error {
+	c.frameLock.Lock()
+	defer c.frameLock.Unlock()
+	c.conn.PayloadType = payloadType
+	_, err := c.conn.Write(data)
+	return err
+}
+
+func (c *WebSocketConn) do(op string, counter prometheus.Counter, f func() error) (err error) {
+	if c.messageSpans {
+		span, ctx := opentracing.StartSpanFromContext(
+			c.ctx,
+			c.name+"."+op,
+			tracing.SpanTypeOption{Type: tracing.SpanTypeLocal},
+		)
+		defer func() {
+			span.FinishWithOptions(tracing.FinishOptions{
+				Ctx: ctx,
+				Err: err,
+			}.Convert())
+		}()
+	}
+	if err = f(); err == nil {
+		counter.Inc()
+	}
+	return err
+}
+
+// webSocketNetConn is a hijacked net.Conn that extends its read deadline after
+// every successful read, so that a read only times out when nothing, not even
+// a pong, was received from the peer for timeout.
+type webSocketNetConn struct {
+	net.Conn
+
+	timeout time.Duration
+}
+
+func (c *webSocketNetConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		c.extendReadDeadline()
+	}
+	return n, err
+}
+
+func (c *webSocketNetConn) extendReadDeadline() {
+	if c.timeout > 0 {
+		c.Conn.SetReadDeadline(time.Now().Add(c.timeout))
+	}
+}
+
+// webSocketHijacker wraps the hijacked connection in a webSocketNetConn.
+type webSocketHijacker struct {
+	http.ResponseWriter
+
+	timeout time.Duration
+	conn    *webSocketNetConn
+}
+
+func (h *webSocketHijacker) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, rw, err := h.ResponseWriter.(http.Hijacker).Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	h.conn = &webSocketNetConn{
+		Conn:    conn,
+		timeout: h.timeout,
+	}
+	// Keep the bytes already buffered by the http.Server,
+	// and read the rest through the wrapped connection.
+	buffered, _ := rw.Reader.Peek(rw.Reader.Buffered())
+	reader := io.MultiReader(bytes.NewReader(append([]byte(nil), buffered...)), h.conn)
+	return h.conn, bufio.NewReadWriter(bufio.NewReader(reader), rw.Writer), nil
+}
+
+// webSocketConns tracks the open WebSocket connections of a server,
+// so they can be closed when the server is closed.
+type webSocketConns struct {
+	lock   sync.Mutex
+	conns  map[*WebSocketConn]struct{}
+	closed bool
+}
+
+func newWebSocketConns() *webSocketConns {
+	return &webSocketConns{
+		conns: make(map[*WebSocketConn]struct{}),
+	}
+}
+
+// add returns false if the server is already closed.
+func (t *webSocketConns) add(c *WebSocketConn) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.closed {
+		return false
+	}
+	t.conns[c] = struct{}{}
+	return true
+}
+
+func (t *webSocketConns) remove(c *WebSocketConn) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	delete(t.conns, c)
+}
+
+// closeAll closes all the open connections and rejects the new ones.
+func (t *webSocketConns) closeAll() {
+	t.lock.Lock()
+	conns := t.conns
+	t.conns = make(map[*WebSocketConn]struct{})
+	t.closed = true
+	t.lock.Unlock()
+
+	for c := range conns {
+		c.CloseWithCode(WebSocketCloseGoingAway, "server shutting down")
+	}
+}
+
+func (f httpHandlerFactory) newWebSocketHandler(endpoint WebSocketEndpoint, conns *webSocketConns) http.Handler {
+	wrappers := make([]Middleware, 0, len(f.middlewares)+len(endpoint.Middlewares)+2)
+	wrappers = append(wrappers, f.middlewares...)
+	wrappers = append(wrappers, SupportedMethods(http.MethodGet))
+	wrappers = append(wrappers, endpoint.Middlewares...)
+	wrappers = append(wrappers, recoverPanic)
+	return NewHandler(endpoint.Name, upgradeWebSocket(endpoint, conns), wrappers...)
+}
+
+// webSocketMiddleware returns the middlewares applied to WebSocket endpoints
+// before upgrading.
+//
+// Only the trust, span and edge request context middlewares are used,
+// as the others either wrap the http.ResponseWriter or assume short-lived
+// requests.
+func webSocketMiddleware(args ServerArgs) []Middleware {
+	return []Middleware{
+		InjectServerSpan(args.TrustHandler),
+		InjectEdgeRequestContext(InjectEdgeRequestContextArgs{
+			TrustHandler:    args.TrustHandler,
+			Logger:          args.Logger,
+			EdgeContextImpl: args.Baseplate.EdgeContextImpl(),
+		}),
+	}
+}
+
+func upgradeWebSocket(endpoint WebSocketEndpoint, conns *webSocketConns) HandlerFunc {
+	checkOrigin := endpoint.CheckOrigin
+	if checkOrigin == nil {
+		checkOrigin = sameOrigin
+	}
+	active := websocketConnections.With(prometheus.Labels{endpointLabel: endpoint.Name})
+	received := websocketMessages.With(prometheus.Labels{
+		endpointLabel:           endpoint.Name,
+		websocketDirectionLabel: websocketDirectionReceived,
+	})
+	sent := websocketMessages.With(prometheus.Labels{
+		endpointLabel:           endpoint.Name,
+		websocketDirectionLabel: websocketDirectionSent,
+	})
+
+	pingInterval := endpoint.PingInterval
+	if pingInterval == 0 {
+		pingInterval = DefaultWebSocketPingInterval
+	}
+	pongTimeout := endpoint.PongTimeout
+	if pongTimeout <= 0 {
+		pongTimeout = DefaultWebSocketPongTimeout
+	}
+	var readTimeout time.Duration
+	if pingInterval > 0 {
+		readTimeout = pingInterval + pongTimeout
+	}
+
+	return func(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+		if _, ok := w.(http.Hijacker); !ok {
+			return ErrWebSocketHijackNotSupported
+		}
+		hijacker := &webSocketHijacker{
+			ResponseWriter: w,
+			timeout:        readTimeout,
+		}
+
+		var handleErr error
+		srv := websocket.Server{
+			Handshake: func(_ *websocket.Config, r *http.Request) error {
+				if !checkOrigin(r) {
+					return errWebSocketOrigin
+				}
+				return nil
+			},
+			Handler: func(ws *websocket.Conn) {
+				// Clear the deadlines set by the http.Server on the hijacked connection.
+				ws.SetDeadline(time.Time{})
+				ws.MaxPayloadBytes = endpoint.MaxMessageSize
+
+				ctx, cancel := context.WithCancel(ctx)
+				conn := &WebSocketConn{
+					ctx:          ctx,
+					cancel:       cancel,
+					conn:         ws,
+					netConn:      hijacker.conn,
+					name:         endpoint.Name,
+					messageSpans: endpoint.MessageSpans,
+					received:     received,
+					sent:         sent,
+					messages:     make(chan webSocketMessage),
+					readDone:     make(chan struct{}),
+				}
+				go conn.readLoop()
+				defer func() {
+					code := WebSocketCloseNormal
+					if handleErr != nil {
+						code = WebSocketCloseInternalError
+					}
+					conn.CloseWithCode(code, "")
+					<-conn.readDone
+				}()
+				if !conns.add(conn) {
+					conn.CloseWithCode(WebSocketCloseGoingAway, "server shutting down")
+					return
+				}
+				defer conns.remove(conn)
+				if pingInterval > 0 {
+					go conn.keepAlive(pingInterval)
+				}
+
+				active.Inc()
+				defer active.Dec()
+				handleErr = endpoint.Handle(ctx, conn)
+			},
+		}
+		srv.ServeHTTP(hijacker, r)
+
+		if handleErr != nil {
+			return webSocketError{err: handleErr}
+		}
+		return nil
+	}
+}
+
+// webSocketError wraps the error returned by a WebSocketHandlerFunc.
+//
+// It's an ErrAbandonRequest as the connection is hijacked and no error
+// response can be written, while still unwrapping to the original error for
+// the server span.
+type webSocketError struct {
+	err error
+}
+
+func (e webSocketError) Error() string {
+	return "httpbp: websocket handler: " + e.err.Error()
+}
+
+func (e webSocketError) Unwrap() error {
+	return e.err
+}
+
+func (e webSocketError) Is(target error) bool {
+	return target == ErrAbandonRequest
+}
+
+// sameOrigin returns true if the request has no Origin header,
+// or the Origin host is the same as the request host.
+func sameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(u.Host, r.Host)
+}
@@ -0,0 +1,430 @@
+package httpbp_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/net/websocket"
+
+	"github.com/reddit/baseplate.go"
+	"github.com/reddit/baseplate.go/ecinterface"
+	"github.com/reddit/baseplate.go/httpbp"
+	"github.com/reddit/baseplate.go/prometheusbp/promtest"
+	"github.com/reddit/baseplate.go/tracing/tracingtest"
+)
+
+func newWebSocketServer(t *testing.T, websockets map[httpbp.Pattern]httpbp.WebSocketEndpoint) (server baseplate.Server, url string) {
+	t.Helper()
+
+	store := newSecretsStore(t)
+	t.Cleanup(func() { store.Close() })
+
+	bp := baseplate.NewTestBaseplate(baseplate.NewTestBaseplateArgs{
+		Config:          baseplate.Config{Addr: ":8080"},
+		Store:           store,
+		EdgeContextImpl: ecinterface.Mock(),
+	})
+	server, ts, err := httpbp.NewTestBaseplateServer(httpbp.ServerArgs{
+		Baseplate:        bp,
+		EndpointRegistry: httpbp.NewRouter(),
+		WebSockets:       websockets,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return server, ts.URL
+}
+
+func dialWebSocket(t *testing.T, url, path, origin string) (*websocket.Conn, error) {
+	t.Helper()
+
+	return websocket.Dial("ws"+strings.TrimPrefix(url, "http")+path, "", origin)
+}
+
+// recordingConn records the bytes read from the server,
+// so the tests can check the control frames hidden by websocket.Conn.
+type recordingConn struct {
+	net.Conn
+
+	lock sync.Mutex
+	read []byte
+}
+
+func (c *recordingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.read = append(c.read, p[:n]...)
+	return n, err
+}
+
+func (c *recordingConn) received() []byte {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return append([]byte(nil), c.read...)
+}
+
+func dialRecordedWebSocket(t *testing.T, url, path string) (*websocket.Conn, *recordingConn) {
+	t.Helper()
+
+	config, err := websocket.NewConfig("ws"+strings.TrimPrefix(url, "http")+path, url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.Dial("tcp", config.Location.Host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rc := &recordingConn{Conn: conn}
+	ws, err := websocket.NewClient(config, rc)
+	if err != nil {
+		conn.Close()
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ws.Close() })
+	return ws, rc
+}
+
+// checkCloseFrame checks that the last frame received from the server is a
+// close frame with code and reason.
+func checkCloseFrame(t *testing.T, rc *recordingConn, code httpbp.WebSocketCloseCode, reason string) {
+	t.Helper()
+
+	expected := []byte{websocket.CloseFrame | 0x80, byte(2 + len(reason)), 0, 0}
+	binary.BigEndian.PutUint16(expected[2:], uint16(code))
+	expected = append(expected, reason...)
+
+	if received := rc.received(); !bytes.HasSuffix(received, expected) {
+		t.Errorf("Expected the connection to end with close frame %v, got %v", expected, received)
+	}
+}
+
+func TestWebSocket(t *testing.T) {
+	recorder := tracingtest.Record(t)
+
+	const name = "/echo"
+	handlerErr := errors.New("test")
+	server, url := newWebSocketServer(t, map[httpbp.Pattern]httpbp.WebSocketEndpoint{
+		"GET /echo": {
+			Handle: func(ctx context.Context, conn *httpbp.WebSocketConn) error {
+				for {
+					var msg string
+					if err := conn.Receive(&msg); err != nil {
+						return err
+					}
+					if msg == "error" {
+						return handlerErr
+					}
+					if err := conn.Send(strings.ToUpper(msg)); err != nil {
+						return err
+					}
+				}
+			},
+			MessageSpans: true,
+		},
+	})
+	defer server.Close()
+
+	active := promtest.NewGatheredMetricTest(t, "httpbp_server_websocket_connections", prometheus.Labels{
+		"http_endpoint": name,
+	})
+	received := promtest.NewGatheredMetricTest(t, "httpbp_server_websocket_messages_total", prometheus.Labels{
+		"http_endpoint":       name,
+		"websocket_direction": "received",
+	})
+
+	ws, err := dialWebSocket(t, url, "/echo", url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, msg := range []string{"foo", "bar"} {
+		if err := websocket.Message.Send(ws, msg); err != nil {
+			t.Fatal(err)
+		}
+		var got string
+		if err := websocket.Message.Receive(ws, &got); err != nil {
+			t.Fatal(err)
+		}
+		if expected := strings.ToUpper(msg); got != expected {
+			t.Errorf("Expected %q, got %q", expected, got)
+		}
+	}
+	active.CheckValue(1)
+	received.CheckDelta(2)
+
+	if err := websocket.Message.Send(ws, "error"); err != nil {
+		t.Fatal(err)
+	}
+	var msg string
+	if err := websocket.Message.Receive(ws, &msg); !errors.Is(err, io.EOF) {
+		t.Errorf("Expected the connection to be closed, got %v", err)
+	}
+
+	var span, receive bool
+	for i := 0; i < 100 && !span; i++ {
+		_, span = recorder.Find(name)
+		time.Sleep(10 * time.Millisecond)
+	}
+	serverSpan := recorder.MustFind(t, name)
+	if !errors.Is(serverSpan.Err, handlerErr) {
+		t.Errorf("Expected the server span error to be %v, got %v", handlerErr, serverSpan.Err)
+	}
+	for _, child := range recorder.Children(serverSpan) {
+		if child.Name == name+".receive" {
+			receive = true
+		}
+	}
+	if !receive {
+		t.Errorf("Expected receive child spans of the server span, got %v", recorder.Spans())
+	}
+	active.CheckValue(0)
+}
+
+func TestWebSocketServerClose(t *testing.T) {
+	t.Parallel()
+
+	opened := make(chan struct{})
+	server, url := newWebSocketServer(t, map[httpbp.Pattern]httpbp.WebSocketEndpoint{
+		"/close": {
+			Handle: func(ctx context.Context, conn *httpbp.WebSocketConn) error {
+				close(opened)
+				<-ctx.Done()
+				return nil
+			},
+		},
+	})
+
+	ws, rc := dialRecordedWebSocket(t, url, "/close")
+	<-opened
+	if err := server.Close(); err != nil {
+		t.Fatal(err)
+	}
+	ws.SetReadDeadline(time.Now().Add(time.Second))
+	var msg string
+	if err := websocket.Message.Receive(ws, &msg); !errors.Is(err, io.EOF) {
+		t.Errorf("Expected the connection to be closed, got %v", err)
+	}
+	checkCloseFrame(t, rc, httpbp.WebSocketCloseGoingAway, "server shutting down")
+}
+
+func TestWebSocketCloseCode(t *testing.T) {
+	t.Parallel()
+
+	server, url := newWebSocketServer(t, map[httpbp.Pattern]httpbp.WebSocketEndpoint{
+		"/ok": {
+			Handle: func(ctx context.Context, conn *httpbp.WebSocketConn) error {
+				return nil
+			},
+		},
+		"/error": {
+			Handle: func(ctx context.Context, conn *httpbp.WebSocketConn) error {
+				return errors.New("test")
+			},
+		},
+		"/policy": {
+			Handle: func(ctx context.Context, conn *httpbp.WebSocketConn) error {
+				return conn.CloseWithCode(httpbp.WebSocketClosePolicyViolation, "forbidden")
+			},
+		},
+	})
+	defer server.Close()
+
+	cases := []struct {
+		path   string
+		code   httpbp.WebSocketCloseCode
+		reason string
+	}{
+		{path: "/ok", code: httpbp.WebSocketCloseNormal},
+		{path: "/error", code: httpbp.WebSocketCloseInternalError},
+		{path: "/policy", code: httpbp.WebSocketClosePolicyViolation, reason: "forbidden"},
+	}
+	for _, c := range cases {
+		t.Run(c.path, func(t *testing.T) {
+			ws, rc := dialRecordedWebSocket(t, url, c.path)
+			ws.SetReadDeadline(time.Now().Add(time.Second))
+			var msg string
+			if err := websocket.Message.Receive(ws, &msg); !errors.Is(err, io.EOF) {
+				t.Errorf("Expected the connection to be closed, got %v", err)
+			}
+			checkCloseFrame(t, rc, c.code, c.reason)
+		})
+	}
+}
+
+func TestWebSocketKeepAlive(t *testing.T) {
+	t.Parallel()
+
+	opened := make(chan struct{})
+	done := make(chan struct{})
+	server, url := newWebSocketServer(t, map[httpbp.Pattern]httpbp.WebSocketEndpoint{
+		"/idle": {
+			Handle: func(ctx context.Context, conn *httpbp.WebSocketConn) error {
+				close(opened)
+				<-ctx.Done()
+				close(done)
+				return nil
+			},
+			PingInterval: 10 * time.Millisecond,
+			PongTimeout:  50 * time.Millisecond,
+		},
+	})
+	defer server.Close()
+
+	ws, rc := dialRecordedWebSocket(t, url, "/idle")
+	<-opened
+	// Receiving answers the pings of the server.
+	go func() {
+		var msg string
+		websocket.Message.Receive(ws, &msg)
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("Expected the idle connection to be kept alive")
+	case <-time.After(200 * time.Millisecond):
+	}
+	if ping := []byte{websocket.PingFrame | 0x80, 0}; !bytes.Contains(rc.received(), ping) {
+		t.Errorf("Expected ping frames from the server, got %v", rc.received())
+	}
+
+	// The close frame of the client cancels the context without any Receive.
+	ws.Close()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Error("Expected the context to be canceled after the client closed the connection")
+	}
+}
+
+func TestWebSocketPongTimeout(t *testing.T) {
+	t.Parallel()
+
+	opened := make(chan struct{})
+	done := make(chan struct{})
+	server, url := newWebSocketServer(t, map[httpbp.Pattern]httpbp.WebSocketEndpoint{
+		"/idle": {
+			Handle: func(ctx context.Context, conn *httpbp.WebSocketConn) error {
+				close(opened)
+				<-ctx.Done()
+				close(done)
+				return nil
+			},
+			PingInterval: 10 * time.Millisecond,
+			PongTimeout:  20 * time.Millisecond,
+		},
+	})
+	defer server.Close()
+
+	// The client never reads, so it never answers the pings.
+	ws, err := dialWebSocket(t, url, "/idle", url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	<-opened
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Error("Expected the context to be canceled after the client stopped answering pings")
+	}
+}
+
+func TestWebSocketOrigin(t *testing.T) {
+	t.Parallel()
+
+	server, url := newWebSocketServer(t, map[httpbp.Pattern]httpbp.WebSocketEndpoint{
+		"/default": {
+			Handle: func(ctx context.Context, conn *httpbp.WebSocketConn) error {
+				return nil
+			},
+		},
+		"/custom": {
+			Handle: func(ctx context.Context, conn *httpbp.WebSocketConn) error {
+				return nil
+			},
+			CheckOrigin: func(r *http.Request) bool {
+				return r.Header.Get("Origin") == "https://example.com"
+			},
+		},
+	})
+	defer server.Close()
+
+	cases := []struct {
+		path     string
+		origin   string
+		expectOK bool
+	}{
+		{path: "/default", origin: url, expectOK: true},
+		{path: "/default", origin: "https://example.com", expectOK: false},
+		{path: "/custom", origin: "https://example.com", expectOK: true},
+		{path: "/custom", origin: url, expectOK: false},
+	}
+	for _, _c := range cases {
+		c := _c
+		t.Run(c.path+" "+c.origin, func(t *testing.T) {
+			ws, err := dialWebSocket(t, url, c.path, c.origin)
+			if ws != nil {
+				ws.Close()
+			}
+			if ok := err == nil; ok != c.expectOK {
+				t.Errorf("Expected dial success to be %v, got error %v", c.expectOK, err)
+			}
+		})
+	}
+}
+
+func TestWebSocketEndpointValidate(t *testing.T) {
+	t.Parallel()
+
+	store := newSecretsStore(t)
+	defer store.Close()
+
+	bp := baseplate.NewTestBaseplate(baseplate.NewTestBaseplateArgs{
+		Config:          baseplate.Config{Addr: ":8080"},
+		Store:           store,
+		EdgeContextImpl: ecinterface.Mock(),
+	})
+	handle := func(ctx context.Context, conn *httpbp.WebSocketConn) error {
+		return nil
+	}
+
+	args, err := httpbp.ServerArgs{
+		Baseplate:        bp,
+		EndpointRegistry: httpbp.NewRouter(),
+		WebSockets: map[httpbp.Pattern]httpbp.WebSocketEndpoint{
+			"GET /ws": {Handle: handle},
+		},
+	}.ValidateAndSetDefaults()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name := args.WebSockets["GET /ws"].Name; name != "/ws" {
+		t.Errorf("Expected default name %q, got %q", "/ws", name)
+	}
+
+	for pattern, endpoint := range map[httpbp.Pattern]httpbp.WebSocketEndpoint{
+		"POST /ws": {Handle: handle},
+		"/ws":      {},
+	} {
+		if _, err := (httpbp.ServerArgs{
+			Baseplate:        bp,
+			EndpointRegistry: httpbp.NewRouter(),
+			WebSockets: map[httpbp.Pattern]httpbp.WebSocketEndpoint{
+				pattern: endpoint,
+			},
+		}).ValidateAndSetDefaults(); err == nil {
+			t.Errorf("Expected an error for %q, got nil", pattern)
+		}
+	}
+}
@@ -32,6 +32,12 @@ type SentryConfig struct {
 	// SampleRate between 0 and 1, default is 1.
 	SampleRate *float64 `yaml:"sampleRate"`
 
+	// TracesSampleRate between 0 and 1, default is 0.
+	//
+	// It's the sample rate of Sentry performance transactions,
+	// see tracing.SentryTransactionCreateServerSpanHook.
+	TracesSampleRate *float64 `yaml:"tracesSampleRate"`
+
 	// The name of your service.
 	//
 	// By default sentry extracts hostname reported by the kernel for this field.
@@ -75,6 +81,10 @@ func InitSentry(cfg SentryConfig) (io.Closer, error) {
 	if cfg.SampleRate != nil && *cfg.SampleRate >= 0 && *cfg.SampleRate <= 1 {
 		sampleRate = *cfg.SampleRate
 	}
+	var tracesSampleRate float64
+	if cfg.TracesSampleRate != nil && *cfg.TracesSampleRate >= 0 && *cfg.TracesSampleRate <= 1 {
+		tracesSampleRate = *cfg.TracesSampleRate
+	}
 
 	// Improve legibility of Sentry errors by using the error message as header
 	// instead of the error type and marking stack trace frame from
@@ -101,12 +111,13 @@ func InitSentry(cfg SentryConfig) (io.Closer, error) {
 	}
 
 	if err := sentry.Init(sentry.ClientOptions{
-		Dsn:          cfg.DSN,
-		SampleRate:   sampleRate,
-		ServerName:   cfg.ServerName,
-		Environment:  cfg.Environment,
-		IgnoreErrors: cfg.IgnoreErrors,
-		BeforeSend:   beforeSend,
+		Dsn:              cfg.DSN,
+		SampleRate:       sampleRate,
+		TracesSampleRate: tracesSampleRate,
+		ServerName:       cfg.ServerName,
+		Environment:      cfg.Environment,
+		IgnoreErrors:     cfg.IgnoreErrors,
+		BeforeSend:       beforeSend,
 	}); err != nil {
 		return nil, err
 	}
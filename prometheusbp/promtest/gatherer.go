@@ -0,0 +1,146 @@
+package promtest
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// GatheredMetricTest is like PrometheusMetricTest,
+// but reads the metric by its name from prometheus.DefaultGatherer instead of
+// from its collector.
+//
+// It's useful when the collector is not accessible to the test,
+// for example from an external test package.
+//
+// The value of the metric is the sum of the values of all its series that
+// have the labels, other labels of the series are ignored.
+// Only counters, gauges and untyped metrics are supported.
+type GatheredMetricTest struct {
+	tb        testing.TB
+	name      string
+	labels    prometheus.Labels
+	initValue []*dto.Metric
+}
+
+// NewGatheredMetricTest creates a new test object for the metric family name.
+// It stores the current values of the series of the metric.
+//
+// Metric vectors are only gathered after their first series is created,
+// so the metric family is allowed to be missing here,
+// but not when checking the values later.
+func NewGatheredMetricTest(tb testing.TB, name string, labels prometheus.Labels) *GatheredMetricTest {
+	tb.Helper()
+
+	family := gatherFamily(tb, name)
+	return &GatheredMetricTest{
+		tb:        tb,
+		name:      name,
+		labels:    labels,
+		initValue: family.GetMetric(),
+	}
+}
+
+// With returns a copy of p narrowed down to the series that also have labels.
+//
+// The copy shares the values stored when p was created.
+func (p *GatheredMetricTest) With(labels prometheus.Labels) *GatheredMetricTest {
+	merged := make(prometheus.Labels, len(p.labels)+len(labels))
+	for k, v := range p.labels {
+		merged[k] = v
+	}
+	for k, v := range labels {
+		merged[k] = v
+	}
+	c := *p
+	c.labels = merged
+	return &c
+}
+
+// Value returns the current value of the metric.
+//
+// The test fails if the metric family does not exist.
+func (p *GatheredMetricTest) Value() float64 {
+	p.tb.Helper()
+
+	family := gatherFamily(p.tb, p.name)
+	if family == nil {
+		p.tb.Fatalf("%s metric not found", p.name)
+	}
+	return p.sum(family.GetMetric())
+}
+
+// CheckDelta checks that the metric value changes exactly delta from when
+// NewGatheredMetricTest was called.
+func (p *GatheredMetricTest) CheckDelta(delta float64) {
+	p.tb.Helper()
+
+	got := p.Value() - p.sum(p.initValue)
+	if got != delta {
+		p.tb.Errorf("%s%v metric delta: wanted %v, got %v", p.name, p.labels, delta, got)
+	}
+}
+
+// CheckValue checks that the current metric value is exactly expected.
+func (p *GatheredMetricTest) CheckValue(expected float64) {
+	p.tb.Helper()
+
+	if got := p.Value(); got != expected {
+		p.tb.Errorf("%s%v metric value: wanted %v, got %v", p.name, p.labels, expected, got)
+	}
+}
+
+// sum returns the sum of the values of the metrics having p.labels.
+func (p *GatheredMetricTest) sum(metrics []*dto.Metric) float64 {
+	p.tb.Helper()
+
+	var value float64
+	for _, m := range metrics {
+		if !hasLabels(m, p.labels) {
+			continue
+		}
+		switch {
+		case m.Counter != nil:
+			value += m.GetCounter().GetValue()
+		case m.Gauge != nil:
+			value += m.GetGauge().GetValue()
+		case m.Untyped != nil:
+			value += m.GetUntyped().GetValue()
+		default:
+			p.tb.Fatalf("not supported type of %s metric: %s", p.name, m)
+		}
+	}
+	return value
+}
+
+// gatherFamily returns the metric family name from
+// prometheus.DefaultGatherer, or nil if it does not exist.
+func gatherFamily(tb testing.TB, name string) *dto.MetricFamily {
+	tb.Helper()
+
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		tb.Fatalf("gather metrics err %v", err)
+	}
+	for _, family := range families {
+		if family.GetName() == name {
+			return family
+		}
+	}
+	return nil
+}
+
+// hasLabels returns true if m has all the labels.
+func hasLabels(m *dto.Metric, labels prometheus.Labels) bool {
+	var matched int
+	for _, label := range m.GetLabel() {
+		if expected, ok := labels[label.GetName()]; ok {
+			if label.GetValue() != expected {
+				return false
+			}
+			matched++
+		}
+	}
+	return matched == len(labels)
+}
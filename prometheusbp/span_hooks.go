@@ -0,0 +1,237 @@
+package prometheusbp
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/reddit/baseplate.go/tracing"
+)
+
+// Default values used by SpanHookConfig.
+const (
+	DefaultMaxSpanNames    = 500
+	DefaultMaxCounterNames = 100
+)
+
+// OverflowLabelValue is the label value used by CreateServerSpanHook in place
+// of span and counter names once the configured max number of distinct names
+// is reached.
+const OverflowLabelValue = "other"
+
+const (
+	spanNameLabel    = "span_name"
+	spanTypeLabel    = "span_type"
+	spanSuccessLabel = "span_success"
+	spanCounterLabel = "span_counter"
+)
+
+var (
+	spanLabels = []string{
+		spanNameLabel,
+		spanTypeLabel,
+		spanSuccessLabel,
+	}
+
+	spanLatency = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "baseplate_span_latency_seconds",
+		Help:    "Latencies of server, client and local spans",
+		Buckets: DefaultBuckets,
+	}, spanLabels)
+
+	spanTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "baseplate_span_total",
+		Help: "Total count of finished server, client and local spans",
+	}, spanLabels)
+
+	spanCounterLabels = []string{
+		spanNameLabel,
+		spanTypeLabel,
+		spanCounterLabel,
+	}
+
+	spanCounters = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "baseplate_span_counters_total",
+		Help: "Sum of the counters added to spans via Span.AddCounter",
+	}, spanCounterLabels)
+)
+
+// SpanHookConfig is the configuration for CreateServerSpanHook.
+//
+// Can be deserialized from YAML.
+type SpanHookConfig struct {
+	// The max number of distinct span names used as label values.
+	// Spans with names beyond that are reported with OverflowLabelValue.
+	//
+	// Default to DefaultMaxSpanNames if <= 0.
+	MaxSpanNames int `yaml:"maxSpanNames"`
+
+	// The max number of distinct span counter names used as label values.
+	// Counters with names beyond that are reported with OverflowLabelValue.
+	//
+	// Default to DefaultMaxCounterNames if <= 0.
+	MaxCounterNames int `yaml:"maxCounterNames"`
+}
+
+// CreateServerSpanHook registers each server span, and all of its descendant
+// spans, with a hook that reports rate, errors and duration prometheus metrics
+// labeled by span name and type:
+//
+// - baseplate_span_latency_seconds (histogram)
+//
+// - baseplate_span_total (counter)
+//
+// It also reports counters added via Span.AddCounter to
+// baseplate_span_counters_total.
+// Negative counter deltas are ignored as prometheus counters can only go up.
+//
+// It's the prometheus counterpart of metricsbp.CreateServerSpanHook.
+//
+// It also implements tracing.CreateRootSpanHook,
+// so client and local spans without a server span parent,
+// like background jobs and the detach.Async tasks started from them,
+// are covered when it's registered with both:
+//
+//     hook := prometheusbp.NewCreateServerSpanHook(cfg)
+//     tracing.RegisterCreateServerSpanHooks(hook)
+//     tracing.RegisterCreateRootSpanHooks(hook)
+//
+// Use NewCreateServerSpanHook to create one with non-default SpanHookConfig.
+// The zero value uses the default config.
+type CreateServerSpanHook struct {
+	spanNames    *labelGuard
+	counterNames *labelGuard
+}
+
+var defaultCreateServerSpanHook = NewCreateServerSpanHook(SpanHookConfig{})
+
+// NewCreateServerSpanHook creates a CreateServerSpanHook from cfg.
+func NewCreateServerSpanHook(cfg SpanHookConfig) CreateServerSpanHook {
+	if cfg.MaxSpanNames <= 0 {
+		cfg.MaxSpanNames = DefaultMaxSpanNames
+	}
+	if cfg.MaxCounterNames <= 0 {
+		cfg.MaxCounterNames = DefaultMaxCounterNames
+	}
+	return CreateServerSpanHook{
+		spanNames:    newLabelGuard(cfg.MaxSpanNames),
+		counterNames: newLabelGuard(cfg.MaxCounterNames),
+	}
+}
+
+// OnCreateServerSpan registers the metrics hook on a server Span.
+func (h CreateServerSpanHook) OnCreateServerSpan(span *tracing.Span) error {
+	h.addHook(span)
+	return nil
+}
+
+// OnCreateRootSpan registers the metrics hook on a client or local Span
+// without a parent.
+func (h CreateServerSpanHook) OnCreateRootSpan(span *tracing.Span) error {
+	h.addHook(span)
+	return nil
+}
+
+func (h CreateServerSpanHook) addHook(span *tracing.Span) {
+	if h.spanNames == nil || h.counterNames == nil {
+		h = defaultCreateServerSpanHook
+	}
+	span.AddHooks(spanHook{
+		spanNames:    h.spanNames,
+		counterNames: h.counterNames,
+	})
+}
+
+type spanHook struct {
+	spanNames    *labelGuard
+	counterNames *labelGuard
+}
+
+// OnCreateChild registers the hook on the child span.
+func (h spanHook) OnCreateChild(parent, child *tracing.Span) error {
+	child.AddHooks(h)
+	return nil
+}
+
+// OnPostStart is a no-op.
+func (h spanHook) OnPostStart(span *tracing.Span) error {
+	return nil
+}
+
+// OnPreStop reports the latency and total metrics.
+func (h spanHook) OnPreStop(span *tracing.Span, err error) error {
+	start := span.StartTime()
+	stop := span.StopTime()
+	if stop.IsZero() {
+		stop = time.Now()
+	}
+	labels := prometheus.Labels{
+		spanNameLabel:    h.spanNames.value(span.Name()),
+		spanTypeLabel:    span.SpanType().String(),
+		spanSuccessLabel: strconv.FormatBool(err == nil),
+	}
+	spanLatency.With(labels).Observe(stop.Sub(start).Seconds())
+	spanTotal.With(labels).Inc()
+	return nil
+}
+
+// OnAddCounter reports the counter delta.
+func (h spanHook) OnAddCounter(span *tracing.Span, key string, delta float64) error {
+	if delta < 0 {
+		return nil
+	}
+	spanCounters.With(prometheus.Labels{
+		spanNameLabel:    h.spanNames.value(span.Name()),
+		spanTypeLabel:    span.SpanType().String(),
+		spanCounterLabel: h.counterNames.value(key),
+	}).Add(delta)
+	return nil
+}
+
+// labelGuard limits the number of distinct values used for a label.
+type labelGuard struct {
+	max int
+
+	lock   sync.RWMutex
+	values map[string]struct{}
+}
+
+func newLabelGuard(max int) *labelGuard {
+	return &labelGuard{
+		max:    max,
+		values: make(map[string]struct{}),
+	}
+}
+
+// value returns v if it's already seen or there's still room for it,
+// OverflowLabelValue otherwise.
+func (g *labelGuard) value(v string) string {
+	g.lock.RLock()
+	_, ok := g.values[v]
+	g.lock.RUnlock()
+	if ok {
+		return v
+	}
+
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	if _, ok := g.values[v]; ok {
+		return v
+	}
+	if len(g.values) >= g.max {
+		return OverflowLabelValue
+	}
+	g.values[v] = struct{}{}
+	return v
+}
+
+var (
+	_ tracing.CreateServerSpanHook = CreateServerSpanHook{}
+	_ tracing.CreateRootSpanHook   = CreateServerSpanHook{}
+	_ tracing.CreateChildSpanHook  = spanHook{}
+	_ tracing.StartStopSpanHook    = spanHook{}
+	_ tracing.AddSpanCounterHook   = spanHook{}
+)
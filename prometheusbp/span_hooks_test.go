@@ -0,0 +1,103 @@
+package prometheusbp
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/opentracing/opentracing-go"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/reddit/baseplate.go/detach"
+	"github.com/reddit/baseplate.go/prometheusbp/promtest"
+	"github.com/reddit/baseplate.go/tracing"
+)
+
+func TestCreateServerSpanHook(t *testing.T) {
+	tracing.RegisterCreateServerSpanHooks(NewCreateServerSpanHook(SpanHookConfig{
+		MaxSpanNames: 2,
+	}))
+	defer tracing.ResetHooks()
+
+	labels := func(name string, spanType tracing.SpanType, success bool) prometheus.Labels {
+		return prometheus.Labels{
+			spanNameLabel:    name,
+			spanTypeLabel:    spanType.String(),
+			spanSuccessLabel: map[bool]string{true: "true", false: "false"}[success],
+		}
+	}
+	serverTotal := promtest.NewPrometheusMetricTest(t, "server total", spanTotal, labels("server", tracing.SpanTypeServer, true))
+	serverLatency := promtest.NewPrometheusMetricTest(t, "server latency", spanLatency, labels("server", tracing.SpanTypeServer, true))
+	clientTotal := promtest.NewPrometheusMetricTest(t, "client total", spanTotal, labels("service.client", tracing.SpanTypeClient, false))
+	overflowTotal := promtest.NewPrometheusMetricTest(t, "overflow total", spanTotal, labels(OverflowLabelValue, tracing.SpanTypeLocal, true))
+	counter := promtest.NewPrometheusMetricTest(t, "counter", spanCounters, prometheus.Labels{
+		spanNameLabel:    "server",
+		spanTypeLabel:    tracing.SpanTypeServer.String(),
+		spanCounterLabel: "foo",
+	})
+
+	ctx, server := tracing.StartSpanFromHeaders(context.Background(), "server", tracing.Headers{})
+	server.AddCounter("foo", 2)
+	server.AddCounter("foo", -1)
+	client, _ := opentracing.StartSpanFromContext(
+		ctx,
+		"service.client",
+		tracing.SpanTypeOption{Type: tracing.SpanTypeClient},
+	)
+	client.FinishWithOptions(tracing.FinishOptions{Err: errors.New("foo")}.Convert())
+	local, _ := opentracing.StartSpanFromContext(
+		ctx,
+		"local",
+		tracing.SpanTypeOption{Type: tracing.SpanTypeLocal},
+	)
+	local.Finish()
+	server.Stop(ctx, nil)
+
+	serverTotal.CheckDelta(1)
+	// server, client, and the overflowed local span.
+	serverLatency.CheckExistsN(3)
+	clientTotal.CheckDelta(1)
+	overflowTotal.CheckDelta(1)
+	counter.CheckDelta(2)
+}
+
+func TestCreateRootSpanHook(t *testing.T) {
+	hook := NewCreateServerSpanHook(SpanHookConfig{})
+	tracing.RegisterCreateServerSpanHooks(hook)
+	tracing.RegisterCreateRootSpanHooks(hook)
+	defer tracing.ResetHooks()
+
+	labels := func(name string) prometheus.Labels {
+		return prometheus.Labels{
+			spanNameLabel:    name,
+			spanTypeLabel:    tracing.SpanTypeLocal.String(),
+			spanSuccessLabel: "true",
+		}
+	}
+	jobTotal := promtest.NewPrometheusMetricTest(t, "job total", spanTotal, labels("job"))
+	asyncTotal := promtest.NewPrometheusMetricTest(t, "async total", spanTotal, labels("asyncTask"))
+
+	job, ctx := opentracing.StartSpanFromContext(
+		context.Background(),
+		"job",
+		tracing.SpanTypeOption{Type: tracing.SpanTypeLocal},
+	)
+	detach.Async(ctx, func(context.Context) {})
+	job.Finish()
+
+	jobTotal.CheckDelta(1)
+	asyncTotal.CheckDelta(1)
+}
+
+func TestLabelGuard(t *testing.T) {
+	g := newLabelGuard(1)
+	if got := g.value("foo"); got != "foo" {
+		t.Errorf("Expected %q, got %q", "foo", got)
+	}
+	if got := g.value("bar"); got != OverflowLabelValue {
+		t.Errorf("Expected %q, got %q", OverflowLabelValue, got)
+	}
+	if got := g.value("foo"); got != "foo" {
+		t.Errorf("Expected %q, got %q", "foo", got)
+	}
+}
@@ -0,0 +1,200 @@
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/reddit/baseplate.go/errorsbp"
+	"github.com/reddit/baseplate.go/log"
+)
+
+// DefaultAlertThresholds are the default latency thresholds used by
+// AlertCreateServerSpanHook, by span type.
+var DefaultAlertThresholds = map[SpanType]time.Duration{
+	SpanTypeServer: time.Second,
+	SpanTypeClient: time.Millisecond * 500,
+	SpanTypeLocal:  time.Millisecond * 500,
+}
+
+const (
+	alertSpanTypeLabel = "span_type"
+	alertReasonLabel   = "reason"
+
+	alertReasonSlow  = "slow"
+	alertReasonError = "error"
+)
+
+var alertsCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: promNamespace,
+	Name:      "span_alerts_total",
+	Help:      "The number of slow or errored spans caught by the alert hook",
+}, []string{alertSpanTypeLabel, alertReasonLabel})
+
+// AlertConfig is the configuration for AlertCreateServerSpanHook.
+//
+// Can be deserialized from YAML.
+type AlertConfig struct {
+	// Latency thresholds by span type.
+	//
+	// When a threshold is 0,
+	// the one from DefaultAlertThresholds will be used instead.
+	// When it's negative, slow spans of that type will not be alerted.
+	ServerThreshold time.Duration `yaml:"serverThreshold"`
+	ClientThreshold time.Duration `yaml:"clientThreshold"`
+	LocalThreshold  time.Duration `yaml:"localThreshold"`
+
+	// Latency thresholds by span name,
+	// takes priority over the thresholds by span type.
+	//
+	// Negative values disable slow span alerting for that span name.
+	Thresholds map[string]time.Duration `yaml:"thresholds"`
+
+	// When set to true, also report slow or errored spans to Sentry,
+	// using the sentry hub attached to the span.
+	ReportToSentry bool `yaml:"reportToSentry"`
+
+	// Optional, errors suppressed by Suppressor will not be alerted.
+	Suppressor errorsbp.Suppressor `yaml:"-"`
+
+	// The logger to log the alerts.
+	//
+	// Optional. If nil, the alerts are logged by the global logger at warning
+	// level with the details as structured fields.
+	Logger log.Wrapper `yaml:"logger"`
+}
+
+func (cfg AlertConfig) threshold(span *Span) time.Duration {
+	if t, ok := cfg.Thresholds[span.Name()]; ok {
+		return t
+	}
+	var t time.Duration
+	switch span.SpanType() {
+	case SpanTypeServer:
+		t = cfg.ServerThreshold
+	case SpanTypeClient:
+		t = cfg.ClientThreshold
+	case SpanTypeLocal:
+		t = cfg.LocalThreshold
+	}
+	if t == 0 {
+		t = DefaultAlertThresholds[span.SpanType()]
+	}
+	return t
+}
+
+// AlertCreateServerSpanHook registers each server span, and all of its
+// descendant spans, with a hook that alerts on the spans that are either
+// slower than the configured threshold,
+// or ended with an error not suppressed by the configured Suppressor.
+//
+// Alerting means the span is logged with trace id and tags (see
+// AlertConfig.Logger),
+// counted in the "tracing_span_alerts_total" prometheus counter,
+// and optionally reported to Sentry.
+type AlertCreateServerSpanHook struct {
+	Config AlertConfig
+}
+
+// OnCreateServerSpan registers the alert hook on a server Span.
+func (h AlertCreateServerSpanHook) OnCreateServerSpan(span *Span) error {
+	span.AddHooks(alertSpanHook(h))
+	return nil
+}
+
+// alertSpanHook alerts slow or errored spans in OnPreStop,
+// and registers itself to all child spans.
+type alertSpanHook struct {
+	Config AlertConfig
+}
+
+// OnCreateChild registers the hook on the child span.
+func (h alertSpanHook) OnCreateChild(parent, child *Span) error {
+	child.AddHooks(h)
+	return nil
+}
+
+// OnPostStart is a no-op.
+func (h alertSpanHook) OnPostStart(span *Span) error {
+	return nil
+}
+
+// OnPreStop checks the span and alerts if needed.
+func (h alertSpanHook) OnPreStop(span *Span, err error) error {
+	stop := span.StopTime()
+	if stop.IsZero() {
+		stop = time.Now()
+	}
+	duration := stop.Sub(span.StartTime())
+
+	if err != nil && !h.Config.Suppressor.Suppress(err) {
+		h.alert(span, alertReasonError, duration, err)
+		return nil
+	}
+	if threshold := h.Config.threshold(span); threshold > 0 && duration > threshold {
+		h.alert(span, alertReasonSlow, duration, fmt.Errorf(
+			"tracing: %s span %q took %v, longer than threshold %v",
+			span.SpanType(),
+			span.Name(),
+			duration,
+			threshold,
+		))
+	}
+	return nil
+}
+
+func (h alertSpanHook) alert(span *Span, reason string, duration time.Duration, err error) {
+	alertsCounter.With(prometheus.Labels{
+		alertSpanTypeLabel: span.SpanType().String(),
+		alertReasonLabel:   reason,
+	}).Inc()
+
+	if h.Config.Logger != nil {
+		h.Config.Logger.Log(context.Background(), fmt.Sprintf(
+			"Span alert: reason=%s traceID=%s spanID=%s span=%q spanType=%s duration=%v tags=%v err=%v",
+			reason,
+			span.TraceID(),
+			span.ID(),
+			span.Name(),
+			span.SpanType(),
+			duration,
+			span.trace.tags,
+			err,
+		))
+	} else {
+		log.Warnw(
+			"Span alert",
+			"reason", reason,
+			"traceID", span.TraceID(),
+			"spanID", span.ID(),
+			"span", span.Name(),
+			"spanType", span.SpanType().String(),
+			"duration", duration,
+			"tags", span.trace.tags,
+			"err", err,
+		)
+	}
+
+	if h.Config.ReportToSentry {
+		hub := span.getHub().Clone()
+		hub.ConfigureScope(func(scope *sentry.Scope) {
+			scope.SetTag("span", span.Name())
+			scope.SetTag("span_type", span.SpanType().String())
+			scope.SetTag("span_alert_reason", reason)
+			for k, v := range span.trace.tags {
+				scope.SetTag(k, v)
+			}
+		})
+		hub.CaptureException(err)
+	}
+}
+
+var (
+	_ CreateServerSpanHook = AlertCreateServerSpanHook{}
+	_ CreateChildSpanHook  = alertSpanHook{}
+	_ StartStopSpanHook    = alertSpanHook{}
+)
@@ -0,0 +1,123 @@
+package tracing
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/opentracing/opentracing-go"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/reddit/baseplate.go/prometheusbp/promtest"
+)
+
+func TestAlertConfigThreshold(t *testing.T) {
+	cfg := AlertConfig{
+		ClientThreshold: time.Millisecond,
+		LocalThreshold:  -1,
+		Thresholds: map[string]time.Duration{
+			"override": time.Minute,
+		},
+	}
+	for _, c := range []struct {
+		label    string
+		name     string
+		spanType SpanType
+		expected time.Duration
+	}{
+		{
+			label:    "default",
+			name:     "server",
+			spanType: SpanTypeServer,
+			expected: DefaultAlertThresholds[SpanTypeServer],
+		},
+		{
+			label:    "type",
+			name:     "client",
+			spanType: SpanTypeClient,
+			expected: time.Millisecond,
+		},
+		{
+			label:    "disabled",
+			name:     "local",
+			spanType: SpanTypeLocal,
+			expected: -1,
+		},
+		{
+			label:    "name",
+			name:     "override",
+			spanType: SpanTypeClient,
+			expected: time.Minute,
+		},
+	} {
+		t.Run(c.label, func(t *testing.T) {
+			span := newSpan(nil, c.name, c.spanType)
+			if got := cfg.threshold(span); got != c.expected {
+				t.Errorf("Expected threshold %v, got %v", c.expected, got)
+			}
+		})
+	}
+}
+
+func TestAlertCreateServerSpanHook(t *testing.T) {
+	suppressed := errors.New("suppressed")
+	var lock sync.Mutex
+	var logged []string
+	RegisterCreateServerSpanHooks(AlertCreateServerSpanHook{
+		Config: AlertConfig{
+			ClientThreshold: time.Millisecond * 10,
+			Suppressor: func(err error) bool {
+				return errors.Is(err, suppressed)
+			},
+			Logger: func(_ context.Context, msg string) {
+				lock.Lock()
+				defer lock.Unlock()
+				logged = append(logged, msg)
+			},
+		},
+	})
+	defer ResetHooks()
+
+	labels := func(reason string) prometheus.Labels {
+		return prometheus.Labels{
+			alertSpanTypeLabel: SpanTypeClient.String(),
+			alertReasonLabel:   reason,
+		}
+	}
+	slow := promtest.NewPrometheusMetricTest(t, "slow", alertsCounter, labels(alertReasonSlow))
+	errored := promtest.NewPrometheusMetricTest(t, "error", alertsCounter, labels(alertReasonError))
+
+	ctx, server := StartSpanFromHeaders(context.Background(), "server", Headers{})
+	newClient := func(start time.Time) opentracing.Span {
+		span, _ := opentracing.StartSpanFromContext(
+			ctx,
+			"service.client",
+			SpanTypeOption{Type: SpanTypeClient},
+			opentracing.StartTime(start),
+		)
+		return span
+	}
+
+	newClient(time.Now()).Finish()
+	newClient(time.Now().Add(-time.Second)).Finish()
+	newClient(time.Now()).FinishWithOptions(FinishOptions{Err: errors.New("foo")}.Convert())
+	newClient(time.Now()).FinishWithOptions(FinishOptions{Err: suppressed}.Convert())
+	server.Stop(ctx, nil)
+
+	slow.CheckDelta(1)
+	errored.CheckDelta(1)
+
+	lock.Lock()
+	defer lock.Unlock()
+	if len(logged) != 2 {
+		t.Fatalf("Expected 2 alerts logged, got %q", logged)
+	}
+	for i, reason := range []string{alertReasonSlow, alertReasonError} {
+		if !strings.Contains(logged[i], "reason="+reason) || !strings.Contains(logged[i], `span="service.client"`) {
+			t.Errorf("Expected alert %d to be logged with reason %q, got %q", i, reason, logged[i])
+		}
+	}
+}
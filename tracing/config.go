@@ -46,7 +46,7 @@ type Config struct {
 	//
 	// QueueName should not contain "traces-" prefix, it will be auto added.
 	//
-	// If QueueName is empty, no spans will be sampled,
+	// If both QueueName and ZipkinHTTP.URL are empty, no spans will be sampled,
 	// including the ones with debug flag set.
 	QueueName string `yaml:"queueName"`
 
@@ -65,11 +65,18 @@ type Config struct {
 	// can handle hex trace ids (Baseplate.go v0.8.0+ or Baseplate.py v2.0.0+).
 	UseHex bool `yaml:"useHex"`
 
+	// ZipkinHTTP configures sending sampled spans directly to a Zipkin v2 http
+	// endpoint in the background, for services running without the trace
+	// publishing sidecar (e.g. local development or batch jobs).
+	//
+	// This is only used when QueueName is empty and ZipkinHTTP.URL is non-empty.
+	ZipkinHTTP ZipkinHTTPConfig `yaml:"zipkinHTTP"`
+
 	// In test code,
 	// this field can be used to set the message queue the tracer publishes to,
 	// usually an *mqsend.MockMessageQueue.
 	//
-	// This field will be ignored when QueueName is non-empty,
+	// This field will be ignored when QueueName or ZipkinHTTP.URL is non-empty,
 	// to help avoiding footgun prod code.
 	//
 	// DO NOT USE IN PROD CODE.
@@ -0,0 +1,128 @@
+package tracing
+
+import (
+	"time"
+)
+
+// FinishedSpan is a snapshot of a Span taken when it's stopped.
+//
+// It's the structured value passed to SpanRecorder implementations.
+type FinishedSpan struct {
+	TraceID  string
+	SpanID   string
+	ParentID string
+	Name     string
+	Type     SpanType
+	Sampled  bool
+	Flags    int64
+
+	Start time.Time
+	Stop  time.Time
+
+	// Tags and Counters are copies of the span's tags and counters at the time
+	// the span was stopped.
+	Tags     map[string]string
+	Counters map[string]float64
+
+	// Err is the error the span was stopped with, if any.
+	Err error
+}
+
+// Duration returns the duration of the span.
+func (fs FinishedSpan) Duration() time.Duration {
+	return fs.Stop.Sub(fs.Start)
+}
+
+// Tag returns the value of the tag with the given key, and whether it's set.
+func (fs FinishedSpan) Tag(key string) (value string, ok bool) {
+	value, ok = fs.Tags[key]
+	return
+}
+
+// Counter returns the value of the counter with the given key.
+func (fs FinishedSpan) Counter(key string) float64 {
+	return fs.Counters[key]
+}
+
+// newFinishedSpan takes a snapshot of s.
+//
+// If s is not stopped yet, current time will be used as the stop time.
+func newFinishedSpan(s *Span, err error) FinishedSpan {
+	fs := FinishedSpan{
+		TraceID:  s.trace.traceID,
+		SpanID:   s.trace.spanID,
+		ParentID: s.trace.parentID,
+		Name:     s.trace.name,
+		Type:     s.spanType,
+		Sampled:  s.trace.sampled,
+		Flags:    s.trace.flags,
+		Start:    s.trace.start,
+		Stop:     s.trace.stop,
+		Tags:     make(map[string]string, len(s.trace.tags)),
+		Counters: make(map[string]float64, len(s.trace.counters)),
+		Err:      err,
+	}
+	if fs.Stop.IsZero() {
+		fs.Stop = time.Now()
+	}
+	for k, v := range s.trace.tags {
+		fs.Tags[k] = v
+	}
+	for k, v := range s.trace.counters {
+		fs.Counters[k] = v
+	}
+	return fs
+}
+
+// SpanRecorder records snapshots of finished spans.
+//
+// Implementations must be safe for concurrent use.
+type SpanRecorder interface {
+	RecordSpan(span FinishedSpan)
+}
+
+// SpanRecorderCreateServerSpanHook registers each server span, and all of its
+// descendant spans, with a hook that records them into Recorder when they are
+// stopped.
+//
+// Spans are recorded regardless of whether they are sampled or not.
+// Top level local and client spans (the ones not created as descendants of a
+// server span) are not recorded.
+type SpanRecorderCreateServerSpanHook struct {
+	Recorder SpanRecorder
+}
+
+// OnCreateServerSpan registers the recording hook on a server Span.
+func (h SpanRecorderCreateServerSpanHook) OnCreateServerSpan(span *Span) error {
+	span.AddHooks(spanRecorderHook(h))
+	return nil
+}
+
+// spanRecorderHook records the span into recorder in OnPreStop,
+// and registers itself to all child spans.
+type spanRecorderHook struct {
+	Recorder SpanRecorder
+}
+
+// OnCreateChild registers the hook on the child span.
+func (h spanRecorderHook) OnCreateChild(parent, child *Span) error {
+	child.AddHooks(h)
+	return nil
+}
+
+// OnPostStart is a no-op.
+func (h spanRecorderHook) OnPostStart(span *Span) error {
+	return nil
+}
+
+// OnPreStop records the snapshot of the span.
+func (h spanRecorderHook) OnPreStop(span *Span, err error) error {
+	h.Recorder.RecordSpan(newFinishedSpan(span, err))
+	return nil
+}
+
+var (
+	_ CreateServerSpanHook = SpanRecorderCreateServerSpanHook{}
+	_ CreateChildSpanHook  = spanRecorderHook{}
+	_ StartStopSpanHook    = spanRecorderHook{}
+)
@@ -15,6 +15,21 @@ type CreateServerSpanHook interface {
 	OnCreateServerSpan(span *Span) error
 }
 
+// CreateRootSpanHook allows you to inject functionality into the creation of
+// client and local spans without a parent span,
+// for example spans of background jobs started outside of any request.
+//
+// Spans started from their descendants are covered by the CreateChildSpanHook
+// Hooks registered onto them.
+type CreateRootSpanHook interface {
+	// OnCreateRootSpan is called after a client or local Span without a parent
+	// is first created, before any OnPostStart Hooks are called.
+	//
+	// OnCreateRootSpan is the recommended place to register Hooks onto the
+	// root Span.
+	OnCreateRootSpan(span *Span) error
+}
+
 // CreateChildSpanHook allows you to inject functionality into the creation of a
 // Baseplate span.
 type CreateChildSpanHook interface {
@@ -55,6 +70,7 @@ type AddSpanCounterHook interface {
 
 var (
 	createServerSpanHooks []CreateServerSpanHook
+	createRootSpanHooks   []CreateRootSpanHook
 )
 
 // IsSpanHook returns true if hook implements at least one of the span Hook
@@ -83,11 +99,21 @@ func RegisterCreateServerSpanHooks(hooks ...CreateServerSpanHook) {
 	createServerSpanHooks = append(createServerSpanHooks, hooks...)
 }
 
+// RegisterCreateRootSpanHooks registers Hooks onto client and local spans
+// without a parent span.
+//
+// This function and ResetHooks are not safe to call concurrently.
+func RegisterCreateRootSpanHooks(hooks ...CreateRootSpanHook) {
+	createRootSpanHooks = append(createRootSpanHooks, hooks...)
+}
+
 // ResetHooks removes all global hooks and resets back to initial state.
 //
-// This function and RegisterCreateServerSpanHooks are not safe to call concurrently.
+// This function, RegisterCreateServerSpanHooks and RegisterCreateRootSpanHooks
+// are not safe to call concurrently.
 func ResetHooks() {
 	createServerSpanHooks = nil
+	createRootSpanHooks = nil
 }
 
 func onCreateServerSpan(span *Span) {
@@ -109,3 +135,11 @@ func onCreateServerSpan(span *Span) {
 		}
 	}
 }
+
+func onCreateRootSpan(span *Span) {
+	for _, hook := range createRootSpanHooks {
+		if err := hook.OnCreateRootSpan(span); err != nil {
+			span.logError(context.Background(), "OnCreateRootSpan hook error: ", err)
+		}
+	}
+}
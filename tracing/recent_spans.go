@@ -0,0 +1,178 @@
+package tracing
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// DefaultRecentSpansSize is the default size used by RecentSpans when
+// RecentSpansConfig.Size <= 0.
+const DefaultRecentSpansSize = 100
+
+// RecentSpansConfig is the configuration for RecentSpans.
+//
+// Can be deserialized from YAML.
+type RecentSpansConfig struct {
+	// The max number of spans to keep.
+	// Once full, the oldest span is dropped for each new span recorded.
+	//
+	// Default to DefaultRecentSpansSize if <= 0.
+	Size int `yaml:"size"`
+
+	// Spans taking longer than SlowThreshold are kept.
+	//
+	// If SlowThreshold <= 0, only errored spans are kept.
+	SlowThreshold time.Duration `yaml:"slowThreshold"`
+}
+
+// RecentSpans is a SpanRecorder implementation keeping the most recent slow or
+// errored spans in a fixed size ring buffer.
+//
+// It also implements http.Handler to show the recorded spans as JSON,
+// newest first, which can be used as a debug endpoint on a running service:
+//
+//     recent := tracing.NewRecentSpans(tracing.RecentSpansConfig{
+//       SlowThreshold: 500*time.Millisecond,
+//     })
+//     tracing.RegisterCreateServerSpanHooks(
+//       tracing.SpanRecorderCreateServerSpanHook{Recorder: recent},
+//     )
+//     mux.Handle("/debug/traces", recent)
+//
+// The handler supports the following optional query parameters:
+//
+// - trace: only show spans from the given trace id
+//
+// - errors: when set to "true", only show errored spans
+//
+// It's safe for concurrent use.
+type RecentSpans struct {
+	slowThreshold time.Duration
+
+	lock  sync.Mutex
+	spans []FinishedSpan
+	// next is the index in spans the next span will be written to.
+	next int
+	full bool
+}
+
+// NewRecentSpans creates a new RecentSpans.
+func NewRecentSpans(cfg RecentSpansConfig) *RecentSpans {
+	size := cfg.Size
+	if size <= 0 {
+		size = DefaultRecentSpansSize
+	}
+	return &RecentSpans{
+		slowThreshold: cfg.SlowThreshold,
+		spans:         make([]FinishedSpan, size),
+	}
+}
+
+// RecordSpan implements SpanRecorder.
+//
+// Spans that are neither slow nor errored are discarded.
+func (r *RecentSpans) RecordSpan(span FinishedSpan) {
+	if !r.keep(span) {
+		return
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.spans[r.next] = span
+	r.next++
+	if r.next >= len(r.spans) {
+		r.next = 0
+		r.full = true
+	}
+}
+
+func (r *RecentSpans) keep(span FinishedSpan) bool {
+	if span.Err != nil {
+		return true
+	}
+	return r.slowThreshold > 0 && span.Duration() > r.slowThreshold
+}
+
+// Spans returns the spans currently kept, newest first.
+func (r *RecentSpans) Spans() []FinishedSpan {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	n := r.next
+	if r.full {
+		n = len(r.spans)
+	}
+	spans := make([]FinishedSpan, 0, n)
+	for i := 1; i <= n; i++ {
+		index := r.next - i
+		if index < 0 {
+			index += len(r.spans)
+		}
+		spans = append(spans, r.spans[index])
+	}
+	return spans
+}
+
+// recentSpanJSON is the JSON format of FinishedSpan used by RecentSpans'
+// http handler.
+type recentSpanJSON struct {
+	TraceID    string             `json:"traceId"`
+	SpanID     string             `json:"id"`
+	ParentID   string             `json:"parentId,omitempty"`
+	Name       string             `json:"name"`
+	Type       string             `json:"type"`
+	Start      time.Time          `json:"start"`
+	DurationMs float64            `json:"durationMs"`
+	Tags       map[string]string  `json:"tags,omitempty"`
+	Counters   map[string]float64 `json:"counters,omitempty"`
+	Error      string             `json:"error,omitempty"`
+}
+
+func toRecentSpanJSON(span FinishedSpan) recentSpanJSON {
+	v := recentSpanJSON{
+		TraceID:    span.TraceID,
+		SpanID:     span.SpanID,
+		ParentID:   span.ParentID,
+		Name:       span.Name,
+		Type:       span.Type.String(),
+		Start:      span.Start,
+		DurationMs: float64(span.Duration()) / float64(time.Millisecond),
+		Tags:       span.Tags,
+		Counters:   span.Counters,
+	}
+	if span.Err != nil {
+		v.Error = span.Err.Error()
+	}
+	return v
+}
+
+// ServeHTTP implements http.Handler.
+func (r *RecentSpans) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+	traceID := query.Get("trace")
+	errorsOnly := query.Get("errors") == "true"
+
+	spans := r.Spans()
+	result := make([]recentSpanJSON, 0, len(spans))
+	for _, span := range spans {
+		if traceID != "" && span.TraceID != traceID {
+			continue
+		}
+		if errorsOnly && span.Err == nil {
+			continue
+		}
+		result = append(result, toRecentSpanJSON(span))
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	if err := json.NewEncoder(w).Encode(result); err != nil {
+		globalTracer.logger.Log(req.Context(), "RecentSpans: failed to write response: "+err.Error())
+	}
+}
+
+var (
+	_ SpanRecorder = (*RecentSpans)(nil)
+	_ http.Handler = (*RecentSpans)(nil)
+)
@@ -0,0 +1,82 @@
+package tracing_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/reddit/baseplate.go/tracing"
+)
+
+func TestRecentSpans(t *testing.T) {
+	const threshold = time.Millisecond * 10
+	recent := tracing.NewRecentSpans(tracing.RecentSpansConfig{
+		Size:          2,
+		SlowThreshold: threshold,
+	})
+	now := time.Now()
+	newSpan := func(name string, duration time.Duration, err error) tracing.FinishedSpan {
+		return tracing.FinishedSpan{
+			TraceID: "trace-" + name,
+			Name:    name,
+			Start:   now,
+			Stop:    now.Add(duration),
+			Err:     err,
+		}
+	}
+
+	recent.RecordSpan(newSpan("fast", time.Millisecond, nil))
+	if spans := recent.Spans(); len(spans) != 0 {
+		t.Errorf("Expected fast span to be discarded, got %+v", spans)
+	}
+
+	recent.RecordSpan(newSpan("slow", threshold*2, nil))
+	recent.RecordSpan(newSpan("error", time.Millisecond, errors.New("foo")))
+	recent.RecordSpan(newSpan("slow2", threshold*2, nil))
+
+	spans := recent.Spans()
+	if len(spans) != 2 {
+		t.Fatalf("Expected 2 spans, got %+v", spans)
+	}
+	if spans[0].Name != "slow2" || spans[1].Name != "error" {
+		t.Errorf("Expected [slow2 error], got %+v", spans)
+	}
+
+	for _, c := range []struct {
+		label    string
+		query    string
+		expected int
+	}{
+		{
+			label:    "all",
+			query:    "",
+			expected: 2,
+		},
+		{
+			label:    "errors",
+			query:    "?errors=true",
+			expected: 1,
+		},
+		{
+			label:    "trace",
+			query:    "?trace=trace-slow2",
+			expected: 1,
+		},
+	} {
+		t.Run(c.label, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest("GET", "/debug/traces"+c.query, nil)
+			recent.ServeHTTP(w, req.WithContext(context.Background()))
+			var result []map[string]interface{}
+			if err := json.NewDecoder(w.Body).Decode(&result); err != nil {
+				t.Fatal(err)
+			}
+			if len(result) != c.expected {
+				t.Errorf("Expected %d spans, got %+v", c.expected, result)
+			}
+		})
+	}
+}
@@ -0,0 +1,166 @@
+package tracing
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+)
+
+// SentryTransactionCreateServerSpanHook registers each server span with a hook
+// that converts it into a Sentry performance transaction,
+// and all of its descendant spans into Sentry spans of that transaction.
+//
+// Transactions are sampled by Sentry's traces sampling,
+// which is controlled by log.SentryConfig.TracesSampleRate.
+// When the upstream caller set the sampled flag to false in the span headers,
+// the transactions are always dropped,
+// so the Sentry transactions are a subset of the baseplate traces.
+// Server spans with debug flag set are always sampled.
+//
+// The trace and span ids of the Sentry transactions and spans are converted
+// from the baseplate ones, so they can be correlated with each other.
+// Baseplate hex ids are used as-is (left padded with zeros),
+// and dec ids are converted into their big endian binary representation.
+type SentryTransactionCreateServerSpanHook struct{}
+
+// OnCreateServerSpan registers the Sentry transaction hook on a server Span.
+func (SentryTransactionCreateServerSpanHook) OnCreateServerSpan(span *Span) error {
+	span.AddHooks(&sentrySpanHook{})
+	return nil
+}
+
+// sentrySpanHook keeps the Sentry span corresponding to the baseplate span
+// it's registered to.
+type sentrySpanHook struct {
+	// For child spans, parent is the Sentry span of the parent span.
+	parent *sentry.Span
+
+	sentrySpan *sentry.Span
+}
+
+// OnPostStart starts the Sentry transaction (for server spans) or span (for
+// child spans).
+func (h *sentrySpanHook) OnPostStart(span *Span) error {
+	setIDs := func(s *sentry.Span) {
+		s.TraceID = sentryTraceID(span.TraceID())
+		s.SpanID = sentrySpanID(span.ID())
+		if span.ParentID() != "" {
+			s.ParentSpanID = sentrySpanID(span.ParentID())
+		}
+		s.StartTime = span.StartTime()
+		s.Description = span.Name()
+	}
+	if h.parent != nil {
+		h.sentrySpan = h.parent.StartChild(span.SpanType().String(), setIDs)
+		return nil
+	}
+
+	options := []sentry.SpanOption{
+		sentry.TransactionName(span.Name()),
+		setIDs,
+	}
+	switch {
+	case span.trace.isDebugSet():
+		options = append(options, func(s *sentry.Span) {
+			s.Sampled = sentry.SampledTrue
+		})
+	case span.trace.sampledSet && !span.trace.sampled:
+		// Drop the traces not sampled upstream. The sampled ones are left to
+		// Sentry's traces sampling, as an explicit decision would bypass
+		// TracesSampleRate.
+		options = append(options, func(s *sentry.Span) {
+			s.Sampled = sentry.SampledFalse
+		})
+	}
+	ctx := sentry.SetHubOnContext(context.Background(), span.getHub())
+	h.sentrySpan = sentry.StartSpan(ctx, span.SpanType().String(), options...)
+	return nil
+}
+
+// OnCreateChild registers a new sentrySpanHook on the child span if the
+// transaction is sampled.
+func (h *sentrySpanHook) OnCreateChild(parent, child *Span) error {
+	if h.sentrySpan == nil || !h.sentrySpan.Sampled.Bool() {
+		return nil
+	}
+	child.AddHooks(&sentrySpanHook{parent: h.sentrySpan})
+	return nil
+}
+
+// OnPreStop finishes the Sentry span.
+//
+// For server spans, that also sends the transaction to Sentry if it's sampled.
+func (h *sentrySpanHook) OnPreStop(span *Span, err error) error {
+	if h.sentrySpan == nil {
+		return nil
+	}
+	for k, v := range span.trace.tags {
+		h.sentrySpan.SetTag(k, v)
+	}
+	h.sentrySpan.Status = sentrySpanStatus(err)
+	h.sentrySpan.EndTime = span.StopTime()
+	if h.sentrySpan.EndTime.IsZero() {
+		h.sentrySpan.EndTime = time.Now()
+	}
+	h.sentrySpan.Finish()
+	return nil
+}
+
+func sentrySpanStatus(err error) sentry.SpanStatus {
+	switch {
+	default:
+		return sentry.SpanStatusInternalError
+	case err == nil:
+		return sentry.SpanStatusOK
+	case errors.Is(err, context.DeadlineExceeded):
+		return sentry.SpanStatusDeadlineExceeded
+	case errors.Is(err, context.Canceled):
+		return sentry.SpanStatusCanceled
+	}
+}
+
+// sentryTraceID converts baseplate trace id to Sentry trace id.
+//
+// If the id is neither hex nor dec, a zero id will be returned.
+func sentryTraceID(id string) (tid sentry.TraceID) {
+	decodeID(id, tid[:])
+	return
+}
+
+// sentrySpanID converts baseplate span id to Sentry span id.
+//
+// If the id is neither hex nor dec, a zero id will be returned.
+func sentrySpanID(id string) (sid sentry.SpanID) {
+	decodeID(id, sid[:])
+	return
+}
+
+// decodeID decodes baseplate id into the right aligned bytes of dst.
+func decodeID(id string, dst []byte) {
+	if len(id) == len(dst)*2 || len(id) == 16 {
+		// Hex ids are fixed length, see hexID64.
+		// Note that 16-digit dec ids are also valid hex ids,
+		// so we always treat them as hex.
+		if _, err := hex.Decode(dst[len(dst)-len(id)/2:], []byte(id)); err == nil {
+			return
+		}
+	}
+	if v, err := strconv.ParseUint(id, 10, 64); err == nil {
+		binary.BigEndian.PutUint64(dst[len(dst)-8:], v)
+		return
+	}
+	for i := range dst {
+		dst[i] = 0
+	}
+}
+
+var (
+	_ CreateServerSpanHook = SentryTransactionCreateServerSpanHook{}
+	_ CreateChildSpanHook  = (*sentrySpanHook)(nil)
+	_ StartStopSpanHook    = (*sentrySpanHook)(nil)
+)
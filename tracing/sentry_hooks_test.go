@@ -0,0 +1,209 @@
+package tracing
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/opentracing/opentracing-go"
+)
+
+type sentryTestTransport struct {
+	lock   sync.Mutex
+	events []*sentry.Event
+}
+
+func (t *sentryTestTransport) Flush(time.Duration) bool {
+	return true
+}
+
+func (t *sentryTestTransport) Configure(sentry.ClientOptions) {}
+
+func (t *sentryTestTransport) SendEvent(event *sentry.Event) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.events = append(t.events, event)
+}
+
+func TestSentryIDs(t *testing.T) {
+	for _, c := range []struct {
+		label string
+		id    string
+		trace string
+		span  string
+	}{
+		{
+			label: "hex",
+			id:    "0123456789abcdef",
+			trace: "00000000000000000123456789abcdef",
+			span:  "0123456789abcdef",
+		},
+		{
+			label: "hex-128",
+			id:    "0123456789abcdef0123456789abcdef",
+			trace: "0123456789abcdef0123456789abcdef",
+			span:  "0000000000000000",
+		},
+		{
+			label: "dec",
+			id:    "255",
+			trace: "000000000000000000000000000000ff",
+			span:  "00000000000000ff",
+		},
+		{
+			label: "invalid",
+			id:    "foo",
+			trace: "00000000000000000000000000000000",
+			span:  "0000000000000000",
+		},
+	} {
+		t.Run(c.label, func(t *testing.T) {
+			if got := sentryTraceID(c.id).String(); got != c.trace {
+				t.Errorf("Expected trace id %q, got %q", c.trace, got)
+			}
+			if got := sentrySpanID(c.id).String(); got != c.span {
+				t.Errorf("Expected span id %q, got %q", c.span, got)
+			}
+		})
+	}
+}
+
+func TestSentryTransactionCreateServerSpanHook(t *testing.T) {
+	RegisterCreateServerSpanHooks(SentryTransactionCreateServerSpanHook{})
+	defer ResetHooks()
+
+	newHub := func(t *testing.T, rate float64) (*sentry.Hub, *sentryTestTransport) {
+		t.Helper()
+		transport := new(sentryTestTransport)
+		client, err := sentry.NewClient(sentry.ClientOptions{
+			TracesSampleRate: rate,
+			Transport:        transport,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return sentry.NewHub(client, sentry.NewScope()), transport
+	}
+
+	t.Run("sampled", func(t *testing.T) {
+		hub, transport := newHub(t, 1)
+		ctx := sentry.SetHubOnContext(context.Background(), hub)
+		ctx, server := StartSpanFromHeaders(ctx, "server", Headers{
+			TraceID: "1234",
+			SpanID:  "5678",
+		})
+		client, _ := opentracing.StartSpanFromContext(
+			ctx,
+			"service.client",
+			SpanTypeOption{Type: SpanTypeClient},
+		)
+		client.FinishWithOptions(FinishOptions{Err: context.DeadlineExceeded}.Convert())
+		server.Stop(ctx, errors.New("foo"))
+
+		if len(transport.events) != 1 {
+			t.Fatalf("Expected 1 transaction, got %+v", transport.events)
+		}
+		event := transport.events[0]
+		if event.Transaction != "server" {
+			t.Errorf("Expected transaction name %q, got %q", "server", event.Transaction)
+		}
+		tc, ok := event.Contexts["trace"].(*sentry.TraceContext)
+		if !ok {
+			t.Fatalf("Unexpected trace context: %#v", event.Contexts["trace"])
+		}
+		if tc.TraceID != sentryTraceID("1234") {
+			t.Errorf("Expected trace id %v, got %v", sentryTraceID("1234"), tc.TraceID)
+		}
+		if tc.ParentSpanID != sentrySpanID("5678") {
+			t.Errorf("Expected parent id %v, got %v", sentrySpanID("5678"), tc.ParentSpanID)
+		}
+		if tc.SpanID != sentrySpanID(server.ID()) {
+			t.Errorf("Expected span id %v, got %v", sentrySpanID(server.ID()), tc.SpanID)
+		}
+		if tc.Status != sentry.SpanStatusInternalError {
+			t.Errorf("Expected status %v, got %v", sentry.SpanStatusInternalError, tc.Status)
+		}
+		if len(event.Spans) != 1 {
+			t.Fatalf("Expected 1 child span, got %+v", event.Spans)
+		}
+		child := event.Spans[0]
+		if child.Description != "service.client" || child.Op != "client" {
+			t.Errorf("Unexpected child span: %+v", child)
+		}
+		if child.ParentSpanID != tc.SpanID || child.TraceID != tc.TraceID {
+			t.Errorf("Child span not under transaction: %+v", child)
+		}
+		if child.Status != sentry.SpanStatusDeadlineExceeded {
+			t.Errorf("Expected status %v, got %v", sentry.SpanStatusDeadlineExceeded, child.Status)
+		}
+	})
+
+	t.Run("not-sampled", func(t *testing.T) {
+		hub, transport := newHub(t, 0)
+		ctx := sentry.SetHubOnContext(context.Background(), hub)
+		ctx, server := StartSpanFromHeaders(ctx, "server", Headers{})
+		server.Stop(ctx, nil)
+		if len(transport.events) != 0 {
+			t.Errorf("Expected no transactions, got %+v", transport.events)
+		}
+	})
+
+	t.Run("upstream-sampled", func(t *testing.T) {
+		// The upstream sampled flag doesn't override the traces sample rate.
+		hub, transport := newHub(t, 0)
+		ctx := sentry.SetHubOnContext(context.Background(), hub)
+		sampled := true
+		ctx, server := StartSpanFromHeaders(ctx, "server", Headers{
+			TraceID: "1234",
+			Sampled: &sampled,
+		})
+		server.Stop(ctx, nil)
+		if len(transport.events) != 0 {
+			t.Errorf("Expected no transactions, got %+v", transport.events)
+		}
+	})
+
+	t.Run("upstream-sampled-rate", func(t *testing.T) {
+		hub, transport := newHub(t, 1)
+		ctx := sentry.SetHubOnContext(context.Background(), hub)
+		sampled := true
+		ctx, server := StartSpanFromHeaders(ctx, "server", Headers{
+			TraceID: "1234",
+			Sampled: &sampled,
+		})
+		server.Stop(ctx, nil)
+		if len(transport.events) != 1 {
+			t.Errorf("Expected 1 transaction, got %+v", transport.events)
+		}
+	})
+
+	t.Run("upstream-not-sampled", func(t *testing.T) {
+		hub, transport := newHub(t, 1)
+		ctx := sentry.SetHubOnContext(context.Background(), hub)
+		sampled := false
+		ctx, server := StartSpanFromHeaders(ctx, "server", Headers{
+			TraceID: "1234",
+			Sampled: &sampled,
+		})
+		server.Stop(ctx, nil)
+		if len(transport.events) != 0 {
+			t.Errorf("Expected no transactions, got %+v", transport.events)
+		}
+	})
+
+	t.Run("debug", func(t *testing.T) {
+		hub, transport := newHub(t, 0)
+		ctx := sentry.SetHubOnContext(context.Background(), hub)
+		ctx, server := StartSpanFromHeaders(ctx, "server", Headers{
+			TraceID: "1234",
+			Flags:   "1",
+		})
+		server.Stop(ctx, nil)
+		if len(transport.events) != 1 {
+			t.Errorf("Expected 1 transaction, got %+v", transport.events)
+		}
+	})
+}
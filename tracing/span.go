@@ -570,6 +570,7 @@ func StartSpanFromHeaders(ctx context.Context, name string, headers Headers) (co
 
 	if sampled, ok := headers.ParseSampled(); ok {
 		span.trace.sampled = sampled
+		span.trace.sampledSet = true
 	}
 
 	ctx = initRootSpan(ctx, span)
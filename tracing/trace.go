@@ -40,6 +40,9 @@ type trace struct {
 	sampled  bool
 	flags    int64
 
+	// sampledSet is true when sampled was set by the upstream caller.
+	sampledSet bool
+
 	timeAnnotationReceiveKey string
 	timeAnnotationSendKey    string
 	start                    time.Time
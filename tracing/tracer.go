@@ -82,6 +82,11 @@ type Tracer struct {
 // If it fails to do so, UndefinedIP will be used instead,
 // and the error will be logged if logger is non-nil.
 func InitGlobalTracer(cfg Config) error {
+	logger := cfg.Logger
+	if logger == nil {
+		logger = log.NopWrapper
+	}
+
 	var tracer Tracer
 	if cfg.QueueName != "" {
 		if cfg.MaxQueueSize <= 0 || cfg.MaxQueueSize > MaxQueueSize {
@@ -96,17 +101,14 @@ func InitGlobalTracer(cfg Config) error {
 			return err
 		}
 		tracer.recorder = recorder
+	} else if cfg.ZipkinHTTP.URL != "" {
+		tracer.recorder = newZipkinHTTPReporter(cfg.ZipkinHTTP, logger)
 	} else {
 		tracer.recorder = cfg.TestOnlyMockMessageQueue
 	}
 
 	tracer.sampleRate = cfg.SampleRate
 	tracer.useHex = cfg.UseHex
-
-	logger := cfg.Logger
-	if logger == nil {
-		logger = log.NopWrapper
-	}
 	tracer.logger = logger
 
 	tracer.maxRecordTimeout = cfg.MaxRecordTimeout
@@ -145,6 +147,9 @@ func InitGlobalTracerWithCloser(cfg Config) (io.Closer, error) {
 
 // Close closes the tracer's reporting.
 //
+// When the tracer is reporting to Zipkin http endpoint directly,
+// Close also flushes all the buffered spans.
+//
 // After Close is called, no more spans will be sampled.
 func (t *Tracer) Close() error {
 	if t.recorder == nil {
@@ -211,6 +216,8 @@ func (t *Tracer) Record(ctx context.Context, zs ZipkinSpan) error {
 //
 // If the new span's type is server,
 // all registered CreateServerSpanHooks will be called as well.
+// If the new span is a client or local span without a parent,
+// all registered CreateRootSpanHooks will be called instead.
 //
 // Please note that trying to set span type via opentracing-go/ext package won't
 // work, please use SpanTypeOption defined in this package instead.
@@ -232,6 +239,10 @@ func (t *Tracer) StartSpan(operationName string, opts ...opentracing.StartSpanOp
 		span.trace.traceID = t.newTraceID()
 		span.trace.sampled = randbp.ShouldSampleWithRate(t.sampleRate)
 		initRootSpan(context.Background(), span)
+		if span.spanType != SpanTypeServer {
+			onCreateRootSpan(span)
+			span.onStart()
+		}
 	}
 
 	if span.spanType == SpanTypeServer {
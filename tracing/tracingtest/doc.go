@@ -0,0 +1,3 @@
+// Package tracingtest provides test utilities for asserting on spans created
+// by the tracing package.
+package tracingtest
@@ -0,0 +1,140 @@
+package tracingtest
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/reddit/baseplate.go/tracing"
+)
+
+// Recorder is a tracing.SpanRecorder implementation that keeps all the
+// recorded spans in memory, in the order they finished.
+//
+// It's safe for concurrent use.
+type Recorder struct {
+	lock  sync.Mutex
+	spans []tracing.FinishedSpan
+}
+
+// Record creates a new Recorder and registers it via
+// tracing.RegisterCreateServerSpanHooks,
+// so all server spans and their descendants will be recorded.
+//
+// It calls tracing.ResetHooks when the test finishes,
+// which also removes all other registered hooks.
+//
+// Like tracing.RegisterCreateServerSpanHooks,
+// it's not safe to be used by parallel tests.
+func Record(tb testing.TB) *Recorder {
+	tb.Helper()
+
+	r := new(Recorder)
+	tracing.RegisterCreateServerSpanHooks(tracing.SpanRecorderCreateServerSpanHook{
+		Recorder: r,
+	})
+	tb.Cleanup(tracing.ResetHooks)
+	return r
+}
+
+// RecordSpan implements tracing.SpanRecorder.
+func (r *Recorder) RecordSpan(span tracing.FinishedSpan) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.spans = append(r.spans, span)
+}
+
+// Reset clears all the recorded spans.
+func (r *Recorder) Reset() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.spans = nil
+}
+
+// Spans returns all the recorded spans, in the order they finished.
+func (r *Recorder) Spans() []tracing.FinishedSpan {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	spans := make([]tracing.FinishedSpan, len(r.spans))
+	copy(spans, r.spans)
+	return spans
+}
+
+// Filter returns all the recorded spans that f returns true,
+// in the order they finished.
+func (r *Recorder) Filter(f func(span tracing.FinishedSpan) bool) []tracing.FinishedSpan {
+	var spans []tracing.FinishedSpan
+	for _, span := range r.Spans() {
+		if f(span) {
+			spans = append(spans, span)
+		}
+	}
+	return spans
+}
+
+// ByName returns all the recorded spans with the given name.
+func (r *Recorder) ByName(name string) []tracing.FinishedSpan {
+	return r.Filter(func(span tracing.FinishedSpan) bool {
+		return span.Name == name
+	})
+}
+
+// ByType returns all the recorded spans with the given type.
+func (r *Recorder) ByType(spanType tracing.SpanType) []tracing.FinishedSpan {
+	return r.Filter(func(span tracing.FinishedSpan) bool {
+		return span.Type == spanType
+	})
+}
+
+// ByTrace returns all the recorded spans from the given trace id.
+func (r *Recorder) ByTrace(traceID string) []tracing.FinishedSpan {
+	return r.Filter(func(span tracing.FinishedSpan) bool {
+		return span.TraceID == traceID
+	})
+}
+
+// Children returns all the recorded direct child spans of parent.
+func (r *Recorder) Children(parent tracing.FinishedSpan) []tracing.FinishedSpan {
+	return r.Filter(func(span tracing.FinishedSpan) bool {
+		return span.TraceID == parent.TraceID && span.ParentID == parent.SpanID
+	})
+}
+
+// Errored returns all the recorded spans finished with a non-nil error.
+func (r *Recorder) Errored() []tracing.FinishedSpan {
+	return r.Filter(func(span tracing.FinishedSpan) bool {
+		return span.Err != nil
+	})
+}
+
+// Find returns the first finished span with the given name.
+func (r *Recorder) Find(name string) (span tracing.FinishedSpan, ok bool) {
+	spans := r.ByName(name)
+	if len(spans) == 0 {
+		return
+	}
+	return spans[0], true
+}
+
+// MustFind is the test helper version of Find.
+//
+// It fails the test immediately when no span with the given name is recorded.
+func (r *Recorder) MustFind(tb testing.TB, name string) tracing.FinishedSpan {
+	tb.Helper()
+
+	span, ok := r.Find(name)
+	if !ok {
+		tb.Fatalf("tracingtest: no span named %q recorded, got %v", name, r.names())
+	}
+	return span
+}
+
+func (r *Recorder) names() []string {
+	spans := r.Spans()
+	names := make([]string, len(spans))
+	for i, span := range spans {
+		names[i] = span.Name
+	}
+	return names
+}
+
+var _ tracing.SpanRecorder = (*Recorder)(nil)
@@ -0,0 +1,87 @@
+package tracingtest_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/opentracing/opentracing-go"
+
+	"github.com/reddit/baseplate.go/tracing"
+	"github.com/reddit/baseplate.go/tracing/tracingtest"
+)
+
+func TestRecorder(t *testing.T) {
+	recorder := tracingtest.Record(t)
+
+	spanErr := errors.New("foo")
+	ctx, server := tracing.StartSpanFromHeaders(context.Background(), "server", tracing.Headers{})
+	client, ctx := opentracing.StartSpanFromContext(
+		ctx,
+		"service.client",
+		tracing.SpanTypeOption{Type: tracing.SpanTypeClient},
+	)
+	local, _ := opentracing.StartSpanFromContext(
+		ctx,
+		"local",
+		tracing.SpanTypeOption{Type: tracing.SpanTypeLocal},
+	)
+	local.SetTag("foo", "bar")
+	tracing.AsSpan(local).AddCounter("count", 2)
+	local.Finish()
+	client.FinishWithOptions(tracing.FinishOptions{Err: spanErr}.Convert())
+	server.Stop(ctx, nil)
+
+	spans := recorder.Spans()
+	if len(spans) != 3 {
+		t.Fatalf("Expected 3 spans recorded, got %+v", spans)
+	}
+	for i, name := range []string{"local", "service.client", "server"} {
+		if spans[i].Name != name {
+			t.Errorf("spans[%d]: expected name %q, got %q", i, name, spans[i].Name)
+		}
+	}
+
+	serverSpan := recorder.MustFind(t, "server")
+	if serverSpan.Type != tracing.SpanTypeServer {
+		t.Errorf("Expected server type, got %v", serverSpan.Type)
+	}
+	clientSpan := recorder.MustFind(t, "service.client")
+	if clientSpan.ParentID != serverSpan.SpanID {
+		t.Errorf("Expected client parent %q, got %q", serverSpan.SpanID, clientSpan.ParentID)
+	}
+	if !errors.Is(clientSpan.Err, spanErr) {
+		t.Errorf("Expected client span error %v, got %v", spanErr, clientSpan.Err)
+	}
+	if v, _ := clientSpan.Tag(tracing.ZipkinBinaryAnnotationKeyError); v != "true" {
+		t.Errorf("Expected error tag to be true, got %q", v)
+	}
+	localSpan := recorder.MustFind(t, "local")
+	if v, _ := localSpan.Tag("foo"); v != "bar" {
+		t.Errorf("Expected tag foo=bar, got %q", v)
+	}
+	if v := localSpan.Counter("count"); v != 2 {
+		t.Errorf("Expected counter 2, got %v", v)
+	}
+
+	if children := recorder.Children(serverSpan); len(children) != 1 || children[0].Name != "service.client" {
+		t.Errorf("Unexpected children of server span: %+v", children)
+	}
+	if errored := recorder.Errored(); len(errored) != 1 || errored[0].Name != "service.client" {
+		t.Errorf("Unexpected errored spans: %+v", errored)
+	}
+	if got := recorder.ByTrace(serverSpan.TraceID); len(got) != 3 {
+		t.Errorf("Expected 3 spans from trace %q, got %+v", serverSpan.TraceID, got)
+	}
+	if got := recorder.ByType(tracing.SpanTypeLocal); len(got) != 1 {
+		t.Errorf("Expected 1 local span, got %+v", got)
+	}
+	if _, ok := recorder.Find("nonexist"); ok {
+		t.Error("Expected Find to return false on nonexist span")
+	}
+
+	recorder.Reset()
+	if spans := recorder.Spans(); len(spans) != 0 {
+		t.Errorf("Expected no spans after Reset, got %+v", spans)
+	}
+}
@@ -0,0 +1,352 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/reddit/baseplate.go/log"
+	"github.com/reddit/baseplate.go/mqsend"
+	"github.com/reddit/baseplate.go/timebp"
+)
+
+// Default values used by ZipkinHTTPConfig.
+const (
+	DefaultZipkinHTTPMaxQueueSize  = 1000
+	DefaultZipkinHTTPBatchSize     = 100
+	DefaultZipkinHTTPFlushInterval = time.Second
+	DefaultZipkinHTTPTimeout       = time.Second * 5
+)
+
+const (
+	promNamespace = "tracing"
+
+	dropReasonLabel = "reason"
+
+	dropReasonQueueFull   = "queue_full"
+	dropReasonClosed      = "closed"
+	dropReasonSendFailure = "send_failure"
+)
+
+var (
+	zipkinHTTPSpansSent = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: promNamespace,
+		Subsystem: "zipkin_http",
+		Name:      "spans_sent_total",
+		Help:      "The number of spans successfully sent to zipkin by the http reporter",
+	})
+
+	zipkinHTTPSpansDropped = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: promNamespace,
+		Subsystem: "zipkin_http",
+		Name:      "spans_dropped_total",
+		Help:      "The number of spans dropped by the zipkin http reporter",
+	}, []string{dropReasonLabel})
+)
+
+// ZipkinHTTPConfig is the configuration for reporting spans directly to a
+// Zipkin v2 http endpoint, without the trace publishing sidecar.
+//
+// Can be deserialized from YAML.
+type ZipkinHTTPConfig struct {
+	// The full url of the Zipkin v2 spans endpoint,
+	// e.g. "http://localhost:9411/api/v2/spans".
+	//
+	// If URL is empty, the http reporter is not used.
+	URL string `yaml:"url"`
+
+	// The max number of spans buffered in memory waiting to be sent.
+	// When the queue is full new spans are dropped.
+	//
+	// Default to DefaultZipkinHTTPMaxQueueSize if <= 0.
+	MaxQueueSize int `yaml:"maxQueueSize"`
+
+	// The max number of spans sent in a single request.
+	//
+	// Default to DefaultZipkinHTTPBatchSize if <= 0.
+	BatchSize int `yaml:"batchSize"`
+
+	// The max time a span is buffered before being sent,
+	// if the batch is not full yet.
+	//
+	// Default to DefaultZipkinHTTPFlushInterval if <= 0.
+	FlushInterval time.Duration `yaml:"flushInterval"`
+
+	// The timeout for each http request.
+	//
+	// Default to DefaultZipkinHTTPTimeout if <= 0.
+	Timeout time.Duration `yaml:"timeout"`
+
+	// The http client used to send the requests.
+	//
+	// Default to http.DefaultClient if nil.
+	Client *http.Client `yaml:"-"`
+}
+
+// zipkinHTTPReporter implements mqsend.MessageQueue by converting the
+// serialized ZipkinSpans into the Zipkin v2 model, batching them and sending
+// them to a Zipkin v2 http endpoint in the background.
+type zipkinHTTPReporter struct {
+	cfg    ZipkinHTTPConfig
+	logger log.Wrapper
+
+	lock   sync.RWMutex
+	closed bool
+	queue  chan []byte
+	done   chan struct{}
+}
+
+func newZipkinHTTPReporter(cfg ZipkinHTTPConfig, logger log.Wrapper) *zipkinHTTPReporter {
+	if cfg.MaxQueueSize <= 0 {
+		cfg.MaxQueueSize = DefaultZipkinHTTPMaxQueueSize
+	}
+	if cfg.BatchSize <= 0 {
+		cfg.BatchSize = DefaultZipkinHTTPBatchSize
+	}
+	if cfg.FlushInterval <= 0 {
+		cfg.FlushInterval = DefaultZipkinHTTPFlushInterval
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = DefaultZipkinHTTPTimeout
+	}
+	if cfg.Client == nil {
+		cfg.Client = http.DefaultClient
+	}
+	if logger == nil {
+		logger = log.NopWrapper
+	}
+	r := &zipkinHTTPReporter{
+		cfg:    cfg,
+		logger: logger,
+		queue:  make(chan []byte, cfg.MaxQueueSize),
+		done:   make(chan struct{}),
+	}
+	go r.run()
+	return r
+}
+
+// Send implements mqsend.MessageQueue.
+//
+// data is a json serialized ZipkinSpan.
+//
+// It never blocks. When the queue is full the span is dropped and counted in
+// the metrics instead.
+func (r *zipkinHTTPReporter) Send(_ context.Context, data []byte) error {
+	if len(data) > MaxSpanSize {
+		return mqsend.MessageTooLargeError{
+			MessageSize: len(data),
+			MaxSize:     MaxSpanSize,
+		}
+	}
+	var span ZipkinSpan
+	if err := json.Unmarshal(data, &span); err != nil {
+		return fmt.Errorf("tracing: failed to decode zipkin span: %w", err)
+	}
+	data, err := json.Marshal(toZipkinV2Span(span))
+	if err != nil {
+		return fmt.Errorf("tracing: failed to encode zipkin v2 span: %w", err)
+	}
+
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	if r.closed {
+		zipkinHTTPSpansDropped.With(prometheus.Labels{
+			dropReasonLabel: dropReasonClosed,
+		}).Inc()
+		return nil
+	}
+	select {
+	case r.queue <- data:
+	default:
+		zipkinHTTPSpansDropped.With(prometheus.Labels{
+			dropReasonLabel: dropReasonQueueFull,
+		}).Inc()
+	}
+	return nil
+}
+
+// Close implements mqsend.MessageQueue.
+//
+// It flushes all the spans still in the queue before returning.
+func (r *zipkinHTTPReporter) Close() error {
+	r.lock.Lock()
+	if !r.closed {
+		r.closed = true
+		close(r.queue)
+	}
+	r.lock.Unlock()
+
+	<-r.done
+	return nil
+}
+
+func (r *zipkinHTTPReporter) run() {
+	defer close(r.done)
+
+	ticker := time.NewTicker(r.cfg.FlushInterval)
+	defer ticker.Stop()
+
+	batch := make([][]byte, 0, r.cfg.BatchSize)
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		r.send(batch)
+		batch = batch[:0]
+	}
+	for {
+		select {
+		case data, ok := <-r.queue:
+			if !ok {
+				flush()
+				return
+			}
+			batch = append(batch, data)
+			if len(batch) >= r.cfg.BatchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+// send sends a batch of serialized spans as a json array.
+func (r *zipkinHTTPReporter) send(batch [][]byte) {
+	body := make([]byte, 0, len(batch)*512)
+	body = append(body, '[')
+	body = append(body, bytes.Join(batch, []byte{','})...)
+	body = append(body, ']')
+
+	if err := r.post(body); err != nil {
+		zipkinHTTPSpansDropped.With(prometheus.Labels{
+			dropReasonLabel: dropReasonSendFailure,
+		}).Add(float64(len(batch)))
+		r.logger.Log(context.Background(), fmt.Sprintf(
+			"Failed to send %d spans to zipkin: %v",
+			len(batch),
+			err,
+		))
+		return
+	}
+	zipkinHTTPSpansSent.Add(float64(len(batch)))
+}
+
+func (r *zipkinHTTPReporter) post(body []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), r.cfg.Timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, r.cfg.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := r.cfg.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		// Drain the body so the connection can be reused.
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("tracing: unexpected zipkin response status %q", resp.Status)
+	}
+	return nil
+}
+
+// Zipkin v2 span kinds.
+const (
+	zipkinV2KindClient = "CLIENT"
+	zipkinV2KindServer = "SERVER"
+)
+
+// zipkinV2Span is the Zipkin v2 json format of a span,
+// see https://zipkin.io/zipkin-api/#/default/post_spans.
+type zipkinV2Span struct {
+	TraceID       string                      `json:"traceId"`
+	ID            string                      `json:"id"`
+	ParentID      string                      `json:"parentId,omitempty"`
+	Name          string                      `json:"name,omitempty"`
+	Kind          string                      `json:"kind,omitempty"`
+	Timestamp     timebp.TimestampMicrosecond `json:"timestamp"`
+	Duration      timebp.DurationMicrosecond  `json:"duration"`
+	LocalEndpoint *zipkinV2Endpoint           `json:"localEndpoint,omitempty"`
+	Annotations   []zipkinV2Annotation        `json:"annotations,omitempty"`
+	Tags          map[string]string           `json:"tags,omitempty"`
+	Debug         bool                        `json:"debug,omitempty"`
+}
+
+// zipkinV2Endpoint is the Zipkin v2 json format of an endpoint.
+type zipkinV2Endpoint struct {
+	ServiceName string `json:"serviceName,omitempty"`
+	IPv4        string `json:"ipv4,omitempty"`
+}
+
+// zipkinV2Annotation is the Zipkin v2 json format of an annotation.
+type zipkinV2Annotation struct {
+	Timestamp timebp.TimestampMicrosecond `json:"timestamp"`
+	Value     string                      `json:"value"`
+}
+
+// toZipkinV2Span converts a ZipkinSpan into the Zipkin v2 model.
+//
+// The cs/cr and sr/ss time annotations become the CLIENT and SERVER kinds,
+// the endpoint of the annotations becomes the local endpoint,
+// and the binary annotations become tags, except for the debug one.
+func toZipkinV2Span(span ZipkinSpan) zipkinV2Span {
+	v2 := zipkinV2Span{
+		TraceID:   span.TraceID,
+		ID:        span.SpanID,
+		ParentID:  span.ParentID,
+		Name:      span.Name,
+		Timestamp: span.Start,
+		Duration:  span.Duration,
+	}
+	setEndpoint := func(endpoint ZipkinEndpointInfo) {
+		if v2.LocalEndpoint == nil && endpoint != (ZipkinEndpointInfo{}) {
+			v2.LocalEndpoint = &zipkinV2Endpoint{
+				ServiceName: endpoint.ServiceName,
+				IPv4:        endpoint.IPv4,
+			}
+		}
+	}
+	for _, annotation := range span.TimeAnnotations {
+		setEndpoint(annotation.Endpoint)
+		switch annotation.Key {
+		case ZipkinTimeAnnotationKeyClientSend, ZipkinTimeAnnotationKeyClientReceive:
+			v2.Kind = zipkinV2KindClient
+		case ZipkinTimeAnnotationKeyServerReceive, ZipkinTimeAnnotationKeyServerSend:
+			v2.Kind = zipkinV2KindServer
+		default:
+			v2.Annotations = append(v2.Annotations, zipkinV2Annotation{
+				Timestamp: annotation.Timestamp,
+				Value:     annotation.Key,
+			})
+		}
+	}
+	for _, annotation := range span.BinaryAnnotations {
+		setEndpoint(annotation.Endpoint)
+		value := fmt.Sprint(annotation.Value)
+		if annotation.Key == ZipkinBinaryAnnotationKeyDebug {
+			v2.Debug = value == "true"
+			continue
+		}
+		if v2.Tags == nil {
+			v2.Tags = make(map[string]string, len(span.BinaryAnnotations))
+		}
+		v2.Tags[annotation.Key] = value
+	}
+	return v2
+}
+
+var _ mqsend.MessageQueue = (*zipkinHTTPReporter)(nil)
@@ -0,0 +1,245 @@
+package tracing
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/opentracing/opentracing-go"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/reddit/baseplate.go/prometheusbp/promtest"
+	"github.com/reddit/baseplate.go/timebp"
+)
+
+func TestZipkinHTTPReporter(t *testing.T) {
+	var lock sync.Mutex
+	var received []zipkinV2Span
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			t.Errorf("Expected POST request, got %q", r.Method)
+		}
+		if ct := r.Header.Get("Content-Type"); ct != "application/json" {
+			t.Errorf("Expected json content type, got %q", ct)
+		}
+		var spans []zipkinV2Span
+		decoder := json.NewDecoder(r.Body)
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&spans); err != nil {
+			t.Errorf("Failed to decode request body: %v", err)
+		}
+		lock.Lock()
+		defer lock.Unlock()
+		received = append(received, spans...)
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer server.Close()
+
+	logger, startFailing := TestWrapper(t)
+	defer func() {
+		CloseTracer()
+		InitGlobalTracer(Config{})
+	}()
+	if err := InitGlobalTracer(Config{
+		SampleRate: 1,
+		Logger:     logger,
+		ZipkinHTTP: ZipkinHTTPConfig{
+			URL:       server.URL + "/api/v2/spans",
+			BatchSize: 2,
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	startFailing()
+
+	sentBefore := testutil.ToFloat64(zipkinHTTPSpansSent)
+	names := []string{"foo", "bar", "fizz"}
+	for _, name := range names {
+		opentracing.StartSpan(name).Finish()
+	}
+	// CloseTracer should flush the last batch that's not full yet.
+	if err := CloseTracer(); err != nil {
+		t.Fatal(err)
+	}
+	if delta := testutil.ToFloat64(zipkinHTTPSpansSent) - sentBefore; delta != float64(len(names)) {
+		t.Errorf("Expected %d spans sent, got %v", len(names), delta)
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	if len(received) != len(names) {
+		t.Fatalf("Expected %d spans, got %+v", len(names), received)
+	}
+	for i, name := range names {
+		if received[i].Name != name {
+			t.Errorf("received[%d]: expected name %q, got %q", i, name, received[i].Name)
+		}
+	}
+}
+
+func TestZipkinHTTPReporterV2Model(t *testing.T) {
+	// The Zipkin v2 json schema, see https://zipkin.io/zipkin-api/#/default/post_spans.
+	type endpoint struct {
+		ServiceName string `json:"serviceName"`
+		IPv4        string `json:"ipv4"`
+	}
+	type annotation struct {
+		Timestamp int64  `json:"timestamp"`
+		Value     string `json:"value"`
+	}
+	type span struct {
+		TraceID       string            `json:"traceId"`
+		ID            string            `json:"id"`
+		ParentID      string            `json:"parentId"`
+		Name          string            `json:"name"`
+		Kind          string            `json:"kind"`
+		Timestamp     int64             `json:"timestamp"`
+		Duration      int64             `json:"duration"`
+		LocalEndpoint *endpoint         `json:"localEndpoint"`
+		Annotations   []annotation      `json:"annotations"`
+		Tags          map[string]string `json:"tags"`
+		Debug         bool              `json:"debug"`
+	}
+
+	received := make(chan []span, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var spans []span
+		decoder := json.NewDecoder(r.Body)
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&spans); err != nil {
+			t.Errorf("Failed to decode request body as zipkin v2 spans: %v", err)
+		}
+		received <- spans
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer server.Close()
+
+	start := time.Unix(1600000000, 0)
+	ep := ZipkinEndpointInfo{ServiceName: "test-service", IPv4: "10.0.0.1"}
+	data, err := json.Marshal(ZipkinSpan{
+		TraceID:  "1234",
+		Name:     "service.method",
+		SpanID:   "5678",
+		ParentID: "9012",
+		Start:    timebp.TimestampMicrosecond(start),
+		Duration: timebp.DurationMicrosecond(time.Millisecond),
+		TimeAnnotations: []ZipkinTimeAnnotation{
+			{Endpoint: ep, Key: ZipkinTimeAnnotationKeyClientSend, Timestamp: timebp.TimestampMicrosecond(start)},
+			{Endpoint: ep, Key: ZipkinTimeAnnotationKeyClientReceive, Timestamp: timebp.TimestampMicrosecond(start.Add(time.Millisecond))},
+		},
+		BinaryAnnotations: []ZipkinBinaryAnnotation{
+			{Endpoint: ep, Key: ZipkinBinaryAnnotationKeyDebug, Value: true},
+			{Endpoint: ep, Key: ZipkinBinaryAnnotationKeyError, Value: true},
+			{Endpoint: ep, Key: "counter.retries", Value: 2.0},
+			{Endpoint: ep, Key: "peer", Value: "other-service"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := newZipkinHTTPReporter(ZipkinHTTPConfig{URL: server.URL}, nil)
+	if err := r.Send(context.Background(), data); err != nil {
+		t.Fatal(err)
+	}
+	r.Close()
+
+	var spans []span
+	select {
+	case spans = <-received:
+	default:
+		t.Fatal("No spans sent")
+	}
+	if len(spans) != 1 {
+		t.Fatalf("Expected 1 span, got %+v", spans)
+	}
+	got := spans[0]
+	if got.TraceID != "1234" || got.ID != "5678" || got.ParentID != "9012" || got.Name != "service.method" {
+		t.Errorf("Unexpected span ids or name: %+v", got)
+	}
+	if got.Kind != "CLIENT" {
+		t.Errorf("Expected kind %q, got %q", "CLIENT", got.Kind)
+	}
+	if expected := start.UnixMicro(); got.Timestamp != expected {
+		t.Errorf("Expected timestamp %d, got %d", expected, got.Timestamp)
+	}
+	if got.Duration != 1000 {
+		t.Errorf("Expected duration %d, got %d", 1000, got.Duration)
+	}
+	if got.LocalEndpoint == nil || *got.LocalEndpoint != (endpoint{ServiceName: "test-service", IPv4: "10.0.0.1"}) {
+		t.Errorf("Unexpected local endpoint: %+v", got.LocalEndpoint)
+	}
+	if len(got.Annotations) != 0 {
+		t.Errorf("Expected cs/cr annotations to be converted into kind, got %+v", got.Annotations)
+	}
+	if !got.Debug {
+		t.Error("Expected debug to be true")
+	}
+	expectedTags := map[string]string{
+		"error":           "true",
+		"counter.retries": "2",
+		"peer":            "other-service",
+	}
+	if len(got.Tags) != len(expectedTags) {
+		t.Errorf("Expected tags %v, got %v", expectedTags, got.Tags)
+	}
+	for k, v := range expectedTags {
+		if got.Tags[k] != v {
+			t.Errorf("Expected tag %q to be %q, got %q", k, v, got.Tags[k])
+		}
+	}
+}
+
+func TestZipkinHTTPReporterDrops(t *testing.T) {
+	block := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-block
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	queueFull := promtest.NewPrometheusMetricTest(t, "queue full", zipkinHTTPSpansDropped, prometheus.Labels{
+		dropReasonLabel: dropReasonQueueFull,
+	})
+	sendFailure := promtest.NewPrometheusMetricTest(t, "send failure", zipkinHTTPSpansDropped, prometheus.Labels{
+		dropReasonLabel: dropReasonSendFailure,
+	})
+	closed := promtest.NewPrometheusMetricTest(t, "closed", zipkinHTTPSpansDropped, prometheus.Labels{
+		dropReasonLabel: dropReasonClosed,
+	})
+
+	r := newZipkinHTTPReporter(ZipkinHTTPConfig{
+		URL:          server.URL,
+		MaxQueueSize: 1,
+		BatchSize:    1,
+	}, nil)
+	ctx := context.Background()
+	// The first one will be taken by the background goroutine and blocks on
+	// the http request, the second one fills the queue.
+	if err := r.Send(ctx, []byte("{}")); err != nil {
+		t.Fatal(err)
+	}
+	for len(r.queue) > 0 {
+		time.Sleep(time.Millisecond)
+	}
+	for i := 0; i < 3; i++ {
+		if err := r.Send(ctx, []byte("{}")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	queueFull.CheckDelta(2)
+
+	close(block)
+	r.Close()
+	sendFailure.CheckDelta(2)
+
+	if err := r.Send(ctx, []byte("{}")); err != nil {
+		t.Fatal(err)
+	}
+	closed.CheckDelta(1)
+}